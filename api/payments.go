@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+)
+
+const maxPaymentsPage = 100
+
+// Limit is payments of config by default, bounded by maxPaymentsPage
+func (s *ApiServer) paymentsPage(r *http.Request) (int64, int64) {
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if limit <= 0 {
+		limit = s.config.Payments
+	}
+	if limit <= 0 || limit > maxPaymentsPage {
+		limit = maxPaymentsPage
+	}
+	return offset, limit
+}
+
+func isPaymentsPage(r *http.Request) bool {
+	query := r.URL.Query()
+	return len(query.Get("offset")) > 0 || len(query.Get("limit")) > 0
+}
+
+// GET /api/accounts/<login>/payments?offset=0&limit=50
+func (s *ApiServer) AccountPaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	s.writePaymentsPage(w, r, strings.ToLower(mux.Vars(r)["login"]))
+}
+
+// Page of history, newest first. Payment in flight leads first page, it is not in history until confirmed.
+func (s *ApiServer) writePaymentsPage(w http.ResponseWriter, r *http.Request, login string) {
+	offset, limit := s.paymentsPage(r)
+	page, err := s.backend.GetPayments(login, offset, limit)
+	if err != nil {
+		log.Printf("Failed to get payments from backend: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Backend error"))
+		return
+	}
+	if offset == 0 {
+		inflight, err := s.backend.GetInflightPayment()
+		if err != nil {
+			log.Printf("Failed to get payment in flight from backend: %v", err)
+		} else if inflight != nil && (len(login) == 0 || inflight.Login == login) {
+			page.Payments = append([]map[string]interface{}{s.inflightEntry(inflight, len(login) == 0)}, page.Payments...)
+		}
+	}
+	if page.Payments == nil {
+		page.Payments = []map[string]interface{}{}
+	}
+	writeJSONReply(w, http.StatusOK, map[string]interface{}{
+		"payments":      page.Payments,
+		"paymentsTotal": page.Total,
+		"paid":          page.Paid,
+		"offset":        offset,
+		"limit":         limit,
+	})
+}
+
+// Entry as of history, tx is the last one sent, pending until its status is recorded
+func (s *ApiServer) inflightEntry(p *storage.InflightPayment, pool bool) map[string]interface{} {
+	entry := map[string]interface{}{"timestamp": p.SentAt, "amount": p.Amount, "status": storage.PaymentPending}
+	if pool {
+		entry["address"] = p.Login
+		if len(p.Kind) > 0 {
+			entry["type"] = p.Kind
+		}
+	}
+	if n := len(p.TxHashes); n > 0 {
+		entry["tx"] = p.TxHashes[n-1]
+		status, block, err := s.backend.GetPaymentStatus(p.TxHashes[n-1])
+		if err != nil {
+			log.Printf("Failed to get status of payout tx %s from backend: %v", p.TxHashes[n-1], err)
+		} else if len(status) > 0 {
+			entry["status"] = status
+			if block > 0 {
+				entry["block"] = block
+			}
+		}
+	}
+	return entry
+}
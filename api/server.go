@@ -22,21 +22,26 @@ type ApiConfig struct {
 	HashrateWindow       string `json:"hashrateWindow"`
 	HashrateLargeWindow  string `json:"hashrateLargeWindow"`
 	Payments             int64  `json:"payments"`
-	LongShifts               int64  `json:"longShifts"`
-	ShortShifts               int64  `json:"shortShifts"`
-	PurgeOnly            bool   `json:"purgeOnly"`
-	PurgeInterval        string `json:"purgeInterval"`
+	LongShifts           int64  `json:"longShifts"`
+	ShortShifts          int64  `json:"shortShifts"`
+	// Offline transitions of workers in account reply, 0 leaves activity out
+	Activity      int64  `json:"activity"`
+	PurgeOnly     bool   `json:"purgeOnly"`
+	PurgeInterval string `json:"purgeInterval"`
+	// Payout settings of miner, see docs/PAYOUTS.md
+	Settings SettingsConfig `json:"settings"`
 }
 
 type ApiServer struct {
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	backend             storage.Storage
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	signatureWindow     time.Duration
 }
 
 type Entry struct {
@@ -44,15 +49,20 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend storage.Storage) *ApiServer {
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
+	window := defaultSignatureWindow
+	if len(cfg.Settings.SignatureWindow) > 0 {
+		window = cfg.Settings.SignatureWindow
+	}
 	return &ApiServer{
 		config:              cfg,
 		backend:             backend,
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
+		signatureWindow:     util.MustParseDuration(window),
 	}
 }
 
@@ -104,7 +114,13 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/api/miners", s.MinersIndex)
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
+	r.HandleFunc("/api/upstreams", s.UpstreamsIndex)
 	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/payments", s.AccountPaymentsIndex)
+	if s.config.Settings.Enabled {
+		r.HandleFunc("/api/settings/{login:0x[0-9a-fA-F]{40}}", s.PayoutSettingsIndex).Methods("GET")
+		r.HandleFunc("/api/settings/{login:0x[0-9a-fA-F]{40}}", s.UpdatePayoutSettings).Methods("POST", "OPTIONS")
+	}
 	r.NotFoundHandler = http.HandlerFunc(notFound)
 	err := http.ListenAndServe(s.config.Listen, r)
 	if err != nil {
@@ -153,6 +169,42 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	reply["nodes"] = nodes
 
+	// Instance whose payer holds leader lock, absent if none does
+	owner, ttl, err := s.backend.GetLeader(storage.LeaderPayouts)
+	if err != nil {
+		log.Printf("Failed to get payouts leader from backend: %v", err)
+	} else if len(owner) > 0 {
+		reply["payoutsLeader"] = map[string]interface{}{"owner": owner, "expiresIn": int64(ttl / time.Second)}
+	}
+
+	// Halt is absent unless payer hit critical error, lock is held while payment is in progress or failed
+	halt, err := s.backend.GetPayoutsHalt()
+	if err != nil {
+		log.Printf("Failed to get payouts halt from backend: %v", err)
+	} else if halt != nil {
+		reply["payoutsHalt"] = halt
+	}
+	locked, err := s.backend.IsPayoutsLocked()
+	if err != nil {
+		log.Printf("Failed to get payouts lock from backend: %v", err)
+	} else {
+		reply["payoutsLocked"] = locked
+	}
+	reviews, err := s.backend.GetPaymentReviews()
+	if err != nil {
+		log.Printf("Failed to get payments held for review from backend: %v", err)
+	} else {
+		reply["payoutsReview"] = len(reviews)
+	}
+
+	// Absent unless pricing of proxy is enabled
+	rate, err := s.backend.GetPPSRate()
+	if err != nil {
+		log.Printf("Failed to get PPS rate from backend: %v", err)
+	} else if rate != nil {
+		reply["ppsRate"] = rate
+	}
+
 	stats := s.getStats()
 	if stats != nil {
 		reply["now"] = util.MakeTimestamp()
@@ -215,7 +267,32 @@ func (s *ApiServer) BlocksIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *ApiServer) UpstreamsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	reply := make(map[string]interface{})
+	switches, err := s.backend.GetUpstreamSwitches()
+	if err != nil {
+		log.Printf("Failed to get upstream switches from backend: %v", err)
+	}
+	reply["now"] = util.MakeTimestamp()
+	reply["switches"] = switches
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Page of history with offset or limit in query, latest payments of stats otherwise
 func (s *ApiServer) PaymentsIndex(w http.ResponseWriter, r *http.Request) {
+	if isPaymentsPage(r) {
+		s.writePaymentsPage(w, r, "")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -274,6 +351,15 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 		for key, value := range workers {
 			stats[key] = value
 		}
+		if s.config.Activity > 0 {
+			activity, err := s.backend.GetMinerActivity(login, s.config.Activity)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Printf("Failed to fetch stats from backend: %v", err)
+				return
+			}
+			stats["activity"] = activity
+		}
 		stats["pageSize"] = s.config.Payments
 		reply = &Entry{stats: stats, updatedAt: now}
 		s.miners[login] = reply
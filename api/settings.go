@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	defaultSignatureWindow = "5m"
+	maxSettingsBody        = 4096
+)
+
+// Miner reads and updates own payout settings, request is signed by key of login with personal_sign
+type SettingsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Signed timestamp must be within that of server time
+	SignatureWindow string `json:"signatureWindow"`
+}
+
+type payoutSettingsRequest struct {
+	MinPayout int64  `json:"minPayout"`
+	Paused    bool   `json:"paused"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+func readSettingsMessage(login string, ts int64) string {
+	return fmt.Sprintf("Read settings of %s at %d", login, ts)
+}
+
+func updateSettingsMessage(login string, req *payoutSettingsRequest) string {
+	return fmt.Sprintf("Set settings of %s at %d: minPayout %d, paused %v", login, req.Timestamp, req.MinPayout, req.Paused)
+}
+
+// Signer of message in EIP-191 form, as signed by personal_sign of wallets
+func recoverSigner(message, signature string) (string, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != 65 {
+		return "", errors.New("Invalid signature")
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	hash := crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return "", errors.New("Invalid signature")
+	}
+	return strings.ToLower(crypto.PubkeyToAddress(*pub).Hex()), nil
+}
+
+func (s *ApiServer) checkSignature(login, message, signature string, ts int64) error {
+	drift := util.MakeTimestamp()/1000 - ts
+	if math.Abs(float64(drift)) > s.signatureWindow.Seconds() {
+		return errors.New("Timestamp is out of signature window")
+	}
+	signer, err := recoverSigner(message, signature)
+	if err != nil {
+		return err
+	}
+	if signer != login {
+		return errors.New("Signature is not of login")
+	}
+	return nil
+}
+
+func writeJSONReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSONReply(w, status, map[string]string{"error": err.Error()})
+}
+
+// GET with timestamp and signature of read message in query
+func (s *ApiServer) PayoutSettingsIndex(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	ts, _ := strconv.ParseInt(r.URL.Query().Get("timestamp"), 10, 64)
+	if err := s.checkSignature(login, readSettingsMessage(login, ts), r.URL.Query().Get("signature"), ts); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err)
+		return
+	}
+	settings, err := s.backend.GetMinerSettings(login)
+	if err != nil {
+		log.Printf("Failed to get settings of %v from backend: %v", login, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Backend error"))
+		return
+	}
+	writeJSONReply(w, http.StatusOK, map[string]interface{}{"minPayout": settings.MinPayout, "paused": settings.Paused})
+}
+
+// POST of settings with timestamp and signature of update message, payouts apply them on next run
+func (s *ApiServer) UpdatePayoutSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	login := strings.ToLower(mux.Vars(r)["login"])
+	var req payoutSettingsRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxSettingsBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MinPayout < 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("Invalid settings"))
+		return
+	}
+	if err := s.checkSignature(login, updateSettingsMessage(login, &req), req.Signature, req.Timestamp); err != nil {
+		writeJSONError(w, http.StatusUnauthorized, err)
+		return
+	}
+	applied, err := s.backend.WritePayoutSettings(login, req.MinPayout, req.Paused, req.Timestamp)
+	if err != nil {
+		log.Printf("Failed to write settings of %v to backend: %v", login, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("Backend error"))
+		return
+	}
+	if !applied {
+		writeJSONError(w, http.StatusConflict, errors.New("Later update is applied already"))
+		return
+	}
+	log.Printf("Updated payout settings of %v: min payout %v, paused %v", login, req.MinPayout, req.Paused)
+	writeJSONReply(w, http.StatusOK, map[string]interface{}{"minPayout": req.MinPayout, "paused": req.Paused})
+}
@@ -2,26 +2,56 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/CryptoManiac/open-ethereum-pool/api"
+	"github.com/CryptoManiac/open-ethereum-pool/maintenance"
 	"github.com/CryptoManiac/open-ethereum-pool/payouts"
 	"github.com/CryptoManiac/open-ethereum-pool/shifts"
 	"github.com/CryptoManiac/open-ethereum-pool/proxy"
 	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
 )
 
 var cfg proxy.Config
-var backend *storage.RedisClient
+var backend storage.Storage
+var payer *payouts.PayoutsProcessor
+var proxyServer *proxy.ProxyServer
 
 func startProxy() {
-	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
+	s, err := proxy.NewProxy(&cfg, backend)
+	if err != nil {
+		log.Fatalf("Failed to start proxy: %v", err)
+	}
+	proxyServer = s
+	go reloadOnSignal(s)
+	go s.Start()
+}
+
+// Only proxy settings are reloaded, other modules keep config they started with
+func reloadOnSignal(s *proxy.ProxyServer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		var newCfg proxy.Config
+		if err := loadConfig(&newCfg); err != nil {
+			log.Printf("Config reload failed: %v", err)
+			continue
+		}
+		if err := s.Reload(&newCfg); err != nil {
+			log.Printf("Config reload rejected: %v", err)
+			continue
+		}
+		log.Println("Config reloaded")
+	}
 }
 
 func startApi() {
@@ -29,8 +59,15 @@ func startApi() {
 	s.Start()
 }
 
-func startPayoutsProcessor() {
-	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
+func startUnlocker() {
+	rewards, err := util.NewRewardSchedule(cfg.RewardSchedule.Preset, cfg.RewardSchedule.Eras)
+	if err != nil {
+		log.Fatalf("Invalid reward schedule: %v", err)
+	}
+	u, err := payouts.NewBlockUnlocker(&cfg.Unlocker, rewards, backend)
+	if err != nil {
+		log.Fatalf("Failed to start block unlocker: %v", err)
+	}
 	u.Start()
 }
 
@@ -39,7 +76,123 @@ func startShiftsProcessor() {
 	p.Start()
 }
 
-func readConfig(cfg *proxy.Config) {
+func startMaintenance() {
+	m := maintenance.NewMaintenanceProcessor(&cfg.Maintenance, util.MustParseDuration(cfg.Proxy.HashrateExpiration), cfg.Name, backend)
+	m.Start()
+}
+
+// Maintenance commands given after config, pool must be stopped meanwhile
+func runCommand(r *storage.RedisClient, command string, args []string) {
+	if _, err := r.Check(); err != nil {
+		log.Fatalf("Can't establish connection to backend: %v", err)
+	}
+	switch command {
+	case "migrate-prefix":
+		migratePrefix(r, args)
+	case "export-state":
+		exportState(r, args)
+	case "import-state":
+		importState(r, args)
+	case "switch-reward-mode":
+		switchRewardMode(r, args)
+	case "merge-logins":
+		mergeLogins(r, args)
+	default:
+		log.Fatalf("Unknown command %s, commands are migrate-prefix, export-state, import-state, switch-reward-mode and merge-logins", command)
+	}
+}
+
+// Usage: open-ethereum-pool config.json merge-logins
+// Payouts must be stopped, mixed case logins are merged into lowercase ones
+func mergeLogins(r *storage.RedisClient, args []string) {
+	if len(args) != 0 {
+		log.Fatal("Usage: merge-logins")
+	}
+	merged, err := r.MergeMixedCaseLogins()
+	if err != nil {
+		log.Fatalf("Merge of logins failed after %v logins: %v", merged, err)
+	}
+	log.Printf("Merged %v mixed case logins into lowercase ones", merged)
+}
+
+// Usage: open-ethereum-pool config.json switch-reward-mode <mode>
+// All instances must be stopped, config of each must have new mode on start
+func switchRewardMode(r *storage.RedisClient, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: switch-reward-mode <mode>")
+	}
+	prev, err := r.SwitchRewardMode(args[0])
+	if err != nil {
+		log.Fatalf("Failed to switch reward mode: %v", err)
+	}
+	log.Printf("Switched reward mode from %s to %s, set rewardMode of every instance to it before start", prev, args[0])
+}
+
+// Usage: open-ethereum-pool config.json export-state <file>
+func exportState(r *storage.RedisClient, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Usage: export-state <file>")
+	}
+	state, err := r.ExportState()
+	if err != nil {
+		log.Fatalf("Failed to export state: %v", err)
+	}
+	if err := storage.WriteStateFile(args[0], state); err != nil {
+		log.Fatalf("Failed to write state file: %v", err)
+	}
+	log.Printf("Exported %v miners, %v payments, %v pending payments and %v blocks to %s, checksum %s",
+		state.Totals.Miners, state.Totals.Payments, state.Totals.PendingPayments, state.Totals.Blocks, args[0], state.Checksum)
+}
+
+// Usage: open-ethereum-pool config.json import-state <file> [force]
+func importState(r *storage.RedisClient, args []string) {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "force") {
+		log.Fatal("Usage: import-state <file> [force]")
+	}
+	state, err := storage.ReadStateFile(args[0])
+	if err != nil {
+		log.Fatalf("Failed to read state file: %v", err)
+	}
+	if state.Prefix != r.Prefix() {
+		log.Printf("State is exported under prefix %s, it is imported under %s", state.Prefix, r.Prefix())
+	}
+	if err := r.ImportState(state, len(args) == 2); err != nil {
+		log.Fatalf("Failed to import state: %v", err)
+	}
+	log.Printf("Imported %v miners, %v payments, %v pending payments and %v blocks from %s",
+		state.Totals.Miners, state.Totals.Payments, state.Totals.PendingPayments, state.Totals.Blocks, args[0])
+}
+
+// Usage: open-ethereum-pool config.json migrate-prefix <old prefix> [dry-run]
+// Keys are moved under prefix of config
+func migratePrefix(r *storage.RedisClient, args []string) {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "dry-run") {
+		log.Fatal("Usage: migrate-prefix <old prefix> [dry-run]")
+	}
+	from, dryRun := args[0], len(args) == 2
+	if dryRun {
+		log.Printf("Dry run of moving keys from prefix %s to %s", from, r.Prefix())
+	} else {
+		log.Printf("Moving keys from prefix %s to %s", from, r.Prefix())
+	}
+	reported := 0
+	moved, conflicts, err := r.MigratePrefix(from, dryRun, 1000, func(walked, moved, conflicts int) {
+		if walked-reported >= 1000 {
+			reported = walked
+			log.Printf("Walked %v keys, %v moved, %v exist under new prefix", walked, moved, conflicts)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Prefix migration failed after %v keys: %v", moved, err)
+	}
+	if dryRun {
+		log.Printf("Dry run done, %v keys would be moved, %v exist under new prefix and would be left", moved, conflicts)
+	} else {
+		log.Printf("Prefix migration done, %v keys moved, %v exist under new prefix and are left", moved, conflicts)
+	}
+}
+
+func loadConfig(cfg *proxy.Config) error {
 	configFileName := "config.json"
 	if len(os.Args) > 1 {
 		configFileName = os.Args[1]
@@ -49,12 +202,22 @@ func readConfig(cfg *proxy.Config) {
 
 	configFile, err := os.Open(configFileName)
 	if err != nil {
-		log.Fatal("File error: ", err.Error())
+		return fmt.Errorf("File error: %v", err)
 	}
 	defer configFile.Close()
 	jsonParser := json.NewDecoder(configFile)
 	if err := jsonParser.Decode(&cfg); err != nil {
-		log.Fatal("Config error: ", err.Error())
+		return fmt.Errorf("Config error: %v", err)
+	}
+	if err := cfg.Payouts.FeeSweep.Validate(); err != nil {
+		return fmt.Errorf("Config error: %v", err)
+	}
+	return nil
+}
+
+func readConfig(cfg *proxy.Config) {
+	if err := loadConfig(cfg); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -67,26 +230,73 @@ func main() {
 		log.Printf("Running with %v threads", cfg.Threads)
 	}
 
-	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
-	pong, err := backend.Check()
+	if cfg.Redis.TLS.Enabled && (cfg.Redis.Sentinel.Enabled() || cfg.Redis.Cluster.Enabled || cfg.Redis.Network == "unix") {
+		log.Fatal("Redis TLS is supported for TCP endpoint only")
+	}
+	if len(cfg.Redis.Username) > 0 && (cfg.Redis.Sentinel.Enabled() || cfg.Redis.Cluster.Enabled) {
+		log.Fatal("Redis username is not supported with sentinel or cluster")
+	}
+	redisClient := storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if err := storage.ValidatePrefix(redisClient.Prefix()); err != nil {
+		log.Fatal(err)
+	}
+	if len(os.Args) > 2 {
+		runCommand(redisClient, os.Args[2], os.Args[3:])
+		return
+	}
+	var err error
+	backend, err = storage.NewBackend(&cfg.Storage, redisClient)
 	if err != nil {
+		log.Fatalf("Failed to start storage backend: %v", err)
+	}
+	pong, err := backend.Check()
+	if err != nil && cfg.Redis.Sentinel.Enabled() {
+		log.Fatalf("Can't resolve Redis master %s from sentinels %v: %v", cfg.Redis.Sentinel.MasterName, cfg.Redis.Sentinel.Addrs, err)
+	} else if err != nil {
 		log.Printf("Can't establish connection to backend: %v", err)
 	} else {
 		log.Printf("Backend check reply: %v", pong)
 	}
+	if err := redisClient.SetRewardMode(cfg.RewardMode, cfg.PPLNSWindow); err != nil {
+		log.Fatalf("Failed to set reward mode: %v", err)
+	}
 
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		startProxy()
 	}
 	if cfg.Api.Enabled {
 		go startApi()
 	}
+	if cfg.Unlocker.Enabled {
+		go startUnlocker()
+	}
+	if cfg.Payouts.FeeSweep.Enabled && !cfg.Unlocker.Enabled {
+		log.Println("Fee sweep sends pool fee accrued by block unlocker, make sure it runs on other instance")
+	}
 	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
+		payer = payouts.NewPayoutsProcessor(&cfg.Payouts, cfg.Name, backend)
+		go payer.Start()
 	}
 	if cfg.Shifts.Enabled {
 		go startShiftsProcessor()
 	}
-	quit := make(chan bool)
-	<-quit
+	if cfg.Maintenance.Enabled {
+		go startMaintenance()
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Printf("Received %v, shutting down", sig)
+	// Submits in flight reach backend before it is closed
+	if proxyServer != nil {
+		proxyServer.Shutdown()
+	}
+	// Leader lock is released, so other payer takes over at once
+	if payer != nil {
+		payer.Stop()
+	}
+	// Buffered shares are written before exit
+	if err := backend.Close(); err != nil {
+		log.Printf("Failed to write buffered shares on exit: %v", err)
+	}
 }
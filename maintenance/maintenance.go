@@ -0,0 +1,108 @@
+package maintenance
+
+import (
+	"log"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	defaultOpsPerSecond    = 500
+	defaultActivityHistory = 100
+)
+
+// Pass is independent of other modules, enable it on one instance of pool
+type MaintenanceConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// Hashrate samples older than that are removed, not shorter than large hashrate window of API
+	HashrateWindow string `json:"hashrateWindow"`
+	// Logins with zero balance and no share for that long are removed, empty keeps them
+	Retention string `json:"retention"`
+	// Redis commands per second sent by pass
+	OpsPerSecond int `json:"opsPerSecond"`
+	// Offline transitions kept per login
+	ActivityHistory int64 `json:"activityHistory"`
+	// Matured blocks are checked against canonical chain on own interval
+	Reorg ReorgConfig `json:"reorg"`
+}
+
+type MaintenanceProcessor struct {
+	config    *MaintenanceConfig
+	backend   storage.Storage
+	window    time.Duration
+	retention time.Duration
+	// Worker without share for that long goes offline
+	expire time.Duration
+	// Name of pool instance, reorg alert goes to its node state
+	name string
+	rpc  *rpc.RPCClient
+}
+
+func NewMaintenanceProcessor(cfg *MaintenanceConfig, hashrateExpiration time.Duration, name string, backend storage.Storage) *MaintenanceProcessor {
+	m := &MaintenanceProcessor{config: cfg, backend: backend, expire: hashrateExpiration, name: name}
+	m.window = util.MustParseDuration(cfg.HashrateWindow)
+	if len(cfg.Retention) > 0 {
+		m.retention = util.MustParseDuration(cfg.Retention)
+	}
+	if cfg.Reorg.Enabled {
+		timeout := cfg.Reorg.Timeout
+		if len(timeout) == 0 {
+			timeout = defaultReorgTimeout
+		}
+		m.rpc = rpc.NewRPCClient("ReorgAudit", cfg.Reorg.Daemon, timeout)
+	}
+	return m
+}
+
+func (m *MaintenanceProcessor) Start() {
+	log.Println("Starting maintenance")
+	intv := util.MustParseDuration(m.config.Interval)
+	log.Printf("Set maintenance interval to %v, hashrate window %v, login retention %v", intv, m.window, m.retention)
+	util.Schedule(m.prune, intv)
+	if m.config.Reorg.Enabled {
+		m.startReorgAudit()
+	}
+}
+
+func (m *MaintenanceProcessor) prune() {
+	ops := m.config.OpsPerSecond
+	if ops <= 0 {
+		ops = defaultOpsPerSecond
+	}
+	start := time.Now()
+	// Offline workers are recorded before their counters are pruned
+	history := m.config.ActivityHistory
+	if history <= 0 {
+		history = defaultActivityHistory
+	}
+	offline, err := m.backend.RecordOffline(m.expire, history, ops)
+	if err != nil {
+		log.Println("Failed to record offline workers:", err)
+	} else if offline > 0 {
+		log.Printf("Recorded %v workers going offline", offline)
+	}
+
+	result, err := m.backend.PruneStale(m.window, m.retention, ops)
+	if err != nil {
+		log.Println("Failed to prune stale data from backend:", err)
+	}
+	log.Printf("Pruned %v hashrate samples, %v worker counters and %v logins, elapsed time %v",
+		result.Samples, result.Workers, result.Logins, time.Since(start))
+
+	report, err := m.backend.ReconcileLedger(ops)
+	if err != nil {
+		log.Println("Failed to reconcile ledger:", err)
+		return
+	}
+	if report == nil {
+		return
+	}
+	for login, diff := range report.Mismatches {
+		log.Printf("Balance of %v differs from ledger by %v Shannon", login, diff)
+	}
+	log.Printf("Reconciled ledger of %v logins, %v mismatches, %v entries folded", report.Checked, len(report.Mismatches), report.Folded)
+}
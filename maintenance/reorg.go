@@ -0,0 +1,111 @@
+package maintenance
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	defaultReorgDepth   = 1000
+	defaultReorgTimeout = "10s"
+)
+
+// Chain may reorg deeper than maturity depth of unlocker, matured blocks within depth below tip
+// are checked against canonical chain again
+type ReorgConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// Blocks below tip checked
+	Depth int64 `json:"depth"`
+	// Reorged block is orphaned and its credit taken back, it is only alerted otherwise
+	Revert  bool   `json:"revert"`
+	Daemon  string `json:"daemon"`
+	Timeout string `json:"timeout"`
+}
+
+func (m *MaintenanceProcessor) startReorgAudit() {
+	intv := util.MustParseDuration(m.config.Reorg.Interval)
+	log.Printf("Set reorg audit interval to %v, depth %v, revert %v", intv, m.reorgDepth(), m.config.Reorg.Revert)
+	util.Schedule(m.auditReorgs, intv)
+}
+
+func (m *MaintenanceProcessor) reorgDepth() int64 {
+	if m.config.Reorg.Depth > 0 {
+		return m.config.Reorg.Depth
+	}
+	return defaultReorgDepth
+}
+
+// Node error stops audit until next interval, block is never reverted on missing reply
+func (m *MaintenanceProcessor) auditReorgs() {
+	tip, err := m.rpc.GetBlockNumber()
+	if err != nil {
+		log.Println("Failed to get block number for reorg audit:", err)
+		return
+	}
+	blocks, err := m.backend.GetMaturedBlocks(int64(tip) - m.reorgDepth())
+	if err != nil {
+		log.Println("Failed to get matured blocks for reorg audit:", err)
+		return
+	}
+	var reorged []*storage.BlockData
+	for _, block := range blocks {
+		if len(block.Hash) == 0 {
+			continue
+		}
+		canonical, err := m.isCanonical(block)
+		if err != nil {
+			log.Printf("Failed to check matured block %v: %v", block.Height, err)
+			break
+		}
+		if canonical {
+			continue
+		}
+		reorged = append(reorged, block)
+		log.Printf("REORG: matured block %v %s of round %v is not in canonical chain", block.Height, block.Hash, block.RoundHeight)
+		if !m.config.Reorg.Revert {
+			continue
+		}
+		result, err := m.backend.RevertMaturedBlock(block)
+		if err != nil {
+			log.Printf("Failed to revert reorged block %v: %v", block.Height, err)
+			continue
+		}
+		log.Printf("Reverted reorged block %v, %v Shannon taken back from balances, %v Shannon of debt", block.Height, result.Debited, result.Debt)
+	}
+	if len(reorged) == 0 {
+		return
+	}
+	alerted, err := m.backend.WriteReorgAlert(m.name, reorged)
+	if err != nil {
+		log.Println("Failed to write reorg alert to backend:", err)
+		return
+	}
+	if alerted > 0 {
+		log.Printf("REORG: %v blocks added to reorg alert", alerted)
+	}
+}
+
+// Block hash at its height, or uncle hash among uncles of block including it
+func (m *MaintenanceProcessor) isCanonical(block *storage.BlockData) (bool, error) {
+	reply, err := m.rpc.GetBlockByHeight(block.Height)
+	if err != nil {
+		return false, err
+	}
+	if reply == nil {
+		return false, fmt.Errorf("No block at height %v", block.Height)
+	}
+	if !block.Uncle {
+		return strings.EqualFold(reply.Hash, block.Hash), nil
+	}
+	for _, hash := range reply.Uncles {
+		if strings.EqualFold(hash, block.Hash) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
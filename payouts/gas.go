@@ -0,0 +1,234 @@
+package payouts
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	GasStatic = "static"
+	GasOracle = "oracle"
+)
+
+const (
+	defaultFeeHistoryBlocks = 20
+	defaultRewardPercentile = 50
+)
+
+// Static sends legacy tx at gasPrice. Oracle takes base fee and priority fee from fee history of node
+// and sends type-2 tx, or legacy one at gas price of node on chains without base fee.
+type GasStrategyConfig struct {
+	// Static or oracle, empty for static
+	Mode             string  `json:"mode"`
+	FeeHistoryBlocks int     `json:"feeHistoryBlocks"`
+	RewardPercentile float64 `json:"rewardPercentile"`
+	// Caps in Wei, empty for none. Max fee caps gas price of legacy tx too
+	MaxFeePerGas         string `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas"`
+	// Run is skipped while estimated fee per gas is above it, in Wei, empty for none
+	FeeCeiling string `json:"feeCeiling"`
+}
+
+// Fees of payout tx in Wei, price is nil if node sets it
+type txFees struct {
+	dynamic bool
+	// Gas price of legacy tx, max fee of type-2 one
+	price *big.Int
+	tip   *big.Int
+	// Expected fee per gas, base fee of next block and tip for type-2 tx
+	estimate *big.Int
+}
+
+func (f *txFees) String() string {
+	if f.price == nil {
+		return "gas price of node"
+	}
+	if f.dynamic {
+		return fmt.Sprintf("max fee %v Wei, priority fee %v Wei, estimated %v Wei per gas", f.price, f.tip, f.estimate)
+	}
+	return fmt.Sprintf("gas price %v Wei", f.price)
+}
+
+func (u *PayoutsProcessor) estimateFees() (*txFees, error) {
+	if u.config.GasStrategy.Mode != GasOracle {
+		if u.config.AutoGas {
+			return &txFees{}, nil
+		}
+		price := util.String2Big(u.config.GasPrice)
+		return &txFees{price: price, estimate: price}, nil
+	}
+
+	blocks := u.config.GasStrategy.FeeHistoryBlocks
+	if blocks <= 0 {
+		blocks = defaultFeeHistoryBlocks
+	}
+	percentile := u.config.GasStrategy.RewardPercentile
+	if percentile <= 0 {
+		percentile = defaultRewardPercentile
+	}
+	history, err := u.rpc().GetFeeHistory(blocks, percentile)
+	if err != nil {
+		log.Printf("Failed to get fee history, using legacy gas price: %v", err)
+		return u.legacyFees()
+	}
+	baseFee := new(big.Int)
+	if n := len(history.BaseFeePerGas); n > 0 {
+		baseFee, _ = math.ParseBig256(history.BaseFeePerGas[n-1])
+	}
+	if baseFee == nil || baseFee.Sign() == 0 {
+		return u.legacyFees()
+	}
+
+	tip := medianReward(history)
+	if maxTip := capOf(u.config.GasStrategy.MaxPriorityFeePerGas); maxTip != nil && tip.Cmp(maxTip) > 0 {
+		tip = maxTip
+	}
+	// Twice the base fee keeps tx includable over six full blocks
+	maxFee := new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(2)), tip)
+	if limit := capOf(u.config.GasStrategy.MaxFeePerGas); limit != nil && maxFee.Cmp(limit) > 0 {
+		maxFee = limit
+	}
+	estimate := new(big.Int).Add(baseFee, tip)
+	if maxFee.Cmp(estimate) < 0 {
+		return nil, fmt.Errorf("Max fee %v Wei is below base fee %v Wei and priority fee %v Wei", maxFee, baseFee, tip)
+	}
+	return &txFees{dynamic: true, price: maxFee, tip: tip, estimate: estimate}, nil
+}
+
+func (u *PayoutsProcessor) legacyFees() (*txFees, error) {
+	price, err := u.rpc().GetGasPrice()
+	if err != nil {
+		return nil, err
+	}
+	if limit := capOf(u.config.GasStrategy.MaxFeePerGas); limit != nil && price.Cmp(limit) > 0 {
+		price = limit
+	}
+	return &txFees{price: price, estimate: price}, nil
+}
+
+// Median over blocks of priority fee at percentile, blocks without transactions report zero and are left out
+func medianReward(history *rpc.FeeHistory) *big.Int {
+	var rewards []*big.Int
+	for _, v := range history.Reward {
+		if len(v) == 0 {
+			continue
+		}
+		if n, ok := math.ParseBig256(v[0]); ok && n.Sign() > 0 {
+			rewards = append(rewards, n)
+		}
+	}
+	if len(rewards) == 0 {
+		return new(big.Int)
+	}
+	sort.Slice(rewards, func(i, j int) bool { return rewards[i].Cmp(rewards[j]) < 0 })
+	return rewards[len(rewards)/2]
+}
+
+func capOf(s string) *big.Int {
+	if len(s) == 0 {
+		return nil
+	}
+	return util.String2Big(s)
+}
+
+// Estimate above ceiling skips the run, unknown price of node is never above it
+func (u *PayoutsProcessor) aboveCeiling(fees *txFees) bool {
+	ceiling := capOf(u.config.GasStrategy.FeeCeiling)
+	return ceiling != nil && fees.estimate != nil && fees.estimate.Cmp(ceiling) > 0
+}
+
+func (u *PayoutsProcessor) sendPayment(login, value string, nonce uint64, fees *txFees) (string, error) {
+	n := hexutil.EncodeUint64(nonce)
+	if fees.dynamic {
+		return u.rpc().SendDynamicFeeTransaction(u.config.Address, login, u.config.GasHex(), hexutil.EncodeBig(fees.price),
+			hexutil.EncodeBig(fees.tip), value, n, u.config.AutoGas)
+	}
+	price := ""
+	if fees.price != nil {
+		price = hexutil.EncodeBig(fees.price)
+	}
+	return u.rpc().SendTransaction(u.config.Address, login, u.config.GasHex(), price, value, n, u.config.AutoGas)
+}
+
+// Fees of strategy, raised by an eighth over fees of stuck tx, so node takes it as replacement.
+// Stuck tx is nil if node dropped it, fees of strategy go then. Max fee cap is never exceeded.
+func (u *PayoutsProcessor) replacementFees(stuck *rpc.Tx) (*txFees, error) {
+	fees, err := u.estimateFees()
+	if err != nil {
+		return nil, err
+	}
+	if fees.price == nil {
+		if fees.price, err = u.rpc().GetGasPrice(); err != nil {
+			return nil, err
+		}
+		fees.estimate = fees.price
+	}
+	if stuck != nil {
+		oldPrice, oldTip := stuck.GasPrice, stuck.GasPrice
+		if len(stuck.MaxFeePerGas) > 0 {
+			oldPrice, oldTip = stuck.MaxFeePerGas, stuck.MaxPriorityFeePerGas
+		}
+		fees.price = maxBig(fees.price, bumpFee(oldPrice))
+		if fees.dynamic {
+			fees.tip = maxBig(fees.tip, bumpFee(oldTip))
+		}
+	}
+	if limit := capOf(u.config.GasStrategy.MaxFeePerGas); limit != nil && fees.price.Cmp(limit) > 0 {
+		return nil, fmt.Errorf("Replacement fee %v Wei is above max fee %v Wei", fees.price, limit)
+	}
+	if fees.dynamic && fees.tip.Cmp(fees.price) > 0 {
+		fees.price = new(big.Int).Set(fees.tip)
+	}
+	return fees, nil
+}
+
+func bumpFee(s string) *big.Int {
+	n, ok := math.ParseBig256(s)
+	if !ok {
+		return new(big.Int)
+	}
+	n.Mul(n, big.NewInt(9))
+	n.Add(n, big.NewInt(7))
+	return n.Div(n, big.NewInt(8))
+}
+
+func maxBig(a, b *big.Int) *big.Int {
+	if a.Cmp(b) < 0 {
+		return b
+	}
+	return a
+}
+
+// Fee paid in Shannon, rounded to nearest. Gas price of tx is taken on receipt without effective gas price.
+func (u *PayoutsProcessor) paidFee(receipt *rpc.TxReceipt) (int64, error) {
+	gasUsed, ok := math.ParseBig256(receipt.GasUsed)
+	if !ok {
+		return 0, fmt.Errorf("Invalid gas used %q", receipt.GasUsed)
+	}
+	priceHex := receipt.EffectiveGasPrice
+	if len(priceHex) == 0 {
+		tx, err := u.rpc().GetTransaction(receipt.TxHash)
+		if err != nil {
+			return 0, err
+		}
+		if tx == nil {
+			return 0, fmt.Errorf("No tx %s", receipt.TxHash)
+		}
+		priceHex = tx.GasPrice
+	}
+	price, ok := math.ParseBig256(priceHex)
+	if !ok {
+		return 0, fmt.Errorf("Invalid gas price %q", priceHex)
+	}
+	fee := new(big.Int).Mul(gasUsed, price)
+	fee.Add(fee, new(big.Int).Div(util.Shannon, big.NewInt(2)))
+	return fee.Div(fee, util.Shannon).Int64(), nil
+}
@@ -0,0 +1,248 @@
+package payouts
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+func paymentValue(amount int64) string {
+	// Shannon^2 = Wei
+	return hexutil.EncodeBig(new(big.Int).Mul(big.NewInt(amount), util.Shannon))
+}
+
+func (u *PayoutsProcessor) confirmations() int64 {
+	if u.config.Confirmations > 0 {
+		return u.config.Confirmations
+	}
+	return 1
+}
+
+// Payment left in flight by previous run is resumed on start, balance is debited already so fee ceiling
+// doesn't hold it back. Nonce is checked before first tx, so tx sent but not recorded is not sent again.
+func (u *PayoutsProcessor) resumePayment(p *storage.InflightPayment) bool {
+	log.Printf("Resuming payment of %v Shannon to %s with nonce %v, sent txs: %v", p.Amount, p.Login, p.Nonce, p.TxHashes)
+	if len(p.TxHashes) == 0 {
+		next, err := u.rpc().GetPendingNonce(u.config.Address)
+		if err != nil {
+			log.Println("Unable to resume payment, failed to get nonce:", err)
+			return false
+		}
+		if next > p.Nonce {
+			log.Printf("Unable to resume payment, nonce %v is used already. Check outgoing tx of %s to %s in block explorer and docs/PAYOUTS.md",
+				p.Nonce, u.config.Address, p.Login)
+			return false
+		}
+		fees, err := u.estimateFees()
+		if err != nil {
+			log.Println("Unable to resume payment, failed to estimate fees:", err)
+			return false
+		}
+		if !u.sendInflight(p, fees) {
+			return false
+		}
+	}
+	receipt := u.confirmPayment(p)
+	if receipt == nil {
+		return false
+	}
+	return u.finishPayment(p, receipt)
+}
+
+// Tx of payment is sent with its nonce and recorded. Send failure halts payouts, payment stays
+// in flight and is sent again with the same nonce on next start.
+func (u *PayoutsProcessor) sendInflight(p *storage.InflightPayment, fees *txFees) bool {
+	txHash, err := u.sendPayment(p.Login, paymentValue(p.Amount), p.Nonce, fees)
+	if err != nil {
+		log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
+			p.Login, p.Amount, err, p.Login)
+		u.haltPayouts(err)
+		return false
+	}
+	p.TxHashes = append(p.TxHashes, txHash)
+	p.SentAt = util.MakeTimestamp() / 1000
+	if err := u.backend.WriteInflightPayment(p); err != nil {
+		log.Printf("Failed to record tx %s of payment to %s, %v Shannon: %v", txHash, p.Login, p.Amount, err)
+		u.haltPayouts(err)
+		return false
+	}
+	u.writeStatus(txHash, storage.PaymentPending, 0)
+	log.Printf("Sent %v Shannon to %v with nonce %v, TxHash: %v, %v", p.Amount, p.Login, p.Nonce, txHash, fees)
+	return true
+}
+
+// Receipt of any tx sent with nonce of payment, once it has enough confirmations. Tx pending for
+// replaceAfter is replaced, so dropped one doesn't keep payer waiting forever.
+// Nil if payer stops meanwhile or tx failed, payment stays in flight then.
+func (u *PayoutsProcessor) confirmPayment(p *storage.InflightPayment) *rpc.TxReceipt {
+	replaceAfter := util.MustParseDuration(defaultReplaceAfter)
+	if len(u.config.ReplaceAfter) > 0 {
+		replaceAfter = util.MustParseDuration(u.config.ReplaceAfter)
+	}
+	for {
+		log.Printf("Waiting for tx confirmation: %v", p.TxHashes)
+		select {
+		case <-time.After(u.checkInterval):
+		case <-u.quit:
+			log.Printf("Payouts stopped before confirmation of tx %v, payment is resumed on next start", p.TxHashes)
+			return nil
+		}
+		u.leader.acquire()
+		receipt, err := u.findReceipt(p)
+		if err != nil {
+			log.Printf("Failed to get tx receipt for %v: %v", p.TxHashes, err)
+			continue
+		}
+		if receipt != nil {
+			if receipt.Failed() {
+				err := fmt.Errorf("Payout tx %s failed", receipt.TxHash)
+				log.Printf("%v, payment of %v Shannon to %s stays pending. See docs/PAYOUTS.md", err, p.Amount, p.Login)
+				height, _ := math.ParseUint64(receipt.BlockNumber)
+				u.writeStatus(receipt.TxHash, storage.PaymentFailed, height)
+				u.haltPayouts(err)
+				return nil
+			}
+			n, err := u.receiptConfirmations(receipt)
+			if err != nil {
+				log.Printf("Failed to count confirmations of tx %v: %v", receipt.TxHash, err)
+			} else if n >= u.confirmations() {
+				return receipt
+			}
+			continue
+		}
+		if time.Since(time.Unix(p.SentAt, 0)) >= replaceAfter {
+			u.replacePayment(p)
+		}
+	}
+}
+
+// Replacement is looked up first, only one tx with nonce is mined
+func (u *PayoutsProcessor) findReceipt(p *storage.InflightPayment) (*rpc.TxReceipt, error) {
+	for i := len(p.TxHashes) - 1; i >= 0; i-- {
+		receipt, err := u.rpc().GetTxReceipt(p.TxHashes[i])
+		if err != nil {
+			return nil, err
+		}
+		if receipt != nil && receipt.Confirmed() {
+			return receipt, nil
+		}
+	}
+	return nil, nil
+}
+
+func (u *PayoutsProcessor) receiptConfirmations(receipt *rpc.TxReceipt) (int64, error) {
+	height, ok := math.ParseUint64(receipt.BlockNumber)
+	if !ok {
+		return 0, fmt.Errorf("Invalid block number %q", receipt.BlockNumber)
+	}
+	tip, err := u.rpc().GetBlockNumber()
+	if err != nil {
+		return 0, err
+	}
+	if tip < height {
+		return 0, nil
+	}
+	return int64(tip-height) + 1, nil
+}
+
+// Stuck tx is sent again with the same nonce and higher fees. Failure is only logged,
+// tx mined meanwhile is found on next poll and replacement is tried again after replaceAfter.
+func (u *PayoutsProcessor) replacePayment(p *storage.InflightPayment) {
+	last := p.TxHashes[len(p.TxHashes)-1]
+	p.SentAt = util.MakeTimestamp() / 1000
+	stuck, err := u.rpc().GetTransaction(last)
+	if err != nil {
+		log.Printf("Not replacing stuck tx %s, failed to get it: %v", last, err)
+		return
+	}
+	fees, err := u.replacementFees(stuck)
+	if err != nil {
+		log.Printf("Not replacing stuck tx %s: %v", last, err)
+		return
+	}
+	txHash, err := u.sendPayment(p.Login, paymentValue(p.Amount), p.Nonce, fees)
+	if err != nil {
+		log.Printf("Failed to replace stuck tx %s: %v", last, err)
+		return
+	}
+	p.TxHashes = append(p.TxHashes, txHash)
+	if err := u.backend.WriteInflightPayment(p); err != nil {
+		log.Printf("Failed to record replacement tx %s of payment to %s, check it on restart: %v", txHash, p.Login, err)
+	}
+	u.writeStatus(txHash, storage.PaymentPending, 0)
+	log.Printf("Replaced stuck tx %s of payment to %s with %s, %v", last, p.Login, txHash, fees)
+}
+
+// Payment is final with confirmed tx, fee paid goes to history, sweep of pool fee too
+func (u *PayoutsProcessor) finishPayment(p *storage.InflightPayment, receipt *rpc.TxReceipt) bool {
+	if p.Kind == storage.PaymentSweep {
+		if !u.finishSweep(p, receipt.TxHash) {
+			return false
+		}
+	} else {
+		if err := u.backend.WritePayment(p.Login, receipt.TxHash, p.Amount); err != nil {
+			log.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", p.Login, p.Amount, receipt.TxHash, err)
+			u.haltPayouts(err)
+			return false
+		}
+		log.Printf("Payout tx for %s confirmed: %s", p.Login, receipt.TxHash)
+	}
+	height, _ := math.ParseUint64(receipt.BlockNumber)
+	u.writeStatus(receipt.TxHash, storage.PaymentConfirmed, height)
+	for _, v := range p.TxHashes {
+		if v != receipt.TxHash {
+			u.writeStatus(v, storage.PaymentReplaced, 0)
+		}
+	}
+
+	// Payment is written already, missing fee only leaves it out of history
+	fee, err := u.paidFee(receipt)
+	if err != nil {
+		log.Printf("Failed to get fee of payout tx %s: %v", receipt.TxHash, err)
+		return true
+	}
+	if err := u.backend.WritePaymentFee(receipt.TxHash, fee); err != nil {
+		log.Printf("Failed to write fee of payout tx %s, %v Shannon: %v", receipt.TxHash, fee, err)
+	}
+	return true
+}
+
+// Status is record only, payment goes on if it fails to be written
+func (u *PayoutsProcessor) writeStatus(txHash, status string, height uint64) {
+	if err := u.backend.WritePaymentStatus(txHash, status, height); err != nil {
+		log.Printf("Failed to write status %s of payout tx %s: %v", status, txHash, err)
+	}
+}
+
+// Payment in flight is credited back only before its tx is sent or once its tx failed,
+// any other one is finished by normal start
+func (u *PayoutsProcessor) canResolve() bool {
+	p, err := u.backend.GetInflightPayment()
+	if err != nil {
+		log.Println("Unable to resolve payouts, failed to get payment in flight:", err)
+		return false
+	}
+	if p == nil || len(p.TxHashes) == 0 {
+		return true
+	}
+	receipt, err := u.findReceipt(p)
+	if err != nil {
+		log.Println("Unable to resolve payouts, failed to get tx receipt:", err)
+		return false
+	}
+	if receipt != nil && receipt.Failed() {
+		log.Printf("Payout tx %s of payment to %s failed, payment can be credited back", receipt.TxHash, p.Login)
+		return true
+	}
+	log.Printf("Payment of %v Shannon to %s has tx %v sent with nonce %v, it is finished on normal start, nothing is credited back",
+		p.Amount, p.Login, p.TxHashes, p.Nonce)
+	return false
+}
@@ -0,0 +1,303 @@
+package payouts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+)
+
+// Storage of payer, writes are recorded, lock is always held
+type paymentBackend struct {
+	storage.Storage
+	sync.Mutex
+	inflight []storage.InflightPayment
+	statuses map[string]string
+	paid     []string
+	halt     string
+}
+
+func (b *paymentBackend) AcquireLeader(name, owner string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (b *paymentBackend) WriteInflightPayment(p *storage.InflightPayment) error {
+	b.Lock()
+	defer b.Unlock()
+	v := *p
+	v.TxHashes = append([]string(nil), p.TxHashes...)
+	b.inflight = append(b.inflight, v)
+	return nil
+}
+
+func (b *paymentBackend) WritePaymentStatus(txHash, status string, block uint64) error {
+	b.Lock()
+	defer b.Unlock()
+	b.statuses[txHash] = status
+	return nil
+}
+
+func (b *paymentBackend) WritePayment(login, txHash string, amount int64) error {
+	b.Lock()
+	defer b.Unlock()
+	b.paid = append(b.paid, txHash)
+	return nil
+}
+
+func (b *paymentBackend) WritePaymentFee(txHash string, fee int64) error {
+	return nil
+}
+
+func (b *paymentBackend) WritePayoutsHalt(reason, by string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.halt = reason
+	return nil
+}
+
+// Wallet node: pending nonce, sent txs by hash, receipts of mined ones and chain tip
+type walletNode struct {
+	sync.Mutex
+	nonce uint64
+	tip   uint64
+	// Tip grows by one on each query
+	mining   bool
+	sent     []map[string]string
+	txs      map[string]*rpc.Tx
+	receipts map[string]*rpc.TxReceipt
+	// Receipt of next sent tx
+	mine func(hash string) *rpc.TxReceipt
+}
+
+func newWalletNode(t *testing.T) (*walletNode, string) {
+	n := &walletNode{txs: make(map[string]*rpc.Tx), receipts: make(map[string]*rpc.TxReceipt)}
+	server := httptest.NewServer(n)
+	t.Cleanup(server.Close)
+	return n, server.URL
+}
+
+func (n *walletNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	var result interface{}
+	switch body.Method {
+	case "eth_getTransactionCount":
+		result = fmt.Sprintf("0x%x", n.nonce)
+	case "eth_blockNumber":
+		result = fmt.Sprintf("0x%x", n.tip)
+		if n.mining {
+			n.tip++
+		}
+	case "eth_sendTransaction":
+		var params map[string]string
+		json.Unmarshal(body.Params[0], &params)
+		n.sent = append(n.sent, params)
+		hash := fmt.Sprintf("0x%064x", len(n.sent))
+		n.txs[hash] = &rpc.Tx{Hash: hash, GasPrice: params["gasPrice"]}
+		if n.mine != nil {
+			n.receipts[hash] = n.mine(hash)
+		}
+		result = hash
+	case "eth_getTransactionByHash", "eth_getTransactionReceipt":
+		var hash string
+		json.Unmarshal(body.Params[0], &hash)
+		if body.Method == "eth_getTransactionByHash" {
+			if tx, ok := n.txs[hash]; ok {
+				result = tx
+			}
+		} else if receipt, ok := n.receipts[hash]; ok {
+			result = receipt
+		}
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 0,
+			"error": map[string]interface{}{"code": -32601, "message": "method not found"}})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 0, "result": result})
+}
+
+func (n *walletNode) sentTxs() []map[string]string {
+	n.Lock()
+	defer n.Unlock()
+	return append([]map[string]string(nil), n.sent...)
+}
+
+func mined(height uint64, status string) func(hash string) *rpc.TxReceipt {
+	return func(hash string) *rpc.TxReceipt {
+		return &rpc.TxReceipt{TxHash: hash, GasUsed: "0x5208", EffectiveGasPrice: "0x4a817c800",
+			BlockHash: "0xb1", BlockNumber: fmt.Sprintf("0x%x", height), Status: status}
+	}
+}
+
+func newTestPayer(t *testing.T, cfg *PayoutsConfig) (*PayoutsProcessor, *walletNode, *paymentBackend) {
+	node, url := newWalletNode(t)
+	backend := &paymentBackend{statuses: make(map[string]string)}
+	cfg.Daemon, cfg.Timeout = url, "1s"
+	cfg.Address = "0x0000000000000000000000000000000000000001"
+	cfg.Gas = "21000"
+	if len(cfg.GasPrice) == 0 {
+		cfg.GasPrice = "20000000000"
+	}
+	u := NewPayoutsProcessor(cfg, "test", backend)
+	u.checkInterval = time.Millisecond
+	return u, node, backend
+}
+
+func TestResumePaymentNonceUsed(t *testing.T) {
+	u, node, backend := newTestPayer(t, &PayoutsConfig{})
+	// Tx was sent with nonce 5 before crash, but not recorded
+	node.nonce = 6
+	p := &storage.InflightPayment{Login: "0x00000000000000000000000000000000000000aa", Amount: 1000, Nonce: 5}
+	if u.resumePayment(p) {
+		t.Fatal("Payment with used nonce is resumed")
+	}
+	if sent := node.sentTxs(); len(sent) != 0 {
+		t.Errorf("Tx is sent again: %v", sent)
+	}
+	if len(backend.paid) != 0 || len(backend.inflight) != 0 {
+		t.Errorf("Payment is written, paid %v, in flight %v", backend.paid, backend.inflight)
+	}
+}
+
+func TestResumePaymentSendsWithRecordedNonce(t *testing.T) {
+	u, node, backend := newTestPayer(t, &PayoutsConfig{})
+	// Crash before tx was sent
+	node.nonce, node.tip, node.mine = 5, 100, mined(100, "0x1")
+	p := &storage.InflightPayment{Login: "0x00000000000000000000000000000000000000aa", Amount: 1000, Nonce: 5}
+	if !u.resumePayment(p) {
+		t.Fatal("Payment is not resumed")
+	}
+	sent := node.sentTxs()
+	if len(sent) != 1 || sent[0]["nonce"] != "0x5" {
+		t.Fatalf("Sent txs are %v, want one with nonce 0x5", sent)
+	}
+	if len(backend.inflight) != 1 || len(backend.inflight[0].TxHashes) != 1 {
+		t.Errorf("Tx hash is not recorded before confirmation: %v", backend.inflight)
+	}
+	if len(backend.paid) != 1 || backend.statuses[backend.paid[0]] != storage.PaymentConfirmed {
+		t.Errorf("Payment is not final, paid %v, statuses %v", backend.paid, backend.statuses)
+	}
+}
+
+func TestConfirmPaymentReplacesStuckTx(t *testing.T) {
+	u, node, backend := newTestPayer(t, &PayoutsConfig{ReplaceAfter: "1m", GasPrice: "10000000000"})
+	stuck := fmt.Sprintf("0x%064x", 0xff)
+	node.txs[stuck] = &rpc.Tx{Hash: stuck, GasPrice: "0x4a817c800"}
+	node.tip, node.mine = 100, mined(100, "0x1")
+	// Sent an hour ago, no receipt
+	p := &storage.InflightPayment{Login: "0x00000000000000000000000000000000000000aa", Amount: 1000, Nonce: 5,
+		TxHashes: []string{stuck}, SentAt: time.Now().Add(-time.Hour).Unix()}
+	receipt := u.confirmPayment(p)
+	if receipt == nil {
+		t.Fatal("Replacement is not confirmed")
+	}
+	sent := node.sentTxs()
+	if len(sent) != 1 {
+		t.Fatalf("Sent txs are %v, want one replacement", sent)
+	}
+	// 20 Gwei of stuck tx raised by an eighth, above 10 Gwei of strategy
+	if sent[0]["nonce"] != "0x5" || sent[0]["gasPrice"] != "0x53d1ac100" {
+		t.Errorf("Replacement is %v, want nonce 0x5 and gas price 0x53d1ac100", sent[0])
+	}
+	if receipt.TxHash == stuck || len(p.TxHashes) != 2 {
+		t.Errorf("Receipt is of %s, payment txs are %v", receipt.TxHash, p.TxHashes)
+	}
+	if n := len(backend.inflight); n != 1 || len(backend.inflight[0].TxHashes) != 2 {
+		t.Errorf("Replacement is not recorded: %v", backend.inflight)
+	}
+}
+
+func TestConfirmPaymentReplacesDroppedTx(t *testing.T) {
+	// Replacement is not configured, dropped tx is sent again after default one
+	u, node, _ := newTestPayer(t, &PayoutsConfig{})
+	node.tip, node.mine = 100, mined(100, "0x1")
+	dropped := fmt.Sprintf("0x%064x", 0xff)
+	p := &storage.InflightPayment{Login: "0x00000000000000000000000000000000000000aa", Amount: 1000, Nonce: 5,
+		TxHashes: []string{dropped}, SentAt: time.Now().Add(-time.Hour).Unix()}
+	if receipt := u.confirmPayment(p); receipt == nil {
+		t.Fatal("Payment with dropped tx is not confirmed")
+	}
+	// Fees of strategy go, node has no fees of dropped tx
+	if sent := node.sentTxs(); len(sent) != 1 || sent[0]["gasPrice"] != "0x4a817c800" {
+		t.Errorf("Sent txs are %v, want one at gas price of strategy", sent)
+	}
+}
+
+func TestConfirmPaymentFailedReceiptHalts(t *testing.T) {
+	u, node, backend := newTestPayer(t, &PayoutsConfig{})
+	hash := fmt.Sprintf("0x%064x", 1)
+	node.tip = 100
+	node.receipts[hash] = mined(100, "0x0")(hash)
+	p := &storage.InflightPayment{Login: "0x00000000000000000000000000000000000000aa", Amount: 1000, Nonce: 5,
+		TxHashes: []string{hash}, SentAt: time.Now().Unix()}
+	if receipt := u.confirmPayment(p); receipt != nil {
+		t.Fatal("Failed tx is confirmed")
+	}
+	if len(backend.halt) == 0 {
+		t.Error("Payouts are not halted")
+	}
+	if backend.statuses[hash] != storage.PaymentFailed {
+		t.Errorf("Status of tx is %q, want %q", backend.statuses[hash], storage.PaymentFailed)
+	}
+	if !u.halt {
+		t.Error("Payer doesn't hold halt")
+	}
+}
+
+func TestConfirmPaymentWaitsForConfirmations(t *testing.T) {
+	u, node, _ := newTestPayer(t, &PayoutsConfig{Confirmations: 3})
+	hash := fmt.Sprintf("0x%064x", 1)
+	// Tx is mined at tip, two more blocks make it final
+	node.tip, node.mining = 100, true
+	node.receipts[hash] = mined(100, "0x1")(hash)
+	p := &storage.InflightPayment{Login: "0x00000000000000000000000000000000000000aa", Amount: 1000, Nonce: 5,
+		TxHashes: []string{hash}, SentAt: time.Now().Unix()}
+	if receipt := u.confirmPayment(p); receipt == nil || receipt.TxHash != hash {
+		t.Fatalf("Receipt is %v, want one of %s", receipt, hash)
+	}
+	node.Lock()
+	defer node.Unlock()
+	if queries := node.tip - 100; queries != 3 {
+		t.Errorf("Payment is final after %v queries of tip, want 3", queries)
+	}
+}
+
+func TestConfirmationsCount(t *testing.T) {
+	u, node, _ := newTestPayer(t, &PayoutsConfig{})
+	cases := []struct {
+		block, tip uint64
+		n          int64
+	}{
+		{100, 100, 1},
+		{100, 102, 3},
+		// Node behind block of receipt
+		{100, 99, 0},
+	}
+	for _, c := range cases {
+		node.tip = c.tip
+		n, err := u.receiptConfirmations(&rpc.TxReceipt{BlockNumber: fmt.Sprintf("0x%x", c.block)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != c.n {
+			t.Errorf("Tx at %v has %v confirmations at tip %v, want %v", c.block, n, c.tip, c.n)
+		}
+	}
+	if _, err := u.receiptConfirmations(&rpc.TxReceipt{BlockNumber: "pending"}); err == nil {
+		t.Error("Invalid block number is accepted")
+	}
+}
@@ -0,0 +1,54 @@
+package payouts
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+)
+
+const defaultLeaderTTL = "1m"
+
+// Payer which holds lock pays, payer run by mistake against the same redis stays idle and takes over
+// once lock expires. Owner is instance name, host and pid, so two processes of one config differ too.
+type leader struct {
+	backend storage.Storage
+	owner   string
+	ttl     time.Duration
+	held    bool
+}
+
+func newLeader(name string, ttl time.Duration, backend storage.Storage) *leader {
+	host, _ := os.Hostname()
+	return &leader{backend: backend, owner: fmt.Sprintf("%s@%s/%d", name, host, os.Getpid()), ttl: ttl}
+}
+
+// Takes or renews lock, false if another payer holds it or redis is unavailable
+func (l *leader) acquire() bool {
+	held, err := l.backend.AcquireLeader(storage.LeaderPayouts, l.owner, l.ttl)
+	if err != nil {
+		log.Println("Unable to renew payouts leader lock:", err)
+		held = false
+	}
+	if held && !l.held {
+		log.Printf("Payouts leader lock acquired by %s", l.owner)
+	} else if !held && l.held {
+		log.Printf("Payouts leader lock lost by %s", l.owner)
+	}
+	l.held = held
+	return held
+}
+
+func (l *leader) release() {
+	if !l.held {
+		return
+	}
+	if err := l.backend.ReleaseLeader(storage.LeaderPayouts, l.owner); err != nil {
+		log.Println("Failed to release payouts leader lock:", err)
+		return
+	}
+	l.held = false
+	log.Printf("Payouts leader lock released by %s", l.owner)
+}
@@ -0,0 +1,68 @@
+package payouts
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logins of a run which are not paid automatically, denied ones accrue balance until removed from blacklist
+type payoutGuard struct {
+	denied   map[string]struct{}
+	reviewed map[string]struct{}
+	// Due payments of run so far, in Shannon
+	total int64
+}
+
+// Run is skipped if lists can't be read, so failure doesn't pay denied or reviewed login
+func (u *PayoutsProcessor) newPayoutGuard() (*payoutGuard, error) {
+	denied, err := u.backend.GetLoginBlacklist()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login blacklist: %v", err)
+	}
+	reviews, err := u.backend.GetPaymentReviews()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payments held for review: %v", err)
+	}
+	g := &payoutGuard{denied: make(map[string]struct{}, len(denied)), reviewed: make(map[string]struct{}, len(reviews))}
+	for _, v := range denied {
+		g.denied[v] = struct{}{}
+	}
+	for _, v := range reviews {
+		g.reviewed[v.Login] = struct{}{}
+	}
+	return g, nil
+}
+
+// Payment above a cap is held for review, payment not fitting in rest of run total is left for next run
+func (u *PayoutsProcessor) allowPayment(g *payoutGuard, login string, amount int64) bool {
+	if _, ok := g.denied[login]; ok {
+		log.Printf("Payment of %v Shannon to %s is skipped, login is blacklisted", amount, login)
+		return false
+	}
+	if _, ok := g.reviewed[login]; ok {
+		log.Printf("Payment of %v Shannon to %s is skipped, login is held for review", amount, login)
+		return false
+	}
+	var reason string
+	if u.config.MaxPayment > 0 && amount > u.config.MaxPayment {
+		reason = fmt.Sprintf("Payment is above maxPayment %v Shannon", u.config.MaxPayment)
+	} else if u.config.MaxRunTotal > 0 && amount > u.config.MaxRunTotal {
+		reason = fmt.Sprintf("Payment is above maxRunTotal %v Shannon", u.config.MaxRunTotal)
+	}
+	if len(reason) > 0 {
+		if err := u.backend.WritePaymentReview(login, amount, reason); err != nil {
+			log.Printf("Failed to hold payment of %v Shannon to %s for review: %v", amount, login, err)
+		} else {
+			log.Printf("Payment of %v Shannon to %s is held for review: %s", amount, login, reason)
+		}
+		g.reviewed[login] = struct{}{}
+		return false
+	}
+	if u.config.MaxRunTotal > 0 && g.total+amount > u.config.MaxRunTotal {
+		log.Printf("Payment of %v Shannon to %s is left for next run, run total reached maxRunTotal %v Shannon",
+			amount, login, u.config.MaxRunTotal)
+		return false
+	}
+	g.total += amount
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -17,6 +18,9 @@ import (
 
 const txCheckInterval = 5 * time.Second
 
+// Tx dropped by node has no receipt ever, it is sent again after that unless replaceAfter is set
+const defaultReplaceAfter = "10m"
+
 type PayoutsConfig struct {
 	Enabled      bool   `json:"enabled"`
 	RequirePeers int64  `json:"requirePeers"`
@@ -27,9 +31,36 @@ type PayoutsConfig struct {
 	Gas          string `json:"gas"`
 	GasPrice     string `json:"gasPrice"`
 	AutoGas      bool   `json:"autoGas"`
+	// Fees of payout tx, see docs/PAYOUTS.md
+	GasStrategy GasStrategyConfig `json:"gasStrategy"`
 	// In Shannon
 	Threshold int64 `json:"threshold"`
+	// Bounds of threshold set by miner in Shannon, threshold is the lower one if 0, upper one is unbounded if 0
+	MinPayout int64 `json:"minPayout"`
+	MaxPayout int64 `json:"maxPayout"`
 	BgSave    bool  `json:"bgsave"`
+	// Pool wallet must hold it on top of due payments to start a run, in Shannon
+	Reserve int64 `json:"reserve"`
+	// Sanity limits in Shannon, payment above them is held for review, 0 for none, see docs/PAYOUTS.md
+	MaxPayment  int64 `json:"maxPayment"`
+	MaxRunTotal int64 `json:"maxRunTotal"`
+	// Wallet nodes with failover, daemon is the only one if not set
+	Upstream              []PayoutsUpstream `json:"upstream"`
+	UpstreamCheckInterval string            `json:"upstreamCheckInterval"`
+	// Leader lock is renewed while payer runs, other payer takes over when it expires
+	LeaderTTL string `json:"leaderTtl"`
+	// Blocks of payout tx and on top of it before payment is final, 1 if 0
+	Confirmations int64 `json:"confirmations"`
+	// Tx pending that long is sent again with the same nonce and higher fees, 10m if empty
+	ReplaceAfter string `json:"replaceAfter"`
+	// Split of accrued pool fee, see docs/PAYOUTS.md
+	FeeSweep FeeSweepConfig `json:"feeSweep"`
+}
+
+type PayoutsUpstream struct {
+	Name    string `json:"name"`
+	Url     string `json:"url"`
+	Timeout string `json:"timeout"`
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -42,21 +73,73 @@ func (self PayoutsConfig) GasPriceHex() string {
 	return hexutil.EncodeBig(x)
 }
 
+const defaultUpstreamCheckInterval = "10s"
+
 type PayoutsProcessor struct {
-	config   *PayoutsConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config    *PayoutsConfig
+	backend   storage.Storage
+	upstreams *rpc.Failover
+	halt      bool
+	lastFail  error
+	leader    *leader
+	quit      chan struct{}
+	done      chan struct{}
+	// Receipt of payout tx is polled this often
+	checkInterval time.Duration
+	// Halt is in storage, operator clears it there
+	haltWritten bool
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+// Name of pool instance goes into leader lock owner
+func NewPayoutsProcessor(cfg *PayoutsConfig, name string, backend storage.Storage) *PayoutsProcessor {
+	u := &PayoutsProcessor{config: cfg, backend: backend, quit: make(chan struct{}), done: make(chan struct{}), checkInterval: txCheckInterval}
+	ttl := defaultLeaderTTL
+	if len(cfg.LeaderTTL) > 0 {
+		ttl = cfg.LeaderTTL
+	}
+	u.leader = newLeader(name, util.MustParseDuration(ttl), backend)
+	upstreams := cfg.Upstream
+	if len(upstreams) == 0 {
+		upstreams = []PayoutsUpstream{{Name: "PayoutsProcessor", Url: cfg.Daemon, Timeout: cfg.Timeout}}
+	}
+	clients := make([]*rpc.RPCClient, len(upstreams))
+	for i, v := range upstreams {
+		clients[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
+		log.Printf("Payouts upstream: %s => %s", v.Name, rpc.RedactUrl(v.Url))
+	}
+	u.upstreams = rpc.NewFailover(clients)
 	return u
 }
 
+func (u *PayoutsProcessor) rpc() *rpc.RPCClient {
+	return u.upstreams.Current()
+}
+
+// Wallet node is never asked for work, and node without pool account must not be used,
+// so mining node can't sign payouts by misconfiguration
+func (u *PayoutsProcessor) checkUpstreams() {
+	u.upstreams.Check(rpc.FailoverPolicy{
+		Check:  (*rpc.RPCClient).CheckChain,
+		Verify: u.verifyAccount,
+	})
+}
+
+func (u *PayoutsProcessor) verifyAccount(upstream *rpc.RPCClient) error {
+	accounts, err := upstream.GetAccounts()
+	if err != nil {
+		return fmt.Errorf("can't get accounts: %v", err)
+	}
+	for _, v := range accounts {
+		if strings.EqualFold(v, u.config.Address) {
+			return nil
+		}
+	}
+	return fmt.Errorf("account %s is not available", u.config.Address)
+}
+
+// Blocks until Stop, run it in goroutine
 func (u *PayoutsProcessor) Start() {
+	defer close(u.done)
 	log.Println("Starting payouts")
 
 	if u.mustResolvePayout() {
@@ -66,48 +149,167 @@ func (u *PayoutsProcessor) Start() {
 		return
 	}
 
+	u.checkUpstreams()
+	if !u.upstreams.Health()[u.rpc()].Healthy {
+		log.Printf("Unable to start payouts, no healthy payouts upstream has account %s", u.config.Address)
+		return
+	}
+	checkIntv := defaultUpstreamCheckInterval
+	if len(u.config.UpstreamCheckInterval) > 0 {
+		checkIntv = u.config.UpstreamCheckInterval
+	}
+	checkTimer := time.NewTicker(util.MustParseDuration(checkIntv))
+	go func() {
+		for range checkTimer.C {
+			u.checkUpstreams()
+		}
+	}()
+
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
+	// Lock is held between runs too, so leader stays the same while it is alive
+	renew := time.NewTicker(u.leader.ttl / 3)
+	defer renew.Stop()
+
+	// Immediately process payouts after start
+	u.process()
+	timer.Reset(intv)
+
+	// Nil channel never fires with sweep disabled
+	var sweep <-chan time.Time
+	if u.config.FeeSweep.Enabled {
+		sweepIntv := util.MustParseDuration(u.config.FeeSweep.Interval)
+		sweepTimer := time.NewTicker(sweepIntv)
+		defer sweepTimer.Stop()
+		sweep = sweepTimer.C
+		log.Printf("Set fee sweep interval to %v", sweepIntv)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			u.process()
+			timer.Reset(intv)
+		case <-sweep:
+			u.sweepFees()
+		case <-renew.C:
+			u.leader.acquire()
+		case <-u.quit:
+			return
+		}
+	}
+}
+
+// Run in progress stops before its next payment, then lock is released
+func (u *PayoutsProcessor) Stop() {
+	close(u.quit)
+	<-u.done
+	u.leader.release()
+}
+
+func (u *PayoutsProcessor) stopping() bool {
+	select {
+	case <-u.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checked before each destructive step, payer which lost lock must not go on
+func (u *PayoutsProcessor) isLeader() bool {
+	if u.stopping() {
+		return false
+	}
+	return u.leader.acquire()
+}
+
+// Halt is written to storage, so it survives restart and shows in API until operator clears it
+func (u *PayoutsProcessor) haltPayouts(err error) {
+	u.halt = true
+	u.lastFail = err
+	if werr := u.backend.WritePayoutsHalt(err.Error(), u.leader.owner); werr != nil {
+		log.Println("Failed to write payouts halt to backend:", werr)
+		return
+	}
+	u.haltWritten = true
+}
+
+// Halt only kept in memory, since it failed to be written, holds until restart
+func (u *PayoutsProcessor) halted() bool {
+	halt, err := u.backend.GetPayoutsHalt()
+	if err != nil {
+		log.Println("Payouts skipped, failed to get payouts halt from backend:", err)
+		return true
+	}
+	if halt != nil {
+		log.Printf("Payments suspended due to critical error at %v: %s", time.Unix(halt.At, 0), halt.Reason)
+		return true
+	}
+	if u.halt && !u.haltWritten {
+		log.Println("Payments suspended due to last critical error:", u.lastFail)
+		return true
+	}
+	if u.halt {
+		log.Println("Payouts halt is cleared, resuming payments")
+		u.halt, u.lastFail, u.haltWritten = false, nil, false
+	}
+	return false
+}
+
+// Payment debited and locked by previous run is finished before anything else. Standby payer leaves it
+// to payer holding leader lock and skips its runs until it takes the lock.
+func (u *PayoutsProcessor) resumed() bool {
+	inflight, err := u.backend.GetInflightPayment()
+	if err != nil {
+		log.Println("Payouts skipped, failed to get payment in flight:", err)
+		return false
+	}
+	if inflight == nil {
+		return true
+	}
+	if !u.isLeader() {
+		log.Println("Payouts skipped, payment in flight is left to payer holding leader lock")
+		return false
+	}
+	return u.resumePayment(inflight)
+}
+
+// Failed payout skips runs until it is resolved, so payer resumes with no restart
+func (u *PayoutsProcessor) resolved() bool {
 	payments := u.backend.GetPendingPayments()
 	if len(payments) > 0 {
-		log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
+		log.Printf("Payouts skipped, previous payout failed, you have to resolve it. List of failed payments:\n %v",
 			formatPendingPayments(payments))
-		return
+		return false
 	}
-
 	locked, err := u.backend.IsPayoutsLocked()
 	if err != nil {
-		log.Println("Unable to start payouts:", err)
-		return
+		log.Println("Payouts skipped, failed to get payouts lock:", err)
+		return false
 	}
 	if locked {
-		log.Println("Unable to start payouts because they are locked")
-		return
+		log.Println("Payouts skipped, they are locked")
+		return false
 	}
+	return true
+}
 
-	// Immediately process payouts after start
-	u.process()
-	timer.Reset(intv)
-
-	go func() {
-		for {
-			select {
-			case <-timer.C:
-				u.process()
-				timer.Reset(intv)
-			}
-		}
-	}()
+type duePayment struct {
+	login  string
+	amount int64
 }
 
 func (u *PayoutsProcessor) process() {
-	if u.halt {
-		log.Println("Payments suspended due to last critical error:", u.lastFail)
+	if u.halted() || !u.resumed() || !u.resolved() {
+		return
+	}
+	if !u.isLeader() {
+		log.Println("Payouts are skipped, leader lock is held by another payer")
 		return
 	}
-	mustPay := 0
 	minersPaid := 0
 	totalAmount := big.NewInt(0)
 	payees, err := u.backend.GetMiners()
@@ -116,39 +318,81 @@ func (u *PayoutsProcessor) process() {
 		return
 	}
 
+	guard, err := u.newPayoutGuard()
+	if err != nil {
+		log.Println("Payouts skipped,", err)
+		return
+	}
+
+	var due []duePayment
 	for _, login := range payees {
 		amount, _ := u.backend.GetBalance(login)
-		amountInShannon := big.NewInt(amount)
-
-		// Shannon^2 = Wei
-		amountInWei := new(big.Int).Mul(amountInShannon, util.Shannon)
 
-		if !u.reachedThreshold(amountInShannon) {
+		// Settings are read on each run, so change by miner applies to next one
+		settings, err := u.backend.GetMinerSettings(login)
+		if err != nil {
+			log.Printf("Failed to get settings of %v, using pool threshold: %v", login, err)
+			settings = &storage.MinerSettings{}
+		}
+		if settings.Paused {
 			continue
 		}
-		mustPay++
-
-		// Require active peers before processing
-		if !u.checkPeers() {
-			break
+		if !u.reachedThreshold(big.NewInt(amount), u.threshold(settings)) {
+			continue
 		}
-		// Require unlocked account
-		if !u.isUnlockedAccount() {
-			break
+		if !u.allowPayment(guard, login, amount) {
+			continue
 		}
+		due = append(due, duePayment{login, amount})
+	}
+	mustPay := len(due)
+
+	// Nothing is debited unless all checks of run pass
+	if mustPay > 0 && !u.preflight(due) {
+		return
+	}
+	// Pending nonce is taken once per run, each tx is confirmed before next one
+	var nonce uint64
+	if mustPay > 0 {
+		if nonce, err = u.rpc().GetPendingNonce(u.config.Address); err != nil {
+			log.Println("Payouts skipped, failed to get nonce:", err)
+			return
+		}
+	}
+
+	for _, v := range due {
+		login, amount := v.login, v.amount
+
+		// Shannon^2 = Wei
+		amountInWei := new(big.Int).Mul(big.NewInt(amount), util.Shannon)
 
 		// Check if we have enough funds
-		poolBalance, err := u.rpc.GetBalance(u.config.Address)
+		poolBalance, err := u.rpc().GetBalance(u.config.Address)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			u.haltPayouts(err)
 			break
 		}
 		if poolBalance.Cmp(amountInWei) < 0 {
 			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
 				amountInWei.String(), poolBalance.String())
-			u.halt = true
-			u.lastFail = err
+			u.haltPayouts(err)
+			break
+		}
+
+		// Nothing is locked yet, so expensive run is left for the next one
+		fees, err := u.estimateFees()
+		if err != nil {
+			log.Println("Payouts skipped, failed to estimate fees:", err)
+			break
+		}
+		if u.aboveCeiling(fees) {
+			log.Printf("Payouts skipped, estimated fee %v Wei per gas is above ceiling %v Wei, retrying on next run",
+				fees.estimate, u.config.GasStrategy.FeeCeiling)
+			break
+		}
+
+		if !u.isLeader() {
+			log.Println("Payouts stopped, leader lock is not held anymore")
 			break
 		}
 
@@ -156,8 +400,7 @@ func (u *PayoutsProcessor) process() {
 		err = u.backend.LockPayouts(login, amount)
 		if err != nil {
 			log.Printf("Failed to lock payment for %s: %v", login, err)
-			u.halt = true
-			u.lastFail = err
+			u.haltPayouts(err)
 			break
 		}
 		log.Printf("Locked payment for %s, %v Shannon", login, amount)
@@ -166,47 +409,39 @@ func (u *PayoutsProcessor) process() {
 		err = u.backend.UpdateBalance(login, amount)
 		if err != nil {
 			log.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
-			u.halt = true
-			u.lastFail = err
+			u.haltPayouts(err)
 			break
 		}
 
-		value := hexutil.EncodeBig(amountInWei)
-		txHash, err := u.rpc.SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
-		if err != nil {
-			log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-				login, amount, err, login)
-			u.halt = true
-			u.lastFail = err
+		// Nothing is sent yet, so balance is credited back and payer stops clean
+		if !u.isLeader() {
+			log.Printf("Payouts stopped, leader lock is not held anymore, crediting %v Shannon back to %s", amount, login)
+			u.undoPayout(login, amount)
 			break
 		}
 
-		// Log transaction hash
-		err = u.backend.WritePayment(login, txHash, amount)
-		if err != nil {
-			log.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
-			u.halt = true
-			u.lastFail = err
+		// Nonce is reserved before tx is sent, so restart sends it again with the same nonce and can't pay twice
+		payment := &storage.InflightPayment{Login: login, Amount: amount, Nonce: nonce}
+		if err := u.backend.WriteInflightPayment(payment); err != nil {
+			log.Printf("Failed to record payment in flight for %s, crediting %v Shannon back: %v", login, amount, err)
+			u.undoPayout(login, amount)
+			break
+		}
+		if !u.sendInflight(payment, fees) {
 			break
 		}
+		nonce++
 
+		// Wait for TX confirmation before further payouts, lock is renewed meanwhile
+		receipt := u.confirmPayment(payment)
+		if receipt == nil {
+			break
+		}
+		if !u.finishPayment(payment, receipt) {
+			break
+		}
 		minersPaid++
 		totalAmount.Add(totalAmount, big.NewInt(amount))
-		log.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
-
-		// Wait for TX confirmation before further payouts
-		for {
-			log.Printf("Waiting for tx confirmation: %v", txHash)
-			time.Sleep(txCheckInterval)
-			receipt, err := u.rpc.GetTxReceipt(txHash)
-			if err != nil {
-				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-			}
-			if receipt != nil && receipt.Confirmed() {
-				break
-			}
-		}
-		log.Printf("Payout tx for %s confirmed: %s", login, txHash)
 	}
 
 	if mustPay > 0 {
@@ -221,8 +456,56 @@ func (u *PayoutsProcessor) process() {
 	}
 }
 
+func (u *PayoutsProcessor) undoPayout(login string, amount int64) {
+	if err := u.backend.RollbackBalance(login, amount); err != nil {
+		log.Printf("Failed to credit %v Shannon back to %s: %v", amount, login, err)
+		u.haltPayouts(err)
+		return
+	}
+	if err := u.backend.UnlockPayouts(); err != nil {
+		log.Println("Failed to unlock payouts:", err)
+		u.haltPayouts(err)
+	}
+}
+
+// Node must be synced with enough peers, and pool wallet must hold all due payments and reserve
+func (u *PayoutsProcessor) preflight(due []duePayment) bool {
+	syncing, err := u.rpc().GetSyncing()
+	if err != nil {
+		log.Println("Unable to start payouts, failed to get sync status of node:", err)
+		return false
+	}
+	if syncing {
+		log.Println("Unable to start payouts, node is syncing")
+		return false
+	}
+	// Require active peers before processing
+	if !u.checkPeers() {
+		return false
+	}
+	// Require unlocked account
+	if !u.isUnlockedAccount() {
+		return false
+	}
+	total := u.config.Reserve
+	for _, v := range due {
+		total += v.amount
+	}
+	need := new(big.Int).Mul(big.NewInt(total), util.Shannon)
+	poolBalance, err := u.rpc().GetBalance(u.config.Address)
+	if err != nil {
+		log.Println("Unable to start payouts, failed to get pool balance:", err)
+		return false
+	}
+	if poolBalance.Cmp(need) < 0 {
+		log.Printf("Unable to start payouts, pool has %v Wei, %v due payments and reserve need %v Wei", poolBalance, len(due), need)
+		return false
+	}
+	return true
+}
+
 func (self PayoutsProcessor) isUnlockedAccount() bool {
-	_, err := self.rpc.Sign(self.config.Address, "0x0")
+	_, err := self.rpc().Sign(self.config.Address, "0x0")
 	if err != nil {
 		log.Println("Unable to process payouts:", err)
 		return false
@@ -231,7 +514,7 @@ func (self PayoutsProcessor) isUnlockedAccount() bool {
 }
 
 func (self PayoutsProcessor) checkPeers() bool {
-	n, err := self.rpc.GetPeerCount()
+	n, err := self.rpc().GetPeerCount()
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
 		return false
@@ -243,8 +526,27 @@ func (self PayoutsProcessor) checkPeers() bool {
 	return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-	return big.NewInt(self.config.Threshold).Cmp(amount) < 0
+func (self PayoutsProcessor) reachedThreshold(amount *big.Int, threshold int64) bool {
+	return big.NewInt(threshold).Cmp(amount) < 0
+}
+
+// Threshold of miner within pool bounds, pool one if miner has not set it
+func (self PayoutsProcessor) threshold(settings *storage.MinerSettings) int64 {
+	if settings.MinPayout <= 0 {
+		return self.config.Threshold
+	}
+	threshold := settings.MinPayout
+	min := self.config.MinPayout
+	if min <= 0 {
+		min = self.config.Threshold
+	}
+	if threshold < min {
+		threshold = min
+	}
+	if self.config.MaxPayout > 0 && threshold > self.config.MaxPayout {
+		threshold = self.config.MaxPayout
+	}
+	return threshold
 }
 
 func formatPendingPayments(list []*storage.PendingPayment) string {
@@ -265,6 +567,9 @@ func (self PayoutsProcessor) bgSave() {
 }
 
 func (self PayoutsProcessor) resolvePayouts() {
+	if !self.canResolve() || !self.resolveSweep() {
+		return
+	}
 	payments := self.backend.GetPendingPayments()
 
 	if len(payments) > 0 {
@@ -0,0 +1,82 @@
+package payouts
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+)
+
+// Failed payout of previous run, miners are listed once it is resolved and run stops there
+type resolveBackend struct {
+	storage.Storage
+	halt     *storage.PayoutsHalt
+	inflight *storage.InflightPayment
+	pending  []*storage.PendingPayment
+	locked   bool
+	standby  bool
+	listed   int
+}
+
+func (b *resolveBackend) GetPayoutsHalt() (*storage.PayoutsHalt, error) { return b.halt, nil }
+func (b *resolveBackend) GetPendingPayments() []*storage.PendingPayment { return b.pending }
+func (b *resolveBackend) IsPayoutsLocked() (bool, error)                { return b.locked, nil }
+
+func (b *resolveBackend) GetInflightPayment() (*storage.InflightPayment, error) {
+	return b.inflight, nil
+}
+
+func (b *resolveBackend) AcquireLeader(name, owner string, ttl time.Duration) (bool, error) {
+	return !b.standby, nil
+}
+
+func (b *resolveBackend) GetMiners() ([]string, error) {
+	b.listed++
+	return nil, errors.New("Run is not tested further")
+}
+
+func TestProcessWaitsForResolvedPayout(t *testing.T) {
+	backend := &resolveBackend{
+		halt:    &storage.PayoutsHalt{Reason: "test"},
+		pending: []*storage.PendingPayment{{Address: "0xa", Amount: 1}},
+		locked:  true,
+	}
+	u := NewPayoutsProcessor(&PayoutsConfig{Daemon: "http://127.0.0.1:0", Timeout: "1s"}, "test", backend)
+	for _, resolve := range []func(){
+		func() { backend.halt = nil },
+		func() { backend.pending = nil },
+		func() { backend.locked = false },
+	} {
+		u.process()
+		if backend.listed != 0 {
+			t.Fatal("Run is not skipped before payout is resolved")
+		}
+		resolve()
+	}
+	u.process()
+	if backend.listed != 1 {
+		t.Error("Run is skipped once payout is resolved")
+	}
+}
+
+// Leader has payment in flight and payouts locked, standby runs once it holds leader lock
+func TestStandbyWaitsForLeaderLock(t *testing.T) {
+	backend := &resolveBackend{inflight: &storage.InflightPayment{Login: "0xa", Amount: 1}, locked: true, standby: true}
+	u := NewPayoutsProcessor(&PayoutsConfig{Daemon: "http://127.0.0.1:0", Timeout: "1s"}, "test", backend)
+	for _, finish := range []func(){
+		func() { backend.inflight = nil },
+		func() { backend.locked = false },
+		func() { backend.standby = false },
+	} {
+		u.process()
+		if backend.listed != 0 {
+			t.Fatal("Standby payer runs while leader holds lock")
+		}
+		finish()
+	}
+	u.process()
+	if backend.listed != 1 {
+		t.Error("Run is skipped once leader lock is taken")
+	}
+}
@@ -0,0 +1,193 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Accrued pool fee is split to destinations by percent once it exceeds threshold
+type FeeSweepConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// In Shannon
+	Threshold    int64            `json:"threshold"`
+	Destinations []FeeDestination `json:"destinations"`
+}
+
+type FeeDestination struct {
+	Address string  `json:"address"`
+	Percent float64 `json:"percent"`
+}
+
+// Percents of destinations must sum to 100
+func (c *FeeSweepConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Interval) == 0 {
+		return errors.New("Fee sweep interval is not set")
+	}
+	if len(c.Destinations) == 0 {
+		return errors.New("Fee sweep has no destinations")
+	}
+	total := 0.0
+	for _, v := range c.Destinations {
+		if !util.IsValidHexAddress(v.Address) {
+			return fmt.Errorf("Invalid fee sweep address %q", v.Address)
+		}
+		if v.Percent <= 0 {
+			return fmt.Errorf("Percent of fee sweep to %s must be positive", v.Address)
+		}
+		total += v.Percent
+	}
+	if math.Abs(total-100) > 1e-9 {
+		return fmt.Errorf("Percents of fee sweep sum to %v, not 100", total)
+	}
+	return nil
+}
+
+// Amounts are rounded down, remainder stays accrued for next sweep
+func (c *FeeSweepConfig) split(total int64) []duePayment {
+	var due []duePayment
+	for _, v := range c.Destinations {
+		amount := int64(float64(total) * v.Percent / 100)
+		if amount > 0 {
+			due = append(due, duePayment{v.Address, amount})
+		}
+	}
+	return due
+}
+
+// Runs between payouts on the same loop, so it never overlaps with a payout run
+func (u *PayoutsProcessor) sweepFees() {
+	if u.halted() {
+		return
+	}
+	if !u.isLeader() {
+		log.Println("Fee sweep is skipped, leader lock is held by another payer")
+		return
+	}
+	accrued, err := u.backend.GetPoolFee()
+	if err != nil {
+		log.Println("Fee sweep is skipped, failed to get accrued pool fee:", err)
+		return
+	}
+	total := int64(accrued)
+	if total <= u.config.FeeSweep.Threshold {
+		log.Printf("Accrued pool fee %v Shannon has not exceeded sweep threshold %v Shannon", total, u.config.FeeSweep.Threshold)
+		return
+	}
+	due := u.config.FeeSweep.split(total)
+	if len(due) == 0 || !u.preflight(due) {
+		return
+	}
+	nonce, err := u.rpc().GetPendingNonce(u.config.Address)
+	if err != nil {
+		log.Println("Fee sweep is skipped, failed to get nonce:", err)
+		return
+	}
+
+	var swept int64
+	for _, v := range due {
+		fees, err := u.estimateFees()
+		if err != nil {
+			log.Println("Fee sweep is skipped, failed to estimate fees:", err)
+			break
+		}
+		if u.aboveCeiling(fees) {
+			log.Printf("Fee sweep is skipped, estimated fee %v Wei per gas is above ceiling %v Wei, retrying on next sweep",
+				fees.estimate, u.config.GasStrategy.FeeCeiling)
+			break
+		}
+		if !u.isLeader() {
+			log.Println("Fee sweep stopped, leader lock is not held anymore")
+			break
+		}
+		if err := u.backend.LockPayouts(v.login, v.amount); err != nil {
+			log.Printf("Failed to lock fee sweep to %s: %v", v.login, err)
+			u.haltPayouts(err)
+			break
+		}
+		// Debit goes before tx, so crash leaves fee unswept rather than swept twice
+		if err := u.backend.DebitPoolFee(v.amount); err != nil {
+			log.Printf("Failed to debit pool fee for sweep to %s, %v Shannon: %v", v.login, v.amount, err)
+			u.haltPayouts(err)
+			break
+		}
+		payment := &storage.InflightPayment{Login: v.login, Amount: v.amount, Nonce: nonce, Kind: storage.PaymentSweep}
+		if err := u.backend.WriteInflightPayment(payment); err != nil {
+			log.Printf("Failed to record fee sweep in flight to %s, crediting %v Shannon back: %v", v.login, v.amount, err)
+			u.undoSweep(v.amount)
+			break
+		}
+		if !u.sendInflight(payment, fees) {
+			break
+		}
+		nonce++
+
+		receipt := u.confirmPayment(payment)
+		if receipt == nil {
+			break
+		}
+		if !u.finishPayment(payment, receipt) {
+			break
+		}
+		swept += v.amount
+	}
+	log.Printf("Swept total %v Shannon of %v Shannon accrued pool fee", swept, total)
+}
+
+func (u *PayoutsProcessor) undoSweep(amount int64) {
+	if err := u.backend.RollbackPoolFee(amount); err != nil {
+		log.Printf("Failed to credit %v Shannon back to pool fee: %v", amount, err)
+		u.haltPayouts(err)
+		return
+	}
+	if err := u.backend.UnlockPayouts(); err != nil {
+		log.Println("Failed to unlock payouts:", err)
+		u.haltPayouts(err)
+	}
+}
+
+// Sweep is final with confirmed tx, it goes to payment history of pool and lock is released
+func (u *PayoutsProcessor) finishSweep(p *storage.InflightPayment, txHash string) bool {
+	if err := u.backend.WriteFeeSweep(p.Login, txHash, p.Amount); err != nil {
+		log.Printf("Failed to log fee sweep to %s, %v Shannon, tx: %s: %v", p.Login, p.Amount, txHash, err)
+		u.haltPayouts(err)
+		return false
+	}
+	if err := u.backend.UnlockPayouts(); err != nil {
+		log.Println("Failed to unlock payouts:", err)
+		u.haltPayouts(err)
+		return false
+	}
+	log.Printf("Fee sweep tx for %s confirmed: %s", p.Login, txHash)
+	return true
+}
+
+// Sweep in flight which resolve may credit back returns to accrued pool fee
+func (u *PayoutsProcessor) resolveSweep() bool {
+	p, err := u.backend.GetInflightPayment()
+	if err != nil {
+		log.Println("Unable to resolve payouts, failed to get payment in flight:", err)
+		return false
+	}
+	if p == nil || p.Kind != storage.PaymentSweep {
+		return true
+	}
+	if err := u.backend.RollbackPoolFee(p.Amount); err != nil {
+		log.Printf("Failed to credit %v Shannon of fee sweep to %s back to pool fee: %v", p.Amount, p.Login, err)
+		return false
+	}
+	if err := u.backend.UnlockPayouts(); err != nil {
+		log.Println("Failed to unlock payouts:", err)
+		return false
+	}
+	log.Printf("Credited %v Shannon of fee sweep to %s back to pool fee", p.Amount, p.Login)
+	return true
+}
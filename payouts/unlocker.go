@@ -0,0 +1,353 @@
+package payouts
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	defaultImmatureDepth   = 20
+	defaultMaturityDepth   = 120
+	defaultUnlockerTimeout = "10s"
+	// Uncle is included at most this many blocks above it
+	maxUncleDepth = 7
+)
+
+// Candidate is credited as immature balance once it is immatureDepth blocks below tip, immature block
+// becomes spendable once it is depth blocks below tip. Enable it on one instance of pool.
+type UnlockerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Percent of block reward kept by pool, see docs/PAYOUTS.md
+	PoolFee float64 `json:"poolFee"`
+	// Percent of block reward paid to finder from pool fee once block matures, 0 for none
+	FinderBonusPercent float64 `json:"finderBonusPercent"`
+	ImmatureDepth      int64   `json:"immatureDepth"`
+	Depth              int64   `json:"depth"`
+	Interval           string  `json:"interval"`
+	Daemon             string  `json:"daemon"`
+	Timeout            string  `json:"timeout"`
+	// Blocks, uncles and receipts are fetched in JSON-RPC batches of that many calls, 0 for one batch per lookup
+	BatchSize int `json:"batchSize"`
+}
+
+type BlockUnlocker struct {
+	config  *UnlockerConfig
+	backend storage.Storage
+	rewards util.RewardSchedule
+	rpc     *rpc.RPCClient
+}
+
+func NewBlockUnlocker(cfg *UnlockerConfig, rewards util.RewardSchedule, backend storage.Storage) (*BlockUnlocker, error) {
+	if cfg.PoolFee < 0 || cfg.PoolFee > 100 {
+		return nil, fmt.Errorf("Pool fee %v is not a percent", cfg.PoolFee)
+	}
+	if cfg.FinderBonusPercent < 0 || cfg.FinderBonusPercent > 100 {
+		return nil, fmt.Errorf("Finder bonus %v is not a percent", cfg.FinderBonusPercent)
+	}
+	u := &BlockUnlocker{config: cfg, backend: backend, rewards: rewards}
+	if u.immatureDepth() >= u.depth() {
+		return nil, fmt.Errorf("Immature depth %v must be below maturity depth %v", u.immatureDepth(), u.depth())
+	}
+	timeout := cfg.Timeout
+	if len(timeout) == 0 {
+		timeout = defaultUnlockerTimeout
+	}
+	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, timeout)
+	return u, nil
+}
+
+func (u *BlockUnlocker) immatureDepth() int64 {
+	if u.config.ImmatureDepth > 0 {
+		return u.config.ImmatureDepth
+	}
+	return defaultImmatureDepth
+}
+
+func (u *BlockUnlocker) depth() int64 {
+	if u.config.Depth > 0 {
+		return u.config.Depth
+	}
+	return defaultMaturityDepth
+}
+
+func (u *BlockUnlocker) Start() {
+	log.Println("Starting block unlocker")
+	intv := util.MustParseDuration(u.config.Interval)
+	log.Printf("Set block unlock interval to %v, immature depth %v, maturity depth %v, pool fee %v%%",
+		intv, u.immatureDepth(), u.depth(), u.config.PoolFee)
+	util.Schedule(u.unlockBlocks, intv)
+}
+
+// Node or backend error stops pass until next interval, block is never orphaned on missing reply
+func (u *BlockUnlocker) unlockBlocks() {
+	tip, err := u.rpc.GetBlockNumber()
+	if err != nil {
+		log.Println("Failed to get block number for block unlock:", err)
+		return
+	}
+	u.unlockCandidates(int64(tip))
+	u.unlockImmature(int64(tip))
+}
+
+func (u *BlockUnlocker) unlockCandidates(tip int64) {
+	candidates, err := u.backend.GetCandidates(tip - u.immatureDepth())
+	if err != nil {
+		log.Println("Failed to get block candidates from backend:", err)
+		return
+	}
+	for _, block := range candidates {
+		reply, decided, err := u.locate(block, tip)
+		if err != nil {
+			log.Printf("Failed to locate block candidate %v: %v", block.RoundHeight, err)
+			return
+		}
+		if !decided {
+			continue
+		}
+		if reply == nil {
+			if err := u.backend.WriteOrphanBlock(block); err != nil {
+				log.Printf("Failed to orphan block candidate %v: %v", block.RoundHeight, err)
+				return
+			}
+			log.Printf("Block candidate %v found by %s is orphaned", block.RoundHeight, block.Finder)
+			continue
+		}
+		credits, poolFee, err := u.credits(block, reply)
+		if err != nil {
+			log.Printf("Failed to compute credits of block %v: %v", block.Height, err)
+			return
+		}
+		bonus := u.finderBonus(block, poolFee)
+		if err := u.backend.WriteImmatureBlock(block, credits, poolFee-bonus, bonus); err != nil {
+			log.Printf("Failed to credit immature block %v: %v", block.Height, err)
+			return
+		}
+		kind := "block"
+		if block.Uncle {
+			kind = "uncle"
+		}
+		log.Printf("Immature %s %v %s of round %v in %s mode, reward %v Wei, %v logins credited, pool fee %v Shannon, finder bonus %v Shannon",
+			kind, block.Height, block.Hash, block.RoundHeight, block.Mode, block.Reward, len(credits), poolFee-bonus, bonus)
+	}
+}
+
+// Immature block is orphaned if it has left canonical chain meanwhile
+func (u *BlockUnlocker) unlockImmature(tip int64) {
+	blocks, err := u.backend.GetImmatureBlocks(tip - u.depth())
+	if err != nil {
+		log.Println("Failed to get immature blocks from backend:", err)
+		return
+	}
+	for _, block := range blocks {
+		reply, err := u.rpc.GetBlockByHeight(block.Height)
+		if err != nil {
+			log.Printf("Failed to get block %v: %v", block.Height, err)
+			return
+		}
+		if reply == nil {
+			log.Printf("No block at height %v, block unlock is stopped until next interval", block.Height)
+			return
+		}
+		if !isIncluded(reply, block) {
+			if err := u.backend.WriteOrphanBlock(block); err != nil {
+				log.Printf("Failed to orphan immature block %v: %v", block.Height, err)
+				return
+			}
+			log.Printf("Immature block %v %s of round %v is not in canonical chain, orphaned", block.Height, block.Hash, block.RoundHeight)
+			continue
+		}
+		// Fees are credited once per login, so block left immature by failed write takes the rest on retry
+		if block.Mode == storage.ModePPSPlus && !block.Uncle {
+			fees, err := u.rpc.GetBlockFees(reply, u.config.BatchSize)
+			if err != nil {
+				log.Printf("Failed to get fees of block %v: %v", block.Height, err)
+				return
+			}
+			if fees.Sign() > 0 {
+				credited, err := u.backend.CreditBlockFees(block.RoundHeight, block.Nonce, weiToShannon(fees), u.config.PoolFee)
+				if err != nil {
+					log.Printf("Failed to credit fees of block %v, %v Shannon credited: %v", block.Height, credited, err)
+					return
+				}
+				log.Printf("Credited %v Shannon of fees of block %v over window", credited, block.Height)
+			}
+		}
+		if err := u.backend.WriteMaturedBlock(block); err != nil {
+			log.Printf("Failed to credit matured block %v: %v", block.Height, err)
+			return
+		}
+		log.Printf("Matured block %v %s of round %v, reward %s Wei", block.Height, block.Hash, block.RoundHeight, block.RewardString)
+	}
+}
+
+// Candidate is block at its round height or uncle included in one of next blocks, block including it is returned.
+// Nil is returned once neither is in canonical chain, nothing is decided while uncle may be included still.
+func (u *BlockUnlocker) locate(block *storage.BlockData, tip int64) (*rpc.GetBlockReply, bool, error) {
+	reply, err := u.rpc.GetBlockByHeight(block.RoundHeight)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, fmt.Errorf("No block at height %v", block.RoundHeight)
+	}
+	if matchCandidate(reply, block) {
+		block.Hash = reply.Hash
+		return reply, true, nil
+	}
+	// Blocks which may include it, top one is below tip until uncle can't be included anymore
+	var heights []int64
+	for height := block.RoundHeight + 1; height <= block.RoundHeight+maxUncleDepth && height <= tip; height++ {
+		heights = append(heights, height)
+	}
+	nephews, err := u.rpc.GetBlocksByHeight(heights, u.config.BatchSize)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, nephew := range nephews {
+		if nephew == nil {
+			return nil, false, fmt.Errorf("No block at height %v", heights[i])
+		}
+		if len(nephew.Uncles) == 0 {
+			continue
+		}
+		uncles, err := u.rpc.GetUnclesByBlockNumber(heights[i], len(nephew.Uncles), u.config.BatchSize)
+		if err != nil {
+			return nil, false, err
+		}
+		for j, uncle := range uncles {
+			if uncle == nil {
+				return nil, false, fmt.Errorf("No uncle %v of block %v", j, heights[i])
+			}
+			if matchCandidate(uncle, block) {
+				block.Hash = uncle.Hash
+				block.Height = heights[i]
+				block.UncleHeight = block.RoundHeight
+				block.Uncle = true
+				return nephew, true, nil
+			}
+		}
+	}
+	return nil, block.RoundHeight+maxUncleDepth <= tip, nil
+}
+
+// Nonce of header, or of seal fields on Parity
+func matchCandidate(reply *rpc.GetBlockReply, block *storage.BlockData) bool {
+	if len(reply.Nonce) > 0 {
+		return strings.EqualFold(reply.Nonce, block.Nonce)
+	}
+	if len(reply.SealFields) == 2 {
+		return strings.EqualFold(reply.SealFields[1], block.Nonce)
+	}
+	return false
+}
+
+// Block hash at its height, or uncle hash among uncles of block including it
+func isIncluded(reply *rpc.GetBlockReply, block *storage.BlockData) bool {
+	if !block.Uncle {
+		return strings.EqualFold(reply.Hash, block.Hash)
+	}
+	for _, hash := range reply.Uncles {
+		if strings.EqualFold(hash, block.Hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reward of block is set, credits of logins and pool fee are in Shannon. Shares of PPS and PPS+ blocks
+// were credited already, pool keeps its fee of block reward then.
+func (u *BlockUnlocker) credits(block *storage.BlockData, reply *rpc.GetBlockReply) (map[string]int64, int64, error) {
+	subsidy, fees, err := u.blockReward(block, reply)
+	if err != nil {
+		return nil, 0, err
+	}
+	block.Reward = new(big.Int).Add(subsidy, fees)
+	total := weiToShannon(block.Reward)
+	fee := u.config.PoolFee / 100
+	switch block.Mode {
+	case storage.ModePPS:
+		return nil, int64(float64(total) * fee), nil
+	case storage.ModePPSPlus:
+		// Fees are distributed over window once block matures, they carry own pool part
+		return nil, int64(float64(weiToShannon(subsidy)) * fee), nil
+	case storage.ModeSolo:
+		amount := int64(float64(total) * (1 - fee))
+		return map[string]int64{block.Finder: amount}, total - amount, nil
+	case storage.ModePPLNS:
+		shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Block stays candidate, reward is not left to pool
+		if len(shares) == 0 {
+			return nil, 0, errors.New("No window snapshot of block")
+		}
+		credits, credited := distribute(int64(float64(total)*(1-fee)), shares)
+		return credits, total - credited, nil
+	}
+	return nil, 0, fmt.Errorf("Block of %s mode is not supported", block.Mode)
+}
+
+// Bonus in Shannon is bounded by pool fee of block, so it never comes from credits of miners
+// and is not part of distribution. Solo finder is credited block reward already.
+func (u *BlockUnlocker) finderBonus(block *storage.BlockData, poolFee int64) int64 {
+	if u.config.FinderBonusPercent <= 0 || block.Solo || len(block.Finder) == 0 {
+		return 0
+	}
+	bonus := int64(float64(weiToShannon(block.Reward)) * u.config.FinderBonusPercent / 100)
+	if bonus > poolFee {
+		return poolFee
+	}
+	return bonus
+}
+
+// Subsidy and uncle inclusion rewards, and fees of block in Wei. Uncle gets its reward only.
+func (u *BlockUnlocker) blockReward(block *storage.BlockData, reply *rpc.GetBlockReply) (*big.Int, *big.Int, error) {
+	if block.Uncle {
+		return shannonToWei(u.rewards.UncleReward(uint64(block.UncleHeight), uint64(block.Height))), new(big.Int), nil
+	}
+	height := uint64(block.Height)
+	subsidy := shannonToWei(u.rewards.BlockReward(height) + u.rewards.NephewReward(height, len(reply.Uncles)))
+	fees, err := u.rpc.GetBlockFees(reply, u.config.BatchSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return subsidy, fees, nil
+}
+
+// Amount in Shannon pro rata to shares, rounded down, and total credited
+func distribute(amount int64, shares map[string]int64) (map[string]int64, int64) {
+	total := new(big.Int)
+	for _, n := range shares {
+		total.Add(total, big.NewInt(n))
+	}
+	credits := make(map[string]int64, len(shares))
+	credited := int64(0)
+	if total.Sign() <= 0 || amount <= 0 {
+		return credits, 0
+	}
+	for login, n := range shares {
+		v := new(big.Int).Mul(big.NewInt(amount), big.NewInt(n))
+		v.Div(v, total)
+		if v.Sign() > 0 {
+			credits[login] = v.Int64()
+			credited += v.Int64()
+		}
+	}
+	return credits, credited
+}
+
+func shannonToWei(amount int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(amount), util.Shannon)
+}
+
+func weiToShannon(amount *big.Int) int64 {
+	return new(big.Int).Div(amount, util.Shannon).Int64()
+}
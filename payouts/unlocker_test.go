@@ -0,0 +1,141 @@
+package payouts
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Window snapshot of every block, other methods of storage are not called
+type snapshotBackend struct {
+	storage.Storage
+	shares map[string]int64
+}
+
+func (b *snapshotBackend) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	return b.shares, nil
+}
+
+func newTestUnlocker(t *testing.T, poolFee float64, shares map[string]int64) *BlockUnlocker {
+	rewards, err := util.NewRewardSchedule(util.RewardsEthereum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &UnlockerConfig{PoolFee: poolFee, Daemon: "http://127.0.0.1:0"}
+	u, err := NewBlockUnlocker(cfg, rewards, &snapshotBackend{shares: shares})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestDistribute(t *testing.T) {
+	credits, credited := distribute(100, map[string]int64{"0xa": 1, "0xb": 1, "0xc": 1})
+	if credited != 99 {
+		t.Errorf("Credited %v, want 99 rounded down", credited)
+	}
+	for login, v := range credits {
+		if v != 33 {
+			t.Errorf("Credit of %s is %v, want 33", login, v)
+		}
+	}
+	// Product of reward and share difficulty is beyond int64
+	credits, credited = distribute(2000000000, map[string]int64{"0xa": 4000000000000000, "0xb": 12000000000000000})
+	if credits["0xa"] != 500000000 || credits["0xb"] != 1500000000 || credited != 2000000000 {
+		t.Errorf("Credits are %v, total %v", credits, credited)
+	}
+	if credits, credited := distribute(100, nil); len(credits) != 0 || credited != 0 {
+		t.Errorf("Empty window credits %v, total %v", credits, credited)
+	}
+}
+
+func TestCreditsByMode(t *testing.T) {
+	shares := map[string]int64{"0xa": 1000, "0xb": 3000}
+	u := newTestUnlocker(t, 1, shares)
+	cases := []struct {
+		mode    string
+		uncle   bool
+		credits map[string]int64
+		poolFee int64
+	}{
+		// 2 Ether of Constantinople, 1% of it to pool
+		{storage.ModePPS, false, nil, 20000000},
+		{storage.ModePPSPlus, false, nil, 20000000},
+		{storage.ModePPLNS, false, map[string]int64{"0xa": 495000000, "0xb": 1485000000}, 20000000},
+		// Window of pool is not touched
+		{storage.ModeSolo, false, map[string]int64{"0xf": 1980000000}, 20000000},
+		// Uncle of depth 2 gets 6/8 of block reward
+		{storage.ModePPLNS, true, map[string]int64{"0xa": 371250000, "0xb": 1113750000}, 15000000},
+	}
+	for _, c := range cases {
+		block := &storage.BlockData{Height: 8000000, RoundHeight: 8000000, Mode: c.mode, Finder: "0xf", Solo: c.mode == storage.ModeSolo}
+		if c.uncle {
+			block.Height, block.UncleHeight, block.Uncle = 8000002, 8000000, true
+		}
+		credits, poolFee, err := u.credits(block, &rpc.GetBlockReply{})
+		if err != nil {
+			t.Errorf("%s: %v", c.mode, err)
+			continue
+		}
+		if poolFee != c.poolFee {
+			t.Errorf("%s: pool fee is %v, want %v", c.mode, poolFee, c.poolFee)
+		}
+		if len(credits) != len(c.credits) {
+			t.Errorf("%s: credits are %v, want %v", c.mode, credits, c.credits)
+		}
+		for login, v := range c.credits {
+			if credits[login] != v {
+				t.Errorf("%s: credit of %s is %v, want %v", c.mode, login, credits[login], v)
+			}
+		}
+		total := poolFee
+		for _, v := range credits {
+			total += v
+		}
+		if (c.mode == storage.ModePPLNS || c.mode == storage.ModeSolo) && big.NewInt(total).Cmp(new(big.Int).Div(block.Reward, util.Shannon)) != 0 {
+			t.Errorf("%s: credits and pool fee sum to %v, reward is %v", c.mode, total, block.Reward)
+		}
+	}
+}
+
+func TestCreditsWithoutSnapshot(t *testing.T) {
+	u := newTestUnlocker(t, 1, nil)
+	block := &storage.BlockData{Height: 8000000, RoundHeight: 8000000, Mode: storage.ModePPLNS, Finder: "0xf"}
+	if credits, poolFee, err := u.credits(block, &rpc.GetBlockReply{}); err == nil {
+		t.Errorf("PPLNS block without snapshot is credited %v, pool fee %v", credits, poolFee)
+	}
+}
+
+func TestFinderBonus(t *testing.T) {
+	u := newTestUnlocker(t, 1, nil)
+	u.config.FinderBonusPercent = 0.5
+	reward := shannonToWei(2000000000)
+	cases := []struct {
+		name    string
+		block   *storage.BlockData
+		poolFee int64
+		bonus   int64
+	}{
+		{"pps block", &storage.BlockData{Finder: "0xf", Reward: reward}, 20000000, 10000000},
+		{"bounded by pool fee", &storage.BlockData{Finder: "0xf", Reward: reward}, 4000000, 4000000},
+		{"solo block", &storage.BlockData{Finder: "0xf", Reward: reward, Solo: true}, 20000000, 0},
+		{"no finder", &storage.BlockData{Reward: reward}, 20000000, 0},
+	}
+	for _, c := range cases {
+		if got := u.finderBonus(c.block, c.poolFee); got != c.bonus {
+			t.Errorf("%s: bonus is %v, want %v", c.name, got, c.bonus)
+		}
+	}
+}
+
+func TestNewBlockUnlockerDepths(t *testing.T) {
+	if _, err := NewBlockUnlocker(&UnlockerConfig{ImmatureDepth: 120, Depth: 120}, nil, nil); err == nil {
+		t.Error("Immature depth equal to maturity depth is accepted")
+	}
+	if _, err := NewBlockUnlocker(&UnlockerConfig{PoolFee: 101}, nil, nil); err == nil {
+		t.Error("Pool fee above 100 percent is accepted")
+	}
+}
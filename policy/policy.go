@@ -3,6 +3,7 @@ package policy
 import (
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
 	"strings"
 	"sync"
@@ -14,11 +15,12 @@ import (
 )
 
 type Config struct {
-	Workers         int     `json:"workers"`
-	Banning         Banning `json:"banning"`
-	Limits          Limits  `json:"limits"`
-	ResetInterval   string  `json:"resetInterval"`
-	RefreshInterval string  `json:"refreshInterval"`
+	Workers         int      `json:"workers"`
+	Banning         Banning  `json:"banning"`
+	Limits          Limits   `json:"limits"`
+	Sessions        Sessions `json:"sessions"`
+	ResetInterval   string   `json:"resetInterval"`
+	RefreshInterval string   `json:"refreshInterval"`
 }
 
 type Limits struct {
@@ -28,6 +30,15 @@ type Limits struct {
 	LimitJump int32  `json:"limitJump"`
 }
 
+// Invalid shares of stratum session are counted against session first,
+// IP is reported only after EscalateAfter sessions were dropped
+type Sessions struct {
+	Enabled       bool   `json:"enabled"`
+	InvalidLimit  int32  `json:"invalidLimit"`
+	Window        string `json:"window"`
+	EscalateAfter int32  `json:"escalateAfter"`
+}
+
 type Banning struct {
 	Enabled        bool    `json:"enabled"`
 	IPSet          string  `json:"ipset"`
@@ -35,52 +46,62 @@ type Banning struct {
 	InvalidPercent float32 `json:"invalidPercent"`
 	CheckThreshold int32   `json:"checkThreshold"`
 	MalformedLimit int32   `json:"malformedLimit"`
+	LowDiffWeight  float32 `json:"lowDiffWeight"`
+	IPv6Prefix     int     `json:"ipv6Prefix"`
 }
 
 type Stats struct {
 	sync.Mutex
 	// We are using atomic with LastBeat,
 	// so moving it before the rest in order to avoid alignment issue
-	LastBeat      int64
-	BannedAt      int64
-	ValidShares   int32
-	InvalidShares int32
-	Malformed     int32
-	ConnLimit     int32
-	Banned        int32
+	LastBeat        int64
+	BannedAt        int64
+	ValidShares     int32
+	InvalidShares   int32
+	LowDiffShares   int32
+	Malformed       int32
+	ConnLimit       int32
+	Banned          int32
+	DroppedSessions int32
 }
 
 type PolicyServer struct {
 	sync.RWMutex
 	statsMu    sync.Mutex
-	config     *Config
+	config     atomic.Value
 	stats      map[string]*Stats
+	logins     map[string]int32
 	banChannel chan string
 	startedAt  int64
 	grace      int64
 	timeout    int64
 	blacklist  []string
 	whitelist  []string
-	storage    *storage.RedisClient
+	storage    storage.Storage
+	quit       chan struct{}
+	stopOnce   sync.Once
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+func Start(cfg *Config, storage storage.Storage) *PolicyServer {
+	s := &PolicyServer{startedAt: util.MakeTimestamp()}
+	s.config.Store(cfg)
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
 	s.banChannel = make(chan string, 64)
 	s.stats = make(map[string]*Stats)
+	s.logins = make(map[string]int32)
 	s.storage = storage
+	s.quit = make(chan struct{})
 	s.refreshState()
 
-	timeout := util.MustParseDuration(s.config.ResetInterval)
+	timeout := util.MustParseDuration(s.cfg().ResetInterval)
 	s.timeout = int64(timeout / time.Millisecond)
 
-	resetIntv := util.MustParseDuration(s.config.ResetInterval)
+	resetIntv := util.MustParseDuration(s.cfg().ResetInterval)
 	resetTimer := time.NewTimer(resetIntv)
 	log.Printf("Set policy stats reset every %v", resetIntv)
 
-	refreshIntv := util.MustParseDuration(s.config.RefreshInterval)
+	refreshIntv := util.MustParseDuration(s.cfg().RefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
 	log.Printf("Set policy state refresh every %v", refreshIntv)
 
@@ -93,23 +114,43 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 			case <-refreshTimer.C:
 				s.refreshState()
 				refreshTimer.Reset(refreshIntv)
+			case <-s.quit:
+				resetTimer.Stop()
+				refreshTimer.Stop()
+				return
 			}
 		}
 	}()
 
-	for i := 0; i < s.config.Workers; i++ {
+	for i := 0; i < s.cfg().Workers; i++ {
 		s.startPolicyWorker()
 	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
+	log.Printf("Running with %v policy workers", s.cfg().Workers)
 	return s
 }
 
+func (s *PolicyServer) cfg() *Config {
+	return s.config.Load().(*Config)
+}
+
+// Timers and workers are stopped, bans in queue are dropped
+func (s *PolicyServer) Stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
+// Banning and limits are applied immediately, intervals and workers are fixed on start
+func (s *PolicyServer) SetConfig(cfg *Config) {
+	s.config.Store(cfg)
+}
+
 func (s *PolicyServer) startPolicyWorker() {
 	go func() {
 		for {
 			select {
 			case ip := <-s.banChannel:
 				s.doBan(ip)
+			case <-s.quit:
+				return
 			}
 		}
 	}()
@@ -117,7 +158,7 @@ func (s *PolicyServer) startPolicyWorker() {
 
 func (s *PolicyServer) resetStats() {
 	now := util.MakeTimestamp()
-	banningTimeout := s.config.Banning.Timeout * 1000
+	banningTimeout := s.cfg().Banning.Timeout * 1000
 	total := 0
 	s.statsMu.Lock()
 	defer s.statsMu.Unlock()
@@ -139,6 +180,7 @@ func (s *PolicyServer) resetStats() {
 			total++
 		}
 	}
+	s.logins = make(map[string]int32)
 	log.Printf("Flushed stats for %v IP addresses", total)
 }
 
@@ -155,18 +197,43 @@ func (s *PolicyServer) refreshState() {
 	if err != nil {
 		log.Printf("Failed to get whitelist from backend: %v", err)
 	}
+	for i, ip := range s.whitelist {
+		s.whitelist[i] = util.NormalizeIP(ip)
+	}
 	log.Println("Policy state refresh complete")
 }
 
 func (s *PolicyServer) NewStats() *Stats {
 	x := &Stats{
-		ConnLimit: s.config.Limits.Limit,
+		ConnLimit: s.cfg().Limits.Limit,
 	}
 	x.heartbeat()
 	return x
 }
 
+// IPv6 clients usually own whole subnet, so they share stats by prefix
+func (s *PolicyServer) statsKey(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	// Mapped IPv4 is keyed as plain one
+	if addr.To4() != nil {
+		return addr.String()
+	}
+	prefix := s.cfg().Banning.IPv6Prefix
+	if prefix <= 0 {
+		prefix = 64
+	}
+	if prefix >= 128 {
+		return addr.String()
+	}
+	network := net.IPNet{IP: addr.Mask(net.CIDRMask(prefix, 128)), Mask: net.CIDRMask(prefix, 128)}
+	return network.String()
+}
+
 func (s *PolicyServer) Get(ip string) *Stats {
+	ip = s.statsKey(ip)
 	s.statsMu.Lock()
 	defer s.statsMu.Unlock()
 
@@ -191,7 +258,7 @@ func (s *PolicyServer) IsBanned(ip string) bool {
 }
 
 func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
-	if !s.config.Limits.Enabled {
+	if !s.cfg().Limits.Enabled {
 		return true
 	}
 	now := util.MakeTimestamp()
@@ -213,7 +280,7 @@ func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
-	if n >= s.config.Banning.MalformedLimit {
+	if n >= s.cfg().Banning.MalformedLimit {
 		s.forceBan(x, ip)
 		return false
 	}
@@ -226,26 +293,58 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 
 	if validShare {
 		x.ValidShares++
-		if s.config.Limits.Enabled {
-			x.incrLimit(s.config.Limits.LimitJump)
+		if s.cfg().Limits.Enabled {
+			x.incrLimit(s.cfg().Limits.LimitJump)
 		}
 	} else {
 		x.InvalidShares++
 	}
+	return s.checkShares(x, ip)
+}
+
+// Low difficulty share is usually caused by miner ignoring retarget,
+// so it is weighted separately from wrong PoW
+func (s *PolicyServer) ApplyLowDiffPolicy(ip string) bool {
+	x := s.Get(ip)
+	x.Lock()
+	x.LowDiffShares++
+	return s.checkShares(x, ip)
+}
 
-	totalShares := x.ValidShares + x.InvalidShares
-	if totalShares < s.config.Banning.CheckThreshold {
+// Must be called with stats locked, lock is released
+func (s *PolicyServer) checkShares(x *Stats, ip string) bool {
+	totalShares := x.ValidShares + x.InvalidShares + x.LowDiffShares
+	if totalShares < s.cfg().Banning.CheckThreshold {
 		x.Unlock()
 		return true
 	}
 	validShares := float32(x.ValidShares)
-	invalidShares := float32(x.InvalidShares)
+	invalidShares := float32(x.InvalidShares) + float32(x.LowDiffShares)*s.cfg().Banning.LowDiffWeight
 	x.resetShares()
 	x.Unlock()
 
 	ratio := invalidShares / validShares
 
-	if ratio >= s.config.Banning.InvalidPercent/100.0 {
+	if ratio >= s.cfg().Banning.InvalidPercent/100.0 {
+		s.forceBan(x, ip)
+		return false
+	}
+	return true
+}
+
+// Called when stratum session is dropped for invalid shares,
+// IP is banned if several sessions from it or of the same login were dropped
+func (s *PolicyServer) ApplySessionPolicy(ip, login string) bool {
+	x := s.Get(ip)
+	n := atomic.AddInt32(&x.DroppedSessions, 1)
+
+	s.statsMu.Lock()
+	s.logins[login]++
+	m := s.logins[login]
+	s.statsMu.Unlock()
+
+	limit := s.cfg().Sessions.EscalateAfter
+	if limit > 0 && (n >= limit || m >= limit) {
 		s.forceBan(x, ip)
 		return false
 	}
@@ -255,19 +354,20 @@ func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 func (x *Stats) resetShares() {
 	x.ValidShares = 0
 	x.InvalidShares = 0
+	x.LowDiffShares = 0
 }
 
 func (s *PolicyServer) forceBan(x *Stats, ip string) {
-	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
+	if !s.cfg().Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
 	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-		if len(s.config.Banning.IPSet) > 0 {
-			s.banChannel <- ip
+		if len(s.cfg().Banning.IPSet) > 0 {
+			s.banChannel <- s.statsKey(ip)
 		} else {
-			log.Println("Banned peer", ip)
+			log.Println("Banned peer", s.statsKey(ip))
 		}
 	}
 }
@@ -297,7 +397,7 @@ func (s *PolicyServer) InWhiteList(ip string) bool {
 }
 
 func (s *PolicyServer) doBan(ip string) {
-	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
+	set, timeout := s.cfg().Banning.IPSet, s.cfg().Banning.Timeout
 	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
 	args := strings.Fields(cmd)
 	head := args[0]
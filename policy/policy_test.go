@@ -0,0 +1,46 @@
+package policy
+
+import "testing"
+
+func newTestPolicy(prefix int) *PolicyServer {
+	s := &PolicyServer{stats: make(map[string]*Stats)}
+	s.config.Store(&Config{Banning: Banning{IPv6Prefix: prefix}})
+	return s
+}
+
+func TestStatsKey(t *testing.T) {
+	s := newTestPolicy(0)
+	cases := []struct {
+		ip, key string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		// Mapped IPv4 shares stats with plain one
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+		// IPv6 is tracked by /64 by default
+		{"2001:db8:1:2:aaaa::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:bbbb::2", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+	}
+	for _, c := range cases {
+		if got := s.statsKey(c.ip); got != c.key {
+			t.Errorf("Key of %v is %v, want %v", c.ip, got, c.key)
+		}
+	}
+
+	if got := newTestPolicy(48).statsKey("2001:db8:1:2::1"); got != "2001:db8:1::/48" {
+		t.Errorf("Key with /48 prefix is %v", got)
+	}
+	if got := newTestPolicy(128).statsKey("2001:DB8::1"); got != "2001:db8::1" {
+		t.Errorf("Key with /128 prefix is %v", got)
+	}
+}
+
+func TestStatsSharedByIPv6Prefix(t *testing.T) {
+	s := newTestPolicy(64)
+	if s.Get("2001:db8::1") != s.Get("2001:db8::2") {
+		t.Error("Addresses of one /64 have separate stats")
+	}
+	if s.Get("10.0.0.1") != s.Get("::ffff:10.0.0.1") {
+		t.Error("Mapped IPv4 address has separate stats")
+	}
+}
@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	defaultSessionsPageSize    = 100
+	maxSessionsPageSize        = 1000
+	defaultAdjustmentsPageSize = 100
+	maxAdjustmentsPageSize     = 1000
+	maxRequestIdLength         = 64
+)
+
+type SessionInfo struct {
+	Id          uint64 `json:"id"`
+	IP          string `json:"ip"`
+	Login       string `json:"login"`
+	Worker      string `json:"worker"`
+	Difficulty  int64  `json:"difficulty"`
+	Protocol    string `json:"protocol"`
+	ConnectedAt int64  `json:"connectedAt"`
+	LastShare   int64  `json:"lastShare"`
+	Accepted    int64  `json:"accepted"`
+	Rejected    int64  `json:"rejected"`
+}
+
+func (s *ProxyServer) registerAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/sessions", s.adminAuth(s.SessionsIndex)).Methods("GET")
+	r.HandleFunc("/admin/sessions", s.adminAuth(s.KickLogin)).Methods("DELETE")
+	r.HandleFunc("/admin/sessions/{id:[0-9]+}", s.adminAuth(s.KickSession)).Methods("DELETE")
+	r.HandleFunc("/admin/settings/{login:0x[0-9a-fA-F]{40}}", s.adminAuth(s.MinerSettingsIndex)).Methods("GET")
+	r.HandleFunc("/admin/settings/{login:0x[0-9a-fA-F]{40}}", s.adminAuth(s.UpdateMinerSettings)).Methods("PUT")
+	r.HandleFunc("/admin/blacklist", s.adminAuth(s.LoginBlacklistIndex)).Methods("GET")
+	r.HandleFunc("/admin/blacklist/{login:0x[0-9a-fA-F]{40}}", s.adminAuth(s.UpdateLoginBlacklist)).Methods("PUT", "DELETE")
+	r.HandleFunc("/admin/payouts", s.adminAuth(s.PayoutsStateIndex)).Methods("GET")
+	r.HandleFunc("/admin/payouts/halt", s.adminAuth(s.ClearPayoutsHalt)).Methods("DELETE")
+	r.HandleFunc("/admin/payouts/review/{login:0x[0-9a-fA-F]{40}}", s.adminAuth(s.ClearPaymentReview)).Methods("DELETE")
+	r.HandleFunc("/admin/adjustments", s.adminAuth(s.AdjustmentsIndex)).Methods("GET")
+	r.HandleFunc("/admin/adjustments/{login:0x[0-9a-fA-F]{40}}", s.adminAuth(s.AdjustBalance)).Methods("POST")
+}
+
+// Context key of operator name of admin request
+type operatorKey struct{}
+
+// Admin endpoint is hidden unless enabled with token, token is read on each request so reload applies.
+// Shared token or token of operator is accepted, name of operator goes with request.
+func (s *ProxyServer) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg().Proxy.Admin
+		if !cfg.Enabled || (len(cfg.Token) == 0 && len(cfg.Operators) == 0) {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		operator, ok := "", len(cfg.Token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1
+		for name, v := range cfg.Operators {
+			if len(v) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(v)) == 1 {
+				operator, ok = name, true
+			}
+		}
+		if !ok {
+			log.Printf("Unauthorized admin request from %s", s.remoteAddr(r))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), operatorKey{}, operator)))
+	}
+}
+
+// Empty for shared token
+func adminOperator(r *http.Request) string {
+	operator, _ := r.Context().Value(operatorKey{}).(string)
+	return operator
+}
+
+// Separator goes in adjustment record
+func validateOperators(operators map[string]string) error {
+	for name, token := range operators {
+		if len(name) == 0 || strings.Contains(name, ":") {
+			return fmt.Errorf("operator name %q must be set and must not hold ':'", name)
+		}
+		if len(token) == 0 {
+			return fmt.Errorf("token of operator %s is empty", name)
+		}
+	}
+	return nil
+}
+
+// Sessions are of stratum endpoint only
+func (s *ProxyServer) stratumSessions(w http.ResponseWriter, r *http.Request) bool {
+	if !s.cfg().Proxy.Stratum.Enabled {
+		http.NotFound(w, r)
+		return false
+	}
+	return true
+}
+
+func (s *ProxyServer) SessionsIndex(w http.ResponseWriter, r *http.Request) {
+	if !s.stratumSessions(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 {
+		limit = defaultSessionsPageSize
+	}
+	if limit > maxSessionsPageSize {
+		limit = maxSessionsPageSize
+	}
+
+	// Sort by id so pages stay stable while sessions come and go
+	sessions := s.findSessions(strings.ToLower(query.Get("login")))
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+
+	total := len(sessions)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	page := make([]SessionInfo, 0, end-offset)
+	for _, cs := range sessions[offset:end] {
+		page = append(page, cs.info())
+	}
+
+	reply := make(map[string]interface{})
+	reply["now"] = util.MakeTimestamp()
+	reply["total"] = total
+	reply["offset"] = offset
+	reply["limit"] = limit
+	reply["sessions"] = page
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+func (s *ProxyServer) KickSession(w http.ResponseWriter, r *http.Request) {
+	if !s.stratumSessions(w, r) {
+		return
+	}
+	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	for _, cs := range s.sessionsSnapshot() {
+		if cs.id == id {
+			login, worker, _ := cs.owner()
+			log.Printf("Kicked session %v of %v.%v@%v by admin request", id, login, worker, cs.ip)
+			cs.conn.Close()
+			writeAdminReply(w, http.StatusOK, map[string]interface{}{"kicked": 1})
+			return
+		}
+	}
+	writeAdminReply(w, http.StatusNotFound, map[string]interface{}{"kicked": 0})
+}
+
+func (s *ProxyServer) KickLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.stratumSessions(w, r) {
+		return
+	}
+	login := strings.ToLower(r.URL.Query().Get("login"))
+	if !util.IsValidHexAddress(login) {
+		http.Error(w, "Invalid login", http.StatusBadRequest)
+		return
+	}
+	sessions := s.findSessions(login)
+	for _, cs := range sessions {
+		cs.conn.Close()
+	}
+	log.Printf("Kicked %v sessions of %v by admin request", len(sessions), login)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"kicked": len(sessions)})
+}
+
+func (s *ProxyServer) MinerSettingsIndex(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	settings, err := s.backend.GetMinerSettings(login)
+	if err != nil {
+		log.Printf("Failed to get settings of %v from backend: %v", login, err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, settings)
+}
+
+// Settings are applied to sessions on next login
+func (s *ProxyServer) UpdateMinerSettings(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	var settings storage.MinerSettings
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg().Proxy.LimitBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || settings.FixedDiff < 0 || !isValidMode(settings.Mode) {
+		http.Error(w, "Invalid settings", http.StatusBadRequest)
+		return
+	}
+	if err := s.backend.WriteMinerSettings(login, &settings); err != nil {
+		log.Printf("Failed to write settings of %v to backend: %v", login, err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Updated settings of %v by admin request: fixed difficulty %v, mode %q", login, settings.FixedDiff, settings.Mode)
+	writeAdminReply(w, http.StatusOK, &settings)
+}
+
+func isValidMode(mode string) bool {
+	return len(mode) == 0 || mode == storage.ModePPS || mode == storage.ModeSolo
+}
+
+func (s *ProxyServer) LoginBlacklistIndex(w http.ResponseWriter, r *http.Request) {
+	logins, err := s.backend.GetLoginBlacklist()
+	if err != nil {
+		log.Printf("Failed to get login blacklist from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"logins": logins})
+}
+
+// PUT adds login to blacklist, DELETE removes it. Sessions already logged in are not kicked.
+func (s *ProxyServer) UpdateLoginBlacklist(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	var err error
+	if r.Method == "PUT" {
+		err = s.backend.AddLoginBlacklist(login)
+	} else {
+		err = s.backend.RemoveLoginBlacklist(login)
+	}
+	if err != nil {
+		log.Printf("Failed to update login blacklist in backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	s.invalidateDenylist()
+	log.Printf("Login blacklist %v %v by admin request", r.Method, login)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"login": login, "denied": r.Method == "PUT"})
+}
+
+// Halt, lock, pending payments, payment in flight and payments held for review of payer
+func (s *ProxyServer) PayoutsStateIndex(w http.ResponseWriter, r *http.Request) {
+	halt, err := s.backend.GetPayoutsHalt()
+	if err != nil {
+		log.Printf("Failed to get payouts halt from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	locked, err := s.backend.IsPayoutsLocked()
+	if err != nil {
+		log.Printf("Failed to get payouts lock from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	inflight, err := s.backend.GetInflightPayment()
+	if err != nil {
+		log.Printf("Failed to get payment in flight from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	reviews, err := s.backend.GetPaymentReviews()
+	if err != nil {
+		log.Printf("Failed to get payments held for review from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{
+		"halt":     halt,
+		"locked":   locked,
+		"pending":  s.backend.GetPendingPayments(),
+		"inflight": inflight,
+		"review":   reviews,
+	})
+}
+
+// Login is paid by next run once its balance is checked, payment above caps is held again
+func (s *ProxyServer) ClearPaymentReview(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	cleared, err := s.backend.ClearPaymentReview(login)
+	if err != nil {
+		log.Printf("Failed to clear payment review in backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	if !cleared {
+		http.Error(w, "No payment held for review", http.StatusNotFound)
+		return
+	}
+	log.Printf("Payment review of %v cleared by admin request", login)
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"login": login, "review": nil})
+}
+
+type adjustmentRequest struct {
+	RequestId string `json:"requestId"`
+	// In Shannon, negative to debit
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+	Force  bool   `json:"force"`
+}
+
+// Separator goes in adjustment record, only reason may hold it
+func (req *adjustmentRequest) valid() bool {
+	return len(req.RequestId) > 0 && len(req.RequestId) <= maxRequestIdLength && !strings.Contains(req.RequestId, ":") &&
+		len(strings.TrimSpace(req.Reason)) > 0 && req.Amount != 0
+}
+
+// Request with request id applied already returns current balance and is not applied again.
+// Operator is one authenticated by token, shared token can't adjust balances.
+func (s *ProxyServer) AdjustBalance(w http.ResponseWriter, r *http.Request) {
+	login := strings.ToLower(mux.Vars(r)["login"])
+	operator := adminOperator(r)
+	if len(operator) == 0 {
+		http.Error(w, "Adjustment requires token of operator", http.StatusForbidden)
+		return
+	}
+	var req adjustmentRequest
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg().Proxy.LimitBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.valid() {
+		http.Error(w, "Invalid adjustment, requestId, amount and reason are required", http.StatusBadRequest)
+		return
+	}
+	exist, err := s.backend.IsMinerExists(login)
+	if err != nil {
+		log.Printf("Failed to check miner %v in backend: %v", login, err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	if !exist {
+		http.Error(w, "Unknown login", http.StatusNotFound)
+		return
+	}
+	applied, balance, err := s.backend.AdjustBalance(login, req.Amount, req.Reason, operator, req.RequestId, req.Force)
+	if err == storage.ErrNegativeBalance {
+		http.Error(w, "Adjustment would make balance negative, set force to apply it", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to adjust balance of %v in backend: %v", login, err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	if applied {
+		log.Printf("Balance of %v adjusted by %v Shannon by %v, request %v: %v", login, req.Amount, operator, req.RequestId, req.Reason)
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"login": login, "requestId": req.RequestId, "applied": applied, "balance": balance})
+}
+
+func (s *ProxyServer) AdjustmentsIndex(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, _ := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	if limit <= 0 {
+		limit = defaultAdjustmentsPageSize
+	}
+	if limit > maxAdjustmentsPageSize {
+		limit = maxAdjustmentsPageSize
+	}
+	adjustments, total, err := s.backend.GetAdjustments(offset, limit)
+	if err != nil {
+		log.Printf("Failed to get adjustments from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"total": total, "offset": offset, "limit": limit, "adjustments": adjustments})
+}
+
+// Halt is cleared only once payments are resolved, so payer doesn't start over a failed one
+func (s *ProxyServer) ClearPayoutsHalt(w http.ResponseWriter, r *http.Request) {
+	locked, err := s.backend.IsPayoutsLocked()
+	if err != nil {
+		log.Printf("Failed to get payouts lock from backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	if locked || len(s.backend.GetPendingPayments()) > 0 {
+		http.Error(w, "Payouts are locked, resolve pending payments first", http.StatusConflict)
+		return
+	}
+	if err := s.backend.ClearPayoutsHalt(); err != nil {
+		log.Printf("Failed to clear payouts halt in backend: %v", err)
+		http.Error(w, "Backend error", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Payouts halt cleared by admin request")
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"halt": nil})
+}
+
+// Sessions map is only held for copying, so broadcasts are not blocked by admin requests
+func (s *ProxyServer) findSessions(login string) []*Session {
+	sessions := s.sessionsSnapshot()
+	if len(login) == 0 {
+		return sessions
+	}
+	result := sessions[:0]
+	for _, cs := range sessions {
+		if owner, _, _ := cs.owner(); owner == login {
+			result = append(result, cs)
+		}
+	}
+	return result
+}
+
+// Login of session is changed by its own goroutine, it is read under workMu
+func (cs *Session) info() SessionInfo {
+	login, worker, _ := cs.owner()
+	return SessionInfo{
+		Id:          cs.id,
+		IP:          cs.ip,
+		Login:       login,
+		Worker:      worker,
+		Difficulty:  cs.Difficulty(),
+		Protocol:    cs.protocol,
+		ConnectedAt: cs.connectedAt.UnixNano() / 1000000,
+		LastShare:   atomic.LoadInt64(&cs.lastShare),
+		Accepted:    atomic.LoadInt64(&cs.accepted),
+		Rejected:    atomic.LoadInt64(&cs.rejected),
+	}
+}
+
+func (cs *Session) countShare(accepted bool) {
+	if accepted {
+		atomic.AddInt64(&cs.accepted, 1)
+		atomic.StoreInt64(&cs.lastShare, util.MakeTimestamp())
+	} else {
+		atomic.AddInt64(&cs.rejected, 1)
+	}
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Println("Error serializing admin response: ", err)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+)
+
+// Listing reads sessions while they switch login, race detector catches unguarded login
+func TestSessionInfoDuringLoginSwitch(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	cfg := testStratumConfig(url)
+	cfg.Proxy.Stratum.AllowLoginSwitch = true
+	s, _, addr := newStratumServer(t, cfg)
+	m := dialMiner(t, addr)
+	m.login()
+
+	done := make(chan struct{})
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, cs := range s.findSessions("") {
+				if info := cs.info(); len(info.Login) == 0 || len(info.Worker) == 0 {
+					t.Errorf("Session is listed as %v.%v", info.Login, info.Worker)
+				}
+			}
+		}
+	}()
+	last := testLogin
+	for i := 0; i < 8; i++ {
+		last = fmt.Sprintf("0x%040x", 0xb0+i)
+		if reply := m.call("eth_submitLogin", last+".rig"); reply.Error != nil {
+			t.Fatalf("Login switch is rejected: %v", reply.Error)
+		}
+	}
+	close(done)
+	<-listed
+
+	if n := len(s.findSessions(last)); n != 1 {
+		t.Errorf("Found %v sessions of last login, want 1", n)
+	}
+	if n := len(s.findSessions(testLogin)); n != 0 {
+		t.Errorf("Found %v sessions of first login, want 0", n)
+	}
+}
+
+type adjustBackend struct {
+	storage.Storage
+	operators []string
+}
+
+func (b *adjustBackend) IsMinerExists(login string) (bool, error) { return true, nil }
+
+func (b *adjustBackend) AdjustBalance(login string, amount int64, reason, operator, requestId string, force bool) (bool, float64, error) {
+	b.operators = append(b.operators, operator)
+	return true, float64(amount), nil
+}
+
+func TestAdjustmentRecordsAuthenticatedOperator(t *testing.T) {
+	backend := &adjustBackend{}
+	s := &ProxyServer{backend: backend}
+	cfg := &Config{}
+	cfg.Proxy.LimitBodySize = 1024
+	cfg.Proxy.Admin = ProxyAdmin{Enabled: true, Token: "shared", Operators: map[string]string{"alice": "secret"}}
+	s.config.Store(cfg)
+	r := mux.NewRouter()
+	s.registerAdminRoutes(r)
+
+	adjust := func(token string) int {
+		body := `{"requestId": "ticket-1", "amount": 1000, "reason": "test", "operator": "mallory"}`
+		req := httptest.NewRequest("POST", "/admin/adjustments/"+testLogin, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := adjust("secret"); code != http.StatusOK {
+		t.Errorf("Adjustment with token of operator got %v", code)
+	}
+	if code := adjust("shared"); code != http.StatusForbidden {
+		t.Errorf("Adjustment with shared token got %v, want %v", code, http.StatusForbidden)
+	}
+	if code := adjust("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Adjustment with unknown token got %v, want %v", code, http.StatusUnauthorized)
+	}
+	// Sessions are hidden without stratum, the rest of admin endpoint is not
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	req.Header.Set("Authorization", "Bearer shared")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Sessions without stratum got %v, want %v", w.Code, http.StatusNotFound)
+	}
+	// Operator of request body is not taken
+	if len(backend.operators) != 1 || backend.operators[0] != "alice" {
+		t.Errorf("Adjustments are recorded by %v, want alice only", backend.operators)
+	}
+}
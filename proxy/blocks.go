@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 
@@ -13,11 +14,37 @@ import (
 	"github.com/CryptoManiac/open-ethereum-pool/util"
 )
 
-const maxBacklog = 6
+// Number of heights of issued work kept by default
+const defaultBacklog = 6
 
 type heightDiffPair struct {
-	diff   *big.Int
-	height uint64
+	diff    *big.Int
+	height  uint64
+	nonces  *nonceSet
+	created time.Time
+	// Node which issued the job, block is submitted to it
+	upstream *rpc.RPCClient
+}
+
+// Nonces accepted for job, set is dropped together with job when it leaves backlog
+type nonceSet struct {
+	sync.Mutex
+	seen map[uint64]struct{}
+}
+
+func newNonceSet() *nonceSet {
+	return &nonceSet{seen: make(map[uint64]struct{})}
+}
+
+// Returns false if nonce was already submitted for this job
+func (n *nonceSet) add(nonce uint64) bool {
+	n.Lock()
+	defer n.Unlock()
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = struct{}{}
+	return true
 }
 
 type BlockTemplate struct {
@@ -28,7 +55,6 @@ type BlockTemplate struct {
 	Difficulty           *big.Int
 	Height               uint64
 	GetPendingBlockCache *rpc.GetBlockReplyPart
-	nonces               map[string]bool
 	headers              map[string]heightDiffPair
 }
 
@@ -46,25 +72,37 @@ func (b Block) Nonce() uint64            { return b.nonce }
 func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
+// Refresh is triggered by timer, head events and found blocks, so it is serialized to not lose backlog
 func (s *ProxyServer) fetchBlockTemplate() {
-	rpc := s.rpc()
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+
+	upstream := s.rpc()
 	t := s.currentBlockTemplate()
 	pendingReply, height, diff, err := s.fetchPendingBlock()
 	if err != nil {
-		log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
+		log.Printf("Error while refreshing pending block on %s: %s", upstream.Name, err)
 		return
 	}
-	reply, err := rpc.GetWork()
+	reply, err := upstream.GetWork()
 	if err != nil {
-		log.Printf("Error while refreshing block template on %s: %s", rpc.Name, err)
+		log.Printf("Error while refreshing block template on %s: %s", upstream.Name, err)
 		return
 	}
 	// No need to update, we have fresh job
 	if t != nil && t.Header == reply[0] {
 		return
 	}
+	// Number reported with work is exact, pending block may be already newer
+	if workHeight, ok := rpc.WorkHeight(reply); ok {
+		height = workHeight
+	}
+	s.storeTemplate(t, upstream, reply, height, diff, pendingReply)
+}
 
-	pendingReply.Difficulty = util.ToHex(s.config.Proxy.Difficulty)
+// Must be called with templateMu held
+func (s *ProxyServer) storeTemplate(t *BlockTemplate, upstream *rpc.RPCClient, reply []string, height uint64, diff int64, pendingReply *rpc.GetBlockReplyPart) {
+	pendingReply.Difficulty = util.ToHex(s.cfg().Proxy.Difficulty)
 
 	newTemplate := BlockTemplate{
 		Header:               reply[0],
@@ -77,25 +115,57 @@ func (s *ProxyServer) fetchBlockTemplate() {
 	}
 	// Copy job backlog and add current one
 	newTemplate.headers[reply[0]] = heightDiffPair{
-		diff:   util.TargetHexToDiff(reply[2]),
-		height: height,
+		diff:     util.TargetHexToDiff(reply[2]),
+		height:   height,
+		nonces:   newNonceSet(),
+		created:  time.Now(),
+		upstream: upstream,
 	}
 	if t != nil {
+		backlog := s.backlogDepth()
 		for k, v := range t.headers {
-			if v.height > height-maxBacklog {
-				newTemplate.headers[k] = v
+			if v.height+backlog <= height {
+				continue
+			}
+			if s.templateTTL > 0 && time.Since(v.created) > s.templateTTL {
+				continue
 			}
+			newTemplate.headers[k] = v
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
-	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	if t == nil || height > t.Height {
+		s.markWorkAdvanced(height)
+	}
+	log.Printf("New block to mine on %s at height %d / %s", upstream.Name, height, reply[0][0:10])
 
 	// Stratum
-	if s.config.Proxy.Stratum.Enabled {
+	if s.cfg().Proxy.Stratum.Enabled {
 		go s.broadcastNewJobs()
 	}
 }
 
+func (s *ProxyServer) backlogDepth() uint64 {
+	if n := s.cfg().Proxy.JobBacklog; n > 0 {
+		return uint64(n)
+	}
+	return defaultBacklog
+}
+
+// Number of retained jobs and age of the oldest one
+func (t *BlockTemplate) backlogStats() (int, time.Duration) {
+	var oldest time.Time
+	for _, v := range t.headers {
+		if oldest.IsZero() || v.created.Before(oldest) {
+			oldest = v.created
+		}
+	}
+	if oldest.IsZero() {
+		return 0, 0
+	}
+	return len(t.headers), time.Since(oldest)
+}
+
 func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReplyPart, uint64, int64, error) {
 	rpc := s.rpc()
 	reply, err := rpc.GetPendingBlock()
@@ -0,0 +1,37 @@
+package proxy
+
+import "testing"
+
+func TestJobBacklogEviction(t *testing.T) {
+	s, backend := newShareServer(t)
+	s.cfg().Proxy.JobBacklog = 3
+	cs := s.newTestSession("0xa", "rig", 1000)
+	var headers []string
+	for height := uint64(100); height <= 103; height++ {
+		headers = append(headers, s.newTestJob(height))
+		cs.issueWork(s.currentBlockTemplate())
+	}
+	if n, _ := s.currentBlockTemplate().backlogStats(); n != 3 {
+		t.Errorf("Backlog holds %v jobs, want 3", n)
+	}
+
+	var reply *ErrorReply
+	s.handleTCPSubmitRPC(cs, "", shareParams(headers[0], 1), func(ok bool, err *ErrorReply) {
+		reply = err
+	})
+	if reply != errJobNotFound {
+		t.Errorf("Reply to share of evicted job is %+v, want job not found", reply)
+	}
+
+	// Oldest retained job is two heights behind, within default stale depth
+	submitTestShare(t, s, cs, headers[1], 2)
+	backend.Lock()
+	defer backend.Unlock()
+	if len(backend.shares) != 1 || !backend.shares[0].stale {
+		t.Errorf("Backend got %+v, want one stale share", backend.shares)
+	}
+	// Share of unknown job is counted as rejected, not credited
+	if backend.stale != 1 {
+		t.Errorf("Backend got %v rejected stale shares, want 1", backend.stale)
+	}
+}
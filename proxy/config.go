@@ -1,11 +1,19 @@
 package proxy
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/CryptoManiac/open-ethereum-pool/api"
+	"github.com/CryptoManiac/open-ethereum-pool/maintenance"
 	"github.com/CryptoManiac/open-ethereum-pool/payouts"
 	"github.com/CryptoManiac/open-ethereum-pool/shifts"
 	"github.com/CryptoManiac/open-ethereum-pool/policy"
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/sharelog"
 	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
 )
 
 type Config struct {
@@ -14,45 +22,308 @@ type Config struct {
 	Api                   api.ApiConfig `json:"api"`
 	Upstream              []Upstream    `json:"upstream"`
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	UpstreamStrategy      string        `json:"upstreamStrategy"`
+	UpstreamRecoverChecks int           `json:"upstreamRecoverChecks"`
+	UpstreamFailChecks    int           `json:"upstreamFailChecks"`
+	UpstreamMaxLag        int           `json:"upstreamMaxLag"`
+	// Turn of each upstream with round-robin strategy
+	UpstreamRotateInterval string `json:"upstreamRotateInterval"`
+	// Upstream on other network is not used, 0 and empty disable checks
+	ChainId     uint64 `json:"chainId"`
+	GenesisHash string `json:"genesisHash"`
 
 	Threads int `json:"threads"`
 
 	Coin  string         `json:"coin"`
 	Redis storage.Config `json:"redis"`
+	// pps or pplns, recorded in redis on first start, pool refuses to start in the other one then
+	RewardMode string `json:"rewardMode"`
+	// PPLNS window in network difficulties worth of shares
+	PPLNSWindow float64 `json:"pplnsWindow"`
+	// Block reward by height, static 3 Ether if empty
+	RewardSchedule RewardSchedule `json:"rewardSchedule"`
+	// Backend of payments and blocks record, redis keeps the rest
+	Storage storage.BackendConfig `json:"storage"`
 
+	Unlocker      payouts.UnlockerConfig `json:"unlocker"`
 	Payouts       payouts.PayoutsConfig  `json:"payouts"`
 	Shifts        shifts.ShiftsConfig  `json:"shifts"`
+	Maintenance   maintenance.MaintenanceConfig `json:"maintenance"`
 }
 
 type Proxy struct {
-	Enabled              bool   `json:"enabled"`
-	Listen               string `json:"listen"`
-	LimitHeadersSize     int    `json:"limitHeadersSize"`
-	LimitBodySize        int64  `json:"limitBodySize"`
-	BehindReverseProxy   bool   `json:"behindReverseProxy"`
-	BlockRefreshInterval string `json:"blockRefreshInterval"`
-	Difficulty           int64  `json:"difficulty"`
-	MiningFee            float64 `json:"miningFee"`
-	StateUpdateInterval  string `json:"stateUpdateInterval"`
-	HashrateExpiration   string `json:"hashrateExpiration"`
+	Enabled              bool       `json:"enabled"`
+	Listen               string     `json:"listen"`
+	LimitHeadersSize     int        `json:"limitHeadersSize"`
+	LimitBodySize        int64      `json:"limitBodySize"`
+	BehindReverseProxy   bool       `json:"behindReverseProxy"`
+	TrustedProxies       []string   `json:"trustedProxies"`
+	RequireChecksum      bool       `json:"requireChecksum"`
+	DenylistTTL          string     `json:"denylistTTL"`
+	SoloLogins           []string   `json:"soloLogins"`
+	BlockRefreshInterval string     `json:"blockRefreshInterval"`
+	BlockSubmitTimeout   string     `json:"blockSubmitTimeout"`
+	Notify               WorkNotify `json:"notify"`
+	Difficulty           int64      `json:"difficulty"`
+	MiningFee            float64    `json:"miningFee"`
+	StateUpdateInterval  string     `json:"stateUpdateInterval"`
+	HashrateExpiration   string     `json:"hashrateExpiration"`
+	StaleDepth           int        `json:"staleDepth"`
+	JobBacklog           int        `json:"jobBacklog"`
+	StaleFullReward      bool       `json:"staleFullReward"`
+	TemplateTTL          string     `json:"templateTTL"`
+	StaleWork            StaleWork  `json:"staleWork"`
+	Pricing              Pricing    `json:"pricing"`
+	ShutdownDrain        string     `json:"shutdownDrain"`
+
+	Admin ProxyAdmin `json:"admin"`
 
 	Policy policy.Config `json:"policy"`
 
+	// Share and block events for external analytics
+	ShareLog sharelog.Config `json:"shareLog"`
+
 	MaxFails    int64 `json:"maxFails"`
 	HealthCheck bool  `json:"healthCheck"`
 
 	Stratum Stratum `json:"stratum"`
 }
 
-type Stratum struct {
+// Alert when height has not advanced for factor times blockTime
+type StaleWork struct {
+	Enabled   bool    `json:"enabled"`
+	BlockTime string  `json:"blockTime"`
+	Factor    float64 `json:"factor"`
+	// Show warning to stratum miners once work goes stale
+	Message bool `json:"message"`
+}
+
+// Preset of chain, ethereum, classic or ubiq, custom eras take precedence over it
+type RewardSchedule struct {
+	Preset string           `json:"preset"`
+	Eras   []util.RewardEra `json:"eras"`
+}
+
+// Share credit follows network difficulty of current template, not difficulty of each job
+type Pricing struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// In Shannon, 0 takes reward schedule at template height
+	BlockReward int64 `json:"blockReward"`
+	// Expected uncle rewards as fraction of block reward
+	UncleRate float64 `json:"uncleRate"`
+	// Largest change per update as fraction of previous rate, 0 is unbounded
+	MaxChange float64 `json:"maxChange"`
+	// Absolute bounds in Shannon per unit of difficulty, 0 is unbounded
+	MinRate float64 `json:"minRate"`
+	MaxRate float64 `json:"maxRate"`
+	// Updates kept in backend
+	History int64 `json:"history"`
+}
+
+type ProxyAdmin struct {
 	Enabled bool   `json:"enabled"`
-	Listen  string `json:"listen"`
-	Timeout string `json:"timeout"`
-	MaxConn int    `json:"maxConn"`
+	Token   string `json:"token"`
+	// Token of each operator by name, adjustments are recorded with name of operator authenticated
+	Operators map[string]string `json:"operators"`
+}
+
+type Stratum struct {
+	Enabled bool          `json:"enabled"`
+	Listen  string        `json:"listen"`
+	Timeout string        `json:"timeout"`
+	MaxConn int           `json:"maxConn"`
+	Ports   []StratumPort `json:"ports"`
+
+	ProxyProtocol bool `json:"proxyProtocol"`
+
+	MaxSessions  int `json:"maxSessions"`
+	MaxConnPerIP int `json:"maxConnPerIP"`
+
+	MaxConnPerLogin int      `json:"maxConnPerLogin"`
+	ExemptLogins    []string `json:"exemptLogins"`
+
+	AllowLoginSwitch bool             `json:"allowLoginSwitch"`
+	TLS              StratumTLS       `json:"tls"`
+	WebSocket        StratumWebSocket `json:"webSocket"`
+	VarDiff          VarDiff          `json:"varDiff"`
+
+	ReconnectGrace string `json:"reconnectGrace"`
+
+	AuthorizeTimeout string `json:"authorizeTimeout"`
+
+	ReadTimeout  string `json:"readTimeout"`
+	TCPKeepAlive string `json:"tcpKeepAlive"`
+	ReadBuffer   int    `json:"readBuffer"`
+	WriteBuffer  int    `json:"writeBuffer"`
+
+	BroadcastWorkers int    `json:"broadcastWorkers"`
+	WriteTimeout     string `json:"writeTimeout"`
+	WriteQueue       int    `json:"writeQueue"`
+
+	MaxIdleWithoutShare string `json:"maxIdleWithoutShare"`
+	IdleGrace           string `json:"idleGrace"`
+
+	SubmitLimit SubmitLimit `json:"submitLimit"`
+
+	HashrateMessage HashrateMessage `json:"hashrateMessage"`
+	BlockMessage    bool            `json:"blockMessage"`
+}
+
+type StratumPort struct {
+	Listen     string `json:"listen"`
+	Difficulty int64  `json:"difficulty"`
+	// Bounds of suggested difficulty with vardiff off, difficulty of port and none if 0
+	MinDiff int64 `json:"minDiff"`
+	MaxDiff int64 `json:"maxDiff"`
+	MaxConn int   `json:"maxConn"`
+	TLS     bool  `json:"tls"`
+}
+
+type StratumWebSocket struct {
+	Enabled    bool   `json:"enabled"`
+	Listen     string `json:"listen"`
+	Path       string `json:"path"`
+	Difficulty int64  `json:"difficulty"`
+	MinDiff    int64  `json:"minDiff"`
+	MaxDiff    int64  `json:"maxDiff"`
+	MaxConn    int    `json:"maxConn"`
+}
+
+type SubmitLimit struct {
+	Enabled     bool    `json:"enabled"`
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+	ReportAfter int     `json:"reportAfter"`
+}
+
+type HashrateMessage struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	Window   string `json:"window"`
+}
+
+type VarDiff struct {
+	Enabled          bool    `json:"enabled"`
+	MinDiff          int64   `json:"minDiff"`
+	MaxDiff          int64   `json:"maxDiff"`
+	SharesPerMin     float64 `json:"sharesPerMin"`
+	Window           string  `json:"window"`
+	RetargetInterval string  `json:"retargetInterval"`
+	MaxFactor        float64 `json:"maxFactor"`
+	Variance         float64 `json:"variance"`
+	Persist          bool    `json:"persist"`
+	PersistTTL       string  `json:"persistTTL"`
+}
+
+type StratumTLS struct {
+	Enabled          bool   `json:"enabled"`
+	Listen           string `json:"listen"`
+	CertFile         string `json:"certFile"`
+	KeyFile          string `json:"keyFile"`
+	MinVersion       string `json:"minVersion"`
+	HandshakeTimeout string `json:"handshakeTimeout"`
+}
+
+// Work pushed by node with --miner.notify
+type WorkNotify struct {
+	Enabled bool     `json:"enabled"`
+	Allow   []string `json:"allow"`
 }
 
 type Upstream struct {
 	Name    string `json:"name"`
 	Url     string `json:"url"`
+	WsUrl   string `json:"wsUrl"`
 	Timeout string `json:"timeout"`
+
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Token     string `json:"token"`
+	JwtSecret string `json:"jwtSecret"`
+
+	// Method name or "pending" for pending block query of template refresh => timeout
+	Timeouts map[string]string `json:"timeouts"`
+	Retry    UpstreamRetry     `json:"retry"`
+
+	// "pending" builds work from pending block for nodes without eth_getWork
+	WorkSource   string `json:"workSource"`
+	SubmitMethod string `json:"submitMethod"`
+	EpochLength  uint64 `json:"epochLength"`
+}
+
+// Retry of failed reads, submissions are never retried
+type UpstreamRetry struct {
+	Attempts   int    `json:"attempts"`
+	Backoff    string `json:"backoff"`
+	MaxBackoff string `json:"maxBackoff"`
+}
+
+// Logins are compared lower case, config lists are brought to it on load and reload
+func (c *Config) normalize() {
+	c.Proxy.SoloLogins = lowerLogins(c.Proxy.SoloLogins)
+	c.Proxy.Stratum.ExemptLogins = lowerLogins(c.Proxy.Stratum.ExemptLogins)
+}
+
+func lowerLogins(logins []string) []string {
+	for i, v := range logins {
+		logins[i] = strings.ToLower(v)
+	}
+	return logins
+}
+
+func (u *Upstream) auth() rpc.Auth {
+	return rpc.Auth{Username: u.Username, Password: u.Password, Token: u.Token, JwtSecret: u.JwtSecret}
+}
+
+func (u *Upstream) validate() error {
+	auth := u.auth()
+	if err := auth.Validate(); err != nil {
+		return err
+	}
+	if _, err := u.timeouts(); err != nil {
+		return err
+	}
+	if !rpc.IsValidWorkSource(u.WorkSource) {
+		return fmt.Errorf("Unknown work source %q", u.WorkSource)
+	}
+	_, err := u.retry()
+	return err
+}
+
+func (u *Upstream) timeouts() (map[string]time.Duration, error) {
+	result := make(map[string]time.Duration, len(u.Timeouts))
+	for method, v := range u.Timeouts {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timeout of %s: %v", method, err)
+		}
+		result[method] = d
+	}
+	return result, nil
+}
+
+func (u *Upstream) retry() (rpc.RetryPolicy, error) {
+	policy := rpc.RetryPolicy{Attempts: u.Retry.Attempts}
+	var err error
+	if len(u.Retry.Backoff) > 0 {
+		if policy.Backoff, err = time.ParseDuration(u.Retry.Backoff); err != nil {
+			return policy, fmt.Errorf("Invalid retry backoff: %v", err)
+		}
+	}
+	if len(u.Retry.MaxBackoff) > 0 {
+		if policy.MaxBackoff, err = time.ParseDuration(u.Retry.MaxBackoff); err != nil {
+			return policy, fmt.Errorf("Invalid retry maxBackoff: %v", err)
+		}
+	}
+	return policy, nil
+}
+
+// Config is validated before, so errors are not expected here
+func (u *Upstream) apply(client *rpc.RPCClient) {
+	timeouts, _ := u.timeouts()
+	client.SetTimeouts(timeouts)
+	policy, _ := u.retry()
+	client.SetRetry(policy)
+	client.SetWorkSource(u.WorkSource, u.SubmitMethod, u.EpochLength)
 }
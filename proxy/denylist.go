@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Denied logins are cached for this time by default, so login doesn't hit backend
+const defaultDenylistTTL = 30 * time.Second
+
+type loginDenylist struct {
+	sync.Mutex
+	logins    map[string]struct{}
+	fetchedAt time.Time
+}
+
+func (s *ProxyServer) denylistTTL() time.Duration {
+	// Validated on start and reload
+	if ttl := s.cfg().Proxy.DenylistTTL; len(ttl) > 0 {
+		d, _ := time.ParseDuration(ttl)
+		return d
+	}
+	return defaultDenylistTTL
+}
+
+// Stale list is kept if backend fails, so failure doesn't let denied logins in
+func (s *ProxyServer) isLoginDenied(login string) bool {
+	d := &s.denylist
+	d.Lock()
+	defer d.Unlock()
+
+	if d.fetchedAt.IsZero() || time.Since(d.fetchedAt) > s.denylistTTL() {
+		logins, err := s.backend.GetLoginBlacklist()
+		if err != nil {
+			log.Printf("Failed to get login blacklist from backend: %v", err)
+		} else {
+			d.logins = make(map[string]struct{}, len(logins))
+			for _, v := range logins {
+				d.logins[v] = struct{}{}
+			}
+		}
+		d.fetchedAt = time.Now()
+	}
+	_, ok := d.logins[login]
+	return ok
+}
+
+// Changes made by admin API are applied immediately on this instance
+func (s *ProxyServer) invalidateDenylist() {
+	s.denylist.Lock()
+	s.denylist.fetchedAt = time.Time{}
+	s.denylist.Unlock()
+}
@@ -1,11 +1,17 @@
 package proxy
 
 import (
+	"encoding/json"
 	"log"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/sharelog"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
 	"github.com/CryptoManiac/open-ethereum-pool/util"
 )
 
@@ -13,32 +19,187 @@ import (
 var noncePattern = regexp.MustCompile("^0x[0-9a-f]{16}$")
 var hashPattern = regexp.MustCompile("^0x[0-9a-f]{64}$")
 var workerPattern = regexp.MustCompile("^[0-9a-zA-Z-_]{1,8}$")
+var workerInvalidChars = regexp.MustCompile("[^0-9a-zA-Z_-]")
+
+const defaultWorker = "0"
+
+// Repeated login is refused without closing connection
+var errAlreadyLoggedIn = &ErrorReply{Code: -1, Message: "Already logged in"}
 
 // Stratum
 func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (bool, *ErrorReply) {
 	if len(params) == 0 {
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
+	relogin := s.isRegistered(cs)
+	if relogin && !s.cfg().Proxy.Stratum.AllowLoginSwitch {
+		log.Printf("Ignoring repeated login from %v.%v@%v", cs.login, cs.worker, cs.ip)
+		return false, errAlreadyLoggedIn
+	}
 
-	login := strings.ToLower(params[0])
-	if !util.IsValidHexAddress(login) {
-		return false, &ErrorReply{Code: -1, Message: "Invalid login"}
+	// Worker name may come as 0xADDRESS.rig, as worker field or instead of password
+	login, worker := params[0], ""
+	if n := strings.Index(login, "."); n >= 0 {
+		login, worker = login[:n], login[n+1:]
+	}
+	if len(worker) == 0 {
+		worker = id
+	}
+	if len(worker) == 0 && len(params) > 1 && !strings.Contains(params[1], "=") {
+		worker = params[1]
+	}
+
+	if errReply := s.checkLoginAddress(login); errReply != nil {
+		return false, errReply
+	}
+	login = strings.ToLower(login)
+	if errReply := s.checkLoginDenied(login, cs.ip); errReply != nil {
+		return false, errReply
 	}
 	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
 		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
 	}
-	cs.login = login
-	s.registerSession(cs)
-	log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	if relogin {
+		return s.switchLogin(cs, login, sanitizeWorker(worker))
+	}
+	cs.setOwner(login, sanitizeWorker(worker), cs.solo)
+	if len(params) > 1 {
+		s.applyStaticDiff(cs, params[1])
+	}
+	s.applyMinerSettings(cs, s.backendSettings(login))
+	s.restoreDifficulty(cs)
+	if errReply := s.registerSession(cs); errReply != nil {
+		log.Printf("Rejected login of %v@%v: %v", login, cs.ip, errReply.Message)
+		s.rejects.add(rejectLoginLimit, cs.ip)
+		return false, errReply
+	}
+	log.Printf("Stratum miner connected %v.%v@%v", login, cs.worker, cs.ip)
 	return true, nil
 }
 
+// Miner can pin difficulty with d=N (in GH) or sd=N options in password, separated by comma
+func (s *ProxyServer) applyStaticDiff(cs *Session, password string) {
+	for _, option := range strings.Split(password, ",") {
+		kv := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var diff float64
+		switch kv[0] {
+		case "d":
+			diff, _ = strconv.ParseFloat(kv[1], 64)
+			diff *= 1e9
+		case "sd":
+			diff, _ = strconv.ParseFloat(kv[1], 64)
+		default:
+			continue
+		}
+		if diff <= 0 || diff > math.MaxInt64 {
+			log.Printf("Ignoring invalid static difficulty %v from %v@%v", option, cs.login, cs.ip)
+			return
+		}
+		value := s.clampDifficulty(int64(diff))
+		if value != int64(diff) {
+			log.Printf("Static difficulty %v from %v@%v is out of bounds, using %v", int64(diff), cs.login, cs.ip, value)
+		}
+		cs.setDifficulty(value)
+		cs.staticDiff = true
+		return
+	}
+}
+
+// Shares of work issued before switch are still credited to previous login,
+// difficulty of session is kept
+func (s *ProxyServer) switchLogin(cs *Session, login, worker string) (bool, *ErrorReply) {
+	prevLogin, prevWorker, prevSolo := cs.owner()
+	settings := s.backendSettings(login)
+	cs.setOwner(login, worker, s.soloMode(login, settings))
+	if errReply := s.registerSession(cs); errReply != nil {
+		cs.setOwner(prevLogin, prevWorker, prevSolo)
+		log.Printf("Rejected login switch of %v@%v to %v: %v", prevLogin, cs.ip, login, errReply.Message)
+		return false, errAlreadyLoggedIn
+	}
+	cs.resetShareStats()
+	log.Printf("Stratum miner switched login %v.%v => %v.%v@%v", prevLogin, prevWorker, login, worker, cs.ip)
+	return true, nil
+}
+
+// Backend failure is not fatal for login, miner gets defaults
+func (s *ProxyServer) backendSettings(login string) *storage.MinerSettings {
+	settings, err := s.backend.GetMinerSettings(login)
+	if err != nil {
+		log.Printf("Failed to get settings of %v from backend: %v", login, err)
+		return &storage.MinerSettings{}
+	}
+	return settings
+}
+
+func (s *ProxyServer) isSoloLogin(login string) bool {
+	return util.StringInSlice(login, s.cfg().Proxy.SoloLogins)
+}
+
+// Mode set in redis overrides config list
+func (s *ProxyServer) soloMode(login string, settings *storage.MinerSettings) bool {
+	if len(settings.Mode) > 0 {
+		return settings.Mode == storage.ModeSolo
+	}
+	return s.isSoloLogin(login)
+}
+
+// Difficulty fixed by operator takes precedence over the one requested by miner
+func (s *ProxyServer) applyMinerSettings(cs *Session, settings *storage.MinerSettings) {
+	cs.solo = s.soloMode(cs.login, settings)
+	if cs.solo {
+		log.Printf("Solo mining mode for %v@%v", cs.login, cs.ip)
+	}
+	if settings.FixedDiff <= 0 {
+		return
+	}
+	value := s.clampDifficulty(settings.FixedDiff)
+	if value != settings.FixedDiff {
+		log.Printf("Fixed difficulty %v of %v is out of bounds, using %v", settings.FixedDiff, cs.login, value)
+	}
+	cs.setDifficulty(value)
+	cs.staticDiff = true
+}
+
+// Address is lowercased for storage after this check, mixed case form is only used to catch typos
+func (s *ProxyServer) checkLoginAddress(login string) *ErrorReply {
+	if !util.IsValidHexAddress(login) {
+		return &ErrorReply{Code: -1, Message: "Invalid login"}
+	}
+	if s.cfg().Proxy.RequireChecksum && !util.IsValidChecksumAddress(login) {
+		return &ErrorReply{Code: -1, Message: "Invalid login checksum"}
+	}
+	return nil
+}
+
+func (s *ProxyServer) checkLoginDenied(login, ip string) *ErrorReply {
+	if s.isLoginDenied(login) {
+		log.Printf("Denied login %v from %v", login, ip)
+		return &ErrorReply{Code: -1, Message: "Login is denied by pool operator"}
+	}
+	return nil
+}
+
+// Strip invalid characters, fallback to default worker if nothing left
+func sanitizeWorker(worker string) string {
+	worker = workerInvalidChars.ReplaceAllString(worker, "")
+	if len(worker) > 8 {
+		worker = worker[:8]
+	}
+	if len(worker) == 0 {
+		return defaultWorker
+	}
+	return worker
+}
+
 func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	t := s.currentBlockTemplate()
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	return []string{t.Header, t.Seed, s.diff}, nil
+	return []string{t.Header, t.Seed, cs.issueWork(t)}, nil
 }
 
 // Stratum
@@ -46,20 +207,30 @@ type submitCB func(bool, *ErrorReply)
 func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string, callback submitCB) {
 	result, err := false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 
-	s.sessionsMu.RLock()
-	_, ok := s.sessions[cs]
-	s.sessionsMu.RUnlock()
-	
-	if ok {
-		result, err = s.handleSubmitRPC(cs, cs.login, id, params)
+	if s.isRegistered(cs) {
+		var login, worker string
+		var solo bool
+		if len(params) > 1 {
+			login, worker, solo = cs.workOwner(params[1])
+		} else {
+			login, worker, solo = cs.owner()
+		}
+		if !workerPattern.MatchString(id) {
+			id = worker
+		}
+		result, err = s.handleSubmitRPC(cs, login, id, solo, params)
+		cs.countShare(result)
 	}
 
 	callback(result, err)
 }
 
-func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
+func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, solo bool, params []string) (bool, *ErrorReply) {
 	if !workerPattern.MatchString(id) {
-		id = "0"
+		id = cs.worker
+	}
+	if len(id) == 0 {
+		id = defaultWorker
 	}
 	if len(params) != 3 {
 		s.policy.ApplyMalformedPolicy(cs.ip)
@@ -73,23 +244,74 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(login, id, cs.ip, t, params)
-	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	shareDiff := cs.workDifficulty(params[1])
+	exist, validShare, stale, errReply := s.processShare(login, id, cs.ip, shareDiff, solo, t, params)
+
+	if errReply == errLowDifficulty {
+		log.Printf("Low difficulty share from %s@%s", login, cs.ip)
+		s.logShare(cs, login, id, t, params, shareDiff, solo, sharelog.StatusInvalid, false)
+		if err := s.backend.WriteInvalidShare(login, id, s.hashrateExpiration()); err != nil {
+			log.Println("Failed to insert invalid share data into backend:", err)
+			s.markSick()
+		}
+		if !s.policy.ApplyLowDiffPolicy(cs.ip) {
+			return false, &ErrorReply{Code: 23, Message: "Low difficulty share"}
+		}
+		return false, errReply
+	}
+
+	// Expired job is mostly caused by latency, yet it is counted by policy as invalid share,
+	// so garbage under made up job doesn't evade banning
+	if errReply != nil {
+		s.logShare(cs, login, id, t, params, shareDiff, solo, sharelog.StatusStale, false)
+		if err := s.backend.WriteStaleShare(login, id, s.hashrateExpiration()); err != nil {
+			log.Println("Failed to insert stale share data into backend:", err)
+			s.markSick()
+		}
+		if !s.applyRejectPolicy(cs) {
+			return false, &ErrorReply{Code: 23, Message: "Too many invalid shares, disconnecting"}
+		}
+		return false, errReply
+	}
+	var ok bool
+	if !exist && !validShare && s.sessionPolicyEnabled(cs) {
+		if !s.applySessionPolicy(cs) {
+			return false, &ErrorReply{Code: 23, Message: "Too many invalid shares, disconnecting"}
+		}
+		ok = true
+	} else {
+		ok = s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	}
 
 	if exist {
 		log.Printf("Duplicate share from %s@%s %v", login, cs.ip, params)
+		s.logShare(cs, login, id, t, params, shareDiff, solo, sharelog.StatusDuplicate, false)
 		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
 	}
 
 	if !validShare {
 		log.Printf("Invalid share from %s@%s", login, cs.ip)
+		s.logShare(cs, login, id, t, params, shareDiff, solo, sharelog.StatusInvalid, false)
+		if err := s.backend.WriteInvalidShare(login, id, s.hashrateExpiration()); err != nil {
+			log.Println("Failed to insert invalid share data into backend:", err)
+			s.markSick()
+		}
 		// Bad shares limit reached, return error and close
 		if !ok {
 			return false, &ErrorReply{Code: 23, Message: "Invalid share"}
 		}
 		return false, nil
 	}
-	log.Printf("Valid share from %s@%s", login, cs.ip)
+	if stale {
+		log.Printf("Valid stale share from %s@%s", login, cs.ip)
+		s.logShare(cs, login, id, t, params, shareDiff, solo, sharelog.StatusStale, true)
+	} else {
+		log.Printf("Valid share from %s@%s", login, cs.ip)
+		s.logShare(cs, login, id, t, params, shareDiff, solo, sharelog.StatusValid, true)
+	}
+	if cfg := s.cfg().Proxy.Stratum; cfg.VarDiff.Enabled || cfg.HashrateMessage.Enabled {
+		cs.trackShare(shareDiff, stale, s.sharesWindow())
+	}
 
 	if !ok {
 		return true, &ErrorReply{Code: -1, Message: "High rate of invalid shares"}
@@ -97,6 +319,68 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	return true, nil
 }
 
+// Getwork sessions live for a single request, so they always go to IP policy
+// Rejected share is counted against session with session policy, against IP otherwise.
+// False if miner must be dropped.
+func (s *ProxyServer) applyRejectPolicy(cs *Session) bool {
+	if s.sessionPolicyEnabled(cs) {
+		return s.applySessionPolicy(cs)
+	}
+	return s.policy.ApplySharePolicy(cs.ip, false)
+}
+
+func (s *ProxyServer) sessionPolicyEnabled(cs *Session) bool {
+	cfg := s.cfg().Proxy.Policy.Sessions
+	return cs.conn != nil && cfg.Enabled && cfg.InvalidLimit > 0
+}
+
+// Counts invalid share against session, returns false if session must be dropped.
+// IP is reported to policy server only for dropped sessions.
+func (s *ProxyServer) applySessionPolicy(cs *Session) bool {
+	cfg := s.cfg().Proxy.Policy.Sessions
+	window := util.MustParseDuration(cfg.Window)
+	now := time.Now()
+
+	cs.invalidMu.Lock()
+	if now.Sub(cs.invalidSince) > window {
+		cs.invalidSince = now
+		cs.invalidShares = 0
+	}
+	cs.invalidShares++
+	n := cs.invalidShares
+	cs.invalidMu.Unlock()
+
+	if n < cfg.InvalidLimit {
+		return true
+	}
+	log.Printf("Dropping session %v.%v@%v after %v invalid shares in %v", cs.login, cs.worker, cs.ip, n, window)
+	if !s.policy.ApplySessionPolicy(cs.ip, cs.login) {
+		log.Printf("Reported %v for repeated invalid shares", cs.ip)
+	}
+	return false
+}
+
+// Malformed suggestion keeps pool difficulty and doesn't close connection.
+// Difficulty fixed by operator or miner is kept too.
+func (s *ProxyServer) handleSuggestDifficultyRPC(cs *Session, raw *json.RawMessage) bool {
+	var params []float64
+	if raw == nil || json.Unmarshal(*raw, &params) != nil || len(params) == 0 || params[0] <= 0 || params[0] > math.MaxInt64 {
+		log.Printf("Malformed difficulty suggestion from %v", cs.ip)
+		return false
+	}
+	if cs.staticDiff {
+		log.Printf("Ignoring difficulty %v suggested by %v, difficulty is fixed at %v", int64(params[0]), cs.ip, cs.Difficulty())
+		return false
+	}
+	diff := s.clampSuggestedDifficulty(cs, int64(params[0]))
+	cs.setDifficulty(diff)
+	log.Printf("Difficulty %v suggested by %v, using %v", int64(params[0]), cs.ip, diff)
+	if s.isRegistered(cs) {
+		s.pushTarget(cs)
+	}
+	return true
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 	t := s.currentBlockTemplate()
 	var reply *rpc.GetBlockReplyPart
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+var hashrateUnits = []string{"H/s", "KH/s", "MH/s", "GH/s", "TH/s", "PH/s"}
+
+// Miner software may log unknown notifications as errors, so it is opt-in
+func (s *ProxyServer) startHashrateMessages() {
+	cfg := s.cfg().Proxy.Stratum.HashrateMessage
+	log.Printf("Set hashrate message every %v over %v", cfg.Interval, cfg.Window)
+
+	s.runLoop(func() string { return s.cfg().Proxy.Stratum.HashrateMessage.Interval }, s.sendHashrateMessages)
+}
+
+func (s *ProxyServer) sendHashrateMessages() {
+	window := util.MustParseDuration(s.cfg().Proxy.Stratum.HashrateMessage.Window)
+	now := time.Now()
+
+	for _, cs := range s.sessionsSnapshot() {
+		hashrate, stale := cs.poolHashrate(now, window)
+		message := fmt.Sprintf("pool-side %v hashrate: %s, %v stale", window, formatHashrate(hashrate), stale)
+		if err := cs.showMessage(message); err != nil {
+			log.Printf("Message transmit error to %v@%v: %v", cs.login, cs.ip, err)
+			cs.conn.Close()
+			s.removeSession(cs)
+		}
+	}
+}
+
+// Hashrate from accepted share difficulty, session younger than window is averaged over its lifetime
+func (cs *Session) poolHashrate(now time.Time, window time.Duration) (float64, int) {
+	cs.sharesMu.Lock()
+	defer cs.sharesMu.Unlock()
+
+	from := now.Add(-window)
+	var hashes float64
+	stale := 0
+	for _, share := range cs.shares {
+		if share.ts.Before(from) {
+			continue
+		}
+		hashes += float64(share.diff)
+		if share.stale {
+			stale++
+		}
+	}
+	if cs.connectedAt.After(from) {
+		from = cs.connectedAt
+	}
+	elapsed := now.Sub(from).Seconds()
+	if elapsed <= 0 {
+		return 0, stale
+	}
+	return hashes / elapsed, stale
+}
+
+// Sent once per height, fan-out runs aside so submit reply and next job are not delayed
+func (s *ProxyServer) announceBlock(height uint64) {
+	for {
+		last := atomic.LoadUint64(&s.announcedHeight)
+		if height <= last {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&s.announcedHeight, last, height) {
+			break
+		}
+	}
+	message := fmt.Sprintf("pool found block %d", height)
+	go func() {
+		for _, cs := range s.sessionsSnapshot() {
+			// Queue is not waited on, failed session is dropped by next job push
+			cs.showMessage(message)
+		}
+	}()
+}
+
+func (cs *Session) showMessage(message string) error {
+	notification := JSONNotification{Version: "2.0", Method: "client.show_message", Params: []interface{}{message}}
+	return cs.enqueue(&notification)
+}
+
+func formatHashrate(hashrate float64) string {
+	i := 0
+	for hashrate >= 1000 && i < len(hashrateUnits)-1 {
+		hashrate /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", hashrate, hashrateUnits[i])
+}
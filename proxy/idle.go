@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Miner which never submitted is idle since connect
+func (cs *Session) lastActivity() time.Time {
+	if ts := atomic.LoadInt64(&cs.lastShare); ts > 0 {
+		return time.Unix(0, ts*int64(time.Millisecond))
+	}
+	return cs.connectedAt
+}
+
+// Expected time between shares grows with difficulty, so limit is scaled
+// for sessions above pool difficulty to protect slow rigs
+func (s *ProxyServer) idleLimit(cs *Session) time.Duration {
+	limit := s.maxIdle
+	diff, poolDiff := cs.Difficulty(), s.cfg().Proxy.Difficulty
+	if poolDiff > 0 && diff > poolDiff {
+		limit = time.Duration(float64(limit) * float64(diff) / float64(poolDiff))
+	}
+	return limit
+}
+
+// Idle session gets no jobs, after grace period it is dropped
+func (s *ProxyServer) checkIdle(cs *Session) (skip, drop bool) {
+	if s.maxIdle <= 0 {
+		return false, false
+	}
+	idle, limit := time.Since(cs.lastActivity()), s.idleLimit(cs)
+	if idle <= limit {
+		return false, false
+	}
+	return true, idle > limit+s.idleGrace
+}
@@ -2,28 +2,55 @@ package proxy
 
 import (
 	"log"
-	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/CryptoManiac/ethash"
 	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+var hasher shareHasher = ethash.New()
+
+// Block submission should not wait on slow node for long
+const defaultBlockSubmitTimeout = 2 * time.Second
+
+var (
+	errJobNotFound = &ErrorReply{Code: 21, Message: "Job not found"}
+	errStaleShare  = &ErrorReply{Code: 21, Message: "Stale share"}
+
+	errLowDifficulty = &ErrorReply{Code: 23, Message: "Low difficulty share"}
 )
 
-var hasher = ethash.New()
+// Share is rejected but miner keeps connection
+func isShareReject(reply *ErrorReply) bool {
+	return reply == errJobNotFound || reply == errStaleShare || reply == errLowDifficulty
+}
 
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string) (bool, bool) {
+func (s *ProxyServer) processShare(login, id, ip string, shareDiff int64, solo bool, t *BlockTemplate, params []string) (bool, bool, bool, *ErrorReply) {
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
-	shareFee := s.config.Proxy.MiningFee
 
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
-		log.Printf("Stale share from %v@%v", login, ip)
-		return false, false
+		log.Printf("Job not found for share from %v@%v", login, ip)
+		return false, false, true, errJobNotFound
+	}
+
+	// Share for one of previous heights, miner is lagging
+	stale := h.height < t.Height
+	if stale && t.Height-h.height > s.staleDepth() {
+		log.Printf("Stale share from %v@%v at height %v", login, ip, h.height)
+		return false, false, true, errStaleShare
+	}
+	topHeight := t.Height
+	if stale && s.cfg().Proxy.StaleFullReward {
+		topHeight = h.height
 	}
 
 	share := Block{
@@ -35,40 +62,138 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	}
 
 	// Verify validity against block and share target
-	isShare, isBlock, actualDiff, _ := hasher.VerifyShare(share, big.NewInt(shareDiff))
+	isShare, isBlock, actualDiff := s.verifier.verify(share, shareDiff)
 
 	if !isShare {
-		return false, false
+		// Correct PoW which doesn't meet target of work it was issued with
+		if actualDiff > 0 && actualDiff < shareDiff {
+			return false, false, false, errLowDifficulty
+		}
+		return false, false, false, nil
+	}
+
+	// Sessions share upstream job, so set is checked after verification
+	// to not let garbage submits reserve nonces of honest miners
+	if !h.nonces.add(nonce) {
+		return true, false, false, nil
+	}
+
+	// Node has already moved to next height, late block can't be imported
+	// and share is credited only
+	if isBlock && h.height < s.currentBlockTemplate().Height {
+		log.Printf("Late block at height %v from %v@%v is not submitted", h.height, login, ip)
+		isBlock = false
+	}
+
+	if isBlock {
+		upstream := h.upstream
+		if upstream == nil {
+			upstream = s.rpc()
+		}
+		// Block which didn't make it is still credited as share, unless node found it invalid.
+		// Node may have imported block it failed to reply for, candidate is written then and
+		// unlocker orphans it if it is not in chain.
+		switch outcome, err := s.submitBlock(upstream, params, h.height); outcome {
+		case rpc.SubmitInvalid:
+			log.Printf("Block rejected at height %v for %v: %v", h.height, t.Header, err)
+			return false, false, false, nil
+		case rpc.SubmitStale:
+			log.Printf("Block at height %v for %v is stale on %v: %v", h.height, t.Header, upstream.Name, err)
+			isBlock, stale = false, true
+		case rpc.SubmitNodeError:
+			log.Printf("Block submission failure to %v at height %v for %v, writing candidate: %v", upstream.Name, h.height, t.Header, err)
+		}
 	}
 
 	if isBlock {
-		ok, err := s.rpc().SubmitBlock(params)
+		s.fetchBlockTemplate()
+		exist, err := s.backend.WriteBlock(login, id, params, shareDiff, actualDiff, s.shareRate(h.diff.Int64(), h.height), h.diff.Int64(), h.height, t.Height, solo, s.hashrateExpiration())
+		if exist {
+			return true, false, false, nil
+		}
 		if err != nil {
-			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
-		} else if !ok {
-			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
-			return false, false
+			log.Println("Failed to insert block candidate into backend:", err)
+			s.markSick()
+		} else {
+			log.Printf("Inserted block %v to backend", h.height)
+		}
+		s.logBlock(login, id, ip, shareDiff, h.height, hashNoNonce, solo)
+		if solo {
+			log.Printf("Solo block found by miner %v@%v at height %d", login, ip, h.height)
 		} else {
-			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, actualDiff, shareFee, h.diff.Int64(), h.height, t.Height, s.hashrateExpiration)
-			if exist {
-				return true, false
-			}
-			if err != nil {
-				log.Println("Failed to insert block candidate into backend:", err)
-			} else {
-				log.Printf("Inserted block %v to backend", h.height)
-			}
 			log.Printf("Block found by miner %v@%v at height %d", login, ip, h.height)
 		}
+		if s.cfg().Proxy.Stratum.BlockMessage {
+			s.announceBlock(h.height)
+		}
 	} else {
-		exist, err := s.backend.WriteShare(login, id, params, shareDiff, actualDiff, shareFee, h.diff.Int64(), h.height, t.Height, s.hashrateExpiration)
+		exist, err := s.backend.WriteShare(login, id, params, shareDiff, actualDiff, s.shareRate(h.diff.Int64(), h.height), h.height, topHeight, stale, solo, s.hashrateExpiration())
 		if exist {
-			return true, false
+			return true, false, false, nil
 		}
 		if err != nil {
 			log.Println("Failed to insert share data into backend:", err)
+			s.markSick()
+		}
+	}
+	return false, true, stale, nil
+}
+
+// Number of previous heights to accept shares for, bounded by template backlog
+func (s *ProxyServer) staleDepth() uint64 {
+	depth, backlog := s.cfg().Proxy.StaleDepth, s.backlogDepth()
+	if depth <= 0 || uint64(depth) >= backlog {
+		return backlog - 1
+	}
+	return uint64(depth)
+}
+
+// Block is sent to all healthy upstreams at once, node which issued the job is essential,
+// others may reject it as unknown or duplicate work and that is not a failure.
+// Outcome of rejected block is decided by reply of node which issued the job.
+func (s *ProxyServer) submitBlock(primary *rpc.RPCClient, params []string, height uint64) (rpc.SubmitOutcome, error) {
+	timeout := defaultBlockSubmitTimeout
+	if len(s.cfg().Proxy.BlockSubmitTimeout) > 0 {
+		timeout = util.MustParseDuration(s.cfg().Proxy.BlockSubmitTimeout)
+	}
+	type result struct {
+		upstream *rpc.RPCClient
+		ok       bool
+		err      error
+	}
+	targets := []*rpc.RPCClient{primary}
+	for _, v := range s.upstreamList() {
+		if v != primary && !v.Sick() {
+			targets = append(targets, v)
+		}
+	}
+	results := make(chan result, len(targets))
+	for _, v := range targets {
+		go func(upstream *rpc.RPCClient) {
+			ok, err := upstream.SubmitBlockTimeout(params, timeout, upstream == primary)
+			results <- result{upstream, ok, err}
+		}(v)
+	}
+
+	accepted := false
+	outcome, primaryErr := rpc.SubmitInvalid, error(nil)
+	for range targets {
+		r := <-results
+		switch {
+		case r.ok:
+			accepted = true
+			log.Printf("Block at height %v accepted by %v", height, r.upstream.Name)
+		case r.err != nil:
+			log.Printf("Block at height %v failed on %v as %v: %v", height, r.upstream.Name, rpc.ClassifySubmitError(r.err), r.err)
+		default:
+			log.Printf("Block at height %v not accepted by %v", height, r.upstream.Name)
 		}
+		if r.upstream == primary && r.err != nil {
+			outcome, primaryErr = rpc.ClassifySubmitError(r.err), r.err
+		}
+	}
+	if accepted {
+		return rpc.SubmitAccepted, nil
 	}
-	return false, true
+	return outcome, primaryErr
 }
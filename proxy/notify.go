@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Work package of node is tiny, full header notification is larger but is not used
+const maxNotifySize = 16 * 1024
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, v := range cidrs {
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// Only direct peer is checked, notifications must not come through reverse proxy
+func (s *ProxyServer) isNotifyAllowed(r *http.Request) bool {
+	ip := parseHostIP(r.RemoteAddr)
+	if ip == nil {
+		return false
+	}
+	networks, _ := parseNetworks(s.cfg().Proxy.Notify.Allow)
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Node posts ["header", "seed", "target", "number"] on new work. Template is built from it directly,
+// anything else is treated as a plain signal to fetch work from upstream.
+func (s *ProxyServer) HandleWorkNotify(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg().Proxy.Notify.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.isNotifyAllowed(r) {
+		log.Printf("Refused work notification from %s", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var work []string
+	err := json.NewDecoder(io.LimitReader(r.Body, maxNotifySize)).Decode(&work)
+	if err != nil || !s.applyWorkNotify(work) {
+		s.fetchBlockTemplate()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returns false if template must be fetched from upstream instead
+func (s *ProxyServer) applyWorkNotify(work []string) bool {
+	work, err := rpc.NormalizeWork(work)
+	if err != nil {
+		return false
+	}
+	height, ok := rpc.WorkHeight(work)
+	if !ok {
+		return false
+	}
+	// Zero target would panic on division
+	if len(strings.TrimLeft(work[2][2:], "0")) == 0 {
+		return false
+	}
+	diff := util.TargetHexToDiff(work[2])
+	if diff.Sign() <= 0 || !diff.IsInt64() {
+		return false
+	}
+
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+
+	// Replayed or late notification can't roll template back
+	t := s.currentBlockTemplate()
+	if t != nil {
+		if _, ok := t.headers[work[0]]; ok || height < t.Height {
+			return true
+		}
+	}
+	upstream := s.rpc()
+	head, err := upstream.GetBlockNumber()
+	if err != nil {
+		log.Printf("Error while checking notified work on %s: %s", upstream.Name, err)
+		return false
+	}
+	// Work is for pending block, anything else is from stale node state
+	if height != head+1 {
+		log.Printf("Notified work at height %d doesn't follow head %d on %s", height, head, upstream.Name)
+		return false
+	}
+	pendingReply := &rpc.GetBlockReplyPart{Number: util.ToHex(int64(height))}
+	s.storeTemplate(t, upstream, work[:3], height, diff.Int64(), pendingReply)
+	return true
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const defaultPricingHistory = 1000
+
+func (c *Pricing) validate() error {
+	if c.BlockReward < 0 {
+		return fmt.Errorf("block reward must not be negative")
+	}
+	if c.MaxRate > 0 && c.MinRate > c.MaxRate {
+		return fmt.Errorf("min rate %v is above max rate %v", c.MinRate, c.MaxRate)
+	}
+	return nil
+}
+
+// Shannon per unit of share difficulty. Rate of last update if pricing is enabled,
+// static rate of job difficulty and height before first update and otherwise.
+func (s *ProxyServer) shareRate(netDiff int64, height uint64) float64 {
+	cfg := s.cfg().Proxy
+	if cfg.Pricing.Enabled {
+		if rate := s.ppsRate(); rate > 0 {
+			return rate
+		}
+	}
+	return util.GetPPSRate(s.rewards.BlockReward(height), 0, cfg.MiningFee, netDiff)
+}
+
+func (s *ProxyServer) ppsRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.ppsRateBits))
+}
+
+func (s *ProxyServer) startPricing() {
+	// Rate written before restart bounds the first change
+	rate, err := s.backend.GetPPSRate()
+	if err != nil {
+		log.Printf("Failed to get PPS rate from backend: %v", err)
+	} else if rate != nil {
+		atomic.StoreUint64(&s.ppsRateBits, math.Float64bits(rate.Rate))
+	}
+	s.updatePPSRate()
+	s.runLoop(func() string { return s.cfg().Proxy.Pricing.Interval }, s.updatePPSRate)
+}
+
+// Template of broken node can't move rate further than bounds allow
+func (s *ProxyServer) updatePPSRate() {
+	cfg := s.cfg()
+	pricing := cfg.Proxy.Pricing
+	t := s.currentBlockTemplate()
+	if !pricing.Enabled || t == nil || t.Difficulty == nil || t.Difficulty.Sign() <= 0 {
+		return
+	}
+	netDiff := t.Difficulty.Int64()
+	blockReward := pricing.BlockReward
+	if blockReward == 0 {
+		blockReward = s.rewards.BlockReward(t.Height)
+	}
+	rate := util.GetPPSRate(blockReward, pricing.UncleRate, cfg.Proxy.MiningFee, netDiff)
+	bounded := boundRate(rate, s.ppsRate(), &pricing)
+	if bounded != rate {
+		log.Printf("PPS rate %v of difficulty %v is bounded to %v", rate, netDiff, bounded)
+	}
+	atomic.StoreUint64(&s.ppsRateBits, math.Float64bits(bounded))
+
+	history := pricing.History
+	if history <= 0 {
+		history = defaultPricingHistory
+	}
+	update := &storage.PPSRate{Timestamp: util.MakeTimestamp() / 1000, Rate: bounded, NetDiff: netDiff, Node: cfg.Name}
+	if err := s.backend.WritePPSRate(update, history); err != nil {
+		log.Printf("Failed to write PPS rate to backend: %v", err)
+	}
+}
+
+func boundRate(rate, prev float64, cfg *Pricing) float64 {
+	if prev > 0 && cfg.MaxChange > 0 {
+		if max := prev * (1 + cfg.MaxChange); rate > max {
+			rate = max
+		}
+		if min := prev * (1 - cfg.MaxChange); rate < min {
+			rate = min
+		}
+	}
+	if cfg.MinRate > 0 && rate < cfg.MinRate {
+		rate = cfg.MinRate
+	}
+	if cfg.MaxRate > 0 && rate > cfg.MaxRate {
+		rate = cfg.MaxRate
+	}
+	return rate
+}
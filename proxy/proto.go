@@ -21,6 +21,13 @@ type JSONPushMessage struct {
 	Result  interface{} `json:"result"`
 }
 
+type JSONNotification struct {
+	Id      *json.RawMessage `json:"id"`
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  []interface{}    `json:"params"`
+}
+
 type JSONRpcResp struct {
 	Id      *json.RawMessage `json:"id"`
 	Version string           `json:"jsonrpc"`
@@ -1,7 +1,10 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -15,150 +18,411 @@ import (
 
 	"github.com/CryptoManiac/open-ethereum-pool/policy"
 	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/sharelog"
 	"github.com/CryptoManiac/open-ethereum-pool/storage"
 	"github.com/CryptoManiac/open-ethereum-pool/util"
 )
 
+// Max time to wait for HTTP requests in flight on stop
+const shutdownTimeout = 5 * time.Second
+
 type ProxyServer struct {
-	config             *Config
-	blockTemplate      atomic.Value
-	upstream           int32
-	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
-	diff               string
-	policy             *policy.PolicyServer
-	hashrateExpiration time.Duration
-	failsCount         int64
+	config         atomic.Value
+	blockTemplate  atomic.Value
+	templateMu     sync.Mutex
+	upstreams      *rpc.Failover
+	backend        storage.Storage
+	policy         *policy.PolicyServer
+	verifier       *shareVerifier
+	rewards        util.RewardSchedule
+	shareLog       *sharelog.ShareLog
+	trustedProxies []*net.IPNet
+	hashrateExpiry int64
+	templateTTL    time.Duration
+	failsCount     int64
 
 	// Stratum
-	sessionsMu sync.RWMutex
-	sessions   map[*Session]struct{}
-	timeout    time.Duration
+	sessionsMu     sync.RWMutex
+	sessions       map[*Session]struct{}
+	ipConns        map[string]int
+	loginConns     map[string]int
+	conns          int
+	rejectedConns  int64
+	unauthorized   int64
+	sessionSeq     uint64
+	rejects        *rejectStats
+	denylist       loginDenylist
+	timeout        time.Duration
+	writeTimeout   time.Duration
+	keepAlive      time.Duration
+	authTimeout    time.Duration
+	diffTTL        time.Duration
+	maxIdle        time.Duration
+	idleGrace      time.Duration
+	listenersMu    sync.Mutex
+	listeners      []net.Listener
+	draining       int32
+	pendingSubmits int64
+
+	httpServer *http.Server
+	quit       chan struct{}
+	stopOnce   sync.Once
+	loops      sync.WaitGroup
+
+	// Last broadcast metrics, accessed atomically
+	broadcastMs     int64
+	broadcastFailed int64
+	announcedHeight uint64
+	// Time of last new height in milliseconds and stale work flag
+	heightChangedAt int64
+	staleWork       int32
+	// Float bits of PPS rate of last update
+	ppsRateBits uint64
 }
 
 type Session struct {
+	// Accessed atomically, must stay first for 64-bit alignment
+	difficulty int64
+	lastShare  int64
+	accepted   int64
+	rejected   int64
+	// Set by writer when connection is dead, following messages are refused
+	writeFailed int32
+
 	ip  string
 	enc *json.Encoder
 
 	// Stratum
-	sync.Mutex
-	conn  *net.TCPConn
-	login string
+	id          uint64
+	protocol    string
+	connectedAt time.Time
+	conn        net.Conn
+	login       string
+	worker      string
+	solo        bool
+	// Login counted in per login limit, guarded by sessionsMu
+	countedLogin string
+
+	// Outbound messages are written by dedicated goroutine
+	out      chan interface{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// Difficulty of work sent to miner, keyed by header hash
+	workMu   sync.Mutex
+	workDiff map[string]*workTarget
+
+	// Submit rate limit
+	submitMu       sync.Mutex
+	submitTokens   float64
+	lastSubmit     time.Time
+	limitedSubmits int
+
+	// Invalid shares counted by session policy
+	invalidMu     sync.Mutex
+	invalidShares int32
+	invalidSince  time.Time
+
+	// Vardiff
+	staticDiff bool
+	// Bounds of port for suggested difficulty with vardiff off
+	minDiff, maxDiff int64
+	sharesMu         sync.Mutex
+	shares           []shareSample
+	varDiffSince     time.Time
+	lastRetarget     time.Time
 }
 
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend storage.Storage) (*ProxyServer, error) {
 	if len(cfg.Name) == 0 {
-		log.Fatal("You must set instance name")
+		return nil, errors.New("You must set instance name")
+	}
+	if len(cfg.Upstream) == 0 {
+		return nil, errors.New("You must configure at least one upstream")
+	}
+	cfg.normalize()
+	for _, v := range cfg.Upstream {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid upstream %s: %v", v.Name, err)
+		}
+	}
+	var trustedProxies []*net.IPNet
+	for _, v := range cfg.Proxy.TrustedProxies {
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy network %v: %v", v, err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	if _, err := parseNetworks(cfg.Proxy.Notify.Allow); err != nil {
+		return nil, fmt.Errorf("Invalid notify network: %v", err)
+	}
+	if !rpc.IsValidStrategy(cfg.UpstreamStrategy) {
+		return nil, fmt.Errorf("Invalid upstream strategy: %v", cfg.UpstreamStrategy)
+	}
+	if len(cfg.Proxy.DenylistTTL) > 0 {
+		if _, err := time.ParseDuration(cfg.Proxy.DenylistTTL); err != nil {
+			return nil, fmt.Errorf("Invalid login denylist TTL: %v", err)
+		}
+	}
+	if len(cfg.UpstreamRotateInterval) > 0 {
+		if _, err := time.ParseDuration(cfg.UpstreamRotateInterval); err != nil {
+			return nil, fmt.Errorf("Invalid upstream rotate interval: %v", err)
+		}
+	}
+	// Parsed on block submission, must not fail there
+	if len(cfg.Proxy.BlockSubmitTimeout) > 0 {
+		if _, err := time.ParseDuration(cfg.Proxy.BlockSubmitTimeout); err != nil {
+			return nil, fmt.Errorf("Invalid block submit timeout: %v", err)
+		}
+	}
+	// Parsed on each template refresh, must not fail there
+	if cfg.Proxy.StaleWork.Enabled {
+		if d, err := time.ParseDuration(cfg.Proxy.StaleWork.BlockTime); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid stale work block time: %v", cfg.Proxy.StaleWork.BlockTime)
+		}
+	}
+	if cfg.Proxy.Pricing.Enabled {
+		if d, err := time.ParseDuration(cfg.Proxy.Pricing.Interval); err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid pricing interval: %v", cfg.Proxy.Pricing.Interval)
+		}
+		if err := cfg.Proxy.Pricing.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid pricing: %v", err)
+		}
+	}
+	if err := validateOperators(cfg.Proxy.Admin.Operators); err != nil {
+		return nil, fmt.Errorf("Invalid admin operators: %v", err)
+	}
+	if cfg.Proxy.Stratum.SubmitLimit.Enabled {
+		if err := cfg.Proxy.Stratum.SubmitLimit.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid submit limit: %v", err)
+		}
+	}
+	rewards, err := util.NewRewardSchedule(cfg.RewardSchedule.Preset, cfg.RewardSchedule.Eras)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reward schedule: %v", err)
+	}
+	if cfg.Proxy.Policy.Sessions.Enabled {
+		if _, err := time.ParseDuration(cfg.Proxy.Policy.Sessions.Window); err != nil {
+			return nil, fmt.Errorf("Invalid session policy window: %v", err)
+		}
 	}
 	policy := policy.Start(&cfg.Proxy.Policy, backend)
 
-	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
-	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
+	proxy := &ProxyServer{backend: backend, policy: policy, verifier: newShareVerifier(), rewards: rewards}
+	proxy.config.Store(cfg)
+	proxy.trustedProxies = trustedProxies
+	proxy.quit = make(chan struct{})
+	proxy.rejects = newRejectStats()
 
-	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
+	if cfg.Proxy.ShareLog.Enabled {
+		shareLog, err := sharelog.New(&cfg.Proxy.ShareLog)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start share log: %v", err)
+		}
+		proxy.shareLog = shareLog
+	}
+
+	upstreams := make([]*rpc.RPCClient, len(cfg.Upstream))
 	for i, v := range cfg.Upstream {
-		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
-		log.Printf("Upstream: %s => %s", v.Name, v.Url)
+		upstreams[i] = proxy.newUpstream(v)
+		log.Printf("Upstream: %s => %s", v.Name, rpc.RedactUrl(v.Url))
 	}
-	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
+	proxy.upstreams = rpc.NewFailover(upstreams)
+	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, rpc.RedactUrl(proxy.rpc().Url))
 
 	if cfg.Proxy.Stratum.Enabled {
 		proxy.sessions = make(map[*Session]struct{})
-		go proxy.ListenTCP()
+		proxy.ipConns = make(map[string]int)
+		proxy.loginConns = make(map[string]int)
+		proxy.timeout = util.MustParseDuration(cfg.Proxy.Stratum.Timeout)
+		if len(cfg.Proxy.Stratum.ReadTimeout) > 0 {
+			proxy.timeout = util.MustParseDuration(cfg.Proxy.Stratum.ReadTimeout)
+		}
+		proxy.authTimeout = defaultAuthorizeTimeout
+		if len(cfg.Proxy.Stratum.AuthorizeTimeout) > 0 {
+			proxy.authTimeout = util.MustParseDuration(cfg.Proxy.Stratum.AuthorizeTimeout)
+		}
+		if len(cfg.Proxy.Stratum.TCPKeepAlive) > 0 {
+			proxy.keepAlive = util.MustParseDuration(cfg.Proxy.Stratum.TCPKeepAlive)
+		}
+		proxy.writeTimeout = defaultWriteTimeout
+		if len(cfg.Proxy.Stratum.WriteTimeout) > 0 {
+			proxy.writeTimeout = util.MustParseDuration(cfg.Proxy.Stratum.WriteTimeout)
+		}
+		if len(cfg.Proxy.Stratum.MaxIdleWithoutShare) > 0 {
+			proxy.maxIdle = util.MustParseDuration(cfg.Proxy.Stratum.MaxIdleWithoutShare)
+		}
+		if len(cfg.Proxy.Stratum.IdleGrace) > 0 {
+			proxy.idleGrace = util.MustParseDuration(cfg.Proxy.Stratum.IdleGrace)
+		}
+		for _, port := range proxy.stratumPorts() {
+			go proxy.ListenTCP(port)
+		}
+		if cfg.Proxy.Stratum.WebSocket.Enabled {
+			go proxy.ListenWebSocket()
+		}
+		if cfg.Proxy.Stratum.VarDiff.Enabled {
+			proxy.diffTTL = defaultPersistTTL
+			if len(cfg.Proxy.Stratum.VarDiff.PersistTTL) > 0 {
+				proxy.diffTTL = util.MustParseDuration(cfg.Proxy.Stratum.VarDiff.PersistTTL)
+			}
+			proxy.startVarDiff()
+		}
+		if cfg.Proxy.Stratum.HashrateMessage.Enabled {
+			proxy.startHashrateMessages()
+		}
+		proxy.listenMigrateSignal()
 	}
 
+	if len(cfg.Proxy.TemplateTTL) > 0 {
+		proxy.templateTTL = util.MustParseDuration(cfg.Proxy.TemplateTTL)
+	}
+	// Upstream on wrong chain must not give the first job
+	proxy.checkUpstreams()
 	proxy.fetchBlockTemplate()
 
-	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
-
-	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
-	refreshTimer := time.NewTimer(refreshIntv)
-	log.Printf("Set block refresh every %v", refreshIntv)
+	proxy.setHashrateExpiration(util.MustParseDuration(cfg.Proxy.HashrateExpiration))
+	if cfg.Proxy.Pricing.Enabled {
+		proxy.startPricing()
+	}
 
-	checkIntv := util.MustParseDuration(cfg.UpstreamCheckInterval)
-	checkTimer := time.NewTimer(checkIntv)
+	log.Printf("Set block refresh every %v", cfg.Proxy.BlockRefreshInterval)
+	proxy.runLoop(func() string { return proxy.cfg().Proxy.BlockRefreshInterval }, proxy.refreshBlockTemplate)
+	proxy.runLoop(func() string { return proxy.cfg().UpstreamCheckInterval }, proxy.checkUpstreams)
+	proxy.runLoop(func() string { return proxy.cfg().Proxy.StateUpdateInterval }, proxy.writeNodeState)
 
-	stateUpdateIntv := util.MustParseDuration(cfg.Proxy.StateUpdateInterval)
-	stateUpdateTimer := time.NewTimer(stateUpdateIntv)
+	return proxy, nil
+}
 
+// Runs fn until server is stopped, interval is read on each tick so reloaded config is picked up
+func (s *ProxyServer) runLoop(interval func() string, fn func()) {
+	intv := util.MustParseDuration(interval())
+	s.loops.Add(1)
 	go func() {
+		defer s.loops.Done()
+		ticker := time.NewTicker(intv)
+		defer func() { ticker.Stop() }()
 		for {
 			select {
-			case <-refreshTimer.C:
-				proxy.fetchBlockTemplate()
-				refreshTimer.Reset(refreshIntv)
+			case <-ticker.C:
+				fn()
+				if next := util.MustParseDuration(interval()); next != intv {
+					intv = next
+					ticker.Stop()
+					ticker = time.NewTicker(intv)
+				}
+			case <-s.quit:
+				return
 			}
 		}
 	}()
+}
 
-	go func() {
-		for {
-			select {
-			case <-checkTimer.C:
-				proxy.checkUpstreams()
-				checkTimer.Reset(checkIntv)
-			}
+func (s *ProxyServer) cfg() *Config {
+	return s.config.Load().(*Config)
+}
+
+func (s *ProxyServer) hashrateExpiration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.hashrateExpiry))
+}
+
+func (s *ProxyServer) setHashrateExpiration(d time.Duration) {
+	atomic.StoreInt64(&s.hashrateExpiry, int64(d))
+}
+
+func (s *ProxyServer) upstreamList() []*rpc.RPCClient {
+	return s.upstreams.Clients()
+}
+
+func (s *ProxyServer) writeNodeState() {
+	t := s.currentBlockTemplate()
+	if t == nil {
+		return
+	}
+	err := s.backend.WriteNodeState(s.cfg().Name, t.Height, t.Difficulty, s.nodeStats())
+	if err != nil {
+		log.Printf("Failed to write node state to backend: %v", err)
+		s.markSick()
+	} else if !s.isStaleWork() {
+		s.markOk()
+	}
+	if err := s.backend.TrimPPLNSWindow(t.Difficulty.Int64()); err != nil {
+		log.Printf("Failed to trim PPLNS window: %v", err)
+	}
+	if s.cfg().Proxy.Stratum.Enabled {
+		_, recent := s.rejects.snapshot()
+		if err := s.backend.WriteNodeRejects(s.cfg().Name, recent); err != nil {
+			log.Printf("Failed to write rejected IPs to backend: %v", err)
 		}
-	}()
+	}
+}
 
-	go func() {
-		for {
-			select {
-			case <-stateUpdateTimer.C:
-				t := proxy.currentBlockTemplate()
-				if t != nil {
-					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
-					if err != nil {
-						log.Printf("Failed to write node state to backend: %v", err)
-						proxy.markSick()
-					} else {
-						proxy.markOk()
-					}
-				}
-				stateUpdateTimer.Reset(stateUpdateIntv)
+// Stops background loops and listeners, sessions which are still connected are left to caller
+func (s *ProxyServer) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		s.policy.Stop()
+		atomic.StoreInt32(&s.draining, 1)
+		s.closeListeners()
+
+		s.listenersMu.Lock()
+		srv := s.httpServer
+		s.listenersMu.Unlock()
+		if srv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Failed to shutdown proxy: %v", err)
 			}
 		}
-	}()
-
-	return proxy
+	})
+	s.loops.Wait()
 }
 
 func (s *ProxyServer) Start() {
-	log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
+	log.Printf("Starting proxy on %v", s.cfg().Proxy.Listen)
 	r := mux.NewRouter()
+	s.registerAdminRoutes(r)
+	r.HandleFunc("/notify", s.HandleWorkNotify).Methods("POST")
 	r.Handle("/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,8}}", s)
 	r.Handle("/{login:0x[0-9a-fA-F]{40}}", s)
+	// Miner URL scheme of legacy getwork setups
+	r.Handle("/miner/{login:0x[0-9a-fA-F]{40}}/{id:[0-9a-zA-Z-_]{1,8}}", s)
+	r.Handle("/miner/{login:0x[0-9a-fA-F]{40}}", s)
 	srv := &http.Server{
-		Addr:           s.config.Proxy.Listen,
+		Addr:           s.cfg().Proxy.Listen,
 		Handler:        r,
-		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
+		MaxHeaderBytes: s.cfg().Proxy.LimitHeadersSize,
 	}
+	s.listenersMu.Lock()
+	s.httpServer = srv
+	s.listenersMu.Unlock()
+
 	err := srv.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start proxy: %v", err)
 	}
 }
 
 func (s *ProxyServer) rpc() *rpc.RPCClient {
-	i := atomic.LoadInt32(&s.upstream)
-	return s.upstreams[i]
+	return s.upstreams.Current()
 }
 
-func (s *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
-
-	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
-		}
-	}
-
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+// Head of active upstream triggers refresh at once, polling is kept as fallback
+func (s *ProxyServer) newUpstream(cfg Upstream) *rpc.RPCClient {
+	client := rpc.NewRPCClient(cfg.Name, cfg.Url, cfg.Timeout)
+	client.Auth = cfg.auth()
+	cfg.apply(client)
+	if len(cfg.WsUrl) > 0 {
+		client.WatchHeads(cfg.WsUrl, func() {
+			if s.rpc() == client {
+				s.fetchBlockTemplate()
+			}
+		})
 	}
+	return client
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -166,34 +430,80 @@ func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.writeError(w, 405, "rpc: POST method required, received "+r.Method)
 		return
 	}
+	// Upstream and miners should switch to another instance
+	if s.isDraining() {
+		s.writeError(w, 503, "Proxy is shutting down")
+		return
+	}
 	ip := s.remoteAddr(r)
 	if !s.policy.IsBanned(ip) {
+		atomic.AddInt64(&s.pendingSubmits, 1)
+		defer atomic.AddInt64(&s.pendingSubmits, -1)
 		s.handleClient(w, r, ip)
 	}
 }
 
 func (s *ProxyServer) remoteAddr(r *http.Request) string {
-	if s.config.Proxy.BehindReverseProxy {
-		ip := r.Header.Get("X-Forwarded-For")
-		if len(ip) > 0 && net.ParseIP(ip) != nil {
-			return ip
+	ip := parseHostIP(r.RemoteAddr)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !s.cfg().Proxy.BehindReverseProxy || !s.isTrustedProxy(ip) {
+		return ip.String()
+	}
+
+	// Walk from the nearest hop and take first one which is not our proxy
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	client := ip
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHostIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Malformed header, fallback to socket address
+			return ip.String()
+		}
+		client = hop
+		if len(s.trustedProxies) == 0 || !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// Accepts bare IP or host:port, IPv6 zone is dropped
+func parseHostIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
+
+// Any peer is trusted if list of proxies is not configured
+func (s *ProxyServer) isTrustedProxy(ip net.IP) bool {
+	if len(s.trustedProxies) == 0 {
+		return true
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
 		}
 	}
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
+	return false
 }
 
 func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip string) {
-	if r.ContentLength > s.config.Proxy.LimitBodySize {
+	if r.ContentLength > s.cfg().Proxy.LimitBodySize {
 		log.Printf("Socket flood from %s", ip)
 		s.policy.ApplyMalformedPolicy(ip)
 		http.Error(w, "Request too large", http.StatusExpectationFailed)
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, s.config.Proxy.LimitBodySize)
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg().Proxy.LimitBodySize)
 	defer r.Body.Close()
 
-	cs := &Session{ip: ip, enc: json.NewEncoder(w)}
+	cs := &Session{ip: ip, enc: json.NewEncoder(w), difficulty: s.cfg().Proxy.Difficulty}
 	dec := json.NewDecoder(r.Body)
 	for {
 		var req JSONRpcReq
@@ -216,10 +526,12 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	}
 
 	vars := mux.Vars(r)
+	if errReply := s.checkLoginAddress(vars["login"]); errReply != nil {
+		cs.sendError(req.Id, errReply)
+		return
+	}
 	login := strings.ToLower(vars["login"])
-
-	if !util.IsValidHexAddress(login) {
-		errReply := &ErrorReply{Code: -1, Message: "Invalid login"}
+	if errReply := s.checkLoginDenied(login, cs.ip); errReply != nil {
 		cs.sendError(req.Id, errReply)
 		return
 	}
@@ -247,7 +559,9 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 				s.policy.ApplyMalformedPolicy(cs.ip)
 				break
 			}
-			reply, errReply := s.handleSubmitRPC(cs, login, vars["id"], params)
+			// HTTP miner has no session, mode of settings is read on each submit
+			solo := s.soloMode(login, s.backendSettings(login))
+			reply, errReply := s.handleSubmitRPC(cs, login, vars["id"], solo, params)
 			if errReply != nil {
 				cs.sendError(req.Id, errReply)
 				break
@@ -269,6 +583,101 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 	}
 }
 
+func (cs *Session) Difficulty() int64 {
+	return atomic.LoadInt64(&cs.difficulty)
+}
+
+func (cs *Session) setDifficulty(diff int64) {
+	atomic.StoreInt64(&cs.difficulty, diff)
+}
+
+// Header is the same when work is pushed again after retarget,
+// so previous difficulty is kept for shares in flight
+type workTarget struct {
+	diff      int64
+	prev      int64
+	prevUntil time.Time
+	login     string
+	worker    string
+	solo      bool
+}
+
+// Remember difficulty of issued work, so retarget won't affect shares in flight
+func (cs *Session) issueWork(t *BlockTemplate) string {
+	diff := cs.Difficulty()
+	cs.workMu.Lock()
+	defer cs.workMu.Unlock()
+
+	if cs.workDiff == nil {
+		cs.workDiff = make(map[string]*workTarget)
+	}
+	for header, _ := range cs.workDiff {
+		if _, ok := t.headers[header]; !ok {
+			delete(cs.workDiff, header)
+		}
+	}
+	if w, ok := cs.workDiff[t.Header]; ok {
+		if w.diff != diff {
+			w.prev, w.prevUntil = w.diff, time.Now().Add(retargetGrace)
+			w.diff = diff
+		}
+		w.login, w.worker, w.solo = cs.login, cs.worker, cs.solo
+	} else {
+		cs.workDiff[t.Header] = &workTarget{diff: diff, login: cs.login, worker: cs.worker, solo: cs.solo}
+	}
+	return util.GetTargetHex(diff)
+}
+
+// Login and worker are changed under workMu, so shares are matched with work they were issued for
+func (cs *Session) setOwner(login, worker string, solo bool) {
+	cs.workMu.Lock()
+	defer cs.workMu.Unlock()
+	cs.login, cs.worker, cs.solo = login, worker, solo
+}
+
+func (cs *Session) owner() (string, string, bool) {
+	cs.workMu.Lock()
+	defer cs.workMu.Unlock()
+	return cs.login, cs.worker, cs.solo
+}
+
+func (cs *Session) workOwner(header string) (string, string, bool) {
+	cs.workMu.Lock()
+	defer cs.workMu.Unlock()
+
+	if w, ok := cs.workDiff[header]; ok && len(w.login) > 0 {
+		return w.login, w.worker, w.solo
+	}
+	return cs.login, cs.worker, cs.solo
+}
+
+// Counters of previous login must not be mixed with new one
+func (cs *Session) resetShareStats() {
+	atomic.StoreInt64(&cs.accepted, 0)
+	atomic.StoreInt64(&cs.rejected, 0)
+
+	cs.sharesMu.Lock()
+	cs.shares = nil
+	cs.sharesMu.Unlock()
+
+	cs.invalidMu.Lock()
+	cs.invalidShares = 0
+	cs.invalidMu.Unlock()
+}
+
+func (cs *Session) workDifficulty(header string) int64 {
+	cs.workMu.Lock()
+	defer cs.workMu.Unlock()
+
+	if w, ok := cs.workDiff[header]; ok {
+		if w.prev > 0 && w.prev < w.diff && time.Now().Before(w.prevUntil) {
+			return w.prev
+		}
+		return w.diff
+	}
+	return cs.Difficulty()
+}
+
 func (cs *Session) sendResult(id *json.RawMessage, result interface{}) error {
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
 	return cs.enc.Encode(&message)
@@ -293,13 +702,48 @@ func (s *ProxyServer) currentBlockTemplate() *BlockTemplate {
 	}
 }
 
+func (s *ProxyServer) nodeStats() map[string]int64 {
+	stats := make(map[string]int64)
+	stats["verifyQueue"] = s.verifier.queueDepth()
+	stats["verifyP99Ms"] = int64(s.verifier.latencyP99() / time.Millisecond)
+	for k, v := range s.upstreamStats() {
+		stats[k] = v
+	}
+	stats["staleWork"] = boolToInt(s.isStaleWork())
+	stats["heightChangedAt"] = atomic.LoadInt64(&s.heightChangedAt)
+	if depth, flush, ok := s.backend.ShareBufferStats(); ok {
+		stats["shareBuffer"] = int64(depth)
+		stats["shareFlushMs"] = int64(flush / time.Millisecond)
+	}
+	for k, v := range s.shareLog.Stats() {
+		stats[k] = v
+	}
+	if t := s.currentBlockTemplate(); t != nil {
+		jobs, age := t.backlogStats()
+		stats["jobBacklog"] = int64(jobs)
+		stats["oldestJobMs"] = int64(age / time.Millisecond)
+	}
+	if s.cfg().Proxy.Stratum.Enabled {
+		stats["sessions"] = int64(s.sessionsCount())
+		stats["rejectedConns"] = atomic.LoadInt64(&s.rejectedConns)
+		stats["unauthorized"] = atomic.LoadInt64(&s.unauthorized)
+		stats["broadcastMs"] = atomic.LoadInt64(&s.broadcastMs)
+		stats["broadcastFailed"] = atomic.LoadInt64(&s.broadcastFailed)
+		counts, _ := s.rejects.snapshot()
+		for reason, n := range counts {
+			stats["rejects."+reason] = n
+		}
+	}
+	return stats
+}
+
 func (s *ProxyServer) markSick() {
 	atomic.AddInt64(&s.failsCount, 1)
 }
 
 func (s *ProxyServer) isSick() bool {
 	x := atomic.LoadInt64(&s.failsCount)
-	if s.config.Proxy.HealthCheck && x >= s.config.Proxy.MaxFails {
+	if s.cfg().Proxy.HealthCheck && x >= s.cfg().Proxy.MaxFails {
 		return true
 	}
 	return false
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteAddrIsNormalized(t *testing.T) {
+	s := &ProxyServer{}
+	s.config.Store(&Config{})
+	cases := []struct {
+		remote, ip string
+	}{
+		{"10.0.0.1:4000", "10.0.0.1"},
+		{"[::ffff:10.0.0.1]:4000", "10.0.0.1"},
+		{"[2001:DB8::1]:4000", "2001:db8::1"},
+		{"[fe80::1%eth0]:4000", "fe80::1"},
+	}
+	for _, c := range cases {
+		if got := s.remoteAddr(&http.Request{RemoteAddr: c.remote}); got != c.ip {
+			t.Errorf("Address of %v is %v, want %v", c.remote, got, c.ip)
+		}
+	}
+}
+
+func TestForwardedAddrIsNormalized(t *testing.T) {
+	_, network, _ := net.ParseCIDR("127.0.0.0/8")
+	s := &ProxyServer{trustedProxies: []*net.IPNet{network}}
+	cfg := &Config{}
+	cfg.Proxy.BehindReverseProxy = true
+	s.config.Store(cfg)
+
+	r := &http.Request{RemoteAddr: "127.0.0.1:4000", Header: http.Header{}}
+	r.Header.Set("X-Forwarded-For", "::ffff:10.0.0.1, 127.0.0.2")
+	if got := s.remoteAddr(r); got != "10.0.0.1" {
+		t.Errorf("Forwarded address is %v, want 10.0.0.1", got)
+	}
+}
+
+// Interval is read again after each tick, not only on start
+func TestRunLoopInterval(t *testing.T) {
+	s := &ProxyServer{quit: make(chan struct{})}
+	var mu sync.Mutex
+	interval, ticks := "10ms", 0
+	s.runLoop(func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return interval
+	}, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		ticks++
+		if ticks == 3 {
+			interval = "1h"
+		}
+	})
+	time.Sleep(300 * time.Millisecond)
+	close(s.quit)
+	s.loops.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ticks != 3 {
+		t.Errorf("Loop ticked %v times, want 3 before interval was raised", ticks)
+	}
+}
+
+// Difficulty of issued work is kept exactly as long as its job is in backlog
+func TestWorkDiffExpiresWithJob(t *testing.T) {
+	s, _ := newShareServer(t)
+	s.cfg().Proxy.JobBacklog = 2
+	first := s.newTestJob(100)
+	cs := s.newTestSession("0xa", "rig", 1000)
+	cs.issueWork(s.currentBlockTemplate())
+
+	s.newTestJob(101)
+	cs.setDifficulty(4000)
+	cs.issueWork(s.currentBlockTemplate())
+	if got := cs.workDifficulty(first); got != 1000 {
+		t.Errorf("Job of previous height is at %v, want 1000 it was issued with", got)
+	}
+	submitTestShare(t, s, cs, first, 1)
+
+	s.newTestJob(102)
+	cs.issueWork(s.currentBlockTemplate())
+	cs.workMu.Lock()
+	_, kept := cs.workDiff[first]
+	n := len(cs.workDiff)
+	cs.workMu.Unlock()
+	if kept || n != 2 {
+		t.Errorf("Work of evicted job is kept: %v, %v entries left, want 2", kept, n)
+	}
+}
+
+func TestSubmitLimitMustBePositive(t *testing.T) {
+	cfg := testStratumConfig("http://127.0.0.1:0")
+	cfg.Proxy.Stratum.SubmitLimit = SubmitLimit{Enabled: true, Rate: 10, Burst: 50}
+	if err := validateReloadable(cfg); err != nil {
+		t.Fatalf("Valid submit limit is refused: %v", err)
+	}
+	for _, limit := range []SubmitLimit{{Enabled: true, Burst: 50}, {Enabled: true, Rate: 10}, {Enabled: true, Rate: -1, Burst: 50}} {
+		cfg.Proxy.Stratum.SubmitLimit = limit
+		if err := validateReloadable(cfg); err == nil {
+			t.Errorf("Submit limit %+v is accepted on reload", limit)
+		}
+		if _, err := NewProxy(cfg, &stratumBackend{}); err == nil {
+			t.Errorf("Submit limit %+v is accepted on start", limit)
+		}
+	}
+}
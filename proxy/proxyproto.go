@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Balancer must send PROXY header in this amount of time
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Keeps bytes buffered while reading PROXY header
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Read PROXY protocol v1 or v2 header and return client IP conveyed by balancer.
+// Empty IP means that balancer sent LOCAL or UNKNOWN header, socket address should be used.
+func readProxyHeader(conn net.Conn) (net.Conn, string, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReaderSize(conn, MaxReqSize)
+	bc := &bufferedConn{Conn: conn, r: r}
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		ip, err := readProxyV2(r)
+		return bc, ip, err
+	}
+	sig, err = r.Peek(6)
+	if err != nil {
+		return nil, "", err
+	}
+	if string(sig) != "PROXY " {
+		return nil, "", errors.New("Missing PROXY protocol header")
+	}
+	ip, err := readProxyV1(r)
+	return bc, ip, err
+}
+
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 8008\r\n
+func readProxyV1(r *bufio.Reader) (string, error) {
+	line, isPrefix, err := r.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	// Header is limited to 107 bytes by spec
+	if isPrefix || len(line) > 107 {
+		return "", errors.New("PROXY v1 header is too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return "", nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return "", errors.New("Malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return "", errors.New("Malformed PROXY v1 source address")
+	}
+	return ip.String(), nil
+}
+
+func readProxyV2(r *bufio.Reader) (string, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return "", errors.New("Unsupported PROXY protocol version")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", err
+	}
+	// LOCAL command, health check of balancer itself
+	if verCmd&0x0F == 0 {
+		return "", nil
+	}
+	if verCmd&0x0F != 1 {
+		return "", errors.New("Unsupported PROXY v2 command")
+	}
+	switch family >> 4 {
+	case 1:
+		if length < 12 {
+			return "", errors.New("Malformed PROXY v2 IPv4 address block")
+		}
+		return net.IP(payload[0:4]).String(), nil
+	case 2:
+		if length < 36 {
+			return "", errors.New("Malformed PROXY v2 IPv6 address block")
+		}
+		return net.IP(payload[0:16]).String(), nil
+	}
+	// Unix sockets and unspecified families carry no usable address
+	return "", nil
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Max time to wait for pending submits before closing connections
+const flushTimeout = 5 * time.Second
+
+func (s *ProxyServer) listenMigrateSignal() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-sigc:
+				log.Println("Received SIGUSR2, migrating stratum miners")
+				go s.migrateSessions()
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop accepting work and let submits in flight reach backend. Caller owns shutdown signal,
+// backend is closed by it afterwards.
+func (s *ProxyServer) Shutdown() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.closeListeners()
+
+	drain := flushTimeout
+	if len(s.cfg().Proxy.ShutdownDrain) > 0 {
+		drain = util.MustParseDuration(s.cfg().Proxy.ShutdownDrain)
+	}
+	s.flushSubmits(drain)
+	s.writeNodeState()
+	s.Stop()
+	if err := s.shareLog.Close(); err != nil {
+		log.Printf("Failed to close share log: %v", err)
+	}
+	log.Println("Proxy stopped")
+}
+
+func (s *ProxyServer) registerListener(l net.Listener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+func (s *ProxyServer) closeListeners() {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *ProxyServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) > 0
+}
+
+// Stop accepting stratum connections so reconnecting miners won't land here again,
+// then close remaining sessions after grace period.
+// Stratum-Proxy protocol has no reconnect notification, we only flush pending replies.
+func (s *ProxyServer) migrateSessions() {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+	s.closeListeners()
+
+	var grace time.Duration
+	if len(s.cfg().Proxy.Stratum.ReconnectGrace) > 0 {
+		grace = util.MustParseDuration(s.cfg().Proxy.Stratum.ReconnectGrace)
+	}
+	log.Printf("Stopped accepting stratum connections, closing sessions in %v", grace)
+	time.Sleep(grace)
+
+	s.flushSubmits(flushTimeout)
+
+	sessions := s.sessionsSnapshot()
+
+	for _, cs := range sessions {
+		cs.conn.Close()
+		s.removeSession(cs)
+	}
+	log.Printf("Closed %v stratum sessions", len(sessions))
+}
+
+func (s *ProxyServer) flushSubmits(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.pendingSubmits) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&s.pendingSubmits); n > 0 {
+		log.Printf("Gave up waiting for %v pending submits", n)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// Number of last rejected IPs kept per reason
+const recentRejectsSize = 8
+
+// Reasons of dropped connections and failed logins, reported in node stats
+const (
+	rejectBanned        = "banned"
+	rejectConnLimit     = "connLimit"
+	rejectPoolFull      = "poolFull"
+	rejectIPLimit       = "ipLimit"
+	rejectProxyHeader   = "proxyHeader"
+	rejectTLSHandshake  = "tlsHandshake"
+	rejectWSUpgrade     = "wsUpgrade"
+	rejectAuthTimeout   = "authTimeout"
+	rejectFlood         = "flood"
+	rejectMalformed     = "malformed"
+	rejectUnknownMethod = "unknownMethod"
+	rejectLogin         = "login"
+	rejectIdle          = "idle"
+	rejectLoginLimit    = "loginLimit"
+)
+
+type rejectStats struct {
+	sync.Mutex
+	counts map[string]int64
+	recent map[string]*ipRing
+}
+
+type ipRing struct {
+	ips  [recentRejectsSize]string
+	next int
+	size int
+}
+
+func newRejectStats() *rejectStats {
+	return &rejectStats{counts: make(map[string]int64), recent: make(map[string]*ipRing)}
+}
+
+func (r *rejectStats) add(reason, ip string) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.counts[reason]++
+	ring, ok := r.recent[reason]
+	if !ok {
+		ring = &ipRing{}
+		r.recent[reason] = ring
+	}
+	ring.ips[ring.next] = ip
+	ring.next = (ring.next + 1) % recentRejectsSize
+	if ring.size < recentRejectsSize {
+		ring.size++
+	}
+}
+
+// Counters are cumulative since start, recent IPs are newest first
+func (r *rejectStats) snapshot() (map[string]int64, map[string][]string) {
+	r.Lock()
+	defer r.Unlock()
+
+	counts := make(map[string]int64, len(r.counts))
+	for reason, n := range r.counts {
+		counts[reason] = n
+	}
+	recent := make(map[string][]string, len(r.recent))
+	for reason, ring := range r.recent {
+		ips := make([]string, 0, ring.size)
+		for i := 1; i <= ring.size; i++ {
+			ips = append(ips, ring.ips[(ring.next-i+recentRejectsSize)%recentRejectsSize])
+		}
+		recent[reason] = ips
+	}
+	return counts, recent
+}
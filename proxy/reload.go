@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+type setting struct {
+	name      string
+	old, next interface{}
+}
+
+// Settings bound to listeners or parsed once on start, pointers to fields of both configs
+func restartOnlySettings(old, cfg *Config) []setting {
+	return []setting{
+		{"name", &old.Name, &cfg.Name},
+		{"rewardMode", &old.RewardMode, &cfg.RewardMode},
+		{"pplnsWindow", &old.PPLNSWindow, &cfg.PPLNSWindow},
+		{"rewardSchedule", &old.RewardSchedule, &cfg.RewardSchedule},
+		{"proxy.listen", &old.Proxy.Listen, &cfg.Proxy.Listen},
+		{"proxy.trustedProxies", &old.Proxy.TrustedProxies, &cfg.Proxy.TrustedProxies},
+		{"proxy.templateTTL", &old.Proxy.TemplateTTL, &cfg.Proxy.TemplateTTL},
+		{"proxy.policy.workers", &old.Proxy.Policy.Workers, &cfg.Proxy.Policy.Workers},
+		{"proxy.policy.resetInterval", &old.Proxy.Policy.ResetInterval, &cfg.Proxy.Policy.ResetInterval},
+		{"proxy.policy.refreshInterval", &old.Proxy.Policy.RefreshInterval, &cfg.Proxy.Policy.RefreshInterval},
+		{"proxy.policy.limits.grace", &old.Proxy.Policy.Limits.Grace, &cfg.Proxy.Policy.Limits.Grace},
+		{"proxy.stratum.enabled", &old.Proxy.Stratum.Enabled, &cfg.Proxy.Stratum.Enabled},
+		{"proxy.stratum.listen", &old.Proxy.Stratum.Listen, &cfg.Proxy.Stratum.Listen},
+		{"proxy.stratum.ports", &old.Proxy.Stratum.Ports, &cfg.Proxy.Stratum.Ports},
+		{"proxy.stratum.maxConn", &old.Proxy.Stratum.MaxConn, &cfg.Proxy.Stratum.MaxConn},
+		{"proxy.stratum.proxyProtocol", &old.Proxy.Stratum.ProxyProtocol, &cfg.Proxy.Stratum.ProxyProtocol},
+		{"proxy.stratum.tls", &old.Proxy.Stratum.TLS, &cfg.Proxy.Stratum.TLS},
+		{"proxy.stratum.webSocket", &old.Proxy.Stratum.WebSocket, &cfg.Proxy.Stratum.WebSocket},
+		{"proxy.stratum.timeout", &old.Proxy.Stratum.Timeout, &cfg.Proxy.Stratum.Timeout},
+		{"proxy.stratum.readTimeout", &old.Proxy.Stratum.ReadTimeout, &cfg.Proxy.Stratum.ReadTimeout},
+		{"proxy.stratum.writeTimeout", &old.Proxy.Stratum.WriteTimeout, &cfg.Proxy.Stratum.WriteTimeout},
+		{"proxy.stratum.authorizeTimeout", &old.Proxy.Stratum.AuthorizeTimeout, &cfg.Proxy.Stratum.AuthorizeTimeout},
+		{"proxy.stratum.tcpKeepAlive", &old.Proxy.Stratum.TCPKeepAlive, &cfg.Proxy.Stratum.TCPKeepAlive},
+		{"proxy.stratum.maxIdleWithoutShare", &old.Proxy.Stratum.MaxIdleWithoutShare, &cfg.Proxy.Stratum.MaxIdleWithoutShare},
+		{"proxy.stratum.idleGrace", &old.Proxy.Stratum.IdleGrace, &cfg.Proxy.Stratum.IdleGrace},
+		{"proxy.stratum.varDiff.enabled", &old.Proxy.Stratum.VarDiff.Enabled, &cfg.Proxy.Stratum.VarDiff.Enabled},
+		{"proxy.stratum.hashrateMessage.enabled", &old.Proxy.Stratum.HashrateMessage.Enabled, &cfg.Proxy.Stratum.HashrateMessage.Enabled},
+		{"proxy.stratum.varDiff.persistTTL", &old.Proxy.Stratum.VarDiff.PersistTTL, &cfg.Proxy.Stratum.VarDiff.PersistTTL},
+		{"proxy.pricing.enabled", &old.Proxy.Pricing.Enabled, &cfg.Proxy.Pricing.Enabled},
+	}
+}
+
+// Apply new config to running proxy. Restart only settings keep old values,
+// config with invalid values is rejected as a whole.
+func (s *ProxyServer) Reload(cfg *Config) error {
+	old := s.cfg()
+	cfg.normalize()
+	for _, v := range restartOnlySettings(old, cfg) {
+		prev, next := reflect.ValueOf(v.old).Elem(), reflect.ValueOf(v.next).Elem()
+		if !reflect.DeepEqual(prev.Interface(), next.Interface()) {
+			log.Printf("Ignoring change of %s, restart is required", v.name)
+			next.Set(prev)
+		}
+	}
+	if err := validateReloadable(cfg); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(old.Upstream, cfg.Upstream) {
+		s.reloadUpstreams(cfg.Upstream)
+	}
+	s.setHashrateExpiration(util.MustParseDuration(cfg.Proxy.HashrateExpiration))
+	s.policy.SetConfig(&cfg.Proxy.Policy)
+	s.config.Store(cfg)
+	return nil
+}
+
+func validateReloadable(cfg *Config) error {
+	if len(cfg.Upstream) == 0 {
+		return errors.New("You must configure at least one upstream")
+	}
+	if _, err := parseNetworks(cfg.Proxy.Notify.Allow); err != nil {
+		return fmt.Errorf("Invalid proxy.notify.allow: %v", err)
+	}
+	if !rpc.IsValidStrategy(cfg.UpstreamStrategy) {
+		return fmt.Errorf("Invalid upstreamStrategy: %v", cfg.UpstreamStrategy)
+	}
+	durations := [][2]string{
+		{"proxy.hashrateExpiration", cfg.Proxy.HashrateExpiration},
+		{"proxy.blockRefreshInterval", cfg.Proxy.BlockRefreshInterval},
+		{"proxy.stateUpdateInterval", cfg.Proxy.StateUpdateInterval},
+		{"upstreamCheckInterval", cfg.UpstreamCheckInterval},
+	}
+	for _, v := range cfg.Upstream {
+		durations = append(durations, [2]string{"upstream " + v.Name + " timeout", v.Timeout})
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("Invalid upstream %s: %v", v.Name, err)
+		}
+	}
+	vd := cfg.Proxy.Stratum.VarDiff
+	if vd.Enabled {
+		durations = append(durations,
+			[2]string{"proxy.stratum.varDiff.window", vd.Window},
+			[2]string{"proxy.stratum.varDiff.retargetInterval", vd.RetargetInterval})
+		if vd.MinDiff > 0 && vd.MaxDiff > 0 && vd.MinDiff > vd.MaxDiff {
+			return fmt.Errorf("Invalid vardiff bounds, minDiff %v is above maxDiff %v", vd.MinDiff, vd.MaxDiff)
+		}
+	}
+	if len(cfg.Proxy.DenylistTTL) > 0 {
+		durations = append(durations, [2]string{"proxy.denylistTTL", cfg.Proxy.DenylistTTL})
+	}
+	if len(cfg.UpstreamRotateInterval) > 0 {
+		durations = append(durations, [2]string{"upstreamRotateInterval", cfg.UpstreamRotateInterval})
+	}
+	if len(cfg.Proxy.BlockSubmitTimeout) > 0 {
+		durations = append(durations, [2]string{"proxy.blockSubmitTimeout", cfg.Proxy.BlockSubmitTimeout})
+	}
+	if cfg.Proxy.StaleWork.Enabled {
+		durations = append(durations, [2]string{"proxy.staleWork.blockTime", cfg.Proxy.StaleWork.BlockTime})
+	}
+	if hm := cfg.Proxy.Stratum.HashrateMessage; hm.Enabled {
+		durations = append(durations,
+			[2]string{"proxy.stratum.hashrateMessage.interval", hm.Interval},
+			[2]string{"proxy.stratum.hashrateMessage.window", hm.Window})
+	}
+	if cfg.Proxy.Policy.Sessions.Enabled {
+		durations = append(durations, [2]string{"proxy.policy.sessions.window", cfg.Proxy.Policy.Sessions.Window})
+	}
+	if cfg.Proxy.Pricing.Enabled {
+		durations = append(durations, [2]string{"proxy.pricing.interval", cfg.Proxy.Pricing.Interval})
+		if err := cfg.Proxy.Pricing.validate(); err != nil {
+			return fmt.Errorf("Invalid proxy.pricing: %v", err)
+		}
+	}
+	if err := validateOperators(cfg.Proxy.Admin.Operators); err != nil {
+		return fmt.Errorf("Invalid proxy.admin.operators: %v", err)
+	}
+	if limit := cfg.Proxy.Stratum.SubmitLimit; limit.Enabled {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("Invalid proxy.stratum.submitLimit: %v", err)
+		}
+	}
+	for _, v := range durations {
+		d, err := time.ParseDuration(v[1])
+		if err != nil {
+			return fmt.Errorf("Invalid %s: %v", v[0], err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("Invalid %s, must be positive", v[0])
+		}
+	}
+	return nil
+}
+
+// Changed credentials make new client
+func upstreamKey(name, url, wsUrl string, auth rpc.Auth) string {
+	return strings.Join([]string{name, url, wsUrl, auth.Username, auth.Password, auth.Token, auth.JwtSecret}, "|")
+}
+
+// Existing clients are kept to not lose their health state,
+// new ones become eligible only after passing check
+func (s *ProxyServer) reloadUpstreams(upstreams []Upstream) {
+	current := make(map[string]*rpc.RPCClient)
+	for _, v := range s.upstreamList() {
+		current[upstreamKey(v.Name, v.Url, v.WsUrl, v.Auth)] = v
+	}
+	clients := make([]*rpc.RPCClient, len(upstreams))
+	for i, v := range upstreams {
+		key := upstreamKey(v.Name, v.Url, v.WsUrl, v.auth())
+		if client, ok := current[key]; ok {
+			v.apply(client)
+			clients[i] = client
+			delete(current, key)
+			continue
+		}
+		clients[i] = s.newUpstream(v)
+		if clients[i].Check() {
+			log.Printf("New upstream: %s => %s", v.Name, rpc.RedactUrl(v.Url))
+		} else {
+			log.Printf("New upstream %s => %s is not healthy", v.Name, rpc.RedactUrl(v.Url))
+		}
+	}
+	s.upstreams.SetClients(clients)
+	for _, v := range current {
+		v.Close()
+	}
+	s.checkUpstreams()
+}
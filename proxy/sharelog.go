@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"github.com/CryptoManiac/open-ethereum-pool/sharelog"
+)
+
+// Share outcome goes to external stream, job height is zero if job is not known
+func (s *ProxyServer) logShare(cs *Session, login, id string, t *BlockTemplate, params []string, diff int64, solo bool, status string, accepted bool) {
+	if s.shareLog == nil {
+		return
+	}
+	var height uint64
+	if h, ok := t.headers[params[1]]; ok {
+		height = h.height
+	}
+	s.shareLog.Log(&sharelog.Event{
+		Type:       sharelog.EventShare,
+		Status:     status,
+		Accepted:   accepted,
+		Login:      login,
+		Worker:     id,
+		IP:         cs.ip,
+		Difficulty: diff,
+		Height:     height,
+		Job:        params[1],
+		Solo:       solo,
+	})
+}
+
+func (s *ProxyServer) logBlock(login, id, ip string, diff int64, height uint64, job string, solo bool) {
+	if s.shareLog == nil {
+		return
+	}
+	s.shareLog.Log(&sharelog.Event{
+		Type:       sharelog.EventBlock,
+		Accepted:   true,
+		Login:      login,
+		Worker:     id,
+		IP:         ip,
+		Difficulty: diff,
+		Height:     height,
+		Job:        job,
+		Solo:       solo,
+	})
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Work is stale after this many expected blocks without new height by default
+const defaultStaleWorkFactor = 10
+
+// Must be called on each new height, clears stale flag
+func (s *ProxyServer) markWorkAdvanced(height uint64) {
+	atomic.StoreInt64(&s.heightChangedAt, util.MakeTimestamp())
+	if atomic.CompareAndSwapInt32(&s.staleWork, 1, 0) {
+		log.Printf("Work advanced to height %d, stale work alert cleared", height)
+	}
+}
+
+// Stuck node keeps giving the same work, instance is marked sick on each refresh
+// until new height arrives, so health check takes it out of rotation
+func (s *ProxyServer) checkStaleWork() {
+	cfg := s.cfg().Proxy.StaleWork
+	changedAt := atomic.LoadInt64(&s.heightChangedAt)
+	if !cfg.Enabled || changedAt == 0 {
+		return
+	}
+	factor := cfg.Factor
+	if factor <= 0 {
+		factor = defaultStaleWorkFactor
+	}
+	limit := time.Duration(factor * float64(util.MustParseDuration(cfg.BlockTime)))
+	age := time.Duration(util.MakeTimestamp()-changedAt) * time.Millisecond
+	if age <= limit {
+		return
+	}
+	s.markSick()
+	if !atomic.CompareAndSwapInt32(&s.staleWork, 0, 1) {
+		return
+	}
+	t := s.currentBlockTemplate()
+	log.Printf("Work is stale, height %d has not advanced for %v on %s", t.Height, age, s.rpc().Name)
+	if cfg.Message && s.cfg().Proxy.Stratum.Enabled {
+		message := fmt.Sprintf("pool work is stale, no new block for %v", age/time.Second*time.Second)
+		go func() {
+			for _, cs := range s.sessionsSnapshot() {
+				cs.showMessage(message)
+			}
+		}()
+	}
+}
+
+func (s *ProxyServer) isStaleWork() bool {
+	return atomic.LoadInt32(&s.staleWork) == 1
+}
+
+func (s *ProxyServer) refreshBlockTemplate() {
+	s.fetchBlockTemplate()
+	s.checkStaleWork()
+}
@@ -2,11 +2,15 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/CryptoManiac/open-ethereum-pool/util"
@@ -14,13 +18,21 @@ import (
 
 const (
 	MaxReqSize = 1024
+
+	rejectTimeout = 5 * time.Second
+
+	defaultBroadcastWorkers = 1024
+	defaultWriteTimeout     = 10 * time.Second
+	defaultAuthorizeTimeout = 30 * time.Second
 )
 
-func (s *ProxyServer) ListenTCP() {
-	timeout := util.MustParseDuration(s.config.Proxy.Stratum.Timeout)
-	s.timeout = timeout
+func (s *ProxyServer) ListenTCP(port StratumPort) {
+	var tlsConfig *tls.Config
+	if port.TLS {
+		tlsConfig = s.mustLoadTLSConfig()
+	}
 
-	addr, err := net.ResolveTCPAddr("tcp", s.config.Proxy.Stratum.Listen)
+	addr, err := net.ResolveTCPAddr("tcp", port.Listen)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
@@ -29,41 +41,185 @@ func (s *ProxyServer) ListenTCP() {
 		log.Fatalf("Error: %v", err)
 	}
 	defer server.Close()
+	s.registerListener(server)
+
+	if port.TLS {
+		log.Printf("Stratum TLS listening on %s with difficulty %v", port.Listen, port.Difficulty)
+	} else {
+		log.Printf("Stratum listening on %s with difficulty %v", port.Listen, port.Difficulty)
+	}
+	s.serveStratum(server, port, tlsConfig)
+}
+
+// Single listen address and TLS section are kept for configs without ports list
+func (s *ProxyServer) stratumPorts() []StratumPort {
+	cfg := s.cfg().Proxy.Stratum
+	ports := cfg.Ports
+	if len(ports) == 0 {
+		ports = []StratumPort{{Listen: cfg.Listen}}
+		if cfg.TLS.Enabled {
+			ports = append(ports, StratumPort{Listen: cfg.TLS.Listen, TLS: true})
+		}
+	}
+	result := make([]StratumPort, len(ports))
+	for i, port := range ports {
+		if port.Difficulty <= 0 {
+			port.Difficulty = s.cfg().Proxy.Difficulty
+		}
+		if port.MinDiff <= 0 {
+			port.MinDiff = port.Difficulty
+		}
+		if port.MaxConn <= 0 {
+			port.MaxConn = cfg.MaxConn
+		}
+		result[i] = port
+	}
+	return result
+}
 
-	log.Printf("Stratum listening on %s", s.config.Proxy.Stratum.Listen)
-	var accept = make(chan int, s.config.Proxy.Stratum.MaxConn)
+func (s *ProxyServer) mustLoadTLSConfig() *tls.Config {
+	cfg := s.cfg().Proxy.Stratum.TLS
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	minVersion, err := parseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion}
+}
+
+func (s *ProxyServer) serveStratum(server *net.TCPListener, port StratumPort, tlsConfig *tls.Config) {
+	var handshakeTimeout time.Duration
+	if tlsConfig != nil {
+		handshakeTimeout = util.MustParseDuration(s.cfg().Proxy.Stratum.TLS.HandshakeTimeout)
+	}
+	proxyProtocol := s.cfg().Proxy.Stratum.ProxyProtocol
+	var accept = make(chan int, port.MaxConn)
 	n := 0
 
 	for {
 		conn, err := server.AcceptTCP()
 		if err != nil {
+			if s.isDraining() {
+				return
+			}
 			continue
 		}
-		conn.SetKeepAlive(true)
+		s.setSocketOptions(conn)
 
 		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		ip = util.NormalizeIP(ip)
 
-		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+		// Client address is known only after PROXY header is read
+		if !proxyProtocol && !s.allowConn(ip) {
 			conn.Close()
 			continue
 		}
 		n += 1
-		cs := &Session{conn: conn, ip: ip}
+		cs := &Session{conn: conn, ip: ip, difficulty: port.Difficulty, minDiff: port.MinDiff, maxDiff: port.MaxDiff, protocol: "stratum"}
 
 		accept <- n
 		go func(cs *Session) {
-			err = s.handleTCPClient(cs)
-			if err != nil {
-				s.removeSession(cs)
-				conn.Close()
+			defer func() { <-accept }()
+
+			if proxyProtocol {
+				conn, ip, err := readProxyHeader(cs.conn)
+				if err != nil {
+					log.Printf("Invalid PROXY header from %s: %v", cs.ip, err)
+					s.rejects.add(rejectProxyHeader, cs.ip)
+					cs.conn.Close()
+					return
+				}
+				cs.conn = conn
+				if len(ip) > 0 {
+					cs.ip = ip
+				}
+				if !s.allowConn(cs.ip) {
+					cs.conn.Close()
+					return
+				}
+			}
+
+			if tlsConfig != nil {
+				tlsConn := tls.Server(cs.conn, tlsConfig)
+				// Client must complete handshake in time, otherwise it would hold goroutine forever
+				tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+				if err := tlsConn.Handshake(); err != nil {
+					log.Printf("TLS handshake error from %s: %v", cs.ip, err)
+					s.rejects.add(rejectTLSHandshake, cs.ip)
+					tlsConn.Close()
+					return
+				}
+				cs.conn = tlsConn
+				cs.protocol = "stratum+tls"
 			}
-			<-accept
+
+			s.serveSession(cs)
 		}(cs)
 	}
 }
 
+// Session lifecycle shared by all transports, connection is closed on return
+func (s *ProxyServer) serveSession(cs *Session) {
+	if errReply := s.acquireConn(cs.ip); errReply != nil {
+		log.Printf("Rejected connection from %s: %s", cs.ip, errReply.Message)
+		s.rejectTCPClient(cs, errReply)
+		return
+	}
+	defer s.releaseConn(cs.ip)
+
+	cs.id = atomic.AddUint64(&s.sessionSeq, 1)
+	cs.connectedAt = time.Now()
+	s.handleTCPClient(cs)
+	s.removeSession(cs)
+	cs.stopWriter()
+	cs.conn.Close()
+}
+
+func (s *ProxyServer) allowConn(ip string) bool {
+	if s.policy.IsBanned(ip) {
+		s.rejects.add(rejectBanned, ip)
+		return false
+	}
+	if !s.policy.ApplyLimitPolicy(ip) {
+		s.rejects.add(rejectConnLimit, ip)
+		return false
+	}
+	return true
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unsupported TLS version `%s`", version)
+}
+
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
+	cs.startWriter(s.cfg().Proxy.Stratum.WriteQueue, s.writeTimeout)
+
+	// Session slot is taken on connect, miner which doesn't log in must go away
+	authTimer := time.AfterFunc(s.authTimeout, func() {
+		if !s.isRegistered(cs) {
+			log.Printf("Client %s did not log in within %v", cs.ip, s.authTimeout)
+			atomic.AddInt64(&s.unauthorized, 1)
+			s.rejects.add(rejectAuthTimeout, cs.ip)
+			cs.conn.Close()
+		}
+	})
+	defer authTimer.Stop()
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
 	s.setDeadline(cs.conn)
 
@@ -71,10 +227,14 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 		data, isPrefix, err := connbuff.ReadLine()
 		if isPrefix {
 			log.Printf("Socket flood detected from %s", cs.ip)
+			s.rejects.add(rejectFlood, cs.ip)
 			s.policy.BanClient(cs.ip)
 			return err
 		} else if err == io.EOF {
 			log.Printf("Client %s disconnected", cs.ip)
+			if s.isRegistered(cs) {
+				s.saveDifficulty(cs)
+			}
 			s.removeSession(cs)
 			break
 		} else if err != nil {
@@ -87,6 +247,7 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 			err = json.Unmarshal(data, &req)
 			if err != nil {
 				s.policy.ApplyMalformedPolicy(cs.ip)
+				s.rejects.add(rejectMalformed, cs.ip)
 				log.Printf("Malformed stratum request from %s: %v", cs.ip, err)
 				return err
 			}
@@ -108,10 +269,15 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		err := json.Unmarshal(*req.Params, &params)
 		if err != nil {
 			log.Println("Malformed stratum request params from", cs.ip)
+			s.rejects.add(rejectMalformed, cs.ip)
 			return err
 		}
 		reply, errReply := s.handleLoginRPC(cs, params, req.Worker)
+		if errReply == errAlreadyLoggedIn {
+			return cs.sendTCPReject(req.Id, errReply)
+		}
 		if errReply != nil {
+			s.rejects.add(rejectLogin, cs.ip)
 			return cs.sendTCPError(req.Id, errReply)
 		}
 		return cs.sendTCPResult(req.Id, reply)
@@ -128,6 +294,16 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 			log.Println("Malformed stratum request params from", cs.ip)
 			return err
 		}
+		// Rejected without touching hasher and backend
+		if s.cfg().Proxy.Stratum.SubmitLimit.Enabled {
+			if ok, keep := s.allowSubmit(cs); !ok {
+				errReply := &ErrorReply{Code: -1, Message: "Submit rate limit exceeded"}
+				if !keep {
+					return cs.sendTCPError(req.Id, errReply)
+				}
+				return cs.sendTCPReject(req.Id, errReply)
+			}
+		}
 		callback := func(reply bool, errReply *ErrorReply) {
 			closeOnErr := func(err error) {
 				if err != nil {
@@ -137,63 +313,180 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 				}
 			}
 			if errReply != nil {
-				closeOnErr(cs.sendTCPError(req.Id, errReply))
+				if isShareReject(errReply) {
+					closeOnErr(cs.sendTCPReject(req.Id, errReply))
+				} else {
+					closeOnErr(cs.sendTCPError(req.Id, errReply))
+				}
 				return
 			}
 			closeOnErr(cs.sendTCPResult(req.Id, &reply))
 		}
-		go s.handleTCPSubmitRPC(cs, req.Worker, params, callback)
+		atomic.AddInt64(&s.pendingSubmits, 1)
+		go func() {
+			defer atomic.AddInt64(&s.pendingSubmits, -1)
+			s.handleTCPSubmitRPC(cs, req.Worker, params, callback)
+		}()
 		return nil
 	case "eth_submitHashrate":
 		return cs.sendTCPResult(req.Id, true)
+	case "mining.suggest_difficulty":
+		return cs.sendTCPResult(req.Id, s.handleSuggestDifficultyRPC(cs, req.Params))
+	case "mining.extranonce.subscribe":
+		// Miner gets whole nonce space of header, there is no extranonce to rotate
+		return cs.sendTCPResult(req.Id, false)
 	default:
+		s.rejects.add(rejectUnknownMethod, cs.ip)
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		return cs.sendTCPError(req.Id, errReply)
 	}
 }
 
 func (cs *Session) sendTCPResult(id *json.RawMessage, result interface{}) error {
-	cs.Lock()
-	defer cs.Unlock()
-
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
-	return cs.enc.Encode(&message)
+	return cs.enqueue(&message)
 }
 
 func (cs *Session) pushNewJob(result interface{}) error {
-	cs.Lock()
-	defer cs.Unlock()
 	// FIXME: Temporarily add ID for Claymore compliance
 	message := JSONPushMessage{Version: "2.0", Result: result, Id: 0}
-	return cs.enc.Encode(&message)
+	return cs.enqueue(&message)
 }
 
 func (cs *Session) sendTCPError(id *json.RawMessage, reply *ErrorReply) error {
-	cs.Lock()
-	defer cs.Unlock()
-
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := cs.enc.Encode(&message)
+	err := cs.enqueue(&message)
 	if err != nil {
 		return err
 	}
 	return errors.New(reply.Message)
 }
 
-func (self *ProxyServer) setDeadline(conn *net.TCPConn) {
-	conn.SetDeadline(time.Now().Add(self.timeout))
+// Error reply which doesn't close connection
+func (cs *Session) sendTCPReject(id *json.RawMessage, reply *ErrorReply) error {
+	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
+	return cs.enqueue(&message)
+}
+
+// Writes have own deadline in session writer
+func (self *ProxyServer) setDeadline(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(self.timeout))
 }
 
-func (s *ProxyServer) registerSession(cs *Session) {
+// Zero values keep OS defaults
+func (s *ProxyServer) setSocketOptions(conn *net.TCPConn) {
+	cfg := s.cfg().Proxy.Stratum
+	conn.SetKeepAlive(true)
+	if s.keepAlive > 0 {
+		conn.SetKeepAlivePeriod(s.keepAlive)
+	}
+	if cfg.ReadBuffer > 0 {
+		conn.SetReadBuffer(cfg.ReadBuffer)
+	}
+	if cfg.WriteBuffer > 0 {
+		conn.SetWriteBuffer(cfg.WriteBuffer)
+	}
+}
+
+func (s *ProxyServer) rejectTCPClient(cs *Session, reply *ErrorReply) {
+	cs.conn.SetDeadline(time.Now().Add(rejectTimeout))
+	message := JSONRpcResp{Version: "2.0", Error: reply}
+	json.NewEncoder(cs.conn).Encode(&message)
+	cs.conn.Close()
+}
+
+// Whitelisted IPs are not limited per IP
+func (s *ProxyServer) acquireConn(ip string) *ErrorReply {
+	cfg := s.cfg().Proxy.Stratum
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if cfg.MaxSessions > 0 && s.conns >= cfg.MaxSessions {
+		atomic.AddInt64(&s.rejectedConns, 1)
+		s.rejects.add(rejectPoolFull, ip)
+		return &ErrorReply{Code: -1, Message: "Pool is full, try backup"}
+	}
+	if cfg.MaxConnPerIP > 0 && s.ipConns[ip] >= cfg.MaxConnPerIP && !s.policy.InWhiteList(ip) {
+		atomic.AddInt64(&s.rejectedConns, 1)
+		s.rejects.add(rejectIPLimit, ip)
+		return &ErrorReply{Code: -1, Message: "Too many connections from your IP"}
+	}
+	s.ipConns[ip]++
+	s.conns++
+	return nil
+}
+
+func (s *ProxyServer) releaseConn(ip string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	s.conns--
+	s.ipConns[ip]--
+	if s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
+
+func (s *ProxyServer) sessionsSnapshot() []*Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for cs, _ := range s.sessions {
+		sessions = append(sessions, cs)
+	}
+	return sessions
+}
+
+func (s *ProxyServer) sessionsCount() int {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	return len(s.sessions)
+}
+
+func (s *ProxyServer) isRegistered(cs *Session) bool {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	_, ok := s.sessions[cs]
+	return ok
+}
+
+// Login limit is checked under the same lock as registration, so concurrent logins can't exceed it
+func (s *ProxyServer) registerSession(cs *Session) *ErrorReply {
+	cfg := s.cfg().Proxy.Stratum
+	cs.startVarDiff()
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
+
+	// Miner may log in again on the same connection
+	if cs.countedLogin != cs.login {
+		if cfg.MaxConnPerLogin > 0 && s.loginConns[cs.login] >= cfg.MaxConnPerLogin && !util.StringInSlice(cs.login, cfg.ExemptLogins) {
+			return &ErrorReply{Code: -1, Message: fmt.Sprintf("Too many connections for your login, limit is %v", cfg.MaxConnPerLogin)}
+		}
+		s.releaseLogin(cs)
+		s.loginConns[cs.login]++
+		cs.countedLogin = cs.login
+	}
 	s.sessions[cs] = struct{}{}
+	return nil
 }
 
 func (s *ProxyServer) removeSession(cs *Session) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
 	delete(s.sessions, cs)
+	s.releaseLogin(cs)
+}
+
+// Must be called with sessionsMu held
+func (s *ProxyServer) releaseLogin(cs *Session) {
+	if len(cs.countedLogin) == 0 {
+		return
+	}
+	s.loginConns[cs.countedLogin]--
+	if s.loginConns[cs.countedLogin] <= 0 {
+		delete(s.loginConns, cs.countedLogin)
+	}
+	cs.countedLogin = ""
 }
 
 func (s *ProxyServer) broadcastNewJobs() {
@@ -201,32 +494,57 @@ func (s *ProxyServer) broadcastNewJobs() {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return
 	}
-	reply := []string{t.Header, t.Seed, s.diff}
-
-	s.sessionsMu.RLock()
-	defer s.sessionsMu.RUnlock()
-
-	count := len(s.sessions)
+	sessions := s.sessionsSnapshot()
+	count := len(sessions)
 	log.Printf("Broadcasting new job to %v stratum miners", count)
 
 	start := time.Now()
-	bcast := make(chan int, 1024)
-	n := 0
-
-	for m, _ := range s.sessions {
-		n++
-		bcast <- n
+	workers := s.cfg().Proxy.Stratum.BroadcastWorkers
+	if workers <= 0 {
+		workers = defaultBroadcastWorkers
+	}
+	if workers > count {
+		workers = count
+	}
+	bcast := make(chan *Session)
+	var failed int64
+	var wg sync.WaitGroup
 
-		go func(cs *Session) {
-			err := cs.pushNewJob(&reply)
-			<-bcast
-			if err != nil {
-				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
-				s.removeSession(cs)
-			} else {
-				s.setDeadline(cs.conn)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cs := range bcast {
+				if skip, drop := s.checkIdle(cs); drop {
+					log.Printf("Dropping idle session %v.%v@%v", cs.login, cs.worker, cs.ip)
+					s.rejects.add(rejectIdle, cs.ip)
+					cs.conn.Close()
+					s.removeSession(cs)
+					continue
+				} else if skip {
+					continue
+				}
+				reply := []string{t.Header, t.Seed, cs.issueWork(t)}
+				err := cs.pushNewJob(&reply)
+				if err != nil {
+					log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+					atomic.AddInt64(&failed, 1)
+					cs.conn.Close()
+					s.removeSession(cs)
+				} else {
+					s.setDeadline(cs.conn)
+				}
 			}
-		}(m)
+		}()
+	}
+	for _, cs := range sessions {
+		bcast <- cs
 	}
-	log.Printf("Jobs broadcast finished %s", time.Since(start))
+	close(bcast)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	atomic.StoreInt64(&s.broadcastMs, int64(elapsed/time.Millisecond))
+	atomic.StoreInt64(&s.broadcastFailed, failed)
+	log.Printf("Jobs broadcast finished %s, %v failed", elapsed, failed)
 }
@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const testLogin = "0x00000000000000000000000000000000000000aa"
+
+// Mining node with work of settable height, submitted blocks are accepted
+type workNode struct {
+	sync.Mutex
+	height uint64
+}
+
+func newWorkNode(t *testing.T, height uint64) (*workNode, string) {
+	n := &workNode{height: height}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var result interface{}
+		height := n.currentHeight()
+		switch req.Method {
+		case "eth_getWork":
+			result = []string{testHeader(height), fmt.Sprintf("0x%064x", 0), util.GetTargetHex(1000000), fmt.Sprintf("0x%x", height)}
+		case "eth_getBlockByNumber":
+			result = map[string]string{"number": fmt.Sprintf("0x%x", height), "difficulty": "0xf4240"}
+		case "eth_blockNumber":
+			result = fmt.Sprintf("0x%x", height)
+		case "eth_syncing":
+			result = false
+		case "eth_submitWork":
+			result = true
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.Id, "result": result})
+	}))
+	t.Cleanup(server.Close)
+	return n, server.URL
+}
+
+func (n *workNode) currentHeight() uint64 {
+	n.Lock()
+	defer n.Unlock()
+	return n.height
+}
+
+func (n *workNode) setHeight(height uint64) {
+	n.Lock()
+	n.height = height
+	n.Unlock()
+}
+
+// Header of job is made of height, so jobs of different heights differ
+func testHeader(height uint64) string {
+	return fmt.Sprintf("0x%064x", height)
+}
+
+// Storage of harness, miners have no settings and node state is dropped
+type stratumBackend struct {
+	shareBackend
+}
+
+func (b *stratumBackend) GetMinerSettings(login string) (*storage.MinerSettings, error) {
+	return &storage.MinerSettings{}, nil
+}
+
+func (b *stratumBackend) GetLoginBlacklist() ([]string, error) {
+	return nil, nil
+}
+
+func (b *stratumBackend) WriteNodeState(id string, height uint64, diff *big.Int, stats map[string]int64) error {
+	return nil
+}
+
+func (b *stratumBackend) ShareBufferStats() (int, time.Duration, bool) {
+	return 0, 0, false
+}
+
+func (b *stratumBackend) sharesCount() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.shares)
+}
+
+func testStratumConfig(url string) *Config {
+	cfg := &Config{
+		Name:                  "test",
+		UpstreamCheckInterval: "1h",
+		Upstream:              []Upstream{{Name: "node", Url: url, Timeout: "1s"}},
+	}
+	cfg.Proxy.Listen = "127.0.0.1:0"
+	cfg.Proxy.Difficulty = 1000
+	cfg.Proxy.HashrateExpiration = "3h"
+	cfg.Proxy.BlockRefreshInterval = "1h"
+	cfg.Proxy.StateUpdateInterval = "1h"
+	cfg.Proxy.Policy = *testPolicyConfig()
+	cfg.Proxy.Stratum.Enabled = true
+	cfg.Proxy.Stratum.Listen = "127.0.0.1:0"
+	cfg.Proxy.Stratum.Timeout = "10s"
+	cfg.Proxy.Stratum.MaxConn = 16
+	return cfg
+}
+
+// Proxy with stratum port on random address, shares meet target they are verified against.
+// Work is refreshed by test, timers of proxy are not fired while it runs.
+func newStratumServer(t *testing.T, cfg *Config) (*ProxyServer, *stratumBackend, string) {
+	prev := hasher
+	hasher = targetHasher{}
+	backend := &stratumBackend{}
+	s, err := NewProxy(cfg, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Stop()
+		hasher = prev
+	})
+	for i := 0; i < 100; i++ {
+		s.listenersMu.Lock()
+		listeners := s.listeners
+		s.listenersMu.Unlock()
+		if len(listeners) > 0 {
+			return s, backend, listeners[0].Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Stratum port is not listening")
+	return nil, nil, ""
+}
+
+type stratumReply struct {
+	Id     *int64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *ErrorReply     `json:"error"`
+}
+
+// Stratum-Proxy miner, job pushes are kept apart from replies
+type testMiner struct {
+	t       *testing.T
+	conn    net.Conn
+	enc     *json.Encoder
+	seq     int64
+	replies chan *stratumReply
+	jobs    chan []string
+	closed  chan struct{}
+}
+
+func dialMiner(t *testing.T, addr string) *testMiner {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	m := &testMiner{
+		t:       t,
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		replies: make(chan *stratumReply, 16),
+		jobs:    make(chan []string, 16),
+		closed:  make(chan struct{}),
+	}
+	go m.read()
+	return m
+}
+
+func (m *testMiner) read() {
+	defer close(m.closed)
+	r := bufio.NewReader(m.conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var reply stratumReply
+		if err := json.Unmarshal(line, &reply); err != nil {
+			m.t.Errorf("Malformed message from proxy: %s", line)
+			return
+		}
+		// Pushed job carries id 0, requests of miner start from 1
+		if reply.Id != nil && *reply.Id == 0 && reply.Error == nil {
+			var job []string
+			json.Unmarshal(reply.Result, &job)
+			m.jobs <- job
+			continue
+		}
+		m.replies <- &reply
+	}
+}
+
+func (m *testMiner) call(method string, params ...string) *stratumReply {
+	reply := m.tryCall(method, params...)
+	if reply == nil {
+		m.t.Fatalf("Connection is closed on %v", method)
+	}
+	return reply
+}
+
+// Nil if connection is closed, error reply may be dropped together with connection
+func (m *testMiner) tryCall(method string, params ...string) *stratumReply {
+	m.seq++
+	req := map[string]interface{}{"id": m.seq, "jsonrpc": "2.0", "method": method, "params": params}
+	if err := m.enc.Encode(req); err != nil {
+		m.t.Fatalf("Can't send %v: %v", method, err)
+	}
+	select {
+	case reply := <-m.replies:
+		return reply
+	case <-m.closed:
+		// Reply is read before connection is reported closed
+		select {
+		case reply := <-m.replies:
+			return reply
+		default:
+			return nil
+		}
+	case <-time.After(5 * time.Second):
+		m.t.Fatalf("No reply to %v", method)
+	}
+	return nil
+}
+
+func (m *testMiner) login() {
+	if reply := m.call("eth_submitLogin", testLogin+".rig"); reply.Error != nil {
+		m.t.Fatalf("Login is rejected: %v", reply.Error)
+	}
+}
+
+func (m *testMiner) getWork() []string {
+	reply := m.call("eth_getWork")
+	if reply.Error != nil {
+		m.t.Fatalf("Work is not given: %v", reply.Error)
+	}
+	var job []string
+	json.Unmarshal(reply.Result, &job)
+	return job
+}
+
+func shareParams(header string, nonce uint64) []string {
+	return []string{fmt.Sprintf("0x%016x", nonce), header, fmt.Sprintf("0x%064x", nonce)}
+}
+
+func (m *testMiner) submit(header string, nonce uint64) *stratumReply {
+	return m.call("eth_submitWork", shareParams(header, nonce)...)
+}
+
+func (m *testMiner) nextJob() []string {
+	select {
+	case job := <-m.jobs:
+		return job
+	case <-time.After(5 * time.Second):
+		m.t.Fatal("No job is pushed")
+	}
+	return nil
+}
+
+func accepted(reply *stratumReply) bool {
+	return reply.Error == nil && string(reply.Result) == "true"
+}
+
+func TestStratumShareAccepted(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	_, backend, addr := newStratumServer(t, testStratumConfig(url))
+	m := dialMiner(t, addr)
+	m.login()
+
+	job := m.getWork()
+	if job[0] != testHeader(100) || job[2] != util.GetTargetHex(1000) {
+		t.Fatalf("Job is %v, want header of height 100 and target of port difficulty", job)
+	}
+	if reply := m.submit(job[0], 1); !accepted(reply) {
+		t.Fatalf("Share is rejected: %+v", reply.Error)
+	}
+	backend.Lock()
+	defer backend.Unlock()
+	if len(backend.shares) != 1 || backend.shares[0] != (writtenShare{testLogin, "rig", 1000, false}) {
+		t.Errorf("Backend got %+v", backend.shares)
+	}
+}
+
+func TestStratumStaleJobRejected(t *testing.T) {
+	node, url := newWorkNode(t, 100)
+	cfg := testStratumConfig(url)
+	cfg.Proxy.StaleDepth = 1
+	s, backend, addr := newStratumServer(t, cfg)
+	m := dialMiner(t, addr)
+	m.login()
+	job := m.getWork()
+
+	for _, height := range []uint64{101, 102} {
+		node.setHeight(height)
+		s.fetchBlockTemplate()
+		m.nextJob()
+	}
+	reply := m.submit(job[0], 1)
+	if reply.Error == nil || reply.Error.Message != errStaleShare.Message {
+		t.Fatalf("Reply to share of job two heights behind is %+v, want stale share", reply.Error)
+	}
+	// Rejected share doesn't drop miner
+	if reply := m.submit(testHeader(102), 2); !accepted(reply) {
+		t.Errorf("Share of current job is rejected: %+v", reply.Error)
+	}
+	backend.Lock()
+	defer backend.Unlock()
+	if backend.stale != 1 || len(backend.shares) != 1 {
+		t.Errorf("Backend got %v stale and %v valid shares, want 1 and 1", backend.stale, len(backend.shares))
+	}
+}
+
+func TestStratumDuplicateNonceRejected(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	_, backend, addr := newStratumServer(t, testStratumConfig(url))
+	m := dialMiner(t, addr)
+	m.login()
+	job := m.getWork()
+
+	if reply := m.submit(job[0], 7); !accepted(reply) {
+		t.Fatalf("Share is rejected: %+v", reply.Error)
+	}
+	// Duplicate is an error, miner is dropped
+	if reply := m.tryCall("eth_submitWork", shareParams(job[0], 7)...); reply != nil && (reply.Error == nil || reply.Error.Code != 22) {
+		t.Errorf("Reply to the same nonce is %+v, want duplicate share", reply.Error)
+	}
+	select {
+	case <-m.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Miner is not dropped on duplicate share")
+	}
+	if n := backend.sharesCount(); n != 1 {
+		t.Errorf("Backend got %v shares, want 1", n)
+	}
+}
+
+func TestStratumDifficultyChangeMidSession(t *testing.T) {
+	node, url := newWorkNode(t, 100)
+	s, backend, addr := newStratumServer(t, testStratumConfig(url))
+	m := dialMiner(t, addr)
+	m.login()
+	m.getWork()
+
+	sessions := s.sessionsSnapshot()
+	if len(sessions) != 1 {
+		t.Fatalf("Proxy has %v sessions, want 1", len(sessions))
+	}
+	sessions[0].setDifficulty(4000)
+	node.setHeight(101)
+	s.fetchBlockTemplate()
+
+	job := m.nextJob()
+	if job[0] != testHeader(101) || job[2] != util.GetTargetHex(4000) {
+		t.Fatalf("Pushed job is %v, want header of height 101 and target of new difficulty", job)
+	}
+	if reply := m.submit(job[0], 1); !accepted(reply) {
+		t.Fatalf("Share is rejected: %+v", reply.Error)
+	}
+	backend.Lock()
+	defer backend.Unlock()
+	if len(backend.shares) != 1 || backend.shares[0].diff != 4000 {
+		t.Errorf("Backend got %+v, want share at 4000", backend.shares)
+	}
+}
+
+func TestStratumReadTimeout(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	cfg := testStratumConfig(url)
+	cfg.Proxy.Stratum.Timeout = "200ms"
+	s, _, addr := newStratumServer(t, cfg)
+	m := dialMiner(t, addr)
+	m.login()
+
+	select {
+	case <-m.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Silent miner is not disconnected")
+	}
+	for i := 0; s.sessionsCount() > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.sessionsCount(); n != 0 {
+		t.Errorf("Proxy has %v sessions after timeout, want 0", n)
+	}
+}
+
+func TestStratumMixedCaseExemptLogin(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	cfg := testStratumConfig(url)
+	cfg.Proxy.Stratum.MaxConnPerLogin = 1
+	cfg.Proxy.Stratum.ExemptLogins = []string{"0x" + strings.ToUpper(testLogin[2:])}
+	_, _, addr := newStratumServer(t, cfg)
+
+	// Limit of connections per login does not apply to exempt one
+	dialMiner(t, addr).login()
+	dialMiner(t, addr).login()
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"math"
+	"time"
+)
+
+// Rate or burst of 0 would refuse every submit
+func (c *SubmitLimit) validate() error {
+	if c.Rate <= 0 {
+		return errors.New("rate must be positive")
+	}
+	if c.Burst <= 0 {
+		return errors.New("burst must be positive")
+	}
+	return nil
+}
+
+// Token bucket of submits per session. First value is false if submit is over limit,
+// second one is false if miner keeps flooding and was banned by policy.
+func (s *ProxyServer) allowSubmit(cs *Session) (bool, bool) {
+	cfg := s.cfg().Proxy.Stratum.SubmitLimit
+	rate, burst := cfg.Rate, float64(cfg.Burst)
+
+	// Miner on lower difficulty than pool default legitimately submits more often
+	if diff := cs.Difficulty(); diff > 0 && diff < s.cfg().Proxy.Difficulty {
+		scale := float64(s.cfg().Proxy.Difficulty) / float64(diff)
+		rate *= scale
+		burst *= scale
+	}
+
+	cs.submitMu.Lock()
+	defer cs.submitMu.Unlock()
+
+	now := time.Now()
+	if cs.lastSubmit.IsZero() {
+		cs.submitTokens = burst
+	} else {
+		cs.submitTokens = math.Min(burst, cs.submitTokens+now.Sub(cs.lastSubmit).Seconds()*rate)
+	}
+	cs.lastSubmit = now
+
+	if cs.submitTokens >= 1 {
+		cs.submitTokens--
+		cs.limitedSubmits = 0
+		return true, true
+	}
+	cs.limitedSubmits++
+	if cfg.ReportAfter > 0 && cs.limitedSubmits >= cfg.ReportAfter {
+		log.Printf("Submit flood from %v@%v", cs.login, cs.ip)
+		cs.limitedSubmits = 0
+		return false, s.policy.ApplyMalformedPolicy(cs.ip)
+	}
+	return false, true
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+)
+
+const defaultUpstreamRotateInterval = 10 * time.Minute
+
+// Policy is built from config on each check, so reload applies at once
+func (s *ProxyServer) checkUpstreams() {
+	cfg := s.cfg()
+	policy := rpc.FailoverPolicy{
+		Strategy:       cfg.UpstreamStrategy,
+		RecoverChecks:  cfg.UpstreamRecoverChecks,
+		FailChecks:     cfg.UpstreamFailChecks,
+		MaxLag:         cfg.UpstreamMaxLag,
+		RotateInterval: s.upstreamRotateInterval(),
+		Verify: func(upstream *rpc.RPCClient) error {
+			if err := s.verifyChain(upstream); err != nil {
+				return fmt.Errorf("wrong chain, %v", err)
+			}
+			return nil
+		},
+	}
+	from, to, switched := s.upstreams.Check(policy)
+	if !switched {
+		return
+	}
+	if err := s.backend.WriteUpstreamSwitch(cfg.Name, from, to); err != nil {
+		log.Printf("Failed to write upstream switch to backend: %v", err)
+	}
+}
+
+func (s *ProxyServer) upstreamRotateInterval() time.Duration {
+	// Validated on start and reload
+	if interval := s.cfg().UpstreamRotateInterval; len(interval) > 0 {
+		d, _ := time.ParseDuration(interval)
+		return d
+	}
+	return defaultUpstreamRotateInterval
+}
+
+// Health and latency of each upstream, reported in node state
+func (s *ProxyServer) upstreamStats() map[string]int64 {
+	active := s.rpc()
+	stats := make(map[string]int64)
+	stats["upstreamSwitchedAt"] = s.upstreams.SwitchedAt()
+	for v, h := range s.upstreams.Health() {
+		height, _ := v.ChainState()
+		m := v.Metrics()
+		prefix := "upstream." + v.Name + "."
+		stats["upstreamLag."+v.Name] = h.Lag
+		stats[prefix+"active"] = boolToInt(v == active)
+		stats[prefix+"healthy"] = boolToInt(h.Healthy)
+		stats[prefix+"lastCheck"] = boolToInt(h.FailChecks == 0 && h.OkChecks > 0)
+		stats[prefix+"failChecks"] = int64(h.FailChecks)
+		stats[prefix+"height"] = int64(height)
+		stats[prefix+"requests"] = m.Requests
+		stats[prefix+"failures"] = m.Failures
+		stats[prefix+"getWorkAvgMs"] = int64(m.GetWorkAvg / time.Millisecond)
+		stats[prefix+"getWorkP95Ms"] = int64(m.GetWorkP95 / time.Millisecond)
+		stats[prefix+"submitAvgMs"] = int64(m.SubmitAvg / time.Millisecond)
+		stats[prefix+"submitP95Ms"] = int64(m.SubmitP95 / time.Millisecond)
+	}
+	return stats
+}
+
+func boolToInt(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// Pool pointed at node of another network would never unlock its blocks
+func (s *ProxyServer) verifyChain(upstream *rpc.RPCClient) error {
+	if expected := s.cfg().ChainId; expected > 0 {
+		chainId, err := upstream.GetChainId()
+		if err != nil {
+			return fmt.Errorf("can't get chain id: %v", err)
+		}
+		if chainId != expected {
+			return fmt.Errorf("chain id %d, expected %d", chainId, expected)
+		}
+	}
+	if expected := s.cfg().GenesisHash; len(expected) > 0 {
+		hash, err := upstream.GetGenesisHash()
+		if err != nil {
+			return fmt.Errorf("can't get genesis block: %v", err)
+		}
+		if !strings.EqualFold(hash, expected) {
+			return fmt.Errorf("genesis %s, expected %s", hash, expected)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Saved difficulty of worker expires after this time by default
+const defaultPersistTTL = time.Hour
+
+// Shares at previous difficulty are accepted for this time after new target is pushed
+const retargetGrace = 30 * time.Second
+
+type shareSample struct {
+	ts    time.Time
+	diff  int64
+	stale bool
+}
+
+func (s *ProxyServer) startVarDiff() {
+	cfg := s.cfg().Proxy.Stratum.VarDiff
+	log.Printf("Set vardiff retarget every %v targeting %v shares per minute over %v", cfg.RetargetInterval, cfg.SharesPerMin, cfg.Window)
+
+	s.runLoop(func() string { return s.cfg().Proxy.Stratum.VarDiff.RetargetInterval }, func() {
+		cfg := s.cfg().Proxy.Stratum.VarDiff
+		s.retargetSessions(util.MustParseDuration(cfg.Window), util.MustParseDuration(cfg.RetargetInterval))
+	})
+}
+
+func (s *ProxyServer) retargetSessions(window, retargetIntv time.Duration) {
+	sessions := s.sessionsSnapshot()
+
+	now := time.Now()
+	for _, cs := range sessions {
+		// Miner has pinned own difficulty
+		if cs.staticDiff {
+			continue
+		}
+		prevDiff := cs.Difficulty()
+		newDiff, ok := s.calcRetarget(cs, now, window, retargetIntv)
+		if !ok {
+			continue
+		}
+		cs.setDifficulty(newDiff)
+		log.Printf("Retarget %v@%v difficulty %v => %v", cs.login, cs.ip, prevDiff, newDiff)
+		s.saveDifficulty(cs)
+		s.pushTarget(cs)
+	}
+}
+
+// Stratum-Proxy has no difficulty notification, so current job is pushed again with new target
+func (s *ProxyServer) pushTarget(cs *Session) {
+	t := s.currentBlockTemplate()
+	if t == nil || len(t.Header) == 0 || s.isSick() {
+		return
+	}
+	reply := []string{t.Header, t.Seed, cs.issueWork(t)}
+	if err := cs.pushNewJob(&reply); err != nil {
+		log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+		cs.conn.Close()
+		s.removeSession(cs)
+	}
+}
+
+// Estimate hashrate from accepted shares in window and find difficulty
+// which would produce configured number of shares per minute
+func (s *ProxyServer) calcRetarget(cs *Session, now time.Time, window, retargetIntv time.Duration) (int64, bool) {
+	cfg := s.cfg().Proxy.Stratum.VarDiff
+
+	cs.sharesMu.Lock()
+	defer cs.sharesMu.Unlock()
+
+	if now.Sub(cs.lastRetarget) < retargetIntv {
+		return 0, false
+	}
+
+	from := now.Add(-window)
+	var hashes float64
+	for _, share := range cs.shares {
+		if !share.ts.Before(from) {
+			hashes += float64(share.diff)
+		}
+	}
+
+	if cs.varDiffSince.After(from) {
+		from = cs.varDiffSince
+	}
+	elapsed := now.Sub(from).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	current := float64(cs.Difficulty())
+	target := hashes / elapsed * 60 / cfg.SharesPerMin
+
+	// Bound change per step to avoid oscillation
+	if cfg.MaxFactor > 1 {
+		target = math.Max(target, current/cfg.MaxFactor)
+		target = math.Min(target, current*cfg.MaxFactor)
+	}
+	newDiff := s.clampDifficulty(int64(target))
+
+	if math.Abs(float64(newDiff)-current)/current*100 < cfg.Variance {
+		return 0, false
+	}
+	cs.lastRetarget = now
+	return newDiff, true
+}
+
+func (s *ProxyServer) clampDifficulty(diff int64) int64 {
+	cfg := s.cfg().Proxy.Stratum.VarDiff
+	if cfg.MinDiff > 0 && diff < cfg.MinDiff {
+		return cfg.MinDiff
+	}
+	if cfg.MaxDiff > 0 && diff > cfg.MaxDiff {
+		return cfg.MaxDiff
+	}
+	if diff < 1 {
+		return 1
+	}
+	return diff
+}
+
+// Vardiff bounds apply with vardiff on, bounds of port otherwise
+func (s *ProxyServer) clampSuggestedDifficulty(cs *Session, diff int64) int64 {
+	if s.cfg().Proxy.Stratum.VarDiff.Enabled {
+		return s.clampDifficulty(diff)
+	}
+	if diff < cs.minDiff {
+		return cs.minDiff
+	}
+	if cs.maxDiff > 0 && diff > cs.maxDiff {
+		return cs.maxDiff
+	}
+	if diff < 1 {
+		return 1
+	}
+	return diff
+}
+
+func (s *ProxyServer) persistDifficulty() bool {
+	cfg := s.cfg().Proxy.Stratum.VarDiff
+	return cfg.Enabled && cfg.Persist
+}
+
+// Seed difficulty of logged in miner with the one it had before reconnect
+func (s *ProxyServer) restoreDifficulty(cs *Session) {
+	if !s.persistDifficulty() || cs.staticDiff {
+		return
+	}
+	diff, err := s.backend.GetWorkerDifficulty(cs.login, cs.worker)
+	if err != nil {
+		log.Printf("Failed to get difficulty of %v.%v from backend: %v", cs.login, cs.worker, err)
+		return
+	}
+	if diff > 0 {
+		cs.setDifficulty(s.clampDifficulty(diff))
+	}
+}
+
+func (s *ProxyServer) saveDifficulty(cs *Session) {
+	if !s.persistDifficulty() || cs.staticDiff {
+		return
+	}
+	err := s.backend.WriteWorkerDifficulty(cs.login, cs.worker, cs.Difficulty(), s.diffTTL)
+	if err != nil {
+		log.Printf("Failed to save difficulty of %v.%v to backend: %v", cs.login, cs.worker, err)
+	}
+}
+
+func (cs *Session) startVarDiff() {
+	cs.sharesMu.Lock()
+	defer cs.sharesMu.Unlock()
+	now := time.Now()
+	cs.varDiffSince = now
+	cs.lastRetarget = now
+}
+
+// Samples are kept for the longest window of vardiff and hashrate message
+func (s *ProxyServer) sharesWindow() time.Duration {
+	cfg := s.cfg().Proxy.Stratum
+	var window time.Duration
+	if cfg.VarDiff.Enabled {
+		window = util.MustParseDuration(cfg.VarDiff.Window)
+	}
+	if cfg.HashrateMessage.Enabled {
+		if w := util.MustParseDuration(cfg.HashrateMessage.Window); w > window {
+			window = w
+		}
+	}
+	return window
+}
+
+func (cs *Session) trackShare(diff int64, stale bool, window time.Duration) {
+	cs.sharesMu.Lock()
+	defer cs.sharesMu.Unlock()
+	now := time.Now()
+
+	from := now.Add(-window)
+	i := 0
+	for i < len(cs.shares) && cs.shares[i].ts.Before(from) {
+		i++
+	}
+	cs.shares = append(cs.shares[i:], shareSample{ts: now, diff: diff, stale: stale})
+}
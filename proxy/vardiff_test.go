@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CryptoManiac/ethash"
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/CryptoManiac/open-ethereum-pool/policy"
+	"github.com/CryptoManiac/open-ethereum-pool/rpc"
+	"github.com/CryptoManiac/open-ethereum-pool/storage"
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Share meets exactly the target it was verified against
+type targetHasher struct{}
+
+func (targetHasher) VerifyShare(block ethash.Block, shareDiff *big.Int) (bool, bool, int64, common.Hash) {
+	return true, false, shareDiff.Int64(), common.Hash{}
+}
+
+type writtenShare struct {
+	login, id string
+	diff      int64
+	stale     bool
+}
+
+// Shares as they reach storage, other methods of storage are not called
+type shareBackend struct {
+	storage.Storage
+	sync.Mutex
+	shares []writtenShare
+	// Rejected shares
+	invalid, stale int
+}
+
+func (b *shareBackend) GetBlacklist() ([]string, error) { return nil, nil }
+func (b *shareBackend) GetWhitelist() ([]string, error) { return nil, nil }
+
+func (b *shareBackend) WriteShare(login, id string, params []string, diff int64, actualDiff int64, rate float64, height, topHeight uint64, stale, solo bool, window time.Duration) (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.shares = append(b.shares, writtenShare{login, id, diff, stale})
+	return false, nil
+}
+
+func (b *shareBackend) WriteInvalidShare(login, id string, expire time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+	b.invalid++
+	return nil
+}
+
+func (b *shareBackend) WriteStaleShare(login, id string, expire time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+	b.stale++
+	return nil
+}
+
+// Sums behind worker validDiff and staleDiff counters
+func (b *shareBackend) totals() (map[string]int64, map[string]int64) {
+	b.Lock()
+	defer b.Unlock()
+	valid, stale := make(map[string]int64), make(map[string]int64)
+	for _, v := range b.shares {
+		if v.stale {
+			stale[v.login+"."+v.id] += v.diff
+		} else {
+			valid[v.login+"."+v.id] += v.diff
+		}
+	}
+	return valid, stale
+}
+
+func newShareServer(t *testing.T) (*ProxyServer, *shareBackend) {
+	prev := hasher
+	hasher = targetHasher{}
+	t.Cleanup(func() { hasher = prev })
+
+	rewards, err := util.NewRewardSchedule(util.RewardsEthereum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &shareBackend{}
+	cfg := &Config{Proxy: Proxy{Difficulty: 1000}}
+	cfg.Proxy.Stratum.VarDiff = VarDiff{Enabled: true, Window: "5m", RetargetInterval: "1m"}
+	s := &ProxyServer{
+		backend:  backend,
+		policy:   policy.Start(testPolicyConfig(), backend),
+		verifier: newShareVerifier(),
+		rewards:  rewards,
+		sessions: make(map[*Session]struct{}),
+	}
+	s.config.Store(cfg)
+	return s, backend
+}
+
+func testPolicyConfig() *policy.Config {
+	return &policy.Config{
+		ResetInterval:   "1h",
+		RefreshInterval: "1h",
+		Banning:         policy.Banning{InvalidPercent: 30, CheckThreshold: 30},
+		Limits:          policy.Limits{Grace: "1s"},
+	}
+}
+
+func (s *ProxyServer) newTestJob(height uint64) string {
+	header := testHeader(height)
+	reply := []string{header, fmt.Sprintf("0x%064x", 0), util.GetTargetHex(1000000)}
+	s.storeTemplate(s.currentBlockTemplate(), rpc.NewRPCClient("test", "http://127.0.0.1:0", "1s"), reply, height, 1000000, &rpc.GetBlockReplyPart{})
+	return header
+}
+
+func (s *ProxyServer) newTestSession(login, worker string, diff int64) *Session {
+	cs := &Session{ip: "10.0.0.1", login: login, worker: worker, difficulty: diff}
+	s.sessions[cs] = struct{}{}
+	return cs
+}
+
+func submitTestShare(t *testing.T, s *ProxyServer, cs *Session, header string, nonce uint64) {
+	s.handleTCPSubmitRPC(cs, "", shareParams(header, nonce), func(ok bool, err *ErrorReply) {
+		if !ok || err != nil {
+			t.Errorf("Share %v of %v is rejected: %v", nonce, cs.worker, err)
+		}
+	})
+}
+
+func TestMixedDifficultySessionTotals(t *testing.T) {
+	s, backend := newShareServer(t)
+	header := s.newTestJob(100)
+	low := s.newTestSession("0xa", "low", 1000)
+	high := s.newTestSession("0xa", "high", 4000)
+	low.issueWork(s.currentBlockTemplate())
+	high.issueWork(s.currentBlockTemplate())
+
+	for i := uint64(1); i <= 4; i++ {
+		submitTestShare(t, s, low, header, i)
+	}
+	submitTestShare(t, s, high, header, 5)
+
+	// Retarget of low session comes with next job, share of previous height is stale
+	next := s.newTestJob(101)
+	low.setDifficulty(4000)
+	low.issueWork(s.currentBlockTemplate())
+	submitTestShare(t, s, low, next, 6)
+	submitTestShare(t, s, high, header, 7)
+
+	// Four shares at quarter of difficulty weigh as one
+	valid, stale := backend.totals()
+	if valid["0xa.low"] != 8000 || valid["0xa.high"] != 4000 {
+		t.Errorf("Valid totals are %v, want 8000 of low and 4000 of high", valid)
+	}
+	if stale["0xa.high"] != 4000 || len(stale) != 1 {
+		t.Errorf("Stale totals are %v, want 4000 of high", stale)
+	}
+	if n := len(backend.shares); n != 7 {
+		t.Errorf("Backend got %v shares, want 7", n)
+	}
+}
+
+func TestShareInFlightKeepsIssuedDifficulty(t *testing.T) {
+	s, backend := newShareServer(t)
+	header := s.newTestJob(100)
+	cs := s.newTestSession("0xa", "rig", 1000)
+	cs.issueWork(s.currentBlockTemplate())
+
+	// Same job is pushed again with higher target, shares found at previous one are in flight
+	cs.setDifficulty(4000)
+	cs.issueWork(s.currentBlockTemplate())
+	submitTestShare(t, s, cs, header, 1)
+
+	cs.workMu.Lock()
+	cs.workDiff[header].prevUntil = time.Now().Add(-time.Second)
+	cs.workMu.Unlock()
+	submitTestShare(t, s, cs, header, 2)
+
+	// Lower target applies at once, shares at higher one meet it too
+	cs.setDifficulty(2000)
+	cs.issueWork(s.currentBlockTemplate())
+	submitTestShare(t, s, cs, header, 3)
+
+	backend.Lock()
+	defer backend.Unlock()
+	for i, want := range []int64{1000, 4000, 2000} {
+		if i >= len(backend.shares) {
+			t.Fatalf("Backend got %v shares, want 3", len(backend.shares))
+		}
+		if got := backend.shares[i].diff; got != want {
+			t.Errorf("Share %v is credited at %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestRetargetPushesNewTarget(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	s, backend, addr := newStratumServer(t, testStratumConfig(url))
+	m := dialMiner(t, addr)
+	m.login()
+	job := m.getWork()
+
+	cs := s.sessionsSnapshot()[0]
+	cs.setDifficulty(4000)
+	s.pushTarget(cs)
+	pushed := m.nextJob()
+	if pushed[0] != job[0] || pushed[2] != util.GetTargetHex(4000) {
+		t.Fatalf("Pushed work is %v, want the same job with target of 4000", pushed)
+	}
+
+	// Share found at previous target is still in flight
+	if reply := m.submit(job[0], 1); !accepted(reply) {
+		t.Fatalf("Share at previous target is rejected: %+v", reply.Error)
+	}
+	backend.Lock()
+	defer backend.Unlock()
+	if len(backend.shares) != 1 || backend.shares[0].diff != 1000 {
+		t.Errorf("Backend got %+v, want share at 1000", backend.shares)
+	}
+}
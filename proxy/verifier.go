@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"math/big"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CryptoManiac/ethash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	verifyQueueSize = 4096
+	latencySamples  = 1024
+)
+
+// Tests replace ethash, DAG is too expensive to build for them
+type shareHasher interface {
+	VerifyShare(block ethash.Block, shareDiff *big.Int) (bool, bool, int64, common.Hash)
+}
+
+type verifyTask struct {
+	share  Block
+	diff   int64
+	queued time.Time
+	reply  chan verifyResult
+}
+
+type verifyResult struct {
+	isShare    bool
+	isBlock    bool
+	actualDiff int64
+}
+
+// Hashimoto is CPU bound, so shares are verified by fixed number of workers
+// instead of goroutine of each submit
+type shareVerifier struct {
+	tasks chan *verifyTask
+
+	latencyMu sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func newShareVerifier() *shareVerifier {
+	v := &shareVerifier{
+		tasks:     make(chan *verifyTask, verifyQueueSize),
+		latencies: make([]time.Duration, 0, latencySamples),
+	}
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go v.work()
+	}
+	return v
+}
+
+func (v *shareVerifier) work() {
+	for task := range v.tasks {
+		isShare, isBlock, actualDiff, _ := hasher.VerifyShare(task.share, big.NewInt(task.diff))
+		v.trackLatency(time.Since(task.queued))
+		task.reply <- verifyResult{isShare: isShare, isBlock: isBlock, actualDiff: actualDiff}
+	}
+}
+
+// Blocks until share is verified, submitter waits if queue is full
+func (v *shareVerifier) verify(share Block, diff int64) (bool, bool, int64) {
+	task := &verifyTask{share: share, diff: diff, queued: time.Now(), reply: make(chan verifyResult, 1)}
+	v.tasks <- task
+	r := <-task.reply
+	return r.isShare, r.isBlock, r.actualDiff
+}
+
+func (v *shareVerifier) trackLatency(d time.Duration) {
+	v.latencyMu.Lock()
+	defer v.latencyMu.Unlock()
+	if len(v.latencies) < latencySamples {
+		v.latencies = append(v.latencies, d)
+	} else {
+		v.latencies[v.next] = d
+	}
+	v.next = (v.next + 1) % latencySamples
+}
+
+func (v *shareVerifier) queueDepth() int64 {
+	return int64(len(v.tasks))
+}
+
+// Over last verified shares, including time spent in queue
+func (v *shareVerifier) latencyP99() time.Duration {
+	v.latencyMu.Lock()
+	samples := make([]time.Duration, len(v.latencies))
+	copy(samples, v.latencies)
+	v.latencyMu.Unlock()
+
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[len(samples)*99/100]
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stratum over WebSocket for miners behind firewalls which allow only HTTPS,
+// TLS is expected to be terminated by reverse proxy
+func (s *ProxyServer) ListenWebSocket() {
+	cfg := s.cfg().Proxy.Stratum.WebSocket
+	path := cfg.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	diff := cfg.Difficulty
+	if diff <= 0 {
+		diff = s.cfg().Proxy.Difficulty
+	}
+	minDiff := cfg.MinDiff
+	if minDiff <= 0 {
+		minDiff = diff
+	}
+	maxConn := cfg.MaxConn
+	if maxConn <= 0 {
+		maxConn = s.cfg().Proxy.Stratum.MaxConn
+	}
+	accept := make(chan struct{}, maxConn)
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  MaxReqSize,
+		WriteBufferSize: MaxReqSize,
+		// Miners are not browsers, there is no origin to check
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ip := s.remoteAddr(r)
+		if !s.allowConn(ip) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		select {
+		case accept <- struct{}{}:
+			defer func() { <-accept }()
+		default:
+			s.rejects.add(rejectPoolFull, ip)
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade error from %s: %v", ip, err)
+			s.rejects.add(rejectWSUpgrade, ip)
+			return
+		}
+		ws.SetReadLimit(MaxReqSize)
+		cs := &Session{conn: &wsConn{Conn: ws}, ip: ip, difficulty: diff, minDiff: minDiff, maxDiff: cfg.MaxDiff, protocol: "websocket"}
+		s.serveSession(cs)
+	})
+
+	server, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	s.registerListener(server)
+	log.Printf("Stratum WebSocket listening on %s%s with difficulty %v", cfg.Listen, path, diff)
+
+	srv := &http.Server{Handler: mux, MaxHeaderBytes: s.cfg().Proxy.LimitHeadersSize}
+	err = srv.Serve(server)
+	if err != nil && !s.isDraining() {
+		log.Fatalf("Failed to start WebSocket stratum: %v", err)
+	}
+}
+
+// Adapts WebSocket to line based stratum, each frame carries single JSON message
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			c.r = io.MultiReader(r, strings.NewReader("\n"))
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// JSON encoder writes whole message with trailing newline at once
+func (c *wsConn) Write(b []byte) (int, error) {
+	err := c.WriteMessage(websocket.TextMessage, bytes.TrimRight(b, "\n"))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const defaultWriteQueue = 64
+
+var (
+	errWriteQueueFull = errors.New("Write queue is full")
+	errSessionClosed  = errors.New("Session is closed")
+)
+
+// Each stratum session has own writer, so slow miner can't block
+// reader goroutine or broadcast with full TCP buffer
+func (cs *Session) startWriter(size int, timeout time.Duration) {
+	if size <= 0 {
+		size = defaultWriteQueue
+	}
+	cs.out = make(chan interface{}, size)
+	cs.quit = make(chan struct{})
+	cs.done = make(chan struct{})
+	go cs.writeLoop(timeout)
+}
+
+func (cs *Session) writeLoop(timeout time.Duration) {
+	defer close(cs.done)
+	for {
+		select {
+		case message := <-cs.out:
+			cs.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err := cs.enc.Encode(message); err != nil {
+				// Half-open connection is detected here, TCP keepalive may take much longer
+				atomic.StoreInt32(&cs.writeFailed, 1)
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					log.Printf("Write timeout to %v@%v after %v, dropping session", cs.login, cs.ip, timeout)
+				} else {
+					log.Printf("Write error to %v@%v: %v", cs.login, cs.ip, err)
+				}
+				cs.conn.Close()
+				return
+			}
+		case <-cs.quit:
+			cs.flushWrites(timeout)
+			return
+		}
+	}
+}
+
+// Deliver replies queued before disconnect, e.g. error message
+func (cs *Session) flushWrites(timeout time.Duration) {
+	cs.conn.SetWriteDeadline(time.Now().Add(timeout))
+	for {
+		select {
+		case message := <-cs.out:
+			if err := cs.enc.Encode(message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Miner which doesn't read what we send is dead, connection is closed
+func (cs *Session) enqueue(message interface{}) error {
+	if atomic.LoadInt32(&cs.writeFailed) > 0 {
+		return errSessionClosed
+	}
+	select {
+	case <-cs.quit:
+		return errSessionClosed
+	default:
+	}
+	select {
+	case cs.out <- message:
+		return nil
+	default:
+		cs.conn.Close()
+		return errWriteQueueFull
+	}
+}
+
+// Blocks until writer has flushed queue and exited
+func (cs *Session) stopWriter() {
+	cs.stopOnce.Do(func() {
+		close(cs.quit)
+	})
+	<-cs.done
+}
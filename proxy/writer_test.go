@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Miner whose network path died silently: it sent login and reads nothing since
+func TestWriteTimeoutEvictsUnreadClient(t *testing.T) {
+	_, url := newWorkNode(t, 100)
+	cfg := testStratumConfig(url)
+	cfg.Proxy.Stratum.WriteTimeout = "200ms"
+	cfg.Proxy.Stratum.WriteBuffer = 4096
+	// Queue must not fill up first, it is the deadline which is tested
+	cfg.Proxy.Stratum.WriteQueue = 100000
+	s, _, addr := newStratumServer(t, cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	if _, err := conn.Write([]byte(`{"id":1,"jsonrpc":"2.0","method":"eth_submitLogin","params":["` + testLogin + `"]}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	var cs *Session
+	for i := 0; cs == nil && i < 100; i++ {
+		if sessions := s.sessionsSnapshot(); len(sessions) > 0 {
+			cs = sessions[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cs == nil {
+		t.Fatal("Miner is not logged in")
+	}
+
+	// Jobs pile up in socket buffers until write blocks
+	start := time.Now()
+	for i := 0; i < 10000 && s.isRegistered(cs); i++ {
+		s.pushTarget(cs)
+	}
+	for s.isRegistered(cs) && time.Since(start) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.isRegistered(cs) {
+		t.Fatal("Unread miner is not evicted")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Unread miner is evicted after %v, write timeout is 200ms", elapsed)
+	}
+	if err := cs.enqueue(&JSONPushMessage{}); err != errSessionClosed {
+		t.Errorf("Write to evicted session gives %v, want %v", err, errSessionClosed)
+	}
+}
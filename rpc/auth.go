@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Credentials of upstream, at most one kind is used, JWT takes precedence over token and token over basic auth
+type Auth struct {
+	Username  string
+	Password  string
+	Token     string
+	JwtSecret string
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (a *Auth) Validate() error {
+	if len(a.JwtSecret) == 0 {
+		return nil
+	}
+	secret, err := hex.DecodeString(strings.TrimPrefix(a.JwtSecret, "0x"))
+	if err != nil {
+		return fmt.Errorf("JWT secret is not hex: %v", err)
+	}
+	if len(secret) == 0 {
+		return errors.New("JWT secret is empty")
+	}
+	return nil
+}
+
+// Authorization header value, JWT is issued for each request as node checks freshness of iat
+func (a *Auth) header(now time.Time) string {
+	switch {
+	case len(a.JwtSecret) > 0:
+		secret, _ := hex.DecodeString(strings.TrimPrefix(a.JwtSecret, "0x"))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"iat":%d}`, now.Unix())))
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(jwtHeader + "." + payload))
+		return "Bearer " + jwtHeader + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	case len(a.Token) > 0:
+		return "Bearer " + a.Token
+	case len(a.Username) > 0:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Username+":"+a.Password))
+	}
+	return ""
+}
+
+func (a *Auth) apply(h http.Header) {
+	if value := a.header(time.Now()); len(value) > 0 {
+		h.Set("Authorization", value)
+	}
+}
+
+// Credentials embedded in URL must not get into logs
+func RedactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "<invalid url>"
+	}
+	if u.User != nil {
+		u.User = url.User("xxx")
+	}
+	return u.String()
+}
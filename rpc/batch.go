@@ -0,0 +1,178 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var errBatchRejected = errors.New("Batch request is not supported by node")
+
+type BatchElem struct {
+	Method string
+	Params interface{}
+	// Pointer to decode result into, result is left untouched if node replied null
+	Result interface{}
+	Error  error
+}
+
+// Elements are filled in place, error is returned only if whole batch failed.
+// Timeout is for the whole batch. Node rejecting batches is asked sequentially from then on.
+func (r *RPCClient) BatchCall(elems []BatchElem, timeout time.Duration) error {
+	if len(elems) == 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = r.methodTimeout(elems[0].Method)
+	}
+	deadline := time.Now().Add(timeout)
+	if r.ipc == nil && atomic.LoadInt32(&r.noBatch) == 0 {
+		err := r.postBatch(elems, timeout)
+		if err != errBatchRejected {
+			if err != nil {
+				r.markSick()
+			}
+			return err
+		}
+		atomic.StoreInt32(&r.noBatch, 1)
+		log.Printf("Upstream %s rejected batch request, falling back to sequential calls", r.Name)
+	}
+	for i := range elems {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("Batch timed out after %d of %d calls", i, len(elems))
+		}
+		rpcResp, err := r.post(r.Url, elems[i].Method, elems[i].Params, remaining, true)
+		elems[i].Error = decodeResult(rpcResp, err, elems[i].Result)
+	}
+	return nil
+}
+
+func (r *RPCClient) postBatch(elems []BatchElem, timeout time.Duration) error {
+	batch := make([]map[string]interface{}, len(elems))
+	for i, elem := range elems {
+		batch[i] = map[string]interface{}{"jsonrpc": "2.0", "method": elem.Method, "params": elem.Params, "id": i}
+	}
+	data, _ := json.Marshal(batch)
+
+	req, err := http.NewRequest("POST", r.Url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	r.Auth.apply(req.Header)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	// Batch is not put into latency samples, it would skew upstream selection
+	atomic.AddInt64(&r.metrics.requests, 1)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&r.metrics.failures, 1)
+		return err
+	}
+	defer resp.Body.Close()
+	// Node without batch support replies with client error status or single error object
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return errBatchRejected
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		atomic.AddInt64(&r.metrics.failures, 1)
+		return err
+	}
+	var replies []JSONRpcResp
+	if err := json.Unmarshal(raw, &replies); err != nil {
+		return errBatchRejected
+	}
+
+	received := make([]bool, len(elems))
+	for i := range replies {
+		var id int
+		if replies[i].Id == nil || json.Unmarshal(*replies[i].Id, &id) != nil || id < 0 || id >= len(elems) {
+			continue
+		}
+		received[id] = true
+		elems[id].Error = decodeResult(&replies[i], nil, elems[id].Result)
+	}
+	for i := range elems {
+		if !received[i] {
+			elems[i].Error = errors.New("No reply in batch")
+		}
+	}
+	return nil
+}
+
+func decodeResult(rpcResp *JSONRpcResp, err error, result interface{}) error {
+	if err != nil {
+		return err
+	}
+	if rpcResp.Error != nil {
+		return newRPCError(rpcResp.Error)
+	}
+	if rpcResp.Result == nil || result == nil {
+		return nil
+	}
+	return json.Unmarshal(*rpcResp.Result, result)
+}
+
+// Blocks in order of heights, nil for unknown ones. Calls are split in batches of batchSize.
+func (r *RPCClient) GetBlocksByHeight(heights []int64, batchSize int) ([]*GetBlockReply, error) {
+	elems := make([]BatchElem, len(heights))
+	replies := make([]*GetBlockReply, len(heights))
+	for i, height := range heights {
+		elems[i] = BatchElem{Method: "eth_getBlockByNumber", Params: []interface{}{fmt.Sprintf("0x%x", height), true}, Result: &replies[i]}
+	}
+	return replies, r.batchChunks(elems, batchSize)
+}
+
+// Uncles of block at height by index, nil for unknown ones
+func (r *RPCClient) GetUnclesByBlockNumber(height int64, count, batchSize int) ([]*GetBlockReply, error) {
+	elems := make([]BatchElem, count)
+	replies := make([]*GetBlockReply, count)
+	for i := 0; i < count; i++ {
+		params := []interface{}{fmt.Sprintf("0x%x", height), fmt.Sprintf("0x%x", i)}
+		elems[i] = BatchElem{Method: "eth_getUncleByBlockNumberAndIndex", Params: params, Result: &replies[i]}
+	}
+	return replies, r.batchChunks(elems, batchSize)
+}
+
+// Receipts in order of hashes, nil for unknown transactions
+func (r *RPCClient) GetTxReceipts(hashes []string, batchSize int) ([]*TxReceipt, error) {
+	elems := make([]BatchElem, len(hashes))
+	replies := make([]*TxReceipt, len(hashes))
+	for i, hash := range hashes {
+		elems[i] = BatchElem{Method: "eth_getTransactionReceipt", Params: []string{hash}, Result: &replies[i]}
+	}
+	return replies, r.batchChunks(elems, batchSize)
+}
+
+// First failed element is reported, so caller can't take missing reply for unknown block
+func (r *RPCClient) batchChunks(elems []BatchElem, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = len(elems)
+	}
+	for start := 0; start < len(elems); start += batchSize {
+		end := start + batchSize
+		if end > len(elems) {
+			end = len(elems)
+		}
+		if err := r.BatchCall(elems[start:end], 0); err != nil {
+			return err
+		}
+	}
+	for _, elem := range elems {
+		if elem.Error != nil {
+			return elem.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Block of requested height, heights above 16 are unknown
+func blocksNode(t *testing.T) (*testNode, *RPCClient) {
+	return newTestNode(t, map[string]func([]json.RawMessage) interface{}{
+		"eth_getBlockByNumber": func(params []json.RawMessage) interface{} {
+			var height string
+			json.Unmarshal(params[0], &height)
+			if n, _ := strconv.ParseUint(strings.TrimPrefix(height, "0x"), 16, 64); n > 16 {
+				return nil
+			}
+			return map[string]interface{}{"number": height}
+		},
+	})
+}
+
+func TestBatchCallMatchesRepliesById(t *testing.T) {
+	node, client := blocksNode(t)
+	var first, second *GetBlockReply
+	var missing interface{}
+	elems := []BatchElem{
+		{Method: "eth_getBlockByNumber", Params: []interface{}{"0x1", true}, Result: &first},
+		{Method: "eth_getBlockByNumber", Params: []interface{}{"0x2", true}, Result: &second},
+		{Method: "eth_unknown", Params: []interface{}{}, Result: &missing},
+	}
+	if err := client.BatchCall(elems, 0); err != nil {
+		t.Fatal(err)
+	}
+	if node.batchCount() != 1 {
+		t.Errorf("Node got %v batches, want 1", node.batchCount())
+	}
+	if first == nil || first.Number != "0x1" || second == nil || second.Number != "0x2" {
+		t.Errorf("Replies are %+v and %+v, want blocks 0x1 and 0x2", first, second)
+	}
+	if elems[0].Error != nil || elems[1].Error != nil {
+		t.Errorf("Errors of known methods: %v, %v", elems[0].Error, elems[1].Error)
+	}
+	if elems[2].Error == nil {
+		t.Error("Error of unknown method is not reported")
+	}
+}
+
+func TestBatchCallFallsBackToSequential(t *testing.T) {
+	node, client := blocksNode(t)
+	node.Lock()
+	node.noBatch = true
+	node.Unlock()
+	for i := 0; i < 2; i++ {
+		blocks, err := client.GetBlocksByHeight([]int64{1, 2, 3}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, block := range blocks {
+			if block == nil {
+				t.Errorf("No block %v", j+1)
+			}
+		}
+	}
+	// Node is not asked for batch again once it refused one
+	if node.batchCount() != 1 {
+		t.Errorf("Node got %v batches, want 1", node.batchCount())
+	}
+	if got := node.count("eth_getBlockByNumber"); got != 6 {
+		t.Errorf("Node got %v calls, want 6", got)
+	}
+}
+
+func TestBatchChunks(t *testing.T) {
+	node, client := blocksNode(t)
+	blocks, err := client.GetBlocksByHeight([]int64{14, 15, 16, 17, 18}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.batchCount() != 3 {
+		t.Errorf("Node got %v batches, want 3", node.batchCount())
+	}
+	// Unknown heights are nil, not errors
+	for i, block := range blocks {
+		if known := i < 3; known != (block != nil) {
+			t.Errorf("Block %v is %+v", 14+i, block)
+		}
+	}
+}
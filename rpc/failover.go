@@ -0,0 +1,270 @@
+package rpc
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	StrategyPriority   = "priority"
+	StrategyRoundRobin = "round-robin"
+	StrategyLatency    = "latency"
+)
+
+// Set of nodes with background health checks, one of healthy ones is active.
+// Proxy keeps one for mining nodes and payouts another one for wallet nodes.
+type Failover struct {
+	// Serializes checks, so health is updated by one of them at a time
+	mu         sync.Mutex
+	clients    atomic.Value
+	current    int32
+	health     map[*RPCClient]*nodeHealth
+	switchedAt int64
+	// Since when active node serves, round-robin rotates by it
+	selectedAt int64
+}
+
+// Read on each check, so reload applies at once
+type FailoverPolicy struct {
+	Strategy      string
+	RecoverChecks int
+	FailChecks    int
+	// Blocks behind best node, 0 disables
+	MaxLag int
+	// Round-robin moves to next healthy node once active one served this long, 0 keeps it while healthy
+	RotateInterval time.Duration
+	// Node check, Check of client is used if not set
+	Check func(*RPCClient) bool
+	// Verified after each failed check, so node replaced behind the same url is caught
+	Verify func(*RPCClient) error
+}
+
+// Copy of node health for reports
+type NodeHealth struct {
+	Healthy    bool
+	OkChecks   int
+	FailChecks int
+	// Blocks behind best node
+	Lag int64
+}
+
+// Consecutive check results, node flapping between states is not switched to and away on every check
+type nodeHealth struct {
+	NodeHealth
+	// Reason of last failed check
+	reason   string
+	verified bool
+}
+
+func (h *nodeHealth) update(ok bool, recoverChecks, failChecks int) bool {
+	if ok {
+		h.OkChecks++
+		h.FailChecks = 0
+	} else {
+		h.FailChecks++
+		h.OkChecks = 0
+	}
+	if !h.Healthy && h.OkChecks >= recoverChecks {
+		h.Healthy = true
+	}
+	if h.Healthy && h.FailChecks >= failChecks {
+		h.Healthy = false
+	}
+	return h.Healthy
+}
+
+func NewFailover(clients []*RPCClient) *Failover {
+	f := &Failover{health: make(map[*RPCClient]*nodeHealth)}
+	f.clients.Store(clients)
+	return f
+}
+
+func IsValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", StrategyPriority, StrategyRoundRobin, StrategyLatency:
+		return true
+	}
+	return false
+}
+
+func (f *Failover) Clients() []*RPCClient {
+	return f.clients.Load().([]*RPCClient)
+}
+
+// New set is used once its nodes pass health check, active index is kept meanwhile
+func (f *Failover) SetClients(clients []*RPCClient) {
+	f.clients.Store(clients)
+}
+
+func (f *Failover) Current() *RPCClient {
+	clients := f.Clients()
+	i := atomic.LoadInt32(&f.current)
+	// Index may be behind reloaded list for a moment
+	if int(i) >= len(clients) {
+		i = 0
+	}
+	return clients[i]
+}
+
+// Time of last switch in milliseconds, 0 if active node was never switched
+func (f *Failover) SwitchedAt() int64 {
+	return atomic.LoadInt64(&f.switchedAt)
+}
+
+func (f *Failover) Health() map[*RPCClient]NodeHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make(map[*RPCClient]NodeHealth, len(f.health))
+	for k, v := range f.health {
+		result[k] = v.NodeHealth
+	}
+	return result
+}
+
+// Checks all nodes and switches to selected healthy one, active node is kept if none is healthy.
+// Returns previous and new node names if switched.
+func (f *Failover) Check(policy FailoverPolicy) (string, string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recoverChecks, failChecks := policy.RecoverChecks, policy.FailChecks
+	if recoverChecks <= 0 {
+		recoverChecks = 1
+	}
+	if failChecks <= 0 {
+		failChecks = 1
+	}
+	check := policy.Check
+	if check == nil {
+		check = (*RPCClient).Check
+	}
+	clients := f.Clients()
+	// Rebuilt on each check, so state of removed nodes is dropped
+	health := make(map[*RPCClient]*nodeHealth, len(clients))
+	checks := make([]bool, len(clients))
+	verifyErrs := make([]error, len(clients))
+	var best uint64
+	for i, v := range clients {
+		h, ok := f.health[v]
+		if !ok {
+			// First successful check is enough for node not seen before
+			h = &nodeHealth{NodeHealth: NodeHealth{OkChecks: recoverChecks - 1}}
+		}
+		health[v] = h
+
+		checks[i] = check(v)
+		if !checks[i] {
+			h.verified = false
+			continue
+		}
+		if !h.verified && policy.Verify != nil {
+			if verifyErrs[i] = policy.Verify(v); verifyErrs[i] != nil {
+				checks[i] = false
+				continue
+			}
+		}
+		h.verified = true
+		// Height of node which failed verification must not be compared
+		if height, _ := v.ChainState(); height > best {
+			best = height
+		}
+	}
+	var healthy []int32
+	for i, v := range clients {
+		h := health[v]
+		height, syncing := v.ChainState()
+		h.Lag = 0
+		if height < best {
+			h.Lag = int64(best - height)
+		}
+		reason := ""
+		switch {
+		case verifyErrs[i] != nil:
+			reason = verifyErrs[i].Error()
+		case syncing:
+			reason = "node is syncing"
+		case !checks[i]:
+			reason = "check failed"
+		case policy.MaxLag > 0 && h.Lag > int64(policy.MaxLag):
+			reason = fmt.Sprintf("node is %d blocks behind best upstream", h.Lag)
+			checks[i] = false
+		}
+		if reason != h.reason {
+			if len(reason) > 0 {
+				log.Printf("Upstream %s is not healthy: %s", v.Name, reason)
+			}
+			h.reason = reason
+		}
+		if h.update(checks[i], recoverChecks, failChecks) {
+			healthy = append(healthy, int32(i))
+		}
+	}
+	f.health = health
+	now := util.MakeTimestamp()
+	if f.selectedAt == 0 {
+		f.selectedAt = now
+	}
+
+	// Nothing better to switch to
+	if len(healthy) == 0 {
+		return "", "", false
+	}
+	current := atomic.LoadInt32(&f.current)
+	candidate := f.selectNode(policy, clients, healthy, now)
+	if current == candidate {
+		return "", "", false
+	}
+	from := ""
+	if int(current) < len(clients) {
+		from = clients[current].Name
+	}
+	log.Printf("Switching to %v upstream", clients[candidate].Name)
+	atomic.StoreInt32(&f.current, candidate)
+	atomic.StoreInt64(&f.switchedAt, now)
+	f.selectedAt = now
+	return from, clients[candidate].Name, true
+}
+
+func (f *Failover) selectNode(policy FailoverPolicy, clients []*RPCClient, healthy []int32, now int64) int32 {
+	switch policy.Strategy {
+	case StrategyRoundRobin:
+		// Healthy active node is kept until its turn is over, so jobs of miners are not switched on every check
+		current := atomic.LoadInt32(&f.current)
+		rotate := policy.RotateInterval > 0 && now-f.selectedAt >= int64(policy.RotateInterval/time.Millisecond)
+		if !rotate && containsIndex(healthy, current) {
+			return current
+		}
+		// Next healthy one after current, so work is taken from each node in turn
+		for _, i := range healthy {
+			if i > current {
+				return i
+			}
+		}
+		return healthy[0]
+	case StrategyLatency:
+		best := healthy[0]
+		bestLatency, _ := clients[best].Latency()
+		for _, i := range healthy[1:] {
+			if latency, ok := clients[i].Latency(); ok && latency < bestLatency {
+				best, bestLatency = i, latency
+			}
+		}
+		return best
+	default:
+		return healthy[0]
+	}
+}
+
+func containsIndex(indexes []int32, index int32) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
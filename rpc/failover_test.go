@@ -0,0 +1,60 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestFailover(names ...string) *Failover {
+	clients := make([]*RPCClient, len(names))
+	for i, name := range names {
+		clients[i] = NewRPCClient(name, "http://127.0.0.1:0", "1s")
+	}
+	return NewFailover(clients)
+}
+
+func TestRoundRobinKeepsHealthyNodeUntilItsTurnIsOver(t *testing.T) {
+	f := newTestFailover("a", "b", "c")
+	down := map[string]bool{}
+	policy := FailoverPolicy{
+		Strategy:       StrategyRoundRobin,
+		RotateInterval: time.Hour,
+		Check:          func(c *RPCClient) bool { return !down[c.Name] },
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, switched := f.Check(policy); switched {
+			t.Fatalf("Healthy node is switched away on check %v", i)
+		}
+	}
+	if f.Current().Name != "a" || f.SwitchedAt() != 0 {
+		t.Errorf("Active node is %v, switched at %v", f.Current().Name, f.SwitchedAt())
+	}
+
+	// Unhealthy one is left at once
+	down["a"] = true
+	if from, to, switched := f.Check(policy); !switched || from != "a" || to != "b" {
+		t.Errorf("Switched %v from %v to %v, want from a to b", switched, from, to)
+	}
+	down["a"] = false
+	if _, _, switched := f.Check(policy); switched {
+		t.Error("Recovered node is switched back to before turn of active one is over")
+	}
+
+	// Turn is over
+	f.selectedAt -= int64(time.Hour / time.Millisecond)
+	if from, to, switched := f.Check(policy); !switched || from != "b" || to != "c" {
+		t.Errorf("Switched %v from %v to %v, want from b to c", switched, from, to)
+	}
+}
+
+func TestRoundRobinWithoutRotateInterval(t *testing.T) {
+	f := newTestFailover("a", "b")
+	policy := FailoverPolicy{
+		Strategy: StrategyRoundRobin,
+		Check:    func(c *RPCClient) bool { return true },
+	}
+	f.selectedAt = 1
+	if _, _, switched := f.Check(policy); switched {
+		t.Error("Healthy node is switched away with rotation disabled")
+	}
+}
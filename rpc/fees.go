@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+// Fees of block to its miner in Wei. Block must be fetched with full transactions. Priority fee is
+// taken per receipt, so header of uncle, which comes without transactions, has no fees. Block without
+// baseFeePerGas is pre-London, whole gas price goes to miner then. Receipts are fetched in batches of batchSize.
+func (r *RPCClient) GetBlockFees(block *GetBlockReply, batchSize int) (*big.Int, error) {
+	baseFee := new(big.Int)
+	if len(block.BaseFee) > 0 {
+		var ok bool
+		if baseFee, ok = math.ParseBig256(block.BaseFee); !ok {
+			return nil, fmt.Errorf("Invalid base fee %q", block.BaseFee)
+		}
+	}
+	hashes := make([]string, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.Hash
+	}
+	receipts, err := r.GetTxReceipts(hashes, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	fees := new(big.Int)
+	for i, tx := range block.Transactions {
+		receipt := receipts[i]
+		if receipt == nil {
+			return nil, fmt.Errorf("No receipt of tx %s", tx.Hash)
+		}
+		gasUsed, ok := math.ParseBig256(receipt.GasUsed)
+		if !ok {
+			return nil, fmt.Errorf("Invalid gas used %q of tx %s", receipt.GasUsed, tx.Hash)
+		}
+		price := receipt.EffectiveGasPrice
+		if len(price) == 0 {
+			price = tx.GasPrice
+		}
+		gasPrice, ok := math.ParseBig256(price)
+		if !ok {
+			return nil, fmt.Errorf("Invalid gas price %q of tx %s", price, tx.Hash)
+		}
+		fees.Add(fees, priorityFee(gasUsed, gasPrice, baseFee))
+	}
+	return fees, nil
+}
+
+// Base fee is burnt, effective price below it is not valid and pays nothing
+func priorityFee(gasUsed, gasPrice, baseFee *big.Int) *big.Int {
+	tip := new(big.Int).Sub(gasPrice, baseFee)
+	if tip.Sign() < 0 {
+		return new(big.Int)
+	}
+	return tip.Mul(tip, gasUsed)
+}
+
+// Base fees of blocks and of next one, rewards of blocks at requested percentiles, in Wei
+type FeeHistory struct {
+	OldestBlock string `json:"oldestBlock"`
+	// One more than blocks, last one is of next block. Missing or zero before London
+	BaseFeePerGas []string   `json:"baseFeePerGas"`
+	Reward        [][]string `json:"reward"`
+}
+
+// Fee history of last blocks with priority fee of each at percentile of gas used
+func (r *RPCClient) GetFeeHistory(blocks int, percentile float64) (*FeeHistory, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_feeHistory", []interface{}{fmt.Sprintf("0x%x", blocks), "latest", []float64{percentile}})
+	if err != nil {
+		return nil, err
+	}
+	var reply *FeeHistory
+	if rpcResp.Result != nil {
+		if err := json.Unmarshal(*rpcResp.Result, &reply); err != nil {
+			return nil, err
+		}
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("No fee history")
+	}
+	return reply, nil
+}
+
+// Legacy gas price suggested by node, in Wei
+func (r *RPCClient) GetGasPrice() (*big.Int, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_gasPrice", []string{})
+	if err != nil {
+		return nil, err
+	}
+	var reply string
+	if err := json.Unmarshal(*rpcResp.Result, &reply); err != nil {
+		return nil, err
+	}
+	price, ok := math.ParseBig256(reply)
+	if !ok {
+		return nil, fmt.Errorf("Invalid gas price %q", reply)
+	}
+	return price, nil
+}
@@ -0,0 +1,209 @@
+package rpc
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Node answering JSON-RPC methods with handlers, result of nil handler is null.
+// Batches are answered in reverse order, as node may reorder them.
+type testNode struct {
+	sync.Mutex
+	handlers map[string]func(params []json.RawMessage) interface{}
+	calls    map[string]int
+	batches  int
+	// Batch is refused with 400 as by node without batch support
+	noBatch bool
+}
+
+type testRequest struct {
+	Id     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func newTestNode(t *testing.T, handlers map[string]func(params []json.RawMessage) interface{}) (*testNode, *RPCClient) {
+	n := &testNode{handlers: handlers, calls: make(map[string]int)}
+	server := httptest.NewServer(n)
+	t.Cleanup(server.Close)
+	return n, NewRPCClient("test", server.URL, "1s")
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var batch []testRequest
+	if json.Unmarshal(raw, &batch) == nil {
+		n.Lock()
+		n.batches++
+		noBatch := n.noBatch
+		n.Unlock()
+		if noBatch {
+			http.Error(w, "batch is not supported", http.StatusBadRequest)
+			return
+		}
+		replies := make([]map[string]interface{}, len(batch))
+		for i, v := range batch {
+			replies[len(batch)-1-i] = n.reply(v)
+		}
+		json.NewEncoder(w).Encode(replies)
+		return
+	}
+	var body testRequest
+	if err := json.Unmarshal(raw, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(n.reply(body))
+}
+
+func (n *testNode) reply(req testRequest) map[string]interface{} {
+	n.Lock()
+	n.calls[req.Method]++
+	handler, ok := n.handlers[req.Method]
+	n.Unlock()
+	reply := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+	if !ok {
+		reply["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+	} else {
+		reply["result"] = handler(req.Params)
+	}
+	return reply
+}
+
+func (n *testNode) batchCount() int {
+	n.Lock()
+	defer n.Unlock()
+	return n.batches
+}
+
+func (n *testNode) count(method string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.calls[method]
+}
+
+// Receipts by tx hash, unknown hash gets null
+func receiptsNode(t *testing.T, receipts map[string]*TxReceipt) *RPCClient {
+	_, client := newTestNode(t, map[string]func([]json.RawMessage) interface{}{
+		"eth_getTransactionReceipt": func(params []json.RawMessage) interface{} {
+			var hash string
+			json.Unmarshal(params[0], &hash)
+			if receipt, ok := receipts[hash]; ok {
+				return receipt
+			}
+			return nil
+		},
+	})
+	return client
+}
+
+func TestPriorityFee(t *testing.T) {
+	cases := []struct {
+		name                       string
+		gasUsed, gasPrice, baseFee int64
+		fee                        int64
+	}{
+		{"tip over base fee", 21000, 12000000000, 10000000000, 42000000000000},
+		{"price equal to base fee", 21000, 10000000000, 10000000000, 0},
+		{"price below base fee", 21000, 9000000000, 10000000000, 0},
+		{"pre-London block", 21000, 20000000000, 0, 420000000000000},
+		{"no gas used", 0, 12000000000, 10000000000, 0},
+	}
+	for _, c := range cases {
+		got := priorityFee(big.NewInt(c.gasUsed), big.NewInt(c.gasPrice), big.NewInt(c.baseFee))
+		if got.Cmp(big.NewInt(c.fee)) != 0 {
+			t.Errorf("%s: fee is %v, want %v", c.name, got, c.fee)
+		}
+	}
+}
+
+func TestGetBlockFeesLondon(t *testing.T) {
+	client := receiptsNode(t, map[string]*TxReceipt{
+		// 2 Gwei tip of 21000 gas
+		"0x01": {TxHash: "0x01", GasUsed: "0x5208", EffectiveGasPrice: "0x2cb417800", BlockHash: "0xb1"},
+		// 1 Gwei tip of 100000 gas
+		"0x02": {TxHash: "0x02", GasUsed: "0x186a0", EffectiveGasPrice: "0x28fa6ae00", BlockHash: "0xb1"},
+		// Price of dynamic fee tx is in receipt only, gas price of tx is its max fee
+		"0x03": {TxHash: "0x03", GasUsed: "0xc350", EffectiveGasPrice: "0x2540be400", BlockHash: "0xb1"},
+	})
+	block := &GetBlockReply{
+		Number:  "0xc5d488",
+		BaseFee: "0x2540be400",
+		Transactions: []Tx{
+			{Hash: "0x01", GasPrice: "0x2cb417800"},
+			{Hash: "0x02", GasPrice: "0x28fa6ae00"},
+			{Hash: "0x03", GasPrice: "0x4a817c800", MaxFeePerGas: "0x4a817c800", MaxPriorityFeePerGas: "0x3b9aca00"},
+		},
+	}
+	fees, err := client.GetBlockFees(block, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Burnt base fee of 171000 gas is not counted, 4.2e13 + 1e14
+	if want := big.NewInt(142000000000000); fees.Cmp(want) != 0 {
+		t.Errorf("Fees are %v, want %v", fees, want)
+	}
+}
+
+func TestGetBlockFeesLegacy(t *testing.T) {
+	client := receiptsNode(t, map[string]*TxReceipt{
+		"0x01": {TxHash: "0x01", GasUsed: "0x5208", BlockHash: "0xb1"},
+		"0x02": {TxHash: "0x02", GasUsed: "0x186a0", BlockHash: "0xb1"},
+	})
+	block := &GetBlockReply{
+		Number: "0x42b4e0",
+		Transactions: []Tx{
+			{Hash: "0x01", GasPrice: "0x4a817c800"},
+			{Hash: "0x02", GasPrice: "0x218711a00"},
+		},
+	}
+	fees, err := client.GetBlockFees(block, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Whole gas price goes to miner without base fee, 21000 * 20 Gwei + 100000 * 9 Gwei
+	if want := big.NewInt(1320000000000000); fees.Cmp(want) != 0 {
+		t.Errorf("Fees are %v, want %v", fees, want)
+	}
+}
+
+func TestGetBlockFeesUncle(t *testing.T) {
+	client := receiptsNode(t, nil)
+	// Uncle header has hashes of uncles and no transactions
+	uncle := &GetBlockReply{Number: "0xc5d487", BaseFee: "0x2540be400", Uncles: []string{}}
+	fees, err := client.GetBlockFees(uncle, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fees.Sign() != 0 {
+		t.Errorf("Uncle has fees %v", fees)
+	}
+}
+
+func TestGetBlockFeesErrors(t *testing.T) {
+	client := receiptsNode(t, map[string]*TxReceipt{
+		"0x01": {TxHash: "0x01", GasUsed: "0x5208", EffectiveGasPrice: "0x2cb417800", BlockHash: "0xb1"},
+		"0x02": {TxHash: "0x02", GasUsed: "bad", BlockHash: "0xb1"},
+	})
+	cases := []struct {
+		name  string
+		block *GetBlockReply
+	}{
+		{"missing receipt", &GetBlockReply{Transactions: []Tx{{Hash: "0x09", GasPrice: "0x1"}}}},
+		{"invalid gas used", &GetBlockReply{Transactions: []Tx{{Hash: "0x02", GasPrice: "0x1"}}}},
+		{"invalid base fee", &GetBlockReply{BaseFee: "fee", Transactions: []Tx{{Hash: "0x01"}}}},
+	}
+	for _, c := range cases {
+		if _, err := client.GetBlockFees(c.block, 0); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ipcScheme = "ipc://"
+
+// Persistent connection to node socket, requests are serialized
+type ipcConn struct {
+	sync.Mutex
+	path string
+	conn net.Conn
+	dec  *json.Decoder
+	seq  uint64
+}
+
+func isIPCUrl(url string) bool {
+	return strings.HasPrefix(url, ipcScheme)
+}
+
+func newIPCConn(url string) *ipcConn {
+	return &ipcConn{path: strings.TrimPrefix(url, ipcScheme)}
+}
+
+// Broken connection is dropped, read is repeated once on fresh one, so socket closed
+// by restarted node (EPIPE) is not reported as failure. Submission may have reached node, it is not repeated.
+func (c *ipcConn) call(method string, params interface{}, timeout time.Duration) (*JSONRpcResp, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	reused := c.conn != nil
+	resp, err := c.roundTrip(method, params, timeout)
+	if err != nil && reused && !isTimeout(err) && idempotentMethods[method] {
+		resp, err = c.roundTrip(method, params, timeout)
+	}
+	return resp, err
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (c *ipcConn) roundTrip(method string, params interface{}, timeout time.Duration) (*JSONRpcResp, error) {
+	deadline := time.Now().Add(timeout)
+	if c.conn == nil {
+		conn, err := net.DialTimeout("unix", c.path, timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.dec = conn, json.NewDecoder(conn)
+	}
+	c.seq++
+	id := c.seq
+	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": id}
+	data, _ := json.Marshal(jsonReq)
+
+	// Hung node must not block caller forever
+	c.conn.SetDeadline(deadline)
+	if _, err := c.conn.Write(data); err != nil {
+		c.close()
+		return nil, err
+	}
+	for {
+		var rpcResp JSONRpcResp
+		if err := c.dec.Decode(&rpcResp); err != nil {
+			c.close()
+			return nil, err
+		}
+		// Reply to request which timed out earlier is skipped
+		var respId uint64
+		if rpcResp.Id != nil && json.Unmarshal(*rpcResp.Id, &respId) == nil && respId == id {
+			return &rpcResp, nil
+		}
+	}
+}
+
+func (c *ipcConn) close() {
+	c.conn.Close()
+	c.conn, c.dec = nil, nil
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Socket of node which closes connection after first reply, as restarted node does
+type ipcNode struct {
+	sync.Mutex
+	calls map[string]int
+}
+
+func newIPCNode(t *testing.T) (*ipcNode, *ipcConn) {
+	path := filepath.Join(t.TempDir(), "node.ipc")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	n := &ipcNode{calls: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n, newIPCConn(ipcScheme + path)
+}
+
+func (n *ipcNode) serve(conn net.Conn) {
+	defer conn.Close()
+	var req struct {
+		Id     uint64 `json:"id"`
+		Method string `json:"method"`
+	}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	n.Lock()
+	n.calls[req.Method]++
+	n.Unlock()
+	json.NewEncoder(conn).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.Id, "result": true})
+}
+
+func (n *ipcNode) count(method string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.calls[method]
+}
+
+func TestIPCRetriesReadOnBrokenConnection(t *testing.T) {
+	n, c := newIPCNode(t)
+	if _, err := c.call("eth_blockNumber", []string{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// Connection is closed by node now, read goes again on fresh one
+	if _, err := c.call("eth_blockNumber", []string{}, time.Second); err != nil {
+		t.Fatalf("Read is not repeated on broken connection: %v", err)
+	}
+	if got := n.count("eth_blockNumber"); got != 2 {
+		t.Errorf("Node got %v reads, want 2", got)
+	}
+}
+
+func TestIPCDoesNotRetrySubmission(t *testing.T) {
+	n, c := newIPCNode(t)
+	if _, err := c.call("eth_submitWork", []string{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// Node may have got submission before connection broke, it is reported instead
+	if _, err := c.call("eth_submitWork", []string{}, time.Second); err == nil {
+		t.Error("Submission on broken connection is not reported")
+	}
+	if got := n.count("eth_submitWork"); got != 1 {
+		t.Errorf("Node got %v submissions, want 1", got)
+	}
+	// Connection is dropped, next call dials again
+	if _, err := c.call("eth_submitWork", []string{}, time.Second); err != nil {
+		t.Errorf("Call after broken connection failed: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package rpc
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Recent round trips of any method, used for upstream selection
+	latencySamples = 16
+	// Recent round trips of reported methods, enough for p95
+	methodSamples = 64
+)
+
+type latencyRing struct {
+	samples []time.Duration
+	next    int
+	size    int
+}
+
+func newLatencyRing(n int) *latencyRing {
+	return &latencyRing{samples: make([]time.Duration, n)}
+}
+
+func (l *latencyRing) add(d time.Duration) {
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+	if l.size < len(l.samples) {
+		l.size++
+	}
+}
+
+func (l *latencyRing) sorted() []time.Duration {
+	samples := make([]time.Duration, l.size)
+	copy(samples, l.samples[:l.size])
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples
+}
+
+// Average and p95, zero if there were no samples
+func (l *latencyRing) stats() (time.Duration, time.Duration) {
+	samples := l.sorted()
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+	return total / time.Duration(len(samples)), samples[len(samples)*95/100]
+}
+
+// Counters are atomic, rings are guarded by mutex
+type clientMetrics struct {
+	requests int64
+	failures int64
+
+	sync.Mutex
+	all     *latencyRing
+	getWork *latencyRing
+	submit  *latencyRing
+}
+
+type Metrics struct {
+	Requests   int64
+	Failures   int64
+	GetWorkAvg time.Duration
+	GetWorkP95 time.Duration
+	SubmitAvg  time.Duration
+	SubmitP95  time.Duration
+}
+
+func (m *clientMetrics) add(method string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if m.all == nil {
+		m.all = newLatencyRing(latencySamples)
+		m.getWork = newLatencyRing(methodSamples)
+		m.submit = newLatencyRing(methodSamples)
+	}
+	m.all.add(d)
+	switch method {
+	case "eth_getWork":
+		m.getWork.add(d)
+	case "eth_submitWork":
+		m.submit.add(d)
+	}
+}
+
+// Median of recent round trips, false if there were none yet
+func (r *RPCClient) Latency() (time.Duration, bool) {
+	r.metrics.Lock()
+	defer r.metrics.Unlock()
+	if r.metrics.all == nil {
+		return 0, false
+	}
+	samples := r.metrics.all.sorted()
+	return samples[len(samples)/2], true
+}
+
+// Requests and failures are counted after retries since start
+func (r *RPCClient) Metrics() Metrics {
+	m := Metrics{
+		Requests: atomic.LoadInt64(&r.metrics.requests),
+		Failures: atomic.LoadInt64(&r.metrics.failures),
+	}
+	r.metrics.Lock()
+	defer r.metrics.Unlock()
+	if r.metrics.all != nil {
+		m.GetWorkAvg, m.GetWorkP95 = r.metrics.getWork.stats()
+		m.SubmitAvg, m.SubmitP95 = r.metrics.submit.stats()
+	}
+	return m
+}
@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	WorkSourceGetWork = "getWork"
+	// Work is assembled from pending block header, for nodes without eth_getWork
+	WorkSourcePending = "pending"
+
+	DefaultEpochLength  = 30000
+	defaultSubmitMethod = "eth_submitWork"
+)
+
+var pow256 = math.BigPow(2, 256)
+
+// Seal fields of pending block, hash and nonce are not set by node for it
+type PendingHeader struct {
+	ParentHash       string `json:"parentHash"`
+	UncleHash        string `json:"sha3Uncles"`
+	Miner            string `json:"miner"`
+	StateRoot        string `json:"stateRoot"`
+	TransactionsRoot string `json:"transactionsRoot"`
+	ReceiptsRoot     string `json:"receiptsRoot"`
+	LogsBloom        string `json:"logsBloom"`
+	Difficulty       string `json:"difficulty"`
+	Number           string `json:"number"`
+	GasLimit         string `json:"gasLimit"`
+	GasUsed          string `json:"gasUsed"`
+	Timestamp        string `json:"timestamp"`
+	ExtraData        string `json:"extraData"`
+	// Set on chains with London rules only
+	BaseFee string `json:"baseFeePerGas"`
+}
+
+// Source of work and submission call of upstream, see SetWorkSource
+type workSource struct {
+	mode         string
+	submitMethod string
+	epochLength  uint64
+}
+
+// Seed hash of each epoch is derived from previous one, so computed ones are kept
+var seedCache = struct {
+	sync.Mutex
+	seeds []common.Hash
+}{seeds: []common.Hash{{}}}
+
+// Empty mode and method select eth_getWork and eth_submitWork
+func (r *RPCClient) SetWorkSource(mode, submitMethod string, epochLength uint64) {
+	if len(mode) == 0 {
+		mode = WorkSourceGetWork
+	}
+	if len(submitMethod) == 0 {
+		submitMethod = defaultSubmitMethod
+	}
+	if epochLength == 0 {
+		epochLength = DefaultEpochLength
+	}
+	r.Lock()
+	r.work = workSource{mode, submitMethod, epochLength}
+	r.Unlock()
+}
+
+func (r *RPCClient) workSource() workSource {
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.work.mode) == 0 {
+		return workSource{WorkSourceGetWork, defaultSubmitMethod, DefaultEpochLength}
+	}
+	return r.work
+}
+
+func IsValidWorkSource(mode string) bool {
+	return len(mode) == 0 || mode == WorkSourceGetWork || mode == WorkSourcePending
+}
+
+// Work package in eth_getWork format with block number as 4th element
+func (r *RPCClient) getPendingWork(epochLength uint64) ([]string, error) {
+	rpcResp, err := r.post(r.Url, "eth_getBlockByNumber", []interface{}{"pending", false}, r.methodTimeout(PendingTimeoutKey), true)
+	if err != nil {
+		return nil, err
+	}
+	var header *PendingHeader
+	if rpcResp.Result == nil || json.Unmarshal(*rpcResp.Result, &header) != nil || header == nil {
+		return nil, errors.New("Invalid pending block reply")
+	}
+	return header.Work(epochLength)
+}
+
+func (h *PendingHeader) Work(epochLength uint64) ([]string, error) {
+	number, ok := math.ParseUint64(h.Number)
+	if !ok {
+		return nil, errors.New("Malformed pending block number")
+	}
+	difficulty, ok := math.ParseBig256(h.Difficulty)
+	if !ok || difficulty.Sign() <= 0 {
+		return nil, errors.New("Malformed pending block difficulty")
+	}
+	sealHash, err := h.SealHash()
+	if err != nil {
+		return nil, err
+	}
+	target := new(big.Int).Div(pow256, difficulty)
+	return []string{
+		sealHash.Hex(),
+		SeedHash(number, epochLength).Hex(),
+		common.BytesToHash(target.Bytes()).Hex(),
+		fmt.Sprintf("0x%x", number),
+	}, nil
+}
+
+// Hash of header without mix digest and nonce, which is what miner seals
+func (h *PendingHeader) SealHash() (common.Hash, error) {
+	var fields []interface{}
+	for _, v := range []string{h.ParentHash, h.UncleHash} {
+		fields = append(fields, common.HexToHash(v))
+	}
+	fields = append(fields, common.HexToAddress(h.Miner))
+	for _, v := range []string{h.StateRoot, h.TransactionsRoot, h.ReceiptsRoot} {
+		fields = append(fields, common.HexToHash(v))
+	}
+	bloom := common.FromHex(h.LogsBloom)
+	if len(bloom) != 256 {
+		return common.Hash{}, errors.New("Malformed pending block bloom")
+	}
+	fields = append(fields, bloom)
+	for _, v := range []string{h.Difficulty, h.Number, h.GasLimit, h.GasUsed, h.Timestamp} {
+		n, ok := math.ParseBig256(v)
+		if !ok {
+			return common.Hash{}, fmt.Errorf("Malformed pending block field %q", v)
+		}
+		fields = append(fields, n)
+	}
+	fields = append(fields, common.FromHex(h.ExtraData))
+	if len(h.BaseFee) > 0 {
+		baseFee, ok := math.ParseBig256(h.BaseFee)
+		if !ok {
+			return common.Hash{}, errors.New("Malformed pending block base fee")
+		}
+		fields = append(fields, baseFee)
+	}
+	data, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(data), nil
+}
+
+func SeedHash(number, epochLength uint64) common.Hash {
+	epoch := int(number / epochLength)
+	seedCache.Lock()
+	defer seedCache.Unlock()
+	for len(seedCache.seeds) <= epoch {
+		last := seedCache.seeds[len(seedCache.seeds)-1]
+		seedCache.seeds = append(seedCache.seeds, crypto.Keccak256Hash(last[:]))
+	}
+	return seedCache.seeds[epoch]
+}
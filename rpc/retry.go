@@ -0,0 +1,69 @@
+package rpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Key of pending block query made on block template refresh, it has own timeout
+const PendingTimeoutKey = "pending"
+
+// Only reads are retried, submission or transaction must not be sent twice
+var idempotentMethods = map[string]bool{
+	"eth_getWork":                       true,
+	"eth_blockNumber":                   true,
+	"eth_syncing":                       true,
+	"eth_getBlockByNumber":              true,
+	"eth_getBlockByHash":                true,
+	"eth_getUncleByBlockNumberAndIndex": true,
+	"eth_getTransactionReceipt":         true,
+	"eth_getBalance":                    true,
+	"net_peerCount":                     true,
+}
+
+type RetryPolicy struct {
+	// Total number of attempts, 1 or less disables retry
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Doubles with each attempt, up to half of it is added as jitter
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff << uint(attempt)
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// Overrides may be changed on reload of running client
+func (r *RPCClient) SetTimeouts(timeouts map[string]time.Duration) {
+	r.Lock()
+	r.timeouts = timeouts
+	r.Unlock()
+}
+
+func (r *RPCClient) SetRetry(policy RetryPolicy) {
+	r.Lock()
+	r.retry = policy
+	r.Unlock()
+}
+
+func (r *RPCClient) methodTimeout(key string) time.Duration {
+	r.RLock()
+	defer r.RUnlock()
+	if d, ok := r.timeouts[key]; ok && d > 0 {
+		return d
+	}
+	return r.timeout
+}
+
+func (r *RPCClient) retryPolicy() RetryPolicy {
+	r.RLock()
+	defer r.RUnlock()
+	return r.retry
+}
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 
@@ -21,10 +24,26 @@ type RPCClient struct {
 	sync.RWMutex
 	Url         string
 	Name        string
+	Auth        Auth
 	sick        bool
 	sickRate    int
 	successRate int
 	client      *http.Client
+	metrics     clientMetrics
+	ipc         *ipcConn
+	timeout     time.Duration
+	timeouts    map[string]time.Duration
+	retry       RetryPolicy
+	// Set once node rejected batch request
+	noBatch int32
+	work    workSource
+	// Chain state seen on last check
+	height  uint64
+	syncing bool
+	// Optional newHeads subscription
+	WsUrl   string
+	wsAlive bool
+	wsQuit  chan struct{}
 }
 
 type GetBlockReply struct {
@@ -37,6 +56,8 @@ type GetBlockReply struct {
 	GasUsed      string   `json:"gasUsed"`
 	Transactions []Tx     `json:"transactions"`
 	Uncles       []string `json:"uncles"`
+	// Burnt per unit of gas, empty before London
+	BaseFee string `json:"baseFeePerGas"`
 	// https://github.com/ethereum/EIPs/issues/95
 	SealFields []string `json:"sealFields"`
 }
@@ -50,16 +71,28 @@ type TxReceipt struct {
 	TxHash    string `json:"transactionHash"`
 	GasUsed   string `json:"gasUsed"`
 	BlockHash string `json:"blockHash"`
+	// Empty on nodes before London, gas price of tx is paid then
+	EffectiveGasPrice string `json:"effectiveGasPrice"`
+	BlockNumber       string `json:"blockNumber"`
+	// 0x0 for reverted tx, empty before Byzantium
+	Status string `json:"status"`
 }
 
 func (r *TxReceipt) Confirmed() bool {
 	return len(r.BlockHash) > 0
 }
 
+func (r *TxReceipt) Failed() bool {
+	return r.Status == "0x0"
+}
+
 type Tx struct {
 	Gas      string `json:"gas"`
 	GasPrice string `json:"gasPrice"`
 	Hash     string `json:"hash"`
+	// Empty for legacy tx
+	MaxFeePerGas         string `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas string `json:"maxPriorityFeePerGas"`
 }
 
 type JSONRpcResp struct {
@@ -70,25 +103,91 @@ type JSONRpcResp struct {
 
 func NewRPCClient(name, url, timeout string) *RPCClient {
 	rpcClient := &RPCClient{Name: name, Url: url}
-	timeoutIntv := util.MustParseDuration(timeout)
-	rpcClient.client = &http.Client{
-		Timeout: timeoutIntv,
+	// Timeout is set per request, overrides may be longer than default one
+	rpcClient.timeout = util.MustParseDuration(timeout)
+	rpcClient.client = &http.Client{}
+	if isIPCUrl(url) {
+		rpcClient.ipc = newIPCConn(url)
 	}
 	return rpcClient
 }
 
 func (r *RPCClient) GetWork() ([]string, error) {
+	if source := r.workSource(); source.mode == WorkSourcePending {
+		return r.getPendingWork(source.epochLength)
+	}
 	rpcResp, err := r.doPost(r.Url, "eth_getWork", []string{})
 	if err != nil {
 		return nil, err
 	}
 	var reply []string
 	err = json.Unmarshal(*rpcResp.Result, &reply)
-	return reply, err
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeWork(reply)
+}
+
+func (r *RPCClient) GetBlockNumber() (uint64, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_blockNumber", []string{})
+	if err != nil {
+		return 0, err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+// Falls back to net_version for nodes without EIP-695, network id equals chain id on main networks
+func (r *RPCClient) GetChainId() (uint64, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_chainId", []string{})
+	if err != nil {
+		rpcResp, err = r.doPost(r.Url, "net_version", []string{})
+		if err != nil {
+			return 0, err
+		}
+		var reply string
+		if err := json.Unmarshal(*rpcResp.Result, &reply); err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(reply, 10, 64)
+	}
+	var reply string
+	if err := json.Unmarshal(*rpcResp.Result, &reply); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+func (r *RPCClient) GetGenesisHash() (string, error) {
+	reply, err := r.getBlockBy("eth_getBlockByNumber", []interface{}{"0x0", true})
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		return "", errors.New("Genesis block not found")
+	}
+	return reply.Hash, nil
+}
+
+// Node replies false when it is not syncing and sync status object otherwise
+func (r *RPCClient) GetSyncing() (bool, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_syncing", []string{})
+	if err != nil {
+		return false, err
+	}
+	var reply bool
+	if err := json.Unmarshal(*rpcResp.Result, &reply); err != nil {
+		return true, nil
+	}
+	return reply, nil
 }
 
 func (r *RPCClient) GetPendingBlock() (*GetBlockReplyPart, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_getBlockByNumber", []interface{}{"pending", false})
+	rpcResp, err := r.post(r.Url, "eth_getBlockByNumber", []interface{}{"pending", false}, r.methodTimeout(PendingTimeoutKey), true)
 	if err != nil {
 		return nil, err
 	}
@@ -141,8 +240,41 @@ func (r *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
 	return nil, nil
 }
 
+// Nil if node doesn't know tx, as with tx dropped from mempool
+func (r *RPCClient) GetTransaction(hash string) (*Tx, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_getTransactionByHash", []string{hash})
+	if err != nil {
+		return nil, err
+	}
+	if rpcResp.Result != nil {
+		var reply *Tx
+		err = json.Unmarshal(*rpcResp.Result, &reply)
+		return reply, err
+	}
+	return nil, nil
+}
+
+// Nonce of next tx of address, pending ones included
+func (r *RPCClient) GetPendingNonce(address string) (uint64, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_getTransactionCount", []string{address, "pending"})
+	if err != nil {
+		return 0, err
+	}
+	var reply string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
 func (r *RPCClient) SubmitBlock(params []string) (bool, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_submitWork", params)
+	return r.SubmitBlockTimeout(params, 0, true)
+}
+
+// Failure of submission which is not essential is not counted in health of upstream
+func (r *RPCClient) SubmitBlockTimeout(params []string, timeout time.Duration, essential bool) (bool, error) {
+	rpcResp, err := r.post(r.Url, r.workSource().submitMethod, params, timeout, essential)
 	if err != nil {
 		return false, err
 	}
@@ -164,6 +296,16 @@ func (r *RPCClient) GetBalance(address string) (*big.Int, error) {
 	return util.String2Big(reply), err
 }
 
+func (r *RPCClient) GetAccounts() ([]string, error) {
+	rpcResp, err := r.doPost(r.Url, "eth_accounts", []string{})
+	if err != nil {
+		return nil, err
+	}
+	var reply []string
+	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return reply, err
+}
+
 func (r *RPCClient) Sign(from string, s string) (string, error) {
 	hash := sha256.Sum256([]byte(s))
 	rpcResp, err := r.doPost(r.Url, "eth_sign", []string{from, common.ToHex(hash[:])})
@@ -194,16 +336,45 @@ func (r *RPCClient) GetPeerCount() (int64, error) {
 	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
 }
 
-func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoGas bool) (string, error) {
+// Legacy transaction, node sets gas limit with autoGas, gas price and nonce if they are empty
+func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value, nonce string, autoGas bool) (string, error) {
 	params := map[string]string{
 		"from":  from,
 		"to":    to,
 		"value": value,
 	}
+	if len(nonce) > 0 {
+		params["nonce"] = nonce
+	}
 	if !autoGas {
 		params["gas"] = gas
+	}
+	if len(gasPrice) > 0 {
 		params["gasPrice"] = gasPrice
 	}
+	return r.sendTransaction(params)
+}
+
+// EIP-1559 transaction, node sets gas limit with autoGas and nonce if it is empty
+func (r *RPCClient) SendDynamicFeeTransaction(from, to, gas, maxFee, maxPriorityFee, value, nonce string, autoGas bool) (string, error) {
+	params := map[string]string{
+		"from":                 from,
+		"to":                   to,
+		"value":                value,
+		"type":                 "0x2",
+		"maxFeePerGas":         maxFee,
+		"maxPriorityFeePerGas": maxPriorityFee,
+	}
+	if len(nonce) > 0 {
+		params["nonce"] = nonce
+	}
+	if !autoGas {
+		params["gas"] = gas
+	}
+	return r.sendTransaction(params)
+}
+
+func (r *RPCClient) sendTransaction(params map[string]string) (string, error) {
 	rpcResp, err := r.doPost(r.Url, "eth_sendTransaction", []interface{}{params})
 	var reply string
 	if err != nil {
@@ -224,17 +395,72 @@ func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoG
 }
 
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
+	return r.post(url, method, params, 0, true)
+}
+
+// Transport errors of reads are retried, only exhausted retries are counted in health of upstream
+func (r *RPCClient) post(url string, method string, params interface{}, timeout time.Duration, track bool) (*JSONRpcResp, error) {
+	if timeout <= 0 {
+		timeout = r.methodTimeout(method)
+	}
+	retry := r.retryPolicy()
+	attempts := 1
+	if idempotentMethods[method] && retry.Attempts > 1 {
+		attempts = retry.Attempts
+	}
+	var rpcResp *JSONRpcResp
+	var err error
+	atomic.AddInt64(&r.metrics.requests, 1)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(retry.delay(i - 1))
+		}
+		start := time.Now()
+		if r.ipc != nil {
+			rpcResp, err = r.ipc.call(method, params, timeout)
+		} else {
+			rpcResp, err = r.postHTTP(url, method, params, timeout)
+		}
+		if err == nil {
+			r.metrics.add(method, time.Since(start))
+			break
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&r.metrics.failures, 1)
+		if track {
+			r.markSick()
+		}
+		return nil, err
+	}
+
+	if rpcResp.Error != nil {
+		if track {
+			r.markSick()
+		}
+		return nil, newRPCError(rpcResp.Error)
+	}
+	return rpcResp, nil
+}
+
+func (r *RPCClient) postHTTP(url string, method string, params interface{}, timeout time.Duration) (*JSONRpcResp, error) {
 	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
 	data, _ := json.Marshal(jsonReq)
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Length", (string)(len(data)))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	r.Auth.apply(req.Header)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
 
 	resp, err := r.client.Do(req)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -242,23 +468,46 @@ func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSON
 	var rpcResp *JSONRpcResp
 	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
-	if rpcResp.Error != nil {
-		r.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
-	}
-	return rpcResp, err
+	return rpcResp, nil
 }
 
+// Upstream with subscription down is not preferred, polling still works with it.
+// Syncing node still gives work, but for old head, so it is not healthy too.
 func (r *RPCClient) Check() bool {
 	_, err := r.GetWork()
 	if err != nil {
 		return false
 	}
+	return r.CheckChain()
+}
+
+// Check of node which is not asked for work, e.g. wallet node of payouts
+func (r *RPCClient) CheckChain() bool {
+	syncing, err := r.GetSyncing()
+	if err != nil {
+		return false
+	}
+	height, err := r.GetBlockNumber()
+	if err != nil {
+		return false
+	}
+	r.Lock()
+	r.height, r.syncing = height, syncing
+	r.Unlock()
+	if syncing {
+		return false
+	}
 	r.markAlive()
-	return !r.Sick()
+	return !r.Sick() && r.WsHealthy()
+}
+
+// Head height and sync status seen on last successful check
+func (r *RPCClient) ChainState() (uint64, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.height, r.syncing
 }
 
 func (r *RPCClient) Sick() bool {
@@ -0,0 +1,140 @@
+package rpc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Outcome of block submission, same for all node flavors
+type SubmitOutcome int
+
+const (
+	SubmitAccepted SubmitOutcome = iota
+	// Node has moved past work, share is still good
+	SubmitStale
+	// Solution or work is not valid
+	SubmitInvalid
+	// Node failed to process submission, block may still be good
+	SubmitNodeError
+)
+
+func (o SubmitOutcome) String() string {
+	switch o {
+	case SubmitAccepted:
+		return "accepted"
+	case SubmitStale:
+		return "stale"
+	case SubmitInvalid:
+		return "invalid"
+	}
+	return "node error"
+}
+
+// Error object of JSON-RPC reply, code is kept so submit errors can be classified
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+func newRPCError(obj map[string]interface{}) *RPCError {
+	e := &RPCError{}
+	if code, ok := obj["code"].(float64); ok {
+		e.Code = int(code)
+	}
+	e.Message, _ = obj["message"].(string)
+	return e
+}
+
+const rpcInvalidParams = -32602
+
+// Known eth_submitWork error messages of geth, Nethermind and Besu. Geth and Besu mostly reply false,
+// errors come from malformed params, Nethermind and Besu report stale work as error.
+var (
+	staleSubmitErrors   = []string{"stale", "too old", "outdated", "no longer", "expired"}
+	invalidSubmitErrors = []string{"invalid", "unknown work", "unknown block", "bad seal", "mismatch", "incorrect", "wrong"}
+)
+
+// Transport failures and unknown errors are node errors
+func ClassifySubmitError(err error) SubmitOutcome {
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		return SubmitNodeError
+	}
+	message := strings.ToLower(rpcErr.Message)
+	for _, v := range staleSubmitErrors {
+		if strings.Contains(message, v) {
+			return SubmitStale
+		}
+	}
+	if rpcErr.Code == rpcInvalidParams {
+		return SubmitInvalid
+	}
+	for _, v := range invalidSubmitErrors {
+		if strings.Contains(message, v) {
+			return SubmitInvalid
+		}
+	}
+	return SubmitNodeError
+}
+
+// Work is [header, seed, target] with optional block number, hashes are
+// brought to 0x-prefixed lower case 32 bytes, so they match miner submissions
+func NormalizeWork(work []string) ([]string, error) {
+	if len(work) < 3 || len(work) > 4 {
+		return nil, errors.New("Invalid work package length")
+	}
+	result := make([]string, len(work))
+	for i := 0; i < 3; i++ {
+		hash, ok := normalizeHash(work[i])
+		if !ok {
+			return nil, errors.New("Malformed hash in work package")
+		}
+		result[i] = hash
+	}
+	if len(work) == 4 {
+		height, ok := parseQuantity(work[3])
+		if !ok {
+			return nil, errors.New("Malformed block number in work package")
+		}
+		result[3] = "0x" + strconv.FormatUint(height, 16)
+	}
+	return result, nil
+}
+
+// Block number of work package if node reports it
+func WorkHeight(work []string) (uint64, bool) {
+	if len(work) < 4 {
+		return 0, false
+	}
+	return parseQuantity(work[3])
+}
+
+func normalizeHash(hash string) (string, bool) {
+	hex := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(hash, "0x"), "0X"))
+	if len(hex) == 0 || len(hex) > 64 {
+		return "", false
+	}
+	for _, c := range hex {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", false
+		}
+	}
+	return "0x" + strings.Repeat("0", 64-len(hex)) + hex, true
+}
+
+// Number may come as hex quantity or, from some clients, as decimal
+func parseQuantity(s string) (uint64, bool) {
+	var n uint64
+	var err error
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err = strconv.ParseUint(s[2:], 16, 64)
+	} else {
+		n, err = strconv.ParseUint(s, 10, 64)
+	}
+	return n, err == nil
+}
@@ -0,0 +1,162 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minWsBackoff = time.Second
+	maxWsBackoff = 30 * time.Second
+	// Node which doesn't answer ping within timeout after it is dropped
+	wsPingInterval = 30 * time.Second
+)
+
+type wsNotification struct {
+	Method string `json:"method"`
+	Params struct {
+		Subscription string `json:"subscription"`
+	} `json:"params"`
+}
+
+// Subscription to newHeads runs until Close, connection is restored with growing backoff
+func (r *RPCClient) WatchHeads(wsUrl string, onHead func()) {
+	r.Lock()
+	r.WsUrl = wsUrl
+	r.wsQuit = make(chan struct{})
+	quit := r.wsQuit
+	r.Unlock()
+
+	go func() {
+		backoff := minWsBackoff
+		for {
+			err := r.subscribeHeads(wsUrl, quit, onHead, func() { backoff = minWsBackoff })
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			log.Printf("Upstream %s newHeads subscription is down: %v, reconnecting in %v", r.Name, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-quit:
+				return
+			}
+			if backoff *= 2; backoff > maxWsBackoff {
+				backoff = maxWsBackoff
+			}
+		}
+	}()
+}
+
+func (r *RPCClient) subscribeHeads(wsUrl string, quit chan struct{}, onHead func(), onSubscribed func()) error {
+	dialer := websocket.Dialer{HandshakeTimeout: r.timeout}
+	header := http.Header{}
+	r.Auth.apply(header)
+	conn, _, err := dialer.Dial(wsUrl, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock read on Close
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-quit:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": []string{"newHeads"}}
+	conn.SetWriteDeadline(time.Now().Add(r.timeout))
+	if err := conn.WriteJSON(req); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(r.timeout))
+	var resp JSONRpcResp
+	if err := conn.ReadJSON(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		if message, ok := resp.Error["message"].(string); ok {
+			return errors.New(message)
+		}
+		return errors.New(fmt.Sprint(resp.Error))
+	}
+	var id string
+	if resp.Result == nil || json.Unmarshal(*resp.Result, &id) != nil {
+		return errors.New("Invalid eth_subscribe reply")
+	}
+	// Heads are not guaranteed to come often, so liveness is checked by ping.
+	// Half-open connection of node gone away would never report an error otherwise.
+	extend := func() {
+		conn.SetReadDeadline(time.Now().Add(wsPingInterval + r.timeout))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(r.timeout)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	r.setWsAlive(true)
+	defer r.setWsAlive(false)
+	onSubscribed()
+	log.Printf("Subscribed to newHeads on %s", r.Name)
+
+	for {
+		var n wsNotification
+		if err := conn.ReadJSON(&n); err != nil {
+			return err
+		}
+		extend()
+		if n.Method == "eth_subscription" && n.Params.Subscription == id {
+			onHead()
+		}
+	}
+}
+
+// True if subscription is not configured or is up
+func (r *RPCClient) WsHealthy() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.WsUrl) == 0 || r.wsAlive
+}
+
+func (r *RPCClient) setWsAlive(alive bool) {
+	r.Lock()
+	r.wsAlive = alive
+	r.Unlock()
+}
+
+// Stops newHeads subscription of removed upstream
+func (r *RPCClient) Close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.wsQuit != nil {
+		close(r.wsQuit)
+		r.wsQuit = nil
+	}
+}
@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Node answering eth_subscribe with reply, then sending notifications
+func newWsNode(t *testing.T, reply map[string]interface{}, notifications ...interface{}) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var subscribe map[string]interface{}
+		if err := conn.ReadJSON(&subscribe); err != nil {
+			return
+		}
+		conn.WriteJSON(reply)
+		for _, n := range notifications {
+			conn.WriteJSON(n)
+		}
+		// Pings are answered while connection is read
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestSubscribeHeadsErrorWithoutMessage(t *testing.T) {
+	url := newWsNode(t, map[string]interface{}{"jsonrpc": "2.0", "id": 1, "error": map[string]interface{}{"code": -32601}})
+	client := NewRPCClient("test", "http://127.0.0.1:0", "1s")
+	err := client.subscribeHeads(url, make(chan struct{}), func() {}, func() {})
+	if err == nil || !strings.Contains(err.Error(), "-32601") {
+		t.Errorf("Error is %v, want one with code of reply", err)
+	}
+}
+
+func TestSubscribeHeadsNotifies(t *testing.T) {
+	head := map[string]interface{}{"jsonrpc": "2.0", "method": "eth_subscription", "params": map[string]interface{}{"subscription": "0x1"}}
+	other := map[string]interface{}{"jsonrpc": "2.0", "method": "eth_subscription", "params": map[string]interface{}{"subscription": "0x2"}}
+	url := newWsNode(t, map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": "0x1"}, head, other, head)
+	client := NewRPCClient("test", "http://127.0.0.1:0", "1s")
+	client.WsUrl = url
+
+	quit := make(chan struct{})
+	heads := make(chan struct{}, 3)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.subscribeHeads(url, quit, func() { heads <- struct{}{} }, func() {})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-heads:
+		case <-time.After(time.Second):
+			t.Fatalf("Got %v heads, want 2", i)
+		}
+	}
+	if !client.WsHealthy() {
+		t.Error("Subscription is not marked alive")
+	}
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Subscription is not closed on quit")
+	}
+	if len(heads) != 0 {
+		t.Errorf("Notification of other subscription is taken as head")
+	}
+	if client.WsHealthy() {
+		t.Error("Closed subscription is healthy")
+	}
+}
@@ -0,0 +1,42 @@
+package sharelog
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type kafkaPublisher struct {
+	writer  *kafka.Writer
+	timeout time.Duration
+}
+
+// Keyed by login, so events of miner stay in order within partition
+func newKafkaPublisher(brokers []string, topic string, timeout time.Duration) (*kafkaPublisher, error) {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    maxBatch,
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: timeout,
+	}
+	return &kafkaPublisher{writer: writer, timeout: timeout}, nil
+}
+
+func (p *kafkaPublisher) Publish(events []*Event) error {
+	messages := make([]kafka.Message, len(events))
+	for i, e := range events {
+		value, _ := json.Marshal(e)
+		messages[i] = kafka.Message{Key: []byte(e.Login), Value: value}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	return p.writer.WriteMessages(ctx, messages...)
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,38 @@
+package sharelog
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+	timeout time.Duration
+}
+
+// Client reconnects on its own, publishes meanwhile go to its reconnect buffer or fail
+func newNatsPublisher(url, subject string, timeout time.Duration) (*natsPublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("open-ethereum-pool"), nats.Timeout(timeout), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, subject: subject, timeout: timeout}, nil
+}
+
+func (p *natsPublisher) Publish(events []*Event) error {
+	for _, e := range events {
+		data, _ := json.Marshal(e)
+		if err := p.conn.Publish(p.subject, data); err != nil {
+			return err
+		}
+	}
+	return p.conn.FlushTimeout(p.timeout)
+}
+
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
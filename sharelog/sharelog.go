@@ -0,0 +1,205 @@
+package sharelog
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	TypeKafka = "kafka"
+	TypeNats  = "nats"
+
+	EventShare = "share"
+	EventBlock = "block"
+
+	StatusValid     = "valid"
+	StatusStale     = "stale"
+	StatusInvalid   = "invalid"
+	StatusDuplicate = "duplicate"
+
+	defaultQueueSize = 10000
+	// Events are published in batches of up to that many
+	maxBatch = 500
+)
+
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// kafka or nats
+	Type string `json:"type"`
+	// Kafka brokers
+	Brokers []string `json:"brokers"`
+	// NATS server url
+	Url string `json:"url"`
+	// Kafka topic or NATS subject
+	Topic string `json:"topic"`
+	// Events queued for publisher, new ones are dropped and counted when full
+	QueueSize int    `json:"queueSize"`
+	Timeout   string `json:"timeout"`
+}
+
+type Event struct {
+	Type string `json:"type"`
+	// Of share, empty for block
+	Status string `json:"status,omitempty"`
+	// Credited share, stale share too if it was late enough to be credited
+	Accepted  bool   `json:"accepted"`
+	Timestamp int64  `json:"timestamp"`
+	Login     string `json:"login"`
+	Worker    string `json:"worker"`
+	IP        string `json:"ip"`
+	// Work difficulty of share
+	Difficulty int64  `json:"difficulty"`
+	Height     uint64 `json:"height"`
+	// Header hash of job
+	Job  string `json:"job"`
+	Solo bool   `json:"solo"`
+}
+
+// Broker client, batch is published synchronously by queue loop
+type Publisher interface {
+	Publish(events []*Event) error
+	Close() error
+}
+
+// Events are handed over through bounded queue, so broker outage never blocks share submission.
+// Nil ShareLog discards events.
+type ShareLog struct {
+	queue     chan *Event
+	publisher Publisher
+	quit      chan struct{}
+	done      chan struct{}
+	published int64
+	dropped   int64
+	failed    int64
+	// Set while broker fails, so outage is logged once
+	failing int32
+}
+
+func New(cfg *Config) (*ShareLog, error) {
+	timeout := 5 * time.Second
+	if len(cfg.Timeout) > 0 {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid shareLog timeout: %v", err)
+		}
+		timeout = d
+	}
+	if len(cfg.Topic) == 0 {
+		return nil, fmt.Errorf("No shareLog topic")
+	}
+	var publisher Publisher
+	var err error
+	switch cfg.Type {
+	case TypeKafka:
+		publisher, err = newKafkaPublisher(cfg.Brokers, cfg.Topic, timeout)
+	case TypeNats:
+		publisher, err = newNatsPublisher(cfg.Url, cfg.Topic, timeout)
+	default:
+		return nil, fmt.Errorf("Unknown shareLog type %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	l := &ShareLog{
+		queue:     make(chan *Event, size),
+		publisher: publisher,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go l.loop()
+	log.Printf("Publishing share events to %s topic %s", cfg.Type, cfg.Topic)
+	return l, nil
+}
+
+// Never blocks
+func (l *ShareLog) Log(e *Event) {
+	if l == nil {
+		return
+	}
+	if e.Timestamp == 0 {
+		e.Timestamp = util.MakeTimestamp()
+	}
+	select {
+	case l.queue <- e:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+func (l *ShareLog) loop() {
+	defer close(l.done)
+	for {
+		select {
+		case e := <-l.queue:
+			l.publish(l.batch(e))
+		case <-l.quit:
+			// Publish what is queued, broker may be down, so it is tried once
+			for {
+				select {
+				case e := <-l.queue:
+					l.publish(l.batch(e))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *ShareLog) batch(first *Event) []*Event {
+	events := []*Event{first}
+	for len(events) < maxBatch {
+		select {
+		case e := <-l.queue:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+	return events
+}
+
+// Failed batch is dropped, events are not kept for broker to come back
+func (l *ShareLog) publish(events []*Event) {
+	if err := l.publisher.Publish(events); err != nil {
+		atomic.AddInt64(&l.failed, int64(len(events)))
+		if atomic.CompareAndSwapInt32(&l.failing, 0, 1) {
+			log.Printf("Failed to publish share events: %v", err)
+		}
+		return
+	}
+	atomic.AddInt64(&l.published, int64(len(events)))
+	if atomic.CompareAndSwapInt32(&l.failing, 1, 0) {
+		log.Println("Share events are published again")
+	}
+}
+
+// Queue depth and counters of published, dropped on overflow and failed events
+func (l *ShareLog) Stats() map[string]int64 {
+	if l == nil {
+		return nil
+	}
+	return map[string]int64{
+		"shareLogQueue":     int64(len(l.queue)),
+		"shareLogPublished": atomic.LoadInt64(&l.published),
+		"shareLogDropped":   atomic.LoadInt64(&l.dropped),
+		"shareLogFailed":    atomic.LoadInt64(&l.failed),
+	}
+}
+
+func (l *ShareLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.quit)
+	<-l.done
+	return l.publisher.Close()
+}
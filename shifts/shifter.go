@@ -18,10 +18,10 @@ type ShiftsConfig struct {
 
 type ShiftsProcessor struct {
 	config   *ShiftsConfig
-	backend  *storage.RedisClient
+	backend  storage.Storage
 }
 
-func NewShiftsProcessor(cfg *ShiftsConfig, backend *storage.RedisClient) *ShiftsProcessor {
+func NewShiftsProcessor(cfg *ShiftsConfig, backend storage.Storage) *ShiftsProcessor {
 	s := &ShiftsProcessor{config: cfg, backend: backend}
 	return s
 }
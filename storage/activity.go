@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Seen hash of login keeps worker:first, worker:last and worker:since, the start of online session.
+// Session is closed by maintenance once worker is silent for expiration while pool is taking shares,
+// it goes to capped activity list of login as worker:since:last.
+func (r *RedisClient) writeSeen(tx *redis.Multi, ts int64, login, id string) {
+	now := strconv.FormatInt(ts, 10)
+	tx.HSetNX(r.minerKey("miners", login), "firstSeen", now)
+	tx.HSetNX(r.minerKey("seen", login), join(id, "first"), now)
+	tx.HSetNX(r.minerKey("seen", login), join(id, "since"), now)
+	tx.HSet(r.minerKey("seen", login), join(id, "last"), now)
+}
+
+// Miner and pool keys are watched by single node client, by node of the slot in cluster mode
+func (r *RedisClient) watch(key string) (*redis.Multi, error) {
+	if r.cluster != nil {
+		return r.cluster.Watch(key)
+	}
+	return r.single.Watch(key)
+}
+
+// Pool is taken for up since first maintenance pass which found shares after gap longer than
+// expiration, so silence of workers while pool itself was down or restarting is not an offline
+// transition. Returns 0 if pool is down.
+func (r *RedisClient) poolActiveSince(now int64, expire int64) (int64, error) {
+	key := r.formatKey("activity", "pool")
+	latest, err := r.client.ZRevRangeWithScores(r.formatKey("hashrate"), 0, 0).Result()
+	if err != nil {
+		return 0, err
+	}
+	state, err := r.client.HGetAllMap(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(latest) == 0 || now-int64(latest[0].Score) > expire {
+		return 0, r.client.Del(key).Err()
+	}
+	last := int64(latest[0].Score)
+	prevLast, _ := strconv.ParseInt(state["last"], 10, 64)
+	since, _ := strconv.ParseInt(state["since"], 10, 64)
+	if since == 0 || last-prevLast > expire {
+		since = now
+	}
+	tx, err := r.multi("")
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	_, err = tx.Exec(func() error {
+		tx.HSet(key, "since", strconv.FormatInt(since, 10))
+		tx.HSet(key, "last", strconv.FormatInt(last, 10))
+		return nil
+	})
+	return since, err
+}
+
+// Online sessions of workers silent for longer than expire are closed and recorded, at most
+// maxEvents are kept per login. Nothing is recorded while pool is down.
+func (r *RedisClient) RecordOffline(expire time.Duration, maxEvents int64, opsPerSecond int) (int64, error) {
+	p := newPacer(opsPerSecond)
+	now := util.MakeTimestamp() / 1000
+	exp := int64(expire / time.Second)
+
+	p.wait()
+	since, err := r.poolActiveSince(now, exp)
+	if err != nil || since == 0 {
+		return 0, err
+	}
+
+	total := int64(0)
+	err = r.scanKeys(join(r.prefix, "seen", "*"), func(keys []string) error {
+		p.wait()
+		for _, key := range keys {
+			p.wait()
+			n, err := r.closeSessions(keyLogin(key), now, exp, since, maxEvents)
+			if err != nil {
+				return err
+			}
+			total += n
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Seen hash is watched, share written meanwhile leaves sessions for next pass
+func (r *RedisClient) closeSessions(login string, now, expire, poolSince, maxEvents int64) (int64, error) {
+	key := r.minerKey("seen", login)
+	tx, err := r.watch(key)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	seen, err := tx.HGetAllMap(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	var closed []string
+	for field, v := range seen {
+		if !strings.HasSuffix(field, ":since") {
+			continue
+		}
+		id := strings.TrimSuffix(field, ":since")
+		last, _ := strconv.ParseInt(seen[join(id, "last")], 10, 64)
+		silentSince := last
+		if silentSince < poolSince {
+			silentSince = poolSince
+		}
+		if now-silentSince <= expire {
+			continue
+		}
+		closed = append(closed, join(id, v, last))
+	}
+	if len(closed) == 0 {
+		return 0, nil
+	}
+	_, err = tx.Exec(func() error {
+		for _, v := range closed {
+			tx.HDel(key, join(strings.Split(v, ":")[0], "since"))
+			tx.LPush(r.minerKey("activity", login), v)
+		}
+		tx.LTrim(r.minerKey("activity", login), 0, maxEvents-1)
+		return nil
+	})
+	if err == redis.TxFailedErr {
+		return 0, nil
+	}
+	return int64(len(closed)), err
+}
+
+type WorkerActivity struct {
+	FirstSeen int64 `json:"firstSeen"`
+	LastSeen  int64 `json:"lastSeen"`
+	// Start of current online session, 0 if worker went offline
+	OnlineSince int64 `json:"onlineSince"`
+}
+
+type ActivityEvent struct {
+	Worker string `json:"worker"`
+	// Online from first share of session to last one
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// First and last seen of login and its workers and recent offline transitions, newest first
+func (r *RedisClient) GetMinerActivity(login string, maxEvents int64) (map[string]interface{}, error) {
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		var err error
+		cmds, err = r.execTx(login, func(tx *redis.Multi) error {
+			tx.HMGet(r.minerKey("miners", login), "firstSeen", "lastShare")
+			tx.HGetAllMap(r.minerKey("seen", login))
+			tx.LRange(r.minerKey("activity", login), 0, maxEvents-1)
+			return nil
+		})
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	activity := make(map[string]interface{})
+	times := cmds[0].(*redis.SliceCmd).Val()
+	activity["firstSeen"], _ = strconv.ParseInt(stringValue(times[0]), 10, 64)
+	activity["lastSeen"], _ = strconv.ParseInt(stringValue(times[1]), 10, 64)
+
+	workers := make(map[string]*WorkerActivity)
+	for field, v := range cmds[1].(*redis.StringStringMapCmd).Val() {
+		i := strings.LastIndex(field, ":")
+		if i < 0 {
+			continue
+		}
+		worker, ok := workers[field[:i]]
+		if !ok {
+			worker = &WorkerActivity{}
+			workers[field[:i]] = worker
+		}
+		ts, _ := strconv.ParseInt(v, 10, 64)
+		switch field[i+1:] {
+		case "first":
+			worker.FirstSeen = ts
+		case "last":
+			worker.LastSeen = ts
+		case "since":
+			worker.OnlineSince = ts
+		}
+	}
+	activity["workers"] = workers
+
+	var events []*ActivityEvent
+	for _, v := range cmds[2].(*redis.StringSliceCmd).Val() {
+		fields := strings.Split(v, ":")
+		if len(fields) != 3 {
+			continue
+		}
+		event := &ActivityEvent{Worker: fields[0]}
+		event.From, _ = strconv.ParseInt(fields[1], 10, 64)
+		event.To, _ = strconv.ParseInt(fields[2], 10, 64)
+		events = append(events, event)
+	}
+	activity["offline"] = events
+	return activity, nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Adjustment would drive balance below zero and force is not set
+var ErrNegativeBalance = errors.New("Adjustment would make balance negative")
+
+// Manual credit or debit of balance by operator, in Shannon
+type BalanceAdjustment struct {
+	RequestId string `json:"requestId"`
+	Login     string `json:"login"`
+	Amount    int64  `json:"amount"`
+	Operator  string `json:"operator"`
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Request id is applied once per login, adjust:login has ids applied, so retry returns current balance.
+// Pool part is written once per member, so retry in cluster mode writes what is missing.
+//
+// KEYS: miners:login, adjust:login, ledger:login, then adjustments and finances in single node mode
+// ARGV: request id, amount, force, ledger entry, adjustments member, ts
+const (
+	adjustLoginLua = `
+local balance = redis.call('HGET', KEYS[1], 'balance') or '0'
+if redis.call('SISMEMBER', KEYS[2], ARGV[1]) == 1 then
+	return {0, balance}
+end
+if ARGV[3] ~= '1' and tonumber(balance) + tonumber(ARGV[2]) < 0 then
+	return {-1, balance}
+end
+redis.call('SADD', KEYS[2], ARGV[1])
+balance = redis.call('HINCRBYFLOAT', KEYS[1], 'balance', ARGV[2])
+if ARGV[4] ~= '' then
+	redis.call('RPUSH', KEYS[3], ARGV[4])
+end
+if #KEYS == 3 then
+	return {1, balance}
+end
+`
+	adjustPoolLua = `
+if not redis.call('ZSCORE', KEYS[#KEYS - 1], ARGV[5]) then
+	redis.call('ZADD', KEYS[#KEYS - 1], ARGV[6], ARGV[5])
+	redis.call('HINCRBYFLOAT', KEYS[#KEYS], 'balance', ARGV[2])
+end
+`
+)
+
+// Balance of login is changed by amount with adjust ledger entry, adjustment goes to adjustments of pool.
+// Applied is false if request id was applied to login already. Debit below zero balance fails with
+// ErrNegativeBalance unless forced.
+func (r *RedisClient) AdjustBalance(login string, amount int64, reason, operator, requestId string, force bool) (bool, float64, error) {
+	ts := util.MakeTimestamp() / 1000
+	entry := r.ledgerEntry(ts, float64(amount), LedgerAdjust, requestId)
+	member := join(requestId, login, amount, operator, reason)
+	forced := "0"
+	if force {
+		forced = "1"
+	}
+	loginKeys := []string{r.minerKey("miners", login), r.minerKey("adjust", login), r.minerKey("ledger", login)}
+	poolKeys := []string{r.formatKey("adjustments"), r.formatKey("finances")}
+	args := []string{requestId, strconv.FormatInt(amount, 10), forced, entry, member, strconv.FormatInt(ts, 10)}
+
+	var res interface{}
+	var err error
+	if r.cluster == nil {
+		res, err = r.client.Eval(adjustLoginLua+adjustPoolLua+"return {1, balance}\n", append(loginKeys, poolKeys...), args).Result()
+	} else {
+		res, err = r.client.Eval(adjustLoginLua, loginKeys, args).Result()
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	reply, _ := res.([]interface{})
+	if len(reply) != 2 {
+		return false, 0, fmt.Errorf("Unexpected reply of adjustment: %v", res)
+	}
+	status, _ := reply[0].(int64)
+	balance, _ := strconv.ParseFloat(stringValue(reply[1]), 64)
+	if status == -1 {
+		return false, balance, ErrNegativeBalance
+	}
+	if r.cluster != nil {
+		if err := r.client.Eval(adjustPoolLua+"return 1\n", poolKeys, args).Err(); err != nil {
+			return false, balance, fmt.Errorf("Balance of %s is adjusted, adjustment is not recorded: %v", login, err)
+		}
+	}
+	// Stream is record only, entry of adjustment applied is not written again on retry
+	if status == 1 && len(entry) > 0 {
+		tx, err := r.multi("")
+		if err != nil {
+			return true, balance, err
+		}
+		defer tx.Close()
+		_, err = tx.Exec(func() error {
+			r.writeLedgerStream(tx, login, entry)
+			return nil
+		})
+		if err != nil {
+			return true, balance, err
+		}
+	}
+	return status == 1, balance, nil
+}
+
+// Newest first, with total of them
+func (r *RedisClient) GetAdjustments(offset, limit int64) ([]*BalanceAdjustment, int64, error) {
+	key := r.formatKey("adjustments")
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		var err error
+		cmds, err = r.execTx("", func(tx *redis.Multi) error {
+			tx.ZRevRangeWithScores(key, offset, offset+limit-1)
+			tx.ZCard(key)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	raw := cmds[0].(*redis.ZSliceCmd).Val()
+	result := make([]*BalanceAdjustment, 0, len(raw))
+	for _, v := range raw {
+		// Reason may hold separator, it goes last
+		fields := strings.SplitN(v.Member.(string), ":", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		a := &BalanceAdjustment{RequestId: fields[0], Login: fields[1], Operator: fields[3], Reason: fields[4], Timestamp: int64(v.Score)}
+		a.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+		result = append(result, a)
+	}
+	return result, cmds[1].(*redis.IntCmd).Val(), nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Bonus recorded with immature block is credited to finder once, as credit of fees,
+// and recorded as finderBonusPaid of block state, so reorg audit takes it back.
+func (r *RedisClient) payFinderBonus(block *BlockData) error {
+	state := r.formatBlockState(block.RoundHeight, block.Nonce)
+	v, err := r.client.HGet(state, "finderBonus").Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bonus, _ := strconv.ParseInt(v, 10, 64)
+	if bonus <= 0 {
+		return nil
+	}
+	ts := util.MakeTimestamp() / 1000
+	ref := join(block.RoundHeight, block.Nonce)
+	entry := r.ledgerEntry(ts, float64(bonus), LedgerFinderBonus, ref)
+	keys := []string{r.minerKey("miners", block.Finder), r.minerKey("bonus", block.Finder), r.minerKey("ledger", block.Finder)}
+	args := []string{ref, v, entry, strconv.FormatInt(int64(feeCreditsExpire/time.Second), 10)}
+	applied, err := r.client.Eval(creditFeesLua, keys, args).Result()
+	if err != nil {
+		return err
+	}
+	if n, _ := applied.(int64); n == 1 && len(entry) > 0 {
+		// Stream is record only, entry of credit applied is not written again on retry
+		tx, err := r.multi("")
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		_, err = tx.Exec(func() error {
+			r.writeLedgerStream(tx, block.Finder, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return r.client.HSetNX(state, "finderBonusPaid", v).Err()
+}
+
+// Bonus credited to finder of block, 0 if none
+func (r *RedisClient) paidFinderBonus(block *BlockData) (int64, error) {
+	v, err := r.client.HGet(r.formatBlockState(block.RoundHeight, block.Nonce), "finderBonusPaid").Result()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
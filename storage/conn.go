@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	// Managed offerings drop idle connections silently, keepalive lets pool notice it
+	dialKeepAlive = 30 * time.Second
+)
+
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+	// PEM bundle of server CA, system roots are used if empty
+	CAFile string `json:"caFile"`
+	// For testing only
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// Failed AUTH on connect, as opposed to network failure
+type AuthError struct {
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// Returned by each dial, so it comes up in startup check
+type tlsConfigError struct {
+	error
+}
+
+// Replies of servers without ACL, with ACL and of older versions to wrong or missing credentials
+var authErrors = []string{"NOAUTH", "WRONGPASS", "ERR invalid password", "ERR invalid username-password pair", "ERR AUTH", "ERR Client sent AUTH"}
+
+func isAuthError(err error) bool {
+	if _, ok := err.(*AuthError); ok {
+		return true
+	}
+	for _, v := range authErrors {
+		if strings.HasPrefix(err.Error(), v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Startup check error telling auth failure from network one
+func describeCheckError(cfg *Config, err error) error {
+	if isAuthError(err) {
+		if len(cfg.Username) > 0 {
+			return fmt.Errorf("Redis authentication failed for user %s: %v", cfg.Username, err)
+		}
+		return fmt.Errorf("Redis authentication failed: %v", err)
+	}
+	var configErr tlsConfigError
+	if errors.As(err, &configErr) {
+		return fmt.Errorf("Redis TLS config is invalid: %v", err)
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) {
+		return fmt.Errorf("Redis TLS certificate is not trusted, check caFile: %v", err)
+	}
+	if errors.As(err, &hostname) {
+		return fmt.Errorf("Redis TLS certificate does not match endpoint: %v", err)
+	}
+	return fmt.Errorf("Redis is unreachable at %s: %v", cfg.Endpoint, err)
+}
+
+// Dialer of endpoint with TLS and ACL auth. Username is sent with password in AUTH,
+// so password must not be passed to client as well, it would send AUTH with password only.
+func newDialer(cfg *Config) func() (net.Conn, error) {
+	tlsConfig, tlsErr := newTLSConfig(cfg)
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: dialKeepAlive}
+	network := "tcp"
+	if cfg.Network == "unix" {
+		network = cfg.Network
+	}
+
+	return func() (net.Conn, error) {
+		if tlsErr != nil {
+			return nil, tlsConfigError{tlsErr}
+		}
+		conn, err := dialer.Dial(network, cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		if tlsConfig != nil {
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		if len(cfg.Username) > 0 {
+			if err := auth(conn, cfg.Username, cfg.Password); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// Config is shared by all connections, so session cache lets reconnects resume TLS session
+func newTLSConfig(cfg *Config) (*tls.Config, error) {
+	if !cfg.TLS.Enabled {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redis endpoint %s: %v", cfg.Endpoint, err)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if len(cfg.TLS.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read redis CA bundle: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in redis CA bundle %s", cfg.TLS.CAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// AUTH of Redis 6 ACL, client library knows only password form of it
+func auth(conn net.Conn, username, password string) error {
+	args := []string{"AUTH", username, password}
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, v := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	}
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "+OK":
+		return nil
+	case strings.HasPrefix(line, "-"):
+		return &AuthError{line[1:]}
+	}
+	return errors.New("Unexpected AUTH reply: " + line)
+}
@@ -0,0 +1,582 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	// Version 2 has block lifecycle, credits, markers, ledger and debt, file of version 1 is imported as is
+	stateVersion = 2
+	// Entries of pool sets written in one transaction on import
+	importBatch = 500
+)
+
+var errNotEmpty = errors.New("not empty")
+
+// Member and score of sorted set, as stored
+type StateEntry struct {
+	Score  int64  `json:"score"`
+	Member string `json:"member"`
+}
+
+// Entry of pool ledger stream, id is kept so import does not add entries target has already
+type StreamEntry struct {
+	Id    string `json:"id"`
+	Login string `json:"login"`
+	Entry string `json:"entry"`
+}
+
+type MinerState struct {
+	Login string `json:"login"`
+	// Float in Shannon, kept as stored
+	Balance  string       `json:"balance"`
+	Pending  int64        `json:"pending"`
+	Paid     int64        `json:"paid"`
+	Payments []StateEntry `json:"payments"`
+	Immature int64        `json:"immature,omitempty"`
+	// Float in Shannon, kept as stored
+	Debt string `json:"debt,omitempty"`
+	// Refs of blocks credited as immature, reverted by reorg audit, with fees or finder bonus credited
+	ImmatureBlocks []string `json:"immatureBlocks,omitempty"`
+	ReorgBlocks    []string `json:"reorgBlocks,omitempty"`
+	FeeBlocks      []string `json:"feeBlocks,omitempty"`
+	BonusBlocks    []string `json:"bonusBlocks,omitempty"`
+	// Ids of adjustments applied
+	AdjustIds []string `json:"adjustIds,omitempty"`
+	// Oldest first, as stored
+	Ledger []string `json:"ledger,omitempty"`
+}
+
+type StateTotals struct {
+	Miners          int     `json:"miners"`
+	Balance         float64 `json:"balance"`
+	Pending         int64   `json:"pending"`
+	Paid            int64   `json:"paid"`
+	MinerPayments   int     `json:"minerPayments"`
+	PendingPayments int     `json:"pendingPayments"`
+	Payments        int     `json:"payments"`
+	Blocks          int     `json:"blocks"`
+	Finders         int     `json:"finders"`
+	Immature        int64   `json:"immature,omitempty"`
+	Debt            float64 `json:"debt,omitempty"`
+	MinerMarkers    int     `json:"minerMarkers,omitempty"`
+	MinerLedger     int     `json:"minerLedger,omitempty"`
+	ImmatureBlocks  int     `json:"immatureBlocks,omitempty"`
+	MaturedBlocks   int     `json:"maturedBlocks,omitempty"`
+	OrphanedBlocks  int     `json:"orphanedBlocks,omitempty"`
+	BlockStates     int     `json:"blockStates,omitempty"`
+	BlockCredits    int     `json:"blockCredits,omitempty"`
+	FeeCredits      int     `json:"feeCredits,omitempty"`
+	Adjustments     int     `json:"adjustments,omitempty"`
+	Ledger          int     `json:"ledger,omitempty"`
+}
+
+// Balances, payments and blocks record. Checksum is SHA-256 of JSON of state with empty checksum,
+// totals are in it too, so file cut short or edited is refused on import. Fields added in version 2
+// are omitted when empty, so checksum of version 1 file holds.
+type State struct {
+	Version         int               `json:"version"`
+	Prefix          string            `json:"prefix"`
+	ExportedAt      int64             `json:"exportedAt"`
+	Finances        map[string]string `json:"finances"`
+	Miners          []*MinerState     `json:"miners"`
+	PendingPayments []StateEntry      `json:"pendingPayments"`
+	Payments        []StateEntry      `json:"payments"`
+	PaymentFees     map[string]string `json:"paymentFees,omitempty"`
+	PaymentStatus   map[string]string `json:"paymentStatus,omitempty"`
+	Blocks          []StateEntry      `json:"blocks"`
+	Finders         []StateEntry      `json:"finders"`
+	ImmatureBlocks  []StateEntry      `json:"immatureBlocks,omitempty"`
+	MaturedBlocks   []StateEntry      `json:"maturedBlocks,omitempty"`
+	OrphanedBlocks  []StateEntry      `json:"orphanedBlocks,omitempty"`
+	// Hashes of blocks:state, credits:immature and credits:fees by height:nonce
+	BlockStates  map[string]map[string]string `json:"blockStates,omitempty"`
+	BlockCredits map[string]map[string]string `json:"blockCredits,omitempty"`
+	FeeCredits   map[string]map[string]string `json:"feeCredits,omitempty"`
+	Adjustments  []StateEntry                 `json:"adjustments,omitempty"`
+	Ledger       []StreamEntry                `json:"ledger,omitempty"`
+	Totals       StateTotals                  `json:"totals"`
+	Checksum     string                       `json:"checksum"`
+}
+
+func (s *State) totals() StateTotals {
+	t := StateTotals{
+		Miners:          len(s.Miners),
+		PendingPayments: len(s.PendingPayments),
+		Payments:        len(s.Payments),
+		Blocks:          len(s.Blocks),
+		Finders:         len(s.Finders),
+		ImmatureBlocks:  len(s.ImmatureBlocks),
+		MaturedBlocks:   len(s.MaturedBlocks),
+		OrphanedBlocks:  len(s.OrphanedBlocks),
+		BlockStates:     len(s.BlockStates),
+		BlockCredits:    len(s.BlockCredits),
+		FeeCredits:      len(s.FeeCredits),
+		Adjustments:     len(s.Adjustments),
+		Ledger:          len(s.Ledger),
+	}
+	for _, m := range s.Miners {
+		balance, _ := strconv.ParseFloat(m.Balance, 64)
+		debt, _ := strconv.ParseFloat(m.Debt, 64)
+		t.Balance += balance
+		t.Pending += m.Pending
+		t.Paid += m.Paid
+		t.MinerPayments += len(m.Payments)
+		t.Immature += m.Immature
+		t.Debt += debt
+		t.MinerMarkers += len(m.ImmatureBlocks) + len(m.ReorgBlocks) + len(m.FeeBlocks) + len(m.BonusBlocks) + len(m.AdjustIds)
+		t.MinerLedger += len(m.Ledger)
+	}
+	return t
+}
+
+func (s *State) checksum() (string, error) {
+	c := *s
+	c.Checksum = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *State) seal() error {
+	s.Totals = s.totals()
+	sum, err := s.checksum()
+	s.Checksum = sum
+	return err
+}
+
+func (s *State) Verify() error {
+	if s.Version < 1 || s.Version > stateVersion {
+		return fmt.Errorf("Unsupported state version %v, up to %v is expected", s.Version, stateVersion)
+	}
+	if s.totals() != s.Totals {
+		return errors.New("Totals of state do not match its contents")
+	}
+	sum, err := s.checksum()
+	if err != nil {
+		return err
+	}
+	if sum != s.Checksum {
+		return errors.New("Checksum of state does not match its contents")
+	}
+	return nil
+}
+
+// Pool must be stopped, so state is not changed while it is read
+func (r *RedisClient) ExportState() (*State, error) {
+	s := &State{Version: stateVersion, Prefix: r.prefix, ExportedAt: util.MakeTimestamp() / 1000}
+	var err error
+	if s.Finances, err = r.client.HGetAllMap(r.formatKey("finances")).Result(); err != nil {
+		return nil, err
+	}
+	if s.PaymentFees, err = r.client.HGetAllMap(r.formatKey("payments", "fees")).Result(); err != nil {
+		return nil, err
+	}
+	if s.PaymentStatus, err = r.client.HGetAllMap(r.formatKey("payments", "status")).Result(); err != nil {
+		return nil, err
+	}
+	for _, v := range []struct {
+		key  string
+		dest *[]StateEntry
+	}{
+		{r.formatKey("payments", "pending"), &s.PendingPayments},
+		{r.formatKey("payments", "all"), &s.Payments},
+		{r.formatKey("blocks", "candidates"), &s.Blocks},
+		{r.formatKey("finders"), &s.Finders},
+		{r.formatKey("blocks", blockSet(BlockImmature)), &s.ImmatureBlocks},
+		{r.formatKey("blocks", blockSet(BlockMatured)), &s.MaturedBlocks},
+		{r.formatKey("blocks", blockSet(BlockOrphaned)), &s.OrphanedBlocks},
+		{r.formatKey("adjustments"), &s.Adjustments},
+	} {
+		if *v.dest, err = r.readEntries(v.key); err != nil {
+			return nil, err
+		}
+	}
+	if s.BlockStates, err = r.readHashes(r.formatKey("blocks", "state")); err != nil {
+		return nil, err
+	}
+	if s.BlockCredits, err = r.readHashes(r.formatKey("credits", "immature")); err != nil {
+		return nil, err
+	}
+	if s.FeeCredits, err = r.readHashes(r.formatKey("credits", "fees")); err != nil {
+		return nil, err
+	}
+	if s.Ledger, err = r.readStream(r.formatKey("ledger")); err != nil {
+		return nil, err
+	}
+
+	err = r.scanKeys(join(r.prefix, "miners", "*"), func(keys []string) error {
+		for _, key := range keys {
+			login := keyLogin(key)
+			values, err := r.client.HMGet(key, "balance", "pending", "paid", "immature", "debt").Result()
+			if err != nil {
+				return err
+			}
+			m := &MinerState{Login: login, Balance: stringValue(values[0]), Debt: stringValue(values[4])}
+			m.Pending, _ = strconv.ParseInt(stringValue(values[1]), 10, 64)
+			m.Paid, _ = strconv.ParseInt(stringValue(values[2]), 10, 64)
+			m.Immature, _ = strconv.ParseInt(stringValue(values[3]), 10, 64)
+			if m.Payments, err = r.readEntries(r.minerKey("payments", login)); err != nil {
+				return err
+			}
+			for _, v := range []struct {
+				kind string
+				dest *[]string
+			}{
+				{"immature", &m.ImmatureBlocks},
+				{"reorg", &m.ReorgBlocks},
+				{"fees", &m.FeeBlocks},
+				{"bonus", &m.BonusBlocks},
+				{"adjust", &m.AdjustIds},
+			} {
+				if *v.dest, err = r.client.SMembers(r.minerKey(v.kind, login)).Result(); err != nil {
+					return err
+				}
+			}
+			if m.Ledger, err = r.client.LRange(r.minerKey("ledger", login), 0, -1).Result(); err != nil {
+				return err
+			}
+			s.Miners = append(s.Miners, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, s.seal()
+}
+
+// Hashes under prefix by rest of key
+func (r *RedisClient) readHashes(prefix string) (map[string]map[string]string, error) {
+	hashes := make(map[string]map[string]string)
+	err := r.scanKeys(join(prefix, "*"), func(keys []string) error {
+		for _, key := range keys {
+			values, err := r.client.HGetAllMap(key).Result()
+			if err != nil {
+				return err
+			}
+			hashes[strings.TrimPrefix(key, prefix+":")] = values
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// Oldest first
+func (r *RedisClient) readStream(key string) ([]StreamEntry, error) {
+	cmd := redis.NewSliceCmd("XRANGE", key, "-", "+")
+	if _, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.Process(cmd)
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	var entries []StreamEntry
+	for _, v := range cmd.Val() {
+		item, _ := v.([]interface{})
+		if len(item) != 2 {
+			continue
+		}
+		e := StreamEntry{Id: stringValue(item[0])}
+		fields, _ := item[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch stringValue(fields[i]) {
+			case "login":
+				e.Login = stringValue(fields[i+1])
+			case "entry":
+				e.Entry = stringValue(fields[i+1])
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (r *RedisClient) readEntries(key string) ([]StateEntry, error) {
+	raw, err := r.client.ZRevRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StateEntry, len(raw))
+	for i, v := range raw {
+		entries[i] = StateEntry{Score: int64(v.Score), Member: v.Member.(string)}
+	}
+	return entries, nil
+}
+
+// State is verified first. Target which has miners, payments or blocks already is refused unless forced,
+// balances of miners in state are overwritten then and entries are added to sets.
+func (r *RedisClient) ImportState(s *State, force bool) error {
+	if err := s.Verify(); err != nil {
+		return err
+	}
+	if !force {
+		if err := r.checkEmpty(); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		for k, v := range s.Finances {
+			tx.HSet(r.formatKey("finances"), k, v)
+		}
+		for k, v := range s.PaymentFees {
+			tx.HSet(r.formatKey("payments", "fees"), k, v)
+		}
+		for k, v := range s.PaymentStatus {
+			tx.HSet(r.formatKey("payments", "status"), k, v)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("Failed to import finances: %v", err)
+	}
+	for _, v := range []struct {
+		key     string
+		entries []StateEntry
+	}{
+		{r.formatKey("payments", "pending"), s.PendingPayments},
+		{r.formatKey("payments", "all"), s.Payments},
+		{r.formatKey("blocks", "candidates"), s.Blocks},
+		{r.formatKey("finders"), s.Finders},
+		{r.formatKey("blocks", blockSet(BlockImmature)), s.ImmatureBlocks},
+		{r.formatKey("blocks", blockSet(BlockMatured)), s.MaturedBlocks},
+		{r.formatKey("blocks", blockSet(BlockOrphaned)), s.OrphanedBlocks},
+		{r.formatKey("adjustments"), s.Adjustments},
+	} {
+		for i := 0; i < len(v.entries); i += importBatch {
+			batch := v.entries[i:minInt(i+importBatch, len(v.entries))]
+			_, err := r.execTx("", func(tx *redis.Multi) error {
+				tx.ZAdd(v.key, stateMembers(batch)...)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("Failed to import %s after %v entries: %v", v.key, i, err)
+			}
+		}
+	}
+	if err := r.writeHashes(r.formatKey("blocks", "state"), s.BlockStates); err != nil {
+		return err
+	}
+	if err := r.writeHashes(r.formatKey("credits", "immature"), s.BlockCredits); err != nil {
+		return err
+	}
+	if err := r.writeHashes(r.formatKey("credits", "fees"), s.FeeCredits); err != nil {
+		return err
+	}
+	if err := r.writeStream(r.formatKey("ledger"), s.Ledger); err != nil {
+		return err
+	}
+
+	for i, m := range s.Miners {
+		_, err := r.execTx(m.Login, func(tx *redis.Multi) error {
+			key := r.minerKey("miners", m.Login)
+			if len(m.Balance) > 0 {
+				tx.HSet(key, "balance", m.Balance)
+			}
+			tx.HSet(key, "pending", strconv.FormatInt(m.Pending, 10))
+			tx.HSet(key, "paid", strconv.FormatInt(m.Paid, 10))
+			if m.Immature != 0 {
+				tx.HSet(key, "immature", strconv.FormatInt(m.Immature, 10))
+			}
+			if len(m.Debt) > 0 {
+				tx.HSet(key, "debt", m.Debt)
+			}
+			for j := 0; j < len(m.Payments); j += importBatch {
+				tx.ZAdd(r.minerKey("payments", m.Login), stateMembers(m.Payments[j:minInt(j+importBatch, len(m.Payments))])...)
+			}
+			// Markers expire as written, credit of block is applied once per login again
+			for _, v := range []struct {
+				kind    string
+				members []string
+				expire  time.Duration
+			}{
+				{"immature", m.ImmatureBlocks, 0},
+				{"reorg", m.ReorgBlocks, reorgRevertsExpire},
+				{"fees", m.FeeBlocks, feeCreditsExpire},
+				{"bonus", m.BonusBlocks, feeCreditsExpire},
+				{"adjust", m.AdjustIds, 0},
+			} {
+				if len(v.members) == 0 {
+					continue
+				}
+				tx.SAdd(r.minerKey(v.kind, m.Login), v.members...)
+				if v.expire > 0 {
+					tx.Expire(r.minerKey(v.kind, m.Login), v.expire)
+				}
+			}
+			// Ledger of login in file replaces one of target, as balance does
+			if len(m.Ledger) > 0 {
+				tx.Del(r.minerKey("ledger", m.Login))
+				tx.RPush(r.minerKey("ledger", m.Login), m.Ledger...)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to import miner %s after %v of %v miners: %v", m.Login, i, len(s.Miners), err)
+		}
+	}
+	return nil
+}
+
+// Hashes of state are written over ones of target, fields missing in state are kept
+func (r *RedisClient) writeHashes(prefix string, hashes map[string]map[string]string) error {
+	ids := make([]string, 0, len(hashes))
+	for id := range hashes {
+		ids = append(ids, id)
+	}
+	for i := 0; i < len(ids); i += importBatch {
+		batch := ids[i:minInt(i+importBatch, len(ids))]
+		_, err := r.execTx("", func(tx *redis.Multi) error {
+			for _, id := range batch {
+				for k, v := range hashes[id] {
+					tx.HSet(join(prefix, id), k, v)
+				}
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("Failed to import %s after %v hashes: %v", prefix, i, err)
+		}
+	}
+	return nil
+}
+
+// Ids are kept, entries up to last one of target are there already
+func (r *RedisClient) writeStream(key string, entries []StreamEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	last := redis.NewSliceCmd("XREVRANGE", key, "+", "-", "COUNT", "1")
+	if _, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.Process(last)
+		return nil
+	}); err != nil && err != redis.Nil {
+		return err
+	}
+	lastId := ""
+	if reply := last.Val(); len(reply) > 0 {
+		if item, _ := reply[0].([]interface{}); len(item) > 0 {
+			lastId = stringValue(item[0])
+		}
+	}
+	for len(entries) > 0 && len(lastId) > 0 && !streamIdAfter(entries[0].Id, lastId) {
+		entries = entries[1:]
+	}
+	for i := 0; i < len(entries); i += importBatch {
+		batch := entries[i:minInt(i+importBatch, len(entries))]
+		_, err := r.execTx("", func(tx *redis.Multi) error {
+			for _, e := range batch {
+				tx.Process(redis.NewStringCmd("XADD", key, e.Id, "login", e.Login, "entry", e.Entry))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to import %s after %v entries: %v", key, i, err)
+		}
+	}
+	return nil
+}
+
+// Stream id is ms-seq
+func streamIdAfter(id, other string) bool {
+	parse := func(v string) (uint64, uint64) {
+		parts := strings.SplitN(v, "-", 2)
+		ms, _ := strconv.ParseUint(parts[0], 10, 64)
+		var seq uint64
+		if len(parts) == 2 {
+			seq, _ = strconv.ParseUint(parts[1], 10, 64)
+		}
+		return ms, seq
+	}
+	ms, seq := parse(id)
+	otherMs, otherSeq := parse(other)
+	return ms > otherMs || ms == otherMs && seq > otherSeq
+}
+
+func (r *RedisClient) checkEmpty() error {
+	for _, key := range []string{r.formatKey("finances"), r.formatKey("payments", "all"), r.formatKey("blocks", "candidates"),
+		r.formatKey("blocks", blockSet(BlockImmature)), r.formatKey("blocks", blockSet(BlockMatured))} {
+		exists, err := r.client.Exists(key).Result()
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("Target has %s already, force is required", key)
+		}
+	}
+	err := r.scanKeys(join(r.prefix, "miners", "*"), func(keys []string) error {
+		if len(keys) > 0 {
+			return errNotEmpty
+		}
+		return nil
+	})
+	if err == errNotEmpty {
+		return errors.New("Target has miners already, force is required")
+	}
+	return err
+}
+
+func stateMembers(entries []StateEntry) []redis.Z {
+	members := make([]redis.Z, len(entries))
+	for i, v := range entries {
+		members[i] = redis.Z{Score: float64(v.Score), Member: v.Member}
+	}
+	return members
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Written to temporary file first, so failed export doesn't leave partial file in place
+func WriteStateFile(path string, s *State) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func ReadStateFile(path string) (*State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &State{}
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("Invalid state file: %v", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Blocks credited to login are kept that long, unlocker retry must come within it
+const feeCreditsExpire = 30 * 24 * time.Hour
+
+// Credit is applied once per login and block, so retry after partial distribution credits the rest only.
+// Keys are miner keys of one login, so script runs in cluster mode too.
+const creditFeesLua = `
+if redis.call('SADD', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+redis.call('HINCRBYFLOAT', KEYS[1], 'balance', ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('RPUSH', KEYS[3], ARGV[3])
+end
+return 1
+`
+
+// Fee credit of block by login in Shannon, so reorg audit takes back what was credited
+func (r *RedisClient) formatFeeCredits(height int64, nonce string) string {
+	return r.formatKey("credits", "fees", height, nonce)
+}
+
+func (r *RedisClient) getFeeCredits(block *BlockData) (map[string]float64, error) {
+	values, err := r.client.HGetAllMap(r.formatFeeCredits(block.RoundHeight, block.Nonce)).Result()
+	if err != nil {
+		return nil, err
+	}
+	credits := make(map[string]float64, len(values))
+	for login, v := range values {
+		credits[login], _ = strconv.ParseFloat(v, 64)
+	}
+	return credits, nil
+}
+
+// Fee credits of block orphaned while immature are taken back as by reorg audit, bounded by balance with rest
+// going to debt, so fees credited before failed maturity write are not kept
+func (r *RedisClient) revertFeeCredits(block *BlockData) error {
+	credits, err := r.getFeeCredits(block)
+	if err != nil || len(credits) == 0 {
+		return err
+	}
+	ts := util.MakeTimestamp() / 1000
+	ref := join(block.RoundHeight, block.Nonce)
+	reason := ""
+	if r.cfg.Ledger.Enabled {
+		reason = LedgerReorg
+	}
+	// Only credit part of reorg script runs, members and height of block are not used
+	args := []string{"", "", "", strconv.FormatInt(ts, 10), ref, strconv.FormatInt(int64(reorgRevertsExpire/time.Second), 10), reason}
+	var logins, amounts []string
+	var loginKeys [][]string
+	for login, amount := range credits {
+		logins = append(logins, login)
+		loginKeys = append(loginKeys, []string{r.minerKey("miners", login), r.minerKey("reorg", login), r.minerKey("ledger", login)})
+		amounts = append(amounts, strconv.FormatFloat(amount, 'f', -1, 64))
+	}
+	replies, debt, err := r.revertLogins(args, logins, loginKeys, amounts)
+	if err != nil {
+		return fmt.Errorf("Fees of block %s are not taken back, %v", ref, err)
+	}
+	_, err = r.execTx("", func(tx *redis.Multi) error {
+		for i := 0; i < len(replies) && i/3 < len(logins); i += 3 {
+			entry, _ := replies[i].(string)
+			r.writeLedgerStream(tx, logins[i/3], entry)
+		}
+		if debt > 0 {
+			tx.HIncrByFloat(r.formatKey("finances"), "debt", debt)
+		}
+		tx.Del(r.formatFeeCredits(block.RoundHeight, block.Nonce))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.revertPoolFee(block)
+}
+
+// Fees of matured PPS+ block in Shannon, less pool fee in percent, are distributed over window snapshot
+// taken at candidate time, pro rata to difficulty of shares. Orphaned block must not be passed.
+// Returns total credited by this call, 0 if block was distributed already.
+func (r *RedisClient) CreditBlockFees(height int64, nonce string, fees int64, fee float64) (float64, error) {
+	shares, err := r.GetRoundShares(height, nonce)
+	if err != nil {
+		return 0, err
+	}
+	if len(shares) == 0 {
+		return 0, errors.New("No window snapshot of block")
+	}
+	total := int64(0)
+	for _, n := range shares {
+		total += n
+	}
+	if total <= 0 || fees <= 0 {
+		return 0, nil
+	}
+	remainder := float64(fees) * (1 - fee/100)
+	// Pool part is accrued first, so it is not lost if distribution fails
+	poolFee := strconv.FormatFloat(float64(fees)-remainder, 'f', -1, 64)
+	if err := r.accruePoolFee(height, nonce, "txPoolFeeAccrued", poolFee, ""); err != nil {
+		return 0, err
+	}
+	ts := util.MakeTimestamp() / 1000
+	ref := join(height, nonce)
+	expire := strconv.FormatInt(int64(feeCreditsExpire/time.Second), 10)
+	credited := 0.0
+	for login, n := range shares {
+		amount := remainder * float64(n) / float64(total)
+		if amount <= 0 {
+			continue
+		}
+		entry := r.ledgerEntry(ts, amount, LedgerFees, ref)
+		keys := []string{r.minerKey("miners", login), r.minerKey("fees", login), r.minerKey("ledger", login)}
+		args := []string{ref, strconv.FormatFloat(amount, 'f', -1, 64), entry, expire}
+		res, err := r.client.Eval(creditFeesLua, keys, args).Result()
+		if err != nil {
+			return credited, err
+		}
+		applied, _ := res.(int64)
+		if applied == 1 {
+			credited += amount
+		}
+		// Credit is recorded on retry too, if crash came after it. Stream is record only,
+		// entry of credit applied is not written again on retry.
+		tx, err := r.multi("")
+		if err != nil {
+			return credited, err
+		}
+		_, err = tx.Exec(func() error {
+			tx.HSetNX(r.formatFeeCredits(height, nonce), login, args[1])
+			if applied == 1 {
+				r.writeLedgerStream(tx, login, entry)
+			}
+			return nil
+		})
+		tx.Close()
+		if err != nil {
+			return credited, err
+		}
+	}
+	return credited, nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"strconv"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Critical error of payer, payouts don't run until operator clears it
+type PayoutsHalt struct {
+	Reason string `json:"reason"`
+	At     int64  `json:"at"`
+	// Payer which halted, as owner of leader lock
+	By string `json:"by"`
+}
+
+// First halt is kept, it is the one operator must look into
+func (r *RedisClient) WritePayoutsHalt(reason, by string) error {
+	key := r.formatKey("payments", "halt")
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.HSetNX(key, "reason", reason)
+		tx.HSetNX(key, "at", strconv.FormatInt(util.MakeTimestamp()/1000, 10))
+		tx.HSetNX(key, "by", by)
+		return nil
+	})
+	return err
+}
+
+// Nil if payouts are not halted
+func (r *RedisClient) GetPayoutsHalt() (*PayoutsHalt, error) {
+	var values map[string]string
+	err := r.retryRead(func() error {
+		var err error
+		values, err = r.client.HGetAllMap(r.formatKey("payments", "halt")).Result()
+		return err
+	})
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	halt := &PayoutsHalt{Reason: values["reason"], By: values["by"]}
+	halt.At, _ = strconv.ParseInt(values["at"], 10, 64)
+	return halt, nil
+}
+
+func (r *RedisClient) ClearPayoutsHalt() error {
+	return r.client.Del(r.formatKey("payments", "halt")).Err()
+}
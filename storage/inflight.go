@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Payment debited and locked whose tx is not final yet. Nonce is reserved before first tx is sent,
+// tx hashes are of tx sent with it, replacement last. Cleared with payment write and with unlock.
+type InflightPayment struct {
+	Login    string   `json:"login"`
+	Amount   int64    `json:"amount"`
+	Nonce    uint64   `json:"nonce"`
+	TxHashes []string `json:"txHashes"`
+	// Time last tx was sent, 0 before first one
+	SentAt int64 `json:"sentAt"`
+	// Empty for payment of miner, PaymentSweep for sweep of pool fee to login
+	Kind string `json:"kind,omitempty"`
+}
+
+func (r *RedisClient) WriteInflightPayment(p *InflightPayment) error {
+	key := r.formatKey("payments", "inflight")
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.Del(key)
+		tx.HMSet(key, "login", p.Login,
+			"amount", strconv.FormatInt(p.Amount, 10),
+			"nonce", strconv.FormatUint(p.Nonce, 10),
+			"txHashes", strings.Join(p.TxHashes, ","),
+			"sentAt", strconv.FormatInt(p.SentAt, 10),
+			"kind", p.Kind)
+		return nil
+	})
+	return err
+}
+
+// Nil if no payment is in flight
+func (r *RedisClient) GetInflightPayment() (*InflightPayment, error) {
+	var values map[string]string
+	err := r.retryRead(func() error {
+		var err error
+		values, err = r.client.HGetAllMap(r.formatKey("payments", "inflight")).Result()
+		return err
+	})
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	p := &InflightPayment{Login: values["login"], Kind: values["kind"]}
+	p.Amount, _ = strconv.ParseInt(values["amount"], 10, 64)
+	p.Nonce, _ = strconv.ParseUint(values["nonce"], 10, 64)
+	p.SentAt, _ = strconv.ParseInt(values["sentAt"], 10, 64)
+	if len(values["txHashes"]) > 0 {
+		p.TxHashes = strings.Split(values["txHashes"], ",")
+	}
+	return p, nil
+}
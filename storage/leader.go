@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// Lock names of modules which must run on one instance
+const LeaderPayouts = "payouts"
+
+// Lock is extended by its owner only, so instance which lost it can't renew lock taken by another one
+const (
+	acquireLeaderLua = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2], 'NX') then
+	return 1
+end
+return 0
+`
+	releaseLeaderLua = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+)
+
+// Takes lock if it is free, renews it if owner holds it already. False if another owner holds it.
+func (r *RedisClient) AcquireLeader(name, owner string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	n, err := r.client.Eval(acquireLeaderLua, []string{r.formatKey("leader", name)}, []string{owner, ms}).Result()
+	if err != nil {
+		return false, err
+	}
+	held, _ := n.(int64)
+	return held == 1, nil
+}
+
+// Lock held by another owner is left in place
+func (r *RedisClient) ReleaseLeader(name, owner string) error {
+	return r.client.Eval(releaseLeaderLua, []string{r.formatKey("leader", name)}, []string{owner}).Err()
+}
+
+// Owner and time left of lock, empty owner if lock is free
+func (r *RedisClient) GetLeader(name string) (string, time.Duration, error) {
+	key := r.formatKey("leader", name)
+	var owner string
+	var ttl time.Duration
+	err := r.retryRead(func() error {
+		var err error
+		if owner, err = r.client.Get(key).Result(); err != nil {
+			return err
+		}
+		ttl, err = r.client.PTTL(key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", 0, nil
+	}
+	return owner, ttl, err
+}
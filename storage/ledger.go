@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Reasons of balance change
+const (
+	LedgerShare  = "share"
+	LedgerPayout = "payout"
+	LedgerMerge  = "merge"
+	LedgerFees   = "fees"
+	// Immature credit of block becomes spendable
+	LedgerBlock = "block"
+	// Credit of matured block which is reorged out is taken back
+	LedgerReorg = "reorg"
+	// Bonus of block finder from pool fee, once block matures
+	LedgerFinderBonus = "finderBonus"
+	// Manual credit or debit by operator, ref is request id
+	LedgerAdjust = "adjust"
+)
+
+const (
+	defaultLedgerEntries      = 1000
+	defaultLedgerStreamLength = 100000
+	// Float credits are summed in different order by redis and by reconciliation
+	ledgerTolerance = 1.0
+)
+
+// Every balance change goes to list of login and to pool stream. Stream needs redis 5.
+type LedgerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Entries kept in list of login by maintenance, older ones are folded into opening balance
+	Entries int64 `json:"entries"`
+	// Approximate length of pool stream
+	StreamLength int64 `json:"streamLength"`
+}
+
+// List entry is ts:amount:reason:ref, ref is header hash of job for shares
+type LedgerEntry struct {
+	Timestamp int64   `json:"timestamp"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason"`
+	Ref       string  `json:"ref,omitempty"`
+}
+
+type LedgerReport struct {
+	Checked int64
+	// Entries folded into opening balance
+	Folded int64
+	// Balance minus ledger total of logins which don't reconcile
+	Mismatches map[string]float64
+}
+
+// Empty if ledger is disabled or there is no change
+func (r *RedisClient) ledgerEntry(ts int64, amount float64, reason, ref string) string {
+	if !r.cfg.Ledger.Enabled || amount == 0 {
+		return ""
+	}
+	return join(ts, strconv.FormatFloat(amount, 'f', -1, 64), reason, ref)
+}
+
+// Miner part, list is cut in the same transaction
+func (r *RedisClient) writeLedger(tx *redis.Multi, login, entry string) {
+	if len(entry) > 0 {
+		tx.RPush(r.minerKey("ledger", login), entry)
+		tx.LTrim(r.minerKey("ledger", login), -r.ledgerListLimit(), -1)
+	}
+}
+
+// Pool part
+func (r *RedisClient) writeLedgerStream(tx *redis.Multi, login, entry string) {
+	if len(entry) > 0 {
+		tx.Process(redis.NewStringCmd("XADD", r.formatKey("ledger"), "MAXLEN", "~", r.ledgerStreamLength(), "*", "login", login, "entry", entry))
+	}
+}
+
+func (r *RedisClient) ledgerStreamLength() int64 {
+	if r.cfg.Ledger.StreamLength > 0 {
+		return r.cfg.Ledger.StreamLength
+	}
+	return defaultLedgerStreamLength
+}
+
+func (r *RedisClient) ledgerEntries() int64 {
+	if r.cfg.Ledger.Entries > 0 {
+		return r.cfg.Ledger.Entries
+	}
+	return defaultLedgerEntries
+}
+
+// Bound of list of login on write, so it does not grow with maintenance off. Maintenance folds
+// entries beyond kept number first, entries cut at this bound are not in opening balance.
+func (r *RedisClient) ledgerListLimit() int64 {
+	return 2 * r.ledgerEntries()
+}
+
+func parseLedgerEntry(v string) (*LedgerEntry, bool) {
+	fields := strings.SplitN(v, ":", 4)
+	if len(fields) != 4 {
+		return nil, false
+	}
+	e := &LedgerEntry{Reason: fields[2], Ref: fields[3]}
+	e.Timestamp, _ = strconv.ParseInt(fields[0], 10, 64)
+	e.Amount, _ = strconv.ParseFloat(fields[1], 64)
+	return e, true
+}
+
+// Newest first, total is number of entries kept for login. Range of negative indexes
+// is clamped by redis at head of list.
+func (r *RedisClient) GetLedger(login string, offset, limit int64) ([]*LedgerEntry, int64, error) {
+	key := r.minerKey("ledger", login)
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		var err error
+		cmds, err = r.execTx(login, func(tx *redis.Multi) error {
+			tx.LLen(key)
+			tx.LRange(key, -(offset + limit), -(offset + 1))
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	total := cmds[0].(*redis.IntCmd).Val()
+	raw := cmds[1].(*redis.StringSliceCmd).Val()
+	entries := make([]*LedgerEntry, 0, len(raw))
+	for i := len(raw) - 1; i >= 0; i-- {
+		if e, ok := parseLedgerEntry(raw[i]); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, total, nil
+}
+
+// Balance of each login must equal ledgerOpening of its miner hash plus ledger entries. Opening is taken
+// on first check for logins which had balance before ledger was enabled. Entries beyond kept number are
+// folded into opening, so run it on single instance. Nil report if ledger is disabled.
+func (r *RedisClient) ReconcileLedger(opsPerSecond int) (*LedgerReport, error) {
+	if !r.cfg.Ledger.Enabled {
+		return nil, nil
+	}
+	p := newPacer(opsPerSecond)
+	report := &LedgerReport{Mismatches: make(map[string]float64)}
+	err := r.scanKeys(join(r.prefix, "miners", "*"), func(keys []string) error {
+		p.wait()
+		for _, key := range keys {
+			p.wait()
+			if err := r.reconcileLogin(p, keyLogin(key), report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+func (r *RedisClient) reconcileLogin(p *pacer, login string, report *LedgerReport) error {
+	key := r.minerKey("ledger", login)
+	// Balance and entries are read at once, share meanwhile would be on one side only
+	cmds, err := r.execTx(login, func(tx *redis.Multi) error {
+		tx.HMGet(r.minerKey("miners", login), "balance", "ledgerOpening", "pending")
+		tx.LRange(key, 0, -1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	values := cmds[0].(*redis.SliceCmd).Val()
+	entries := cmds[1].(*redis.StringSliceCmd).Val()
+	// Payout is debited in ledger once it is written with tx hash, amount in flight is pending until then
+	balance, _ := strconv.ParseFloat(stringValue(values[0]), 64)
+	pending, _ := strconv.ParseFloat(stringValue(values[2]), 64)
+	balance += pending
+	total := 0.0
+	for _, v := range entries {
+		if e, ok := parseLedgerEntry(v); ok {
+			total += e.Amount
+		}
+	}
+	report.Checked++
+
+	if values[1] == nil {
+		p.wait()
+		return r.client.HSetNX(r.minerKey("miners", login), "ledgerOpening", strconv.FormatFloat(balance-total, 'f', -1, 64)).Err()
+	}
+	opening, _ := strconv.ParseFloat(stringValue(values[1]), 64)
+	if diff := balance - opening - total; math.Abs(diff) > ledgerTolerance {
+		report.Mismatches[login] = diff
+	}
+
+	fold := int64(len(entries)) - r.ledgerEntries()
+	if fold <= 0 {
+		return nil
+	}
+	folded := 0.0
+	for _, v := range entries[:fold] {
+		if e, ok := parseLedgerEntry(v); ok {
+			folded += e.Amount
+		}
+	}
+	// Only this pass removes head of list, entries appended meanwhile are past it
+	p.wait()
+	_, err = r.execTx(login, func(tx *redis.Multi) error {
+		tx.HIncrByFloat(r.minerKey("miners", login), "ledgerOpening", folded)
+		tx.LTrim(key, fold, -1)
+		return nil
+	})
+	if err == nil {
+		report.Folded += fold
+	}
+	return err
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Candidate goes to immature once credited as immature balance, immature one to matured
+// once credit is spendable, either of them to orphaned with immature credit reverted
+const (
+	BlockCandidate = "candidate"
+	BlockImmature  = "immature"
+	BlockMatured   = "matured"
+	BlockOrphaned  = "orphaned"
+)
+
+const (
+	creditImmature = "credit"
+	creditMature   = "mature"
+	creditRevert   = "revert"
+)
+
+// Block is moved between state sets and its state record is written first, script returns then
+// if block has left source set already. Credit of login is applied once per block in each direction,
+// immature:login has blocks credited as immature, so retry only does the rest.
+//
+// KEYS: source set, target set, state of block, then miners:login, immature:login and ledger:login of each login
+// ARGV: source member, target member, height, state, ts, block ref, credit op, then amount and ledger entry of each login
+const (
+	blockStateLua = `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return {}
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+redis.call('HMSET', KEYS[3], 'state', ARGV[4], ARGV[4] .. 'At', ARGV[5])
+`
+	immatureCreditsLua = `
+local applied = {}
+for i = 0, (#KEYS - base) / 3 - 1 do
+	local miner, marker, ledger = KEYS[base + 1 + i * 3], KEYS[base + 2 + i * 3], KEYS[base + 3 + i * 3]
+	local amount, entry = ARGV[8 + i * 2], ARGV[9 + i * 2]
+	applied[i + 1] = 0
+	if ARGV[7] == 'credit' then
+		if redis.call('SADD', marker, ARGV[6]) == 1 then
+			redis.call('HINCRBY', miner, 'immature', amount)
+			applied[i + 1] = 1
+		end
+	elseif redis.call('SREM', marker, ARGV[6]) == 1 then
+		redis.call('HINCRBY', miner, 'immature', '-' .. amount)
+		if ARGV[7] == 'mature' then
+			redis.call('HINCRBYFLOAT', miner, 'balance', amount)
+			if entry ~= '' then
+				redis.call('RPUSH', ledger, entry)
+			end
+		end
+		applied[i + 1] = 1
+	end
+end
+return applied
+`
+)
+
+// One script over pool and miner keys, credit and state change are atomic
+var lifecycleLua = blockStateLua + "local base = 3\n" + immatureCreditsLua
+
+// Miner keys of one login in cluster mode, state is changed after all logins
+var loginCreditsLua = "local base = 0\n" + immatureCreditsLua
+
+// Member of immature, matured and orphaned sets is hash:height:uncleHeight:reward followed by candidate member,
+// score is round height as of candidate. Height of uncle is one of block including it.
+func (b *BlockData) lifecycleKey() string {
+	reward := "0"
+	if b.Reward != nil {
+		reward = b.Reward.String()
+	}
+	return join(b.Hash, b.Height, b.UncleHeight, reward, b.candidateKey)
+}
+
+func (r *RedisClient) formatBlockState(height int64, nonce string) string {
+	return r.formatKey("blocks", "state", height, nonce)
+}
+
+// Immature credit of block in Shannon, written once so orphan and maturity revert what was credited.
+// Kept for matured block, so reorg audit takes back what was credited.
+func (r *RedisClient) formatBlockCredits(height int64, nonce string) string {
+	return r.formatKey("credits", "immature", height, nonce)
+}
+
+func blockSet(state string) string {
+	if state == BlockCandidate {
+		return "candidates"
+	}
+	return state
+}
+
+// Candidate of GetCandidates is credited as immature balance, in Shannon. Reward and hash of block are kept.
+// Pool fee and finder bonus of block in Shannon are accrued and paid once block matures, see docs/PAYOUTS.md.
+func (r *RedisClient) WriteImmatureBlock(block *BlockData, credits map[string]int64, poolFee, bonus int64) error {
+	if len(credits) > 0 || poolFee > 0 || bonus > 0 {
+		_, err := r.execTx("", func(tx *redis.Multi) error {
+			key := r.formatBlockCredits(block.RoundHeight, block.Nonce)
+			for login, amount := range credits {
+				tx.HSet(key, login, strconv.FormatInt(amount, 10))
+			}
+			if poolFee > 0 {
+				tx.HSet(r.formatBlockState(block.RoundHeight, block.Nonce), "poolFee", strconv.FormatInt(poolFee, 10))
+			}
+			if bonus > 0 {
+				tx.HSet(r.formatBlockState(block.RoundHeight, block.Nonce), "finderBonus", strconv.FormatInt(bonus, 10))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return r.moveBlock(block, BlockCandidate, BlockImmature, block.candidateKey, creditImmature, credits)
+}
+
+// Immature credit of block of GetImmatureBlocks becomes spendable balance, finder bonus is credited
+func (r *RedisClient) WriteMaturedBlock(block *BlockData) error {
+	credits, err := r.getBlockCredits(block)
+	if err != nil {
+		return err
+	}
+	if err := r.moveBlock(block, BlockImmature, BlockMatured, block.immatureKey, creditMature, credits); err != nil {
+		return err
+	}
+	// Retry of matured block pays what is not paid yet
+	if err := r.payFinderBonus(block); err != nil {
+		return err
+	}
+	return r.accruePoolFee(block.RoundHeight, block.Nonce, "poolFeeAccrued", "", BlockMatured)
+}
+
+// Candidate or immature block, immature credit is reverted. Fees credited to immature block are taken back first,
+// so block stays immature until retry if it fails.
+func (r *RedisClient) WriteOrphanBlock(block *BlockData) error {
+	credits, err := r.getBlockCredits(block)
+	if err != nil {
+		return err
+	}
+	from, member := BlockCandidate, block.candidateKey
+	if len(block.immatureKey) > 0 {
+		if err := r.revertFeeCredits(block); err != nil {
+			return err
+		}
+		from, member = BlockImmature, block.immatureKey
+	}
+	block.Orphan = true
+	block.Reward = nil
+	return r.moveBlock(block, from, BlockOrphaned, member, creditRevert, credits)
+}
+
+func (r *RedisClient) getBlockCredits(block *BlockData) (map[string]int64, error) {
+	var values map[string]string
+	err := r.retryRead(func() error {
+		var err error
+		values, err = r.client.HGetAllMap(r.formatBlockCredits(block.RoundHeight, block.Nonce)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	credits := make(map[string]int64, len(values))
+	for login, v := range values {
+		credits[login], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return credits, nil
+}
+
+func (r *RedisClient) moveBlock(block *BlockData, from, to, member, op string, credits map[string]int64) error {
+	ts := util.MakeTimestamp() / 1000
+	ref := join(block.RoundHeight, block.Nonce)
+	poolKeys := []string{
+		r.formatKey("blocks", blockSet(from)),
+		r.formatKey("blocks", blockSet(to)),
+		r.formatBlockState(block.RoundHeight, block.Nonce),
+	}
+	poolArgs := []string{member, block.lifecycleKey(), strconv.FormatInt(block.RoundHeight, 10), to, strconv.FormatInt(ts, 10), ref, op}
+
+	var logins, entries []string
+	var loginKeys, loginArgs [][]string
+	for login, amount := range credits {
+		entry := ""
+		if op == creditMature {
+			entry = r.ledgerEntry(ts, float64(amount), LedgerBlock, ref)
+		}
+		logins = append(logins, login)
+		entries = append(entries, entry)
+		loginKeys = append(loginKeys, []string{r.minerKey("miners", login), r.minerKey("immature", login), r.minerKey("ledger", login)})
+		loginArgs = append(loginArgs, []string{strconv.FormatInt(amount, 10), entry})
+	}
+
+	var applied []interface{}
+	if r.cluster == nil {
+		keys, args := poolKeys, poolArgs
+		for i := range logins {
+			keys = append(keys, loginKeys[i]...)
+			args = append(args, loginArgs[i]...)
+		}
+		res, err := r.client.Eval(lifecycleLua, keys, args).Result()
+		if err != nil {
+			return err
+		}
+		applied, _ = res.([]interface{})
+	} else {
+		for i, login := range logins {
+			res, err := r.client.Eval(loginCreditsLua, loginKeys[i], append(append([]string{}, poolArgs...), loginArgs[i]...)).Result()
+			if err != nil {
+				return fmt.Errorf("Block %s is not moved to %s, credit of %s failed: %v", ref, to, login, err)
+			}
+			flags, _ := res.([]interface{})
+			applied = append(applied, flags...)
+		}
+		if err := r.client.Eval(blockStateLua+"return {}\n", poolKeys, poolArgs).Err(); err != nil && err != redis.Nil {
+			return fmt.Errorf("Credits of block %s are applied, it is not moved to %s: %v", ref, to, err)
+		}
+	}
+
+	// Stream is record only, entry of credit applied is not written again on retry
+	tx, err := r.multi("")
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	_, err = tx.Exec(func() error {
+		for i, v := range applied {
+			if n, _ := v.(int64); n == 1 && i < len(logins) {
+				r.writeLedgerStream(tx, logins[i], entries[i])
+			}
+		}
+		if to == BlockOrphaned {
+			tx.Del(r.formatBlockCredits(block.RoundHeight, block.Nonce))
+		}
+		return nil
+	})
+	return err
+}
+
+// Immature blocks up to maxHeight, oldest first
+func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	return r.getLifecycleBlocks(BlockImmature, redis.ZRangeByScore{Min: "0", Max: strconv.FormatInt(maxHeight, 10)})
+}
+
+// Matured blocks from round height minHeight on, oldest first
+func (r *RedisClient) GetMaturedBlocks(minHeight int64) ([]*BlockData, error) {
+	return r.getLifecycleBlocks(BlockMatured, redis.ZRangeByScore{Min: strconv.FormatInt(minHeight, 10), Max: "+inf"})
+}
+
+func (r *RedisClient) getLifecycleBlocks(state string, option redis.ZRangeByScore) ([]*BlockData, error) {
+	var cmd *redis.ZSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.ZRangeByScoreWithScores(r.formatKey("blocks", state), option)
+		return cmd.Err()
+	})
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertLifecycleResults(cmd.Val()), nil
+}
+
+// Page of blocks in state, newest first, with time of transitions, and total of them
+func (r *RedisClient) GetBlocks(state string, offset, limit int64) ([]*BlockData, int64, error) {
+	switch state {
+	case BlockCandidate, BlockImmature, BlockMatured, BlockOrphaned:
+	default:
+		return nil, 0, fmt.Errorf("Unknown block state %s", state)
+	}
+	key := r.formatKey("blocks", blockSet(state))
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		tx, err := r.multi("")
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		cmds, err = tx.Exec(func() error {
+			tx.ZRevRangeWithScores(key, offset, offset+limit-1)
+			tx.ZCard(key)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	raw := cmds[0].(*redis.ZSliceCmd).Val()
+	total := cmds[1].(*redis.IntCmd).Val()
+	var blocks []*BlockData
+	if state == BlockCandidate {
+		blocks = convertCandidateResults(cmds[0].(*redis.ZSliceCmd))
+	} else {
+		blocks = convertLifecycleResults(raw)
+	}
+	if len(blocks) == 0 {
+		return blocks, total, nil
+	}
+
+	err = r.retryRead(func() error {
+		tx, err := r.multi("")
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		cmds, err = tx.Exec(func() error {
+			for _, b := range blocks {
+				tx.HGetAllMap(r.formatBlockState(b.RoundHeight, b.Nonce))
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, b := range blocks {
+		times, _ := cmds[i].(*redis.StringStringMapCmd).Result()
+		b.State = state
+		b.Orphan = state == BlockOrphaned
+		b.ImmatureAt, _ = strconv.ParseInt(times[BlockImmature+"At"], 10, 64)
+		b.MaturedAt, _ = strconv.ParseInt(times[BlockMatured+"At"], 10, 64)
+		b.OrphanedAt, _ = strconv.ParseInt(times[BlockOrphaned+"At"], 10, 64)
+		b.FinderBonus, _ = strconv.ParseInt(times["finderBonus"], 10, 64)
+	}
+	return blocks, total, nil
+}
+
+func convertLifecycleResults(raw []redis.Z) []*BlockData {
+	var result []*BlockData
+	for _, v := range raw {
+		fields := strings.SplitN(v.Member.(string), ":", 5)
+		if len(fields) < 5 {
+			continue
+		}
+		block := parseCandidate(v.Score, fields[4])
+		block.Hash = fields[0]
+		block.Height, _ = strconv.ParseInt(fields[1], 10, 64)
+		block.UncleHeight, _ = strconv.ParseInt(fields[2], 10, 64)
+		block.Uncle = block.UncleHeight > 0
+		block.RewardString = fields[3]
+		if reward, ok := new(big.Int).SetString(fields[3], 10); ok {
+			block.Reward = reward
+		}
+		block.immatureKey = v.Member.(string)
+		result = append(result, block)
+	}
+	return result
+}
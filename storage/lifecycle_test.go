@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"math/big"
+	"testing"
+
+	"gopkg.in/redis.v3"
+)
+
+// Block read back from immature set keeps its reward in member of matured set
+func TestLifecycleKeyKeepsReward(t *testing.T) {
+	candidate := "0x1:0x2:0x3:1500000000:1000:200:0xaa:pps:rig:500"
+	block := parseCandidate(100, candidate)
+	block.Hash = "0xabc"
+	block.Height = 102
+	block.Reward, _ = new(big.Int).SetString("3000000000000000000", 10)
+	immature := block.lifecycleKey()
+
+	blocks := convertLifecycleResults([]redis.Z{{Score: 100, Member: immature}})
+	if len(blocks) != 1 {
+		t.Fatalf("Got %v blocks, want 1", len(blocks))
+	}
+	read := blocks[0]
+	if read.Reward == nil || read.Reward.Cmp(block.Reward) != 0 {
+		t.Errorf("Reward of read block is %v, want %v", read.Reward, block.Reward)
+	}
+	if matured := read.lifecycleKey(); matured != immature {
+		t.Errorf("Matured member is %v, want %v", matured, immature)
+	}
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+)
+
+// Prefix goes before every key and is hash tag of pool keys in cluster mode,
+// so separator, hash tag braces and glob characters of SCAN patterns are not allowed
+var prefixPattern = regexp.MustCompile("^[0-9a-zA-Z-_.]{1,32}$")
+
+func ValidatePrefix(prefix string) error {
+	if !prefixPattern.MatchString(prefix) {
+		return fmt.Errorf("Invalid redis key prefix %q, it must be 1 to 32 of letters, digits, '-', '_' and '.'", prefix)
+	}
+	return nil
+}
+
+func (r *RedisClient) Prefix() string {
+	return r.prefix
+}
+
+// Key of old prefix under prefix of client, hash tag of pool key is kept in place
+func (r *RedisClient) migratedKey(key, from string) string {
+	if strings.HasPrefix(key, "{"+from+"}:") {
+		return "{" + r.prefix + "}:" + key[len(from)+3:]
+	}
+	return r.prefix + ":" + key[len(from)+1:]
+}
+
+// Keys of old prefix are moved under prefix of client with value and TTL, key which exists under new
+// prefix already is left in place and counted as conflict. Keys are dumped and restored, as pool keys
+// change slot in cluster mode, so pool must be stopped while it runs. Nothing is written on dry run,
+// progress is called with number of keys walked so far.
+func (r *RedisClient) MigratePrefix(from string, dryRun bool, opsPerSecond int, progress func(walked, moved, conflicts int)) (int, int, error) {
+	if err := ValidatePrefix(from); err != nil {
+		return 0, 0, err
+	}
+	if from == r.prefix {
+		return 0, 0, fmt.Errorf("Keys are under prefix %s already", from)
+	}
+	p := newPacer(opsPerSecond)
+	walked, moved, conflicts := 0, 0, 0
+
+	migrate := func(keys []string) error {
+		p.wait()
+		for _, key := range keys {
+			walked++
+			to := r.migratedKey(key, from)
+			p.wait()
+			exists, err := r.client.Exists(to).Result()
+			if err != nil {
+				return err
+			}
+			if exists {
+				conflicts++
+				continue
+			}
+			if !dryRun {
+				if err := r.moveKey(p, key, to); err != nil {
+					return fmt.Errorf("Failed to move %s to %s: %v", key, to, err)
+				}
+			}
+			moved++
+		}
+		progress(walked, moved, conflicts)
+		return nil
+	}
+	// Pool keys are hash tagged if old keys were written in cluster mode
+	for _, match := range []string{from + ":*", "{" + from + "}:*"} {
+		if err := r.scanKeys(match, migrate); err != nil {
+			return moved, conflicts, err
+		}
+	}
+	return moved, conflicts, nil
+}
+
+func (r *RedisClient) moveKey(p *pacer, from, to string) error {
+	p.wait()
+	dump, err := r.client.Dump(from).Result()
+	if err == redis.Nil {
+		// Expired meanwhile
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.wait()
+	ttl, err := r.client.PTTL(from).Result()
+	if err != nil {
+		return err
+	}
+	// Negative for key without expiration
+	if ttl < 0 {
+		ttl = 0
+	} else if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	p.wait()
+	if err := r.client.Restore(to, ttl, dump).Err(); err != nil {
+		return err
+	}
+	p.wait()
+	return r.client.Del(from).Err()
+}
@@ -0,0 +1,66 @@
+package storage
+
+// Schema of postgres backend, append new migrations, never edit applied ones.
+// Amounts are in Shannon and timestamps in unix seconds, as in redis.
+var migrations = []string{
+	// 1: payments, balances, blocks and finders
+	`CREATE TABLE balances (
+		login TEXT PRIMARY KEY,
+		pending BIGINT NOT NULL DEFAULT 0,
+		paid BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE TABLE pending_payments (
+		id BIGSERIAL PRIMARY KEY,
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE payments (
+		id BIGSERIAL PRIMARY KEY,
+		tx_hash TEXT NOT NULL,
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE INDEX payments_login_idx ON payments (login, created_at);
+	CREATE TABLE payouts_lock (
+		id INT PRIMARY KEY CHECK (id = 1),
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		locked_at BIGINT NOT NULL
+	);
+	CREATE TABLE blocks (
+		height BIGINT NOT NULL,
+		nonce TEXT NOT NULL,
+		pow_hash TEXT NOT NULL,
+		mix_digest TEXT NOT NULL,
+		round_diff BIGINT NOT NULL,
+		finder TEXT NOT NULL,
+		worker TEXT NOT NULL,
+		share_diff BIGINT NOT NULL,
+		solo BOOLEAN NOT NULL,
+		found_at BIGINT NOT NULL,
+		PRIMARY KEY (height, nonce)
+	);
+	CREATE INDEX blocks_finder_idx ON blocks (finder, height);
+	CREATE TABLE finders (
+		login TEXT PRIMARY KEY,
+		blocks BIGINT NOT NULL DEFAULT 0
+	)`,
+	// 2: fee paid for payout tx, null until it is confirmed
+	`ALTER TABLE payments ADD COLUMN fee BIGINT;
+	CREATE INDEX payments_tx_hash_idx ON payments (tx_hash)`,
+	// 3: payment debited and locked whose tx is not final yet
+	`CREATE TABLE inflight_payment (
+		id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+		login TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		nonce BIGINT NOT NULL,
+		tx_hashes TEXT NOT NULL,
+		sent_at BIGINT NOT NULL
+	)`,
+	// 4: payment in flight may be sweep of pool fee
+	`ALTER TABLE inflight_payment ADD COLUMN kind TEXT NOT NULL DEFAULT ''`,
+	// 5: owed balance of login as of its last payout debit or rollback
+	`ALTER TABLE balances ADD COLUMN balance BIGINT NOT NULL DEFAULT 0`,
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Status of payout tx in payments:status by tx hash. Payment in history without status was written
+// once its tx was confirmed, before status was recorded, so it is confirmed.
+const (
+	PaymentPending   = "pending"
+	PaymentConfirmed = "confirmed"
+	PaymentFailed    = "failed"
+	// Other tx with the same nonce was confirmed
+	PaymentReplaced = "replaced"
+)
+
+// Block is height tx was mined in, 0 while pending
+func (r *RedisClient) WritePaymentStatus(txHash, status string, block uint64) error {
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.HSet(r.formatKey("payments", "status"), txHash, join(status, block))
+		return nil
+	})
+	return err
+}
+
+// Status and block of tx, empty status if none is recorded
+func (r *RedisClient) GetPaymentStatus(txHash string) (string, uint64, error) {
+	var v string
+	err := r.retryRead(func() error {
+		var err error
+		v, err = r.client.HGet(r.formatKey("payments", "status"), txHash).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return "", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Split(v, ":")
+	if len(fields) != 2 {
+		return "", 0, nil
+	}
+	block, _ := strconv.ParseUint(fields[1], 10, 64)
+	return fields[0], block, nil
+}
+
+// Entries have status, block and fee of tx, as entries of stats. Paid is total paid to login,
+// or by pool, it is counted with history entry of each payment.
+type PaymentsPage struct {
+	Payments []map[string]interface{} `json:"payments"`
+	Total    int64                    `json:"paymentsTotal"`
+	Paid     int64                    `json:"paid"`
+}
+
+// Page of payment history of login, or of pool with empty login, newest first
+func (r *RedisClient) GetPayments(login string, offset, limit int64) (*PaymentsPage, error) {
+	key, counter := r.formatKey("payments", "all"), r.formatKey("finances")
+	if len(login) > 0 {
+		key, counter = r.minerKey("payments", login), r.minerKey("miners", login)
+	}
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		tx, err := r.multi(login)
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		cmds, err = tx.Exec(func() error {
+			tx.ZRevRangeWithScores(key, offset, offset+limit-1)
+			tx.ZCard(key)
+			tx.HGet(counter, "paid")
+			return nil
+		})
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	page := &PaymentsPage{Payments: convertPaymentsResults(cmds[0].(*redis.ZSliceCmd)), Total: cmds[1].(*redis.IntCmd).Val()}
+	page.Paid, _ = cmds[2].(*redis.StringCmd).Int64()
+	r.fillPaymentDetails(page.Payments)
+	return page, nil
+}
+
+// Fee and status are left out if they can't be read, list is shown anyway
+func (r *RedisClient) fillPaymentDetails(payments []map[string]interface{}) {
+	if len(payments) == 0 {
+		return
+	}
+	txs := make([]string, len(payments))
+	for i, tx := range payments {
+		txs[i], _ = tx["tx"].(string)
+	}
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		tx, err := r.multi("")
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		cmds, err = tx.Exec(func() error {
+			tx.HMGet(r.formatKey("payments", "fees"), txs...)
+			tx.HMGet(r.formatKey("payments", "status"), txs...)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return
+	}
+	fees := cmds[0].(*redis.SliceCmd).Val()
+	statuses := cmds[1].(*redis.SliceCmd).Val()
+	for i, tx := range payments {
+		if i < len(fees) {
+			if fee, err := strconv.ParseInt(stringValue(fees[i]), 10, 64); err == nil {
+				tx["fee"] = fee
+			}
+		}
+		tx["status"] = PaymentConfirmed
+		if i < len(statuses) {
+			if fields := strings.Split(stringValue(statuses[i]), ":"); len(fields) == 2 {
+				tx["status"] = fields[0]
+				if block, _ := strconv.ParseUint(fields[1], 10, 64); block > 0 {
+					tx["block"] = block
+				}
+			}
+		}
+	}
+}
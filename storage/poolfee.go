@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"strconv"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Payment of pool fee sweep in payment history, payment of miner has no type
+const PaymentSweep = "sweep"
+
+// Pool fee is accrued in poolFee of finances once per block and source, state of block gates it,
+// so retry of unlocker doesn't accrue it twice. Fee of block is accrued only while block is matured.
+//
+// KEYS: state of block, finances
+// ARGV: gate field, amount, required state, or empty to take amount from poolFee of state
+const accruePoolFeeLua = `
+if ARGV[3] ~= '' and redis.call('HGET', KEYS[1], 'state') ~= ARGV[3] then
+	return 0
+end
+local amount = ARGV[2]
+if amount == '' then
+	amount = redis.call('HGET', KEYS[1], 'poolFee')
+	if not amount then
+		return 0
+	end
+end
+if redis.call('HSETNX', KEYS[1], ARGV[1], amount) == 0 then
+	return 0
+end
+redis.call('HINCRBYFLOAT', KEYS[2], 'poolFee', amount)
+return 1
+`
+
+// Sweep is recorded once per tx, so resumed sweep doesn't count it twice.
+//
+// KEYS: payments:all, finances
+// ARGV: member, ts, amount
+const feeSweepLua = `
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HINCRBY', KEYS[2], 'sweepPending', '-' .. ARGV[3])
+redis.call('HINCRBY', KEYS[2], 'swept', ARGV[3])
+return 1
+`
+
+func (r *RedisClient) accruePoolFee(height int64, nonce, gate, amount, state string) error {
+	keys := []string{r.formatBlockState(height, nonce), r.formatKey("finances")}
+	return r.client.Eval(accruePoolFeeLua, keys, []string{gate, amount, state}).Err()
+}
+
+// Accrued pool fee not swept yet, in Shannon
+func (r *RedisClient) GetPoolFee() (float64, error) {
+	var fee float64
+	err := r.retryRead(func() error {
+		v, err := r.client.HGet(r.formatKey("finances"), "poolFee").Result()
+		if err != nil {
+			return err
+		}
+		fee, err = strconv.ParseFloat(v, 64)
+		return err
+	})
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return fee, err
+}
+
+// Amount of sweep is taken from accrued pool fee before its tx is sent, so crash never sweeps it twice
+func (r *RedisClient) DebitPoolFee(amount int64) error {
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.HIncrByFloat(r.formatKey("finances"), "poolFee", float64(-amount))
+		tx.HIncrBy(r.formatKey("finances"), "sweepPending", amount)
+		return nil
+	})
+	return err
+}
+
+// Debit of sweep whose tx was not sent
+func (r *RedisClient) RollbackPoolFee(amount int64) error {
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.HIncrByFloat(r.formatKey("finances"), "poolFee", float64(amount))
+		tx.HIncrBy(r.formatKey("finances"), "sweepPending", -amount)
+		return nil
+	})
+	return err
+}
+
+// Confirmed sweep tx goes to payment history of pool with sweep type
+func (r *RedisClient) WriteFeeSweep(address, txHash string, amount int64) error {
+	keys := []string{r.formatKey("payments", "all"), r.formatKey("finances")}
+	member := join(txHash, address, amount, PaymentSweep)
+	args := []string{member, strconv.FormatInt(util.MakeTimestamp()/1000, 10), strconv.FormatInt(amount, 10)}
+	return r.client.Eval(feeSweepLua, keys, args).Err()
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/redis.v3"
+)
+
+// Window of PPLNS is this many network difficulties worth of shares by default
+const defaultPPLNSWindow = 2
+
+// Window is list of login:diff, newest first. Shares past limit of weight are trimmed,
+// share crossing it is counted in part. Shares are summed by login into KEYS[2] if given.
+// Keys are pool keys, so scripts run in cluster mode too.
+const (
+	walkWindowLua = `
+local limit = tonumber(ARGV[1])
+local total = 0
+local i = 0
+while total < limit do
+	local chunk = redis.call('LRANGE', KEYS[1], i, i + 999)
+	if #chunk == 0 then
+		break
+	end
+	for _, v in ipairs(chunk) do
+		local sep = string.find(v, ':', 1, true)
+		local diff = math.min(tonumber(string.sub(v, sep + 1)), limit - total)
+		if KEYS[2] then
+			redis.call('HINCRBY', KEYS[2], string.sub(v, 1, sep - 1), string.format('%d', diff))
+		end
+		total = total + diff
+		i = i + 1
+		if total >= limit then
+			break
+		end
+	end
+end
+redis.call('LTRIM', KEYS[1], 0, i - 1)
+return string.format('%d', total)
+`
+	// Snapshot left by write of the same block is kept
+	snapshotWindowLua = `
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	local total = 0
+	for _, v in ipairs(redis.call('HVALS', KEYS[2])) do
+		total = total + tonumber(v)
+	end
+	return string.format('%d', total)
+end
+` + walkWindowLua
+)
+
+func parseRewardMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ModePPS, nil
+	case ModePPS, ModePPLNS, ModePPSPlus:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown reward mode %s", mode)
+}
+
+// Mode is recorded on first start, pool refuses to start in other mode then, so instances never credit
+// per share and distribute over window at once. Mode is changed with SwitchRewardMode only.
+func (r *RedisClient) SetRewardMode(mode string, window float64) error {
+	mode, err := parseRewardMode(mode)
+	if err != nil {
+		return err
+	}
+	key := r.formatKey("rewardMode")
+	if err := r.client.SetNX(key, mode, 0).Err(); err != nil {
+		return err
+	}
+	recorded, err := r.client.Get(key).Result()
+	if err != nil {
+		return err
+	}
+	if recorded != mode {
+		return fmt.Errorf("Pool accounts in %s reward mode, refusing to run in %s mode, switch it with switch-reward-mode command", recorded, mode)
+	}
+	r.rewardMode = mode
+	r.pplnsWindow = window
+	if r.pplnsWindow <= 0 {
+		r.pplnsWindow = defaultPPLNSWindow
+	}
+	return nil
+}
+
+// Recorded mode is replaced and previous one returned, run it with all instances stopped. Candidates keep mode
+// they were found in, so unlocker credits them as before. Window is dropped unless both modes keep it,
+// so shares of earlier PPLNS period are never counted again.
+func (r *RedisClient) SwitchRewardMode(mode string) (string, error) {
+	mode, err := parseRewardMode(mode)
+	if err != nil {
+		return "", err
+	}
+	key := r.formatKey("rewardMode")
+	prev, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		prev = ModePPS
+	} else if err != nil {
+		return "", err
+	}
+	windowed := func(mode string) bool {
+		return mode == ModePPLNS || mode == ModePPSPlus
+	}
+	_, err = r.execTx("", func(tx *redis.Multi) error {
+		tx.Set(key, mode, 0)
+		if !windowed(prev) || !windowed(mode) {
+			tx.Del(r.formatKey("shares", "pplns"))
+		}
+		return nil
+	})
+	return prev, err
+}
+
+// Balance is credited per share, except in PPLNS mode
+func (r *RedisClient) creditShares() bool {
+	return r.rewardMode != ModePPLNS
+}
+
+// Shares go to window in PPLNS and PPS+ modes
+func (r *RedisClient) windowShares() bool {
+	return r.rewardMode == ModePPLNS || r.rewardMode == ModePPSPlus
+}
+
+func (r *RedisClient) windowLimit(netDiff int64) string {
+	return strconv.FormatFloat(r.pplnsWindow*float64(netDiff), 'f', 0, 64)
+}
+
+// Shares past window of network difficulty are dropped, no-op in PPS mode
+func (r *RedisClient) TrimPPLNSWindow(netDiff int64) error {
+	if !r.windowShares() {
+		return nil
+	}
+	return r.client.Eval(walkWindowLua, []string{r.formatKey("shares", "pplns")}, []string{r.windowLimit(netDiff)}).Err()
+}
+
+// Mode of candidate. Shares of window at candidate time are summed by login in PPLNS and PPS+ modes,
+// block reward or fees of block are distributed over them on unlock.
+func (r *RedisClient) snapshotRound(height int64, nonce string, netDiff int64) (string, error) {
+	if !r.windowShares() {
+		return ModePPS, nil
+	}
+	keys := []string{r.formatKey("shares", "pplns"), r.formatPPLNSRound(height, nonce)}
+	return r.rewardMode, r.client.Eval(snapshotWindowLua, keys, []string{r.windowLimit(netDiff)}).Err()
+}
+
+// Window snapshot of PPLNS or PPS+ block summed by login, empty if block has none
+func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	var snapshot map[string]string
+	err := r.retryRead(func() error {
+		var err error
+		snapshot, err = r.client.HGetAllMap(r.formatPPLNSRound(height, nonce)).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	shares := make(map[string]int64, len(snapshot))
+	for login, v := range snapshot {
+		shares[login], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return shares, nil
+}
+
+func (r *RedisClient) formatPPLNSRound(height int64, nonce string) string {
+	return r.formatKey("shares", "pplns"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (r *RedisClient) writeWindowShare(tx *redis.Multi, login string, diff int64) {
+	tx.LPush(r.formatKey("shares", "pplns"), join(login, diff))
+}
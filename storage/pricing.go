@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Effective PPS rate, Shannon per unit of share difficulty with fee deducted
+type PPSRate struct {
+	Timestamp int64   `json:"timestamp"`
+	Rate      float64 `json:"rate"`
+	// Network difficulty rate was derived from
+	NetDiff int64 `json:"netDiff"`
+	// Instance which computed it
+	Node string `json:"node"`
+}
+
+// Current rate in pps hash, history in pps:history sorted by time, maxHistory entries are kept
+func (r *RedisClient) WritePPSRate(rate *PPSRate, maxHistory int64) error {
+	value := strconv.FormatFloat(rate.Rate, 'g', -1, 64)
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.HMSet(r.formatKey("pps"), "rate", value, "timestamp", strconv.FormatInt(rate.Timestamp, 10),
+			"netDiff", strconv.FormatInt(rate.NetDiff, 10), "node", rate.Node)
+		tx.ZAdd(r.formatKey("pps", "history"), redis.Z{Score: float64(rate.Timestamp), Member: join(rate.Timestamp, value, rate.NetDiff, rate.Node)})
+		tx.ZRemRangeByRank(r.formatKey("pps", "history"), 0, -(maxHistory + 1))
+		return nil
+	})
+	return err
+}
+
+// Nil if rate was never written
+func (r *RedisClient) GetPPSRate() (*PPSRate, error) {
+	var cmd *redis.StringStringMapCmd
+	r.retryRead(func() error {
+		cmd = r.client.HGetAllMap(r.formatKey("pps"))
+		return cmd.Err()
+	})
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	v := cmd.Val()
+	if len(v["rate"]) == 0 {
+		return nil, nil
+	}
+	rate := &PPSRate{Node: v["node"]}
+	rate.Rate, _ = strconv.ParseFloat(v["rate"], 64)
+	rate.Timestamp, _ = strconv.ParseInt(v["timestamp"], 10, 64)
+	rate.NetDiff, _ = strconv.ParseInt(v["netDiff"], 10, 64)
+	return rate, nil
+}
+
+// Newest first
+func (r *RedisClient) GetPPSRates(max int64) ([]*PPSRate, error) {
+	var cmd *redis.ZSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.ZRevRangeWithScores(r.formatKey("pps", "history"), 0, max-1)
+		return cmd.Err()
+	})
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	var result []*PPSRate
+	for _, v := range cmd.Val() {
+		fields := strings.SplitN(v.Member.(string), ":", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		rate := &PPSRate{Timestamp: int64(v.Score), Node: fields[3]}
+		rate.Rate, _ = strconv.ParseFloat(fields[1], 64)
+		rate.NetDiff, _ = strconv.ParseInt(fields[2], 10, 64)
+		result = append(result, rate)
+	}
+	return result, nil
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Removed by prune pass
+type PruneResult struct {
+	// Hashrate samples older than window
+	Samples int64
+	// Worker counters of workers without recent samples
+	Workers int64
+	// Logins with zero balance and no share within retention
+	Logins int64
+}
+
+// Sends at most ops commands per second, SCAN included, so maintenance can't stall production redis
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(ops int) *pacer {
+	if ops <= 0 {
+		return &pacer{}
+	}
+	return &pacer{interval: time.Second / time.Duration(ops)}
+}
+
+func (p *pacer) wait() {
+	if p.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if p.next.After(now) {
+		time.Sleep(p.next.Sub(now))
+		now = p.next
+	}
+	p.next = now.Add(p.interval)
+}
+
+// Hashrate samples older than window are removed from pool and miner sets, worker counters of
+// workers without samples left are removed. Miner, settings and activity keys of logins with zero balance,
+// nothing pending and no share within retention are deleted, zero retention keeps them.
+func (r *RedisClient) PruneStale(window, retention time.Duration, opsPerSecond int) (*PruneResult, error) {
+	result := &PruneResult{}
+	p := newPacer(opsPerSecond)
+	now := util.MakeTimestamp() / 1000
+	max := fmt.Sprint("(", now-int64(window/time.Second))
+
+	p.wait()
+	n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", max).Result()
+	if err != nil {
+		return result, err
+	}
+	result.Samples += n
+
+	err = r.scanKeys(join(r.prefix, "hashrate", "*"), func(keys []string) error {
+		p.wait()
+		for _, key := range keys {
+			if err := r.pruneHashrate(p, keyLogin(key), max, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Workers of miners who have no samples at all have no hashrate key to be found by
+	err = r.scanKeys(join(r.prefix, "workers", "*"), func(keys []string) error {
+		p.wait()
+		for _, key := range keys {
+			login := keyLogin(key)
+			p.wait()
+			exists, err := r.client.Exists(r.minerKey("hashrate", login)).Result()
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			p.wait()
+			fields, err := r.client.HKeys(key).Result()
+			if err != nil {
+				return err
+			}
+			p.wait()
+			if err := r.client.Del(key).Err(); err != nil {
+				return err
+			}
+			result.Workers += int64(len(fields))
+		}
+		return nil
+	})
+	if err != nil || retention <= 0 {
+		return result, err
+	}
+
+	inactiveSince := now - int64(retention/time.Second)
+	err = r.scanKeys(join(r.prefix, "miners", "*"), func(keys []string) error {
+		p.wait()
+		for _, key := range keys {
+			p.wait()
+			deleted, err := r.pruneLogin(keyLogin(key), inactiveSince)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				result.Logins++
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Counter fields are worker:valid, worker:validDiff and alike, samples are diff:worker:ms
+func (r *RedisClient) pruneHashrate(p *pacer, login, max string, result *PruneResult) error {
+	p.wait()
+	n, err := r.client.ZRemRangeByScore(r.minerKey("hashrate", login), "-inf", max).Result()
+	if err != nil {
+		return err
+	}
+	result.Samples += n
+	p.wait()
+	samples, err := r.client.ZRange(r.minerKey("hashrate", login), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	workers := make(map[string]struct{})
+	for _, v := range samples {
+		if fields := strings.Split(v, ":"); len(fields) == 3 {
+			workers[fields[1]] = struct{}{}
+		}
+	}
+	p.wait()
+	fields, err := r.client.HKeys(r.minerKey("workers", login)).Result()
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, field := range fields {
+		i := strings.LastIndex(field, ":")
+		if i < 0 {
+			continue
+		}
+		if _, ok := workers[field[:i]]; !ok {
+			stale = append(stale, field)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	p.wait()
+	n, err = r.client.HDel(r.minerKey("workers", login), stale...).Result()
+	result.Workers += n
+	return err
+}
+
+// Miner hash is watched, so share or payment written meanwhile keeps login
+func (r *RedisClient) pruneLogin(login string, inactiveSince int64) (bool, error) {
+	key := r.minerKey("miners", login)
+	tx, err := r.watch(key)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+
+	values, err := tx.HMGet(key, "balance", "pending", "lastShare", "immature", "debt").Result()
+	if err != nil {
+		return false, err
+	}
+	balance, _ := strconv.ParseFloat(stringValue(values[0]), 64)
+	pending, _ := strconv.ParseInt(stringValue(values[1]), 10, 64)
+	lastShare, _ := strconv.ParseInt(stringValue(values[2]), 10, 64)
+	immature, _ := strconv.ParseInt(stringValue(values[3]), 10, 64)
+	debt, _ := strconv.ParseFloat(stringValue(values[4]), 64)
+	// Balance is truncated to Shannon, as by payouts
+	if int64(balance) != 0 || pending != 0 || immature != 0 || debt > 0 || lastShare >= inactiveSince {
+		return false, nil
+	}
+	_, err = tx.Exec(func() error {
+		// Ids of adjustments applied are kept, so retried request is not applied again once login is back
+		tx.Del(key, r.minerKey("settings", login), r.minerKey("seen", login), r.minerKey("activity", login), r.minerKey("ledger", login), r.minerKey("fees", login),
+			r.minerKey("immature", login), r.minerKey("reorg", login))
+		return nil
+	})
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
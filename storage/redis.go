@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"strconv"
 	"strings"
@@ -19,11 +21,102 @@ type Config struct {
 	Password string `json:"password"`
 	Database int64  `json:"database"`
 	PoolSize int    `json:"poolSize"`
+	// Namespace of all keys, so pools of several coins share one redis. Coin is used if empty.
+	Prefix string `json:"prefix"`
+	// Redis 6 ACL user, password is of this user then
+	Username string `json:"username"`
+	// Endpoint connection only, not of sentinels or cluster
+	TLS TLSConfig `json:"tls"`
+	// Pooled connections idle for longer are closed, should be less than timeout of server
+	IdleTimeout string `json:"idleTimeout"`
+	// Shares are written behind, see shareBuffer
+	ShareBuffer ShareBufferConfig `json:"shareBuffer"`
+	// Go transactions instead of share scripts, to be removed in next release
+	LegacyShareWrites bool `json:"legacyShareWrites"`
+	// Master is resolved through sentinels if set, network and endpoint are ignored then
+	Sentinel SentinelConfig `json:"sentinel"`
+	// Keys are hash tagged in cluster mode, see minerKey
+	Cluster ClusterConfig `json:"cluster"`
+	// Record of balance changes, reconciled by maintenance
+	Ledger LedgerConfig `json:"ledger"`
 }
 
+type SentinelConfig struct {
+	MasterName string   `json:"masterName"`
+	Addrs      []string `json:"addrs"`
+	// Password of master, redis password is used if empty. Sentinels are asked without auth.
+	Password string `json:"password"`
+}
+
+func (c *SentinelConfig) Enabled() bool {
+	return len(c.MasterName) > 0
+}
+
+type ClusterConfig struct {
+	Enabled bool `json:"enabled"`
+	// Seed nodes, the rest of cluster is discovered from them
+	Addrs []string `json:"addrs"`
+}
+
+// Reads are repeated over connection errors of master failover, writes are not,
+// as they may have been applied, and their errors go to caller
+const (
+	readAttempts = 4
+	readBackoff  = 100 * time.Millisecond
+)
+
+// Commands sent outside of transactions, served by single node and cluster clients alike
+type commander interface {
+	BgSave() *redis.StatusCmd
+	ClusterSlots() *redis.ClusterSlotCmd
+	Del(keys ...string) *redis.IntCmd
+	Dump(key string) *redis.StringCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	Exists(key string) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	HGet(key, field string) *redis.StringCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	HKeys(key string) *redis.StringSliceCmd
+	HMGet(key string, fields ...string) *redis.SliceCmd
+	HSetNX(key, field, value string) *redis.BoolCmd
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	PTTL(key string) *redis.DurationCmd
+	Ping() *redis.StatusCmd
+	Restore(key string, ttl time.Duration, value string) *redis.StatusCmd
+	SAdd(key string, members ...string) *redis.IntCmd
+	SMembers(key string) *redis.StringSliceCmd
+	SRem(key string, members ...string) *redis.IntCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRangeByScoreWithScores(key string, opt redis.ZRangeByScore) *redis.ZSliceCmd
+	ZRemRangeByScore(key, min, max string) *redis.IntCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+}
+
+// In cluster mode pool keys share one slot and keys of each miner share another one, so transaction
+// over pool keys or over keys of one miner stays atomic. Transactions over both are split in cluster
+// mode, miner part goes first, see execMinerPool. That is what loses atomicity:
+//   - share: miner credit and hashrate vs pool round shares and hashrate
+//   - block: finder counters vs round rename, round shares and finders
+//   - payment: miner balance and pending vs pool finances and pending payments
+//   - miner stats: miner keys vs current round shares of miner, read only
+// Merging of mixed case logins spans two miners and is refused in cluster mode.
 type RedisClient struct {
-	client *redis.Client
-	prefix string
+	client commander
+	// Nil in cluster mode
+	single   *redis.Client
+	cluster  *redis.ClusterClient
+	password string
+	prefix   string
+	cfg      *Config
+	// Nil if share buffer is disabled
+	shares *shareBuffer
+	// Reward mode of pool, see SetRewardMode
+	rewardMode  string
+	pplnsWindow float64
 }
 
 type BlockData struct {
@@ -43,8 +136,21 @@ type BlockData struct {
 	ImmatureReward string   `json:"-"`
 	RewardString   string   `json:"reward"`
 	RoundHeight    int64    `json:"-"`
-	candidateKey   string
-	immatureKey    string
+	Finder         string   `json:"finder"`
+	Worker         string   `json:"worker"`
+	ShareDiff      int64    `json:"shareDiff"`
+	Solo           bool     `json:"solo"`
+	// Reward mode of candidate, pps for ones written before modes
+	Mode string `json:"-"`
+	// Lifecycle state and unix time of transitions, set by GetBlocks
+	State      string `json:"state,omitempty"`
+	ImmatureAt int64  `json:"immatureAt,omitempty"`
+	MaturedAt  int64  `json:"maturedAt,omitempty"`
+	OrphanedAt int64  `json:"orphanedAt,omitempty"`
+	// Bonus of finder in Shannon, paid once block matures
+	FinderBonus  int64 `json:"finderBonus,omitempty"`
+	candidateKey string
+	immatureKey  string
 }
 
 type Miner struct {
@@ -56,12 +162,67 @@ type Miner struct {
 
 type Worker struct {
 	Miner
-	TotalHR int64 `json:"hr2"`
+	TotalHR       int64 `json:"hr2"`
+	ValidShares   int64 `json:"valid"`
+	InvalidShares int64 `json:"invalid"`
+	StaleShares   int64 `json:"stale"`
+	// Sum of difficulty of credited shares, counts are kept for charts of existing frontends
+	ValidDiff int64 `json:"validDiff"`
+	StaleDiff int64 `json:"staleDiff"`
 }
 
-func NewRedisClient(cfg *Config, prefix string) *RedisClient {
+// Prefix of config overrides coin
+func NewRedisClient(cfg *Config, coin string) *RedisClient {
+	prefix := coin
+	if len(cfg.Prefix) > 0 {
+		prefix = cfg.Prefix
+	}
+	var idleTimeout time.Duration
+	if len(cfg.IdleTimeout) > 0 {
+		idleTimeout = util.MustParseDuration(cfg.IdleTimeout)
+	}
+	if cfg.Cluster.Enabled {
+		// Cluster has no databases, database option is not used
+		cluster := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:       cfg.Cluster.Addrs,
+			Password:    cfg.Password,
+			PoolSize:    cfg.PoolSize,
+			IdleTimeout: idleTimeout,
+		})
+		r := &RedisClient{client: cluster, cluster: cluster, password: cfg.Password, prefix: prefix, cfg: cfg}
+		if cfg.ShareBuffer.Enabled {
+			r.startShareBuffer(&cfg.ShareBuffer)
+		}
+		return r
+	}
 	var client *redis.Client
-	if cfg.Network == "unix" {
+	if cfg.Sentinel.Enabled() {
+		password := cfg.Sentinel.Password
+		if len(password) == 0 {
+			password = cfg.Password
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.Sentinel.MasterName,
+			SentinelAddrs: cfg.Sentinel.Addrs,
+			Password:      password,
+			DB:            cfg.Database,
+			PoolSize:      cfg.PoolSize,
+			IdleTimeout:   idleTimeout,
+		})
+	} else if cfg.TLS.Enabled || len(cfg.Username) > 0 {
+		password := cfg.Password
+		// Sent by dialer along with username
+		if len(cfg.Username) > 0 {
+			password = ""
+		}
+		client = redis.NewClient(&redis.Options{
+			Dialer:      newDialer(cfg),
+			Password:    password,
+			DB:          cfg.Database,
+			PoolSize:    cfg.PoolSize,
+			IdleTimeout: idleTimeout,
+		})
+	} else if cfg.Network == "unix" {
 	    client = redis.NewClient(&redis.Options{
 		Dialer: func() (net.Conn, error) {
 		    return net.DialTimeout("unix", cfg.Endpoint, 1*time.Second)
@@ -69,6 +230,7 @@ func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 		Password: cfg.Password,
 		DB:       cfg.Database,
 		PoolSize: cfg.PoolSize,
+		IdleTimeout: idleTimeout,
 	    })
 	} else {
 	    client = redis.NewClient(&redis.Options{
@@ -76,17 +238,162 @@ func NewRedisClient(cfg *Config, prefix string) *RedisClient {
 		Password: cfg.Password,
 		DB:       cfg.Database,
 		PoolSize: cfg.PoolSize,
+		IdleTimeout: idleTimeout,
 	    })
 	}
-	return &RedisClient{client: client, prefix: prefix}
+	r := &RedisClient{client: client, single: client, prefix: prefix, cfg: cfg}
+	if cfg.ShareBuffer.Enabled {
+		r.startShareBuffer(&cfg.ShareBuffer)
+	}
+	return r
 }
 
+// Nil in cluster mode
 func (r *RedisClient) Client() *redis.Client {
-	return r.client
+	return r.single
+}
+
+// Transaction over pool keys if login is empty, over keys of login otherwise
+func (r *RedisClient) multi(login string) (*redis.Multi, error) {
+	if r.cluster == nil {
+		return r.single.Multi(), nil
+	}
+	key := r.formatKey("stats")
+	if len(login) > 0 {
+		key = r.minerKey("miners", login)
+	}
+	// Watch is the only way to get transaction on node of the slot, keys are not meant to be watched
+	tx, err := r.cluster.Watch(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Unwatch().Err(); err != nil {
+		tx.Close()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Miner and pool commands in one transaction, in two of them in cluster mode. Replies come in the same order.
+// Pool part is not written if miner one failed, error tells which part is written otherwise.
+// Missing key is not a failure, redis.Nil is returned after both parts then, as by single transaction.
+func (r *RedisClient) execMinerPool(login string, minerCmds, poolCmds func(tx *redis.Multi) error) ([]redis.Cmder, error) {
+	if r.cluster == nil {
+		tx := r.single.Multi()
+		defer tx.Close()
+		return tx.Exec(func() error {
+			if err := minerCmds(tx); err != nil {
+				return err
+			}
+			return poolCmds(tx)
+		})
+	}
+	cmds, err := r.execTx(login, minerCmds)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	poolReplies, poolErr := r.execTx("", poolCmds)
+	if poolErr != nil && poolErr != redis.Nil {
+		return nil, fmt.Errorf("Keys of miner %s are written, pool keys are not: %v", login, poolErr)
+	}
+	if err == nil {
+		err = poolErr
+	}
+	return append(cmds, poolReplies...), err
 }
 
+// Keys are spread over masters in cluster mode, each of them is scanned
+func (r *RedisClient) scanKeys(match string, fn func(keys []string) error) error {
+	nodes := []commander{r.client}
+	if r.cluster != nil {
+		slots, err := r.cluster.ClusterSlots().Result()
+		if err != nil {
+			return err
+		}
+		nodes = nil
+		seen := make(map[string]bool)
+		for _, slot := range slots {
+			// First address is of master
+			if len(slot.Addrs) == 0 || seen[slot.Addrs[0]] {
+				continue
+			}
+			seen[slot.Addrs[0]] = true
+			node := redis.NewClient(&redis.Options{Addr: slot.Addrs[0], Password: r.password})
+			defer node.Close()
+			nodes = append(nodes, node)
+		}
+	}
+	for _, node := range nodes {
+		var c int64
+		for {
+			var keys []string
+			cursor := c
+			err := r.retryRead(func() error {
+				var err error
+				c, keys, err = node.Scan(cursor, match, 100).Result()
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if err := fn(keys); err != nil {
+				return err
+			}
+			if c == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (r *RedisClient) execTx(login string, cmds func(tx *redis.Multi) error) ([]redis.Cmder, error) {
+	tx, err := r.multi(login)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	return tx.Exec(func() error {
+		return cmds(tx)
+	})
+}
+
+// Error tells authentication failure from network one
 func (r *RedisClient) Check() (string, error) {
-	return r.client.Ping().Result()
+	pong, err := r.client.Ping().Result()
+	if err != nil {
+		return pong, describeCheckError(r.cfg, err)
+	}
+	if r.useScripts() {
+		return pong, r.loadScripts()
+	}
+	return pong, nil
+}
+
+func (r *RedisClient) retryRead(fn func() error) error {
+	var err error
+	for i := 0; i < readAttempts; i++ {
+		if i > 0 {
+			time.Sleep(readBackoff << uint(i-1))
+		}
+		if err = fn(); err == nil || !isConnError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Demoted master replies READONLY and fresh replica LOADING until failover completes
+func isConnError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	s := err.Error()
+	return strings.HasPrefix(s, "READONLY ") || strings.HasPrefix(s, "LOADING ") ||
+		strings.Contains(s, "sentinels are unreachable") || strings.Contains(s, "connection refused")
 }
 
 func (r *RedisClient) BgSave() (string, error) {
@@ -95,40 +402,147 @@ func (r *RedisClient) BgSave() (string, error) {
 
 // Always returns list of addresses. If Redis fails it will return empty list.
 func (r *RedisClient) GetBlacklist() ([]string, error) {
-	cmd := r.client.SMembers(r.formatKey("blacklist"))
+	var cmd *redis.StringSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.SMembers(r.formatKey("blacklist"))
+		return cmd.Err()
+	})
 	if cmd.Err() != nil {
 		return []string{}, cmd.Err()
 	}
 	return cmd.Val(), nil
 }
 
+// Logins refused by pool operator, checked on each login unlike address blacklist which bans IP
+func (r *RedisClient) GetLoginBlacklist() ([]string, error) {
+	var cmd *redis.StringSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.SMembers(r.formatKey("blacklist", "logins"))
+		return cmd.Err()
+	})
+	if cmd.Err() != nil {
+		return []string{}, cmd.Err()
+	}
+	return cmd.Val(), nil
+}
+
+func (r *RedisClient) AddLoginBlacklist(login string) error {
+	return r.client.SAdd(r.formatKey("blacklist", "logins"), login).Err()
+}
+
+func (r *RedisClient) RemoveLoginBlacklist(login string) error {
+	return r.client.SRem(r.formatKey("blacklist", "logins"), login).Err()
+}
+
 // Always returns list of IPs. If Redis fails it will return empty list.
 func (r *RedisClient) GetWhitelist() ([]string, error) {
-	cmd := r.client.SMembers(r.formatKey("whitelist"))
+	var cmd *redis.StringSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.SMembers(r.formatKey("whitelist"))
+		return cmd.Err()
+	})
 	if cmd.Err() != nil {
 		return []string{}, cmd.Err()
 	}
 	return cmd.Val(), nil
 }
 
-func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
-	tx := r.client.Multi()
+// Stats are extra per instance counters stored along with node state
+func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int, stats map[string]int64) error {
+	tx, err := r.multi("")
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
 		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
 		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
 		tx.HSet(r.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+		for k, v := range stats {
+			tx.HSet(r.formatKey("nodes"), join(id, k), strconv.FormatInt(v, 10))
+		}
 		return nil
 	})
 	return err
 }
 
+// Last rejected IPs of node by reason, space separated
+func (r *RedisClient) WriteNodeRejects(id string, recent map[string][]string) error {
+	if len(recent) == 0 {
+		return nil
+	}
+	tx, err := r.multi("")
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for reason, ips := range recent {
+			tx.HSet(r.formatKey("nodes"), join(id, "rejectedIPs."+reason), strings.Join(ips, " "))
+		}
+		return nil
+	})
+	return err
+}
+
+// Number of upstream switches kept per pool
+const maxUpstreamSwitches = 100
+
+// "timestamp:node:from:to", newest first
+func (r *RedisClient) WriteUpstreamSwitch(id, from, to string) error {
+	tx, err := r.multi("")
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	now := util.MakeTimestamp() / 1000
+	key := r.formatKey("upstreams", "switches")
+
+	_, err = tx.Exec(func() error {
+		tx.LPush(key, join(now, id, from, to))
+		tx.LTrim(key, 0, maxUpstreamSwitches-1)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetUpstreamSwitches() ([]map[string]interface{}, error) {
+	var cmd *redis.StringSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.LRange(r.formatKey("upstreams", "switches"), 0, maxUpstreamSwitches-1)
+		return cmd.Err()
+	})
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	result := make([]map[string]interface{}, 0, len(cmd.Val()))
+	for _, v := range cmd.Val() {
+		fields := strings.Split(v, ":")
+		if len(fields) != 4 {
+			continue
+		}
+		event := make(map[string]interface{})
+		event["timestamp"], _ = strconv.ParseInt(fields[0], 10, 64)
+		event["node"] = fields[1]
+		event["from"] = fields[2]
+		event["to"] = fields[3]
+		result = append(result, event)
+	}
+	return result, nil
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
-	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
+	var cmd *redis.StringStringMapCmd
+	r.retryRead(func() error {
+		cmd = r.client.HGetAllMap(r.formatKey("nodes"))
+		return cmd.Err()
+	})
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
@@ -159,7 +573,10 @@ func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error
 	return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, actualDiff int64, fee float64, netDiff int64, height, topHeight uint64, window time.Duration) (bool, error) {
+func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, actualDiff int64, rate float64, height, topHeight uint64, stale, solo bool, window time.Duration) (bool, error) {
+	if r.shares == nil && r.useScripts() {
+		return r.writeShareScript(login, id, params, diff, actualDiff, rate, height, topHeight, stale, solo, window)
+	}
 	exist, err := r.checkPoWExist(height, params)
 	if err != nil {
 		return false, err
@@ -168,21 +585,39 @@ func (r *RedisClient) WriteShare(login, id string, params []string, diff int64,
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
-	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, actualDiff, height, topHeight, fee, netDiff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+	if r.shares != nil {
+		err = r.shares.add(bufferedShare{ms: ms, ts: ts, login: login, id: id, job: params[1], diff: diff, actualDiff: actualDiff,
+			height: height, topHeight: topHeight, rate: rate, stale: stale, solo: solo, expire: window})
+		return false, err
+	}
+	var ledger string
+	_, err = r.execMinerPool(login, func(tx *redis.Multi) error {
+		ledger = r.writeMinerShare(tx, ms, ts, login, id, params[1], diff, actualDiff, height, topHeight, rate, stale, solo, window)
+		return nil
+	}, func(tx *redis.Multi) error {
+		r.writePoolShare(tx, ms, ts, login, id, ledger, diff, solo)
+		if !solo {
+			tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+		}
 		return nil
 	})
 	return false, err
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, actualDiff int64, fee float64, roundDiff int64, height, topHeight uint64, window time.Duration) (bool, error) {
+// Candidate records finder, worker, share difficulty and mode, so block of solo miner is credited to finder only.
+// Finder counters are not reverted if block is orphaned later.
+func (r *RedisClient) WriteBlock(login, id string, params []string, diff, actualDiff int64, rate float64, roundDiff int64, height, topHeight uint64, solo bool, window time.Duration) (bool, error) {
+	// Buffered shares belong to the round being closed, error is reported to next share writer
+	r.flushShares()
+	if r.useScripts() {
+		return r.writeBlockScript(login, id, params, diff, actualDiff, rate, roundDiff, height, topHeight, solo, window)
+	}
+	if solo {
+		return r.writeSoloBlock(login, id, params, diff, actualDiff, rate, roundDiff, height, topHeight, window)
+	}
 	exist, err := r.checkPoWExist(height, params)
 	if err != nil {
 		return false, err
@@ -191,20 +626,34 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, actual
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
+	round := r.formatRound(int64(height), params[0])
+	mode, err := r.snapshotRound(int64(height), params[0], roundDiff)
+	if err != nil {
+		return false, err
+	}
+
+	// Snapshot left by write of the same block which crashed before candidate is kept, current round goes on then
+	snapshot, err := r.client.Exists(round).Result()
+	if err != nil {
+		return false, err
+	}
 
-	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, actualDiff, height, topHeight, fee, roundDiff, window)
+	var ledger string
+	cmds, err := r.execMinerPool(login, func(tx *redis.Multi) error {
+		ledger = r.writeMinerShare(tx, ms, ts, login, id, params[1], diff, actualDiff, height, topHeight, rate, false, false, window)
+		tx.HIncrBy(r.minerKey("miners", login), "blocksFound", 1)
+		return nil
+	}, func(tx *redis.Multi) error {
+		r.writePoolShare(tx, ms, ts, login, id, ledger, diff, false)
 		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
 		tx.ZIncrBy(r.formatKey("finders"), 1, login)
-		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
-		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
+		if !snapshot {
+			tx.HDel(r.formatKey("stats"), "roundShares")
+			tx.RenameNX(r.formatKey("shares", "roundCurrent"), round)
+		}
+		tx.HGetAllMap(round)
 		return nil
 	})
 	if err != nil {
@@ -217,31 +666,159 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, actual
 			totalShares += n
 		}
 		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares)
+		s := join(hashHex, ts, roundDiff, totalShares, login, mode, id, diff)
 		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
 		return false, cmd.Err()
 	}
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, actualDiff int64, height, topHeight uint64, fee float64, netDiff int64, expire time.Duration) {
-	reward := util.GetShareReward(diff, netDiff, height, topHeight, fee)
-	tx.HIncrByFloat(r.formatKey("miners", login), "balance", reward)
-	tx.HIncrByFloat(r.formatKey("miners", login), "minedShort", reward)
-	tx.HIncrByFloat(r.formatKey("miners", login), "minedCurrent", reward)
-	tx.HIncrBy(r.formatKey("miners", login), "hashesShort", diff)
-	tx.HIncrBy(r.formatKey("miners", login), "hashesCurrent", diff)
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+// Solo round is kept per login, PPS round of pool is not touched
+func (r *RedisClient) writeSoloBlock(login, id string, params []string, diff, actualDiff int64, rate float64, roundDiff int64, height, topHeight uint64, window time.Duration) (bool, error) {
+	exist, err := r.checkPoWExist(height, params)
+	if err != nil {
+		return false, err
+	}
+	// Duplicate share, (nonce, powHash, mixDigest) pair exist
+	if exist {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	cmds, err := r.execMinerPool(login, func(tx *redis.Multi) error {
+		r.writeMinerShare(tx, ms, ts, login, id, params[1], diff, actualDiff, height, topHeight, rate, false, true, window)
+		tx.HIncrBy(r.minerKey("miners", login), "blocksFound", 1)
+		return nil
+	}, func(tx *redis.Multi) error {
+		r.writePoolShare(tx, ms, ts, login, id, "", diff, true)
+		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+		tx.ZIncrBy(r.formatKey("finders"), 1, login)
+		tx.HGet(r.formatKey("shares", "soloCurrent"), login)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	totalShares, _ := cmds[len(cmds)-1].(*redis.StringCmd).Int64()
+
+	// Snapshot left by write of the same block which crashed before candidate is kept
+	round := r.formatRound(int64(height), params[0])
+	snapshot, err := r.client.HGet(round, login).Int64()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	exists := err == nil
+	if exists {
+		totalShares = snapshot
+	}
+
+	// Shares submitted meanwhile stay in the next solo round
+	tx, err := r.multi("")
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+	_, err = tx.Exec(func() error {
+		if !exists {
+			tx.HIncrBy(r.formatKey("shares", "soloCurrent"), login, -totalShares)
+			tx.HSet(round, login, strconv.FormatInt(totalShares, 10))
+		}
+		hashHex := strings.Join(params, ":")
+		s := join(hashHex, ts, roundDiff, totalShares, login, ModeSolo, id, diff)
+		tx.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+		return nil
+	})
+	return false, err
+}
+
+func (r *RedisClient) WriteInvalidShare(login, id string, expire time.Duration) error {
+	return r.writeShareCounter(login, id, "invalid", expire)
+}
+
+// Late share which was not credited
+func (r *RedisClient) WriteStaleShare(login, id string, expire time.Duration) error {
+	return r.writeShareCounter(login, id, "stale", expire)
+}
+
+func (r *RedisClient) writeShareCounter(login, id, counter string, expire time.Duration) error {
+	tx, err := r.multi(login)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.HIncrBy(r.minerKey("workers", login), join(id, counter), 1)
+		tx.Expire(r.minerKey("workers", login), expire)
+		return nil
+	})
+	return err
+}
+
+// Solo shares are not paid, they are counted in solo round of login instead of pool round.
+// Ledger entry of credit is returned for pool part, empty if there is none.
+func (r *RedisClient) writeMinerShare(tx *redis.Multi, ms, ts int64, login, id, job string, diff int64, actualDiff int64, height, topHeight uint64, rate float64, stale, solo bool, expire time.Duration) string {
+	var entry string
+	// Reward is distributed over window on unlock in PPLNS mode
+	if !solo && r.creditShares() {
+		reward := util.GetShareReward(diff, rate, height, topHeight)
+		tx.HIncrByFloat(r.minerKey("miners", login), "balance", reward)
+		tx.HIncrByFloat(r.minerKey("miners", login), "minedShort", reward)
+		tx.HIncrByFloat(r.minerKey("miners", login), "minedCurrent", reward)
+		entry = r.ledgerEntry(ts, reward, LedgerShare, job)
+		r.writeLedger(tx, login, entry)
+	}
+	tx.HIncrBy(r.minerKey("miners", login), "hashesShort", diff)
+	tx.HIncrBy(r.minerKey("miners", login), "hashesCurrent", diff)
+	tx.ZAdd(r.minerKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
+	tx.Expire(r.minerKey("hashrate", login), expire) // Will delete hashrates for miners that gone
+	counter := join(id, "valid")
+	if stale {
+		counter = join(id, "stale")
+	}
+	tx.HIncrBy(r.minerKey("workers", login), counter, 1)
+	tx.HIncrBy(r.minerKey("workers", login), counter+"Diff", diff)
+	tx.Expire(r.minerKey("workers", login), expire)
+	tx.HSet(r.minerKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+	tx.HSet(r.minerKey("miners", login), "lastShareDiff", strconv.FormatInt(actualDiff, 10))
+	r.writeSeen(tx, ts, login, id)
+	return entry
+}
+
+func (r *RedisClient) writePoolShare(tx *redis.Multi, ms, ts int64, login, id, ledger string, diff int64, solo bool) {
+	r.writeLedgerStream(tx, login, ledger)
+	if solo {
+		tx.HIncrBy(r.formatKey("shares", "soloCurrent"), login, diff)
+	} else {
+		tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+		if r.windowShares() {
+			r.writeWindowShare(tx, login, diff)
+		}
+	}
 	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
-	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
-	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
-	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
-	tx.HSet(r.formatKey("miners", login), "lastShareDiff", strconv.FormatInt(actualDiff, 10))
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
+	// Pool keys share one slot in cluster mode
+	if r.cluster != nil {
+		return join("{"+r.prefix+"}", join(args...))
+	}
 	return join(r.prefix, join(args...))
 }
 
+// Key of miner data, login is hash tag in cluster mode. Same as pool key of kind and login otherwise.
+func (r *RedisClient) minerKey(kind, login string) string {
+	if r.cluster != nil {
+		login = "{" + login + "}"
+	}
+	return join(r.prefix, kind, login)
+}
+
+// Login of miner key, also of key written before cluster mode
+func keyLogin(key string) string {
+	return strings.Trim(strings.Split(key, ":")[2], "{}")
+}
+
 func (r *RedisClient) formatRound(height int64, nonce string) string {
 	return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
@@ -280,7 +857,11 @@ func join(args ...interface{}) string {
 
 func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
 	option := redis.ZRangeByScore{Min: "0", Max: strconv.FormatInt(maxHeight, 10)}
-	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "candidates"), option)
+	var cmd *redis.ZSliceCmd
+	r.retryRead(func() error {
+		cmd = r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "candidates"), option)
+		return cmd.Err()
+	})
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
@@ -290,22 +871,15 @@ func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
 func (r *RedisClient) GetMiners() ([]string, error) {
 	payees := make(map[string]struct{})
 	var result []string
-	var c int64
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
-		if err != nil {
-			return nil, err
-		}
+	err := r.scanKeys(join(r.prefix, "miners", "*"), func(keys []string) error {
 		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
-			payees[login] = struct{}{}
-		}
-		if c == 0 {
-			break
+			payees[keyLogin(row)] = struct{}{}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	for login, _ := range payees {
 		result = append(result, login)
@@ -313,8 +887,170 @@ func (r *RedisClient) GetMiners() ([]string, error) {
 	return result, nil
 }
 
+// One-shot migration for data written before logins were lowercased.
+// Stats, balances, settings, difficulty and workers of mixed case login are merged into lowercase one,
+// returns number of merged logins.
+// Run it with payouts stopped, pending payments are not touched.
+func (r *RedisClient) MergeMixedCaseLogins() (int, error) {
+	// Keys of both logins are in one transaction, run it before moving data to cluster
+	if r.cluster != nil {
+		return 0, errors.New("Merge of logins is not supported in cluster mode")
+	}
+	logins, err := r.GetMiners()
+	if err != nil {
+		return 0, err
+	}
+	merged := 0
+	for _, login := range logins {
+		lower := strings.ToLower(login)
+		if lower == login {
+			continue
+		}
+		if err := r.mergeLogin(login, lower); err != nil {
+			return merged, fmt.Errorf("Failed to merge %v into %v: %v", login, lower, err)
+		}
+		merged++
+	}
+	return merged, nil
+}
+
+func (r *RedisClient) mergeLogin(from, to string) error {
+	cmd := r.client.HGetAllMap(r.minerKey("miners", from))
+	if cmd.Err() != nil {
+		return cmd.Err()
+	}
+	roundShares, err := r.client.HGet(r.formatKey("shares", "roundCurrent"), from).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	lastShare, err := r.client.HGet(r.minerKey("miners", to), "lastShare").Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	firstSeen, err := r.client.HGet(r.minerKey("miners", to), "firstSeen").Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	// Immature credit is reverted or matured by login of block credits
+	if immature, _ := strconv.ParseInt(cmd.Val()["immature"], 10, 64); immature != 0 {
+		return fmt.Errorf("%v has immature credit, merge once blocks are matured", from)
+	}
+	// Balance of from moves over as one credit, its entries go away with it
+	balance, _ := strconv.ParseFloat(cmd.Val()["balance"], 64)
+	entry := r.ledgerEntry(util.MakeTimestamp()/1000, balance, LedgerMerge, from)
+
+	// Settings and difficulty of to win over those of from, worker counters add up
+	var hashes []func(tx *redis.Multi) error
+	for _, kind := range []string{"settings", "difficulty", "workers", "seen"} {
+		merge, err := r.mergeHash(kind, from, to, kind == "workers")
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, merge)
+	}
+
+	tx := r.single.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for field, value := range cmd.Val() {
+			switch field {
+			case "lastShare", "lastShareDiff":
+				// Keep the most recent share
+				if ts, _ := strconv.ParseInt(cmd.Val()["lastShare"], 10, 64); ts > lastShare {
+					tx.HSet(r.minerKey("miners", to), field, value)
+				}
+			case "firstSeen":
+				// Keep the earliest one
+				if ts, _ := strconv.ParseInt(value, 10, 64); firstSeen == 0 || ts < firstSeen {
+					tx.HSet(r.minerKey("miners", to), field, value)
+				}
+			case "ledgerOpening":
+				// Balance of from is credited to ledger of to by merge entry
+			default:
+				n, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return fmt.Errorf("Invalid %v %v", field, value)
+				}
+				tx.HIncrByFloat(r.minerKey("miners", to), field, n)
+			}
+		}
+		for _, merge := range hashes {
+			if err := merge(tx); err != nil {
+				return err
+			}
+		}
+		r.writeLedger(tx, to, entry)
+		r.writeLedgerStream(tx, to, entry)
+		if roundShares > 0 {
+			tx.HIncrBy(r.formatKey("shares", "roundCurrent"), to, roundShares)
+			tx.HDel(r.formatKey("shares", "roundCurrent"), from)
+		}
+		for _, key := range []string{"payments", "shifts", "shifts_short", "hashrate"} {
+			tx.ZUnionStore(r.minerKey(key, to), redis.ZStore{}, r.minerKey(key, to), r.minerKey(key, from))
+		}
+		tx.Del(
+			r.minerKey("miners", from),
+			r.minerKey("payments", from),
+			r.minerKey("shifts", from),
+			r.minerKey("shifts_short", from),
+			r.minerKey("hashrate", from),
+			r.minerKey("workers", from),
+			r.minerKey("difficulty", from),
+			r.minerKey("settings", from),
+			r.minerKey("seen", from),
+			r.minerKey("activity", from),
+			r.minerKey("ledger", from),
+			r.minerKey("fees", from),
+			r.minerKey("immature", from),
+			r.minerKey("reorg", from),
+		)
+		return nil
+	})
+	return err
+}
+
+// Fields of hash of from missing under to are copied, or added up with incr. Hash missing under to
+// takes TTL of the one of from, so merged workers and difficulty expire as before.
+func (r *RedisClient) mergeHash(kind, from, to string, incr bool) (func(tx *redis.Multi) error, error) {
+	src, dst := r.minerKey(kind, from), r.minerKey(kind, to)
+	fields, err := r.client.HGetAllMap(src).Result()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := r.client.PTTL(src).Result()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := r.client.Exists(dst).Result()
+	if err != nil {
+		return nil, err
+	}
+	return func(tx *redis.Multi) error {
+		for field, value := range fields {
+			if !incr {
+				tx.HSetNX(dst, field, value)
+				continue
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %v %v of %v", field, value, kind)
+			}
+			tx.HIncrBy(dst, field, n)
+		}
+		if len(fields) > 0 && !exists && ttl > 0 {
+			tx.PExpire(dst, ttl)
+		}
+		return nil
+	}, nil
+}
+
 func (r *RedisClient) GetBalance(login string) (int64, error) {
-	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
+	var cmd *redis.StringCmd
+	r.retryRead(func() error {
+		cmd = r.client.HGet(r.minerKey("miners", login), "balance")
+		return cmd.Err()
+	})
 	if cmd.Err() == redis.Nil {
 		return 0, nil
 	} else if cmd.Err() != nil {
@@ -334,14 +1070,17 @@ func (r *RedisClient) LockPayouts(login string, amount int64) error {
 	return nil
 }
 
+// Payment in flight is cleared with lock
 func (r *RedisClient) UnlockPayouts() error {
 	key := r.formatKey("payments", "lock")
-	_, err := r.client.Del(key).Result()
+	_, err := r.client.Del(key, r.formatKey("payments", "inflight")).Result()
 	return err
 }
 
 func (r *RedisClient) IsPayoutsLocked() (bool, error) {
-	_, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+	err := r.retryRead(func() error {
+		return r.client.Get(r.formatKey("payments", "lock")).Err()
+	})
 	if err == redis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -374,14 +1113,14 @@ func (r *RedisClient) GetPendingPayments() []*PendingPayment {
 
 // Deduct miner's balance for payment
 func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrByFloat(r.formatKey("miners", login), "balance", float64(amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
+	// Transaction is not sent yet, ledger entry is written with its hash by WritePayment
+	_, err := r.execMinerPool(login, func(tx *redis.Multi) error {
+		tx.HIncrByFloat(r.minerKey("miners", login), "balance", float64(amount * -1))
+		tx.HIncrBy(r.minerKey("miners", login), "pending", amount)
+		return nil
+	}, func(tx *redis.Multi) error {
 		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
 		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
 		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
@@ -390,13 +1129,13 @@ func (r *RedisClient) UpdateBalance(login string, amount int64) error {
 	return err
 }
 
+// Payout was not debited in ledger yet, pending amount goes back to balance
 func (r *RedisClient) RollbackBalance(login string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	_, err := tx.Exec(func() error {
-		tx.HIncrByFloat(r.formatKey("miners", login), "balance", float64(amount))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+	_, err := r.execMinerPool(login, func(tx *redis.Multi) error {
+		tx.HIncrByFloat(r.minerKey("miners", login), "balance", float64(amount))
+		tx.HIncrBy(r.minerKey("miners", login), "pending", (amount * -1))
+		return nil
+	}, func(tx *redis.Multi) error {
 		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
 		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
 		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
@@ -406,15 +1145,18 @@ func (r *RedisClient) RollbackBalance(login string, amount int64) error {
 }
 
 func (r *RedisClient) WriteLongShift(login string) error {
-	tx := r.client.Multi()
+	tx, err := r.multi(login)
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 	
 	
 	ts := util.MakeTimestamp() / 1000
 
 	cmds, _ := tx.Exec(func() error {
-		tx.HGet(r.formatKey("miners", login), "minedCurrent")
-		tx.HGet(r.formatKey("miners", login), "hashesCurrent")
+		tx.HGet(r.minerKey("miners", login), "minedCurrent")
+		tx.HGet(r.minerKey("miners", login), "hashesCurrent")
 		return nil
 	})
 	
@@ -425,10 +1167,10 @@ func (r *RedisClient) WriteLongShift(login string) error {
 		return nil
 	}
 	
-	_, err := tx.Exec(func() error {
-		tx.HSet(r.formatKey("miners", login), "minedCurrent", "0")
-		tx.HSet(r.formatKey("miners", login), "hashesCurrent", "0")
-		tx.ZAdd(r.formatKey("shifts", login), redis.Z{Score: float64(ts), Member: join(mined, hashes)})
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.minerKey("miners", login), "minedCurrent", "0")
+		tx.HSet(r.minerKey("miners", login), "hashesCurrent", "0")
+		tx.ZAdd(r.minerKey("shifts", login), redis.Z{Score: float64(ts), Member: join(mined, hashes)})
 		return nil
 	})
 	
@@ -436,15 +1178,18 @@ func (r *RedisClient) WriteLongShift(login string) error {
 }
 
 func (r *RedisClient) WriteShortShift(login string) error {
-	tx := r.client.Multi()
+	tx, err := r.multi(login)
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 	
 	
 	ts := util.MakeTimestamp() / 1000
 
 	cmds, _ := tx.Exec(func() error {
-		tx.HGet(r.formatKey("miners", login), "minedShort")
-		tx.HGet(r.formatKey("miners", login), "hashesShort")
+		tx.HGet(r.minerKey("miners", login), "minedShort")
+		tx.HGet(r.minerKey("miners", login), "hashesShort")
 		return nil
 	})
 	
@@ -455,10 +1200,10 @@ func (r *RedisClient) WriteShortShift(login string) error {
 		return nil
 	}
 	
-	_, err := tx.Exec(func() error {
-		tx.HSet(r.formatKey("miners", login), "minedShort", "0")
-		tx.HSet(r.formatKey("miners", login), "hashesShort", "0")
-		tx.ZAdd(r.formatKey("shifts_short", login), redis.Z{Score: float64(ts), Member: join(mined, hashes)})
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.minerKey("miners", login), "minedShort", "0")
+		tx.HSet(r.minerKey("miners", login), "hashesShort", "0")
+		tx.ZAdd(r.minerKey("shifts_short", login), redis.Z{Score: float64(ts), Member: join(mined, hashes)})
 		return nil
 	})
 	
@@ -466,44 +1211,209 @@ func (r *RedisClient) WriteShortShift(login string) error {
 }
 
 func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	ts := util.MakeTimestamp() / 1000
+	entry := r.ledgerEntry(ts, float64(amount*-1), LedgerPayout, txHash)
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrByFloat(r.formatKey("miners", login), "pending", float64(amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+	_, err := r.execMinerPool(login, func(tx *redis.Multi) error {
+		tx.HIncrByFloat(r.minerKey("miners", login), "pending", float64(amount * -1))
+		tx.HIncrBy(r.minerKey("miners", login), "paid", amount)
+		tx.ZAdd(r.minerKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+		r.writeLedger(tx, login, entry)
+		return nil
+	}, func(tx *redis.Multi) error {
+		r.writeLedgerStream(tx, login, entry)
 		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
 		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
 		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
 		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
 		tx.Del(r.formatKey("payments", "lock"))
+		tx.Del(r.formatKey("payments", "inflight"))
 		return nil
 	})
 	return err
 }
 
-func (r *RedisClient) IsMinerExists(login string) (bool, error) {
-	return r.client.Exists(r.formatKey("miners", login)).Result()
+// Fee is written once per tx, so retry does not count it twice in finances.
+//
+// KEYS: payments:fees, finances
+// ARGV: tx hash, fee
+const paymentFeeLua = `
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call('HINCRBY', KEYS[2], 'txFees', ARGV[2])
+end
+return 1
+`
+
+// Fee paid for confirmed payout tx, in Shannon
+func (r *RedisClient) WritePaymentFee(txHash string, fee int64) error {
+	keys := []string{r.formatKey("payments", "fees"), r.formatKey("finances")}
+	return r.client.Eval(paymentFeeLua, keys, []string{txHash, strconv.FormatInt(fee, 10)}).Err()
 }
 
-func (r *RedisClient) GetMinerStats(login string, maxPayments, maxShiftsLong, maxShiftsShort int64) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+// Last vardiff difficulty of worker, so reconnecting miner doesn't start from port difficulty
+func (r *RedisClient) WriteWorkerDifficulty(login, id string, diff int64, expire time.Duration) error {
+	tx, err := r.multi(login)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.minerKey("difficulty", login), id, strconv.FormatInt(diff, 10))
+		tx.Expire(r.minerKey("difficulty", login), expire)
+		return nil
+	})
+	return err
+}
 
-	tx := r.client.Multi()
+// Returns 0 if there is no saved difficulty
+func (r *RedisClient) GetWorkerDifficulty(login, id string) (int64, error) {
+	var cmd *redis.StringCmd
+	r.retryRead(func() error {
+		cmd = r.client.HGet(r.minerKey("difficulty", login), id)
+		return cmd.Err()
+	})
+	if cmd.Err() == redis.Nil {
+		return 0, nil
+	} else if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	return cmd.Int64()
+}
+
+// Reward modes of miner, PPLNS is mode of pool
+const (
+	ModePPS   = "pps"
+	ModeSolo  = "solo"
+	ModePPLNS = "pplns"
+	// PPS of block subsidy, fees of found blocks are distributed over window
+	ModePPSPlus = "pps+"
+)
+
+// Settings of miner set by pool operator, payout ones are set by miner
+type MinerSettings struct {
+	// Difficulty forced on all sessions of miner, 0 if not set
+	FixedDiff int64 `json:"fixedDiff"`
+	// Empty for PPS
+	Mode string `json:"mode"`
+	// Payout threshold in Shannon, 0 for pool one, payouts clamp it to their bounds
+	MinPayout int64 `json:"minPayout"`
+	Paused    bool  `json:"paused"`
+}
+
+// Update is applied if it is signed later than the last one, so signed request can't be replayed
+const payoutSettingsLua = `
+if tonumber(ARGV[1]) <= tonumber(redis.call('HGET', KEYS[1], 'signedAt') or '0') then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'signedAt', ARGV[1])
+if ARGV[2] == '0' then
+	redis.call('HDEL', KEYS[1], 'minPayout')
+else
+	redis.call('HSET', KEYS[1], 'minPayout', ARGV[2])
+end
+if ARGV[3] == '0' then
+	redis.call('HDEL', KEYS[1], 'paused')
+else
+	redis.call('HSET', KEYS[1], 'paused', ARGV[3])
+end
+return 1
+`
+
+func (r *RedisClient) GetMinerSettings(login string) (*MinerSettings, error) {
+	var cmd *redis.StringStringMapCmd
+	r.retryRead(func() error {
+		cmd = r.client.HGetAllMap(r.minerKey("settings", login))
+		return cmd.Err()
+	})
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	settings := &MinerSettings{}
+	if v, ok := cmd.Val()["fixedDiff"]; ok {
+		diff, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid fixedDiff %v", v)
+		}
+		settings.FixedDiff = diff
+	}
+	settings.Mode = cmd.Val()["mode"]
+	if v, ok := cmd.Val()["minPayout"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid minPayout %v", v)
+		}
+		settings.MinPayout = n
+	}
+	settings.Paused = cmd.Val()["paused"] == "1"
+	return settings, nil
+}
+
+// Operator settings, empty values are removed from settings hash, payout settings are kept
+func (r *RedisClient) WriteMinerSettings(login string, settings *MinerSettings) error {
+	key := r.minerKey("settings", login)
+	tx, err := r.multi(login)
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	cmds, err := tx.Exec(func() error {
-		tx.HGetAllMap(r.formatKey("miners", login))
-		tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
-		tx.ZRevRangeWithScores(r.formatKey("shifts", login), 0, maxShiftsLong-1)
-		tx.ZRevRangeWithScores(r.formatKey("shifts_short", login), 0, maxShiftsShort-1)
-		tx.ZCard(r.formatKey("payments", login))
-		tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+	_, err = tx.Exec(func() error {
+		if settings.FixedDiff > 0 {
+			tx.HSet(key, "fixedDiff", strconv.FormatInt(settings.FixedDiff, 10))
+		} else {
+			tx.HDel(key, "fixedDiff")
+		}
+		if len(settings.Mode) > 0 {
+			tx.HSet(key, "mode", settings.Mode)
+		} else {
+			tx.HDel(key, "mode")
+		}
 		return nil
 	})
+	return err
+}
+
+// Payout settings of miner signed at unix time signedAt, false if later update is applied already
+func (r *RedisClient) WritePayoutSettings(login string, minPayout int64, paused bool, signedAt int64) (bool, error) {
+	args := []string{strconv.FormatInt(signedAt, 10), strconv.FormatInt(minPayout, 10), join(paused)}
+	applied, err := r.client.Eval(payoutSettingsLua, []string{r.minerKey("settings", login)}, args).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := applied.(int64)
+	return n == 1, nil
+}
+
+func (r *RedisClient) IsMinerExists(login string) (bool, error) {
+	var exists bool
+	err := r.retryRead(func() error {
+		var err error
+		exists, err = r.client.Exists(r.minerKey("miners", login)).Result()
+		return err
+	})
+	return exists, err
+}
+
+func (r *RedisClient) GetMinerStats(login string, maxPayments, maxShiftsLong, maxShiftsShort int64) (map[string]interface{}, error) {
+	stats := make(map[string]interface{})
+
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		var err error
+		cmds, err = r.execMinerPool(login, func(tx *redis.Multi) error {
+			tx.HGetAllMap(r.minerKey("miners", login))
+			tx.ZRevRangeWithScores(r.minerKey("payments", login), 0, maxPayments-1)
+			tx.ZRevRangeWithScores(r.minerKey("shifts", login), 0, maxShiftsLong-1)
+			tx.ZRevRangeWithScores(r.minerKey("shifts_short", login), 0, maxShiftsShort-1)
+			tx.ZCard(r.minerKey("payments", login))
+			return nil
+		}, func(tx *redis.Multi) error {
+			tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+			return nil
+		})
+		return err
+	})
 
 	if err != nil && err != redis.Nil {
 		return nil, err
@@ -511,6 +1421,7 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments, maxShiftsLong, ma
 		result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
 		stats["stats"] = convertStringMap(result)
 		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
+		r.fillPaymentDetails(payments)
 		stats["payments"] = payments
 		shiftsLong := convertShiftsResults(cmds[2].(*redis.ZSliceCmd))
 		stats["shifts"] = shiftsLong
@@ -546,33 +1457,24 @@ func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64,
 		return total, err
 	}
 
-	var c int64
 	miners := make(map[string]struct{})
 	max = fmt.Sprint("(", now-int64(largeWindow/time.Second))
 
-	for {
-		var keys []string
-		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("hashrate", "*"), 100).Result()
-		if err != nil {
-			return total, err
-		}
+	err = r.scanKeys(join(r.prefix, "hashrate", "*"), func(keys []string) error {
 		for _, row := range keys {
-			login := strings.Split(row, ":")[2]
+			login := keyLogin(row)
 			if _, ok := miners[login]; !ok {
-				n, err := r.client.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", max).Result()
+				n, err := r.client.ZRemRangeByScore(r.minerKey("hashrate", login), "-inf", max).Result()
 				if err != nil {
-					return total, err
+					return err
 				}
 				miners[login] = struct{}{}
 				total += n
 			}
 		}
-		if c == 0 {
-			break
-		}
-	}
-	return total, nil
+		return nil
+	})
+	return total, err
 }
 
 func (r *RedisClient) FlushShifts(windowLong, windowShort time.Duration, users []string) (int64, error) {
@@ -582,7 +1484,7 @@ func (r *RedisClient) FlushShifts(windowLong, windowShort time.Duration, users [
 	for _, login := range users {
 		// Long shifts
 		{
-			total_current, err := r.client.ZRemRangeByScore(r.formatKey("shifts", login), "-inf", maxLong).Result()
+			total_current, err := r.client.ZRemRangeByScore(r.minerKey("shifts", login), "-inf", maxLong).Result()
 			total += total_current
 			if err != nil {
 				return total, err
@@ -591,7 +1493,7 @@ func (r *RedisClient) FlushShifts(windowLong, windowShort time.Duration, users [
 		
 		// Short shifts
 		{
-			total_current, err := r.client.ZRemRangeByScore(r.formatKey("shifts_short", login), "-inf", maxShort).Result()
+			total_current, err := r.client.ZRemRangeByScore(r.minerKey("shifts_short", login), "-inf", maxShort).Result()
 			total += total_current
 			if err != nil {
 				return total, err
@@ -605,20 +1507,29 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxPayments int64)
 	window := int64(smallWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	now := util.MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
-		tx.ZRangeWithScores(r.formatKey("hashrate"), 0, -1)
-		tx.HGetAllMap(r.formatKey("stats"))
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
-		tx.ZCard(r.formatKey("blocks", "candidates"))
-		tx.ZCard(r.formatKey("payments", "all"))
-		return nil
+	// Trimming of expired hashrate is idempotent, so the whole transaction is repeated
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		tx, err := r.multi("")
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		cmds, err = tx.Exec(func() error {
+			tx.ZRemRangeByScore(r.formatKey("hashrate"), "-inf", fmt.Sprint("(", now-window))
+			tx.ZRangeWithScores(r.formatKey("hashrate"), 0, -1)
+			tx.HGetAllMap(r.formatKey("stats"))
+			tx.ZRevRangeWithScores(r.formatKey("blocks", "candidates"), 0, -1)
+			tx.ZRevRangeWithScores(r.formatKey("payments", "all"), 0, maxPayments-1)
+			tx.ZCard(r.formatKey("blocks", "candidates"))
+			tx.ZCard(r.formatKey("payments", "all"))
+			tx.ZCard(r.formatKey("blocks", "immature"))
+			tx.ZCard(r.formatKey("blocks", "matured"))
+			return nil
+		})
+		return err
 	})
 
 	if err != nil {
@@ -630,8 +1541,11 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxPayments int64)
 	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
 	stats["candidates"] = candidates
 	stats["candidatesTotal"] = cmds[5].(*redis.IntCmd).Val()
+	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
+	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
 
 	payments := convertPaymentsResults(cmds[4].(*redis.ZSliceCmd))
+	r.fillPaymentDetails(payments)
 	stats["payments"] = payments
 	stats["paymentsTotal"] = cmds[6].(*redis.IntCmd).Val()
 
@@ -647,15 +1561,23 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	largeWindow := int64(lWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
 	now := util.MakeTimestamp() / 1000
 
-	cmds, err := tx.Exec(func() error {
-		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
-		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
-		return nil
+	// Trimming of expired hashrate is idempotent, so the whole transaction is repeated
+	var cmds []redis.Cmder
+	err := r.retryRead(func() error {
+		tx, err := r.multi(login)
+		if err != nil {
+			return err
+		}
+		defer tx.Close()
+		cmds, err = tx.Exec(func() error {
+			tx.ZRemRangeByScore(r.minerKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
+			tx.ZRangeWithScores(r.minerKey("hashrate", login), 0, -1)
+			tx.HGetAllMap(r.minerKey("workers", login))
+			return nil
+		})
+		return err
 	})
 
 	if err != nil {
@@ -667,6 +1589,7 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	online := int64(0)
 	offline := int64(0)
 	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	counters, _ := cmds[2].(*redis.StringStringMapCmd).Result()
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -693,6 +1616,12 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 			online++
 		}
 
+		worker.ValidShares, _ = strconv.ParseInt(counters[join(id, "valid")], 10, 64)
+		worker.InvalidShares, _ = strconv.ParseInt(counters[join(id, "invalid")], 10, 64)
+		worker.StaleShares, _ = strconv.ParseInt(counters[join(id, "stale")], 10, 64)
+		worker.ValidDiff, _ = strconv.ParseInt(counters[join(id, "validDiff")], 10, 64)
+		worker.StaleDiff, _ = strconv.ParseInt(counters[join(id, "staleDiff")], 10, 64)
+
 		currentHashrate += worker.HR
 		totalHashrate += worker.TotalHR
 		workers[id] = worker
@@ -709,23 +1638,38 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 	var result []*BlockData
 	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
-		block := BlockData{}
-		block.Height = int64(v.Score)
-		block.RoundHeight = block.Height
-		fields := strings.Split(v.Member.(string), ":")
-		block.Nonce = fields[0]
-		block.PowHash = fields[1]
-		block.MixDigest = fields[2]
-		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
-		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
-		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
-		block.candidateKey = v.Member.(string)
-		result = append(result, &block)
+		result = append(result, parseCandidate(v.Score, v.Member.(string)))
 	}
 	return result
 }
 
+// "nonce:powHash:mixDigest:timestamp:diff:totalShares:finder:mode:worker:shareDiff",
+// older ones have no finder fields
+func parseCandidate(height float64, member string) *BlockData {
+	block := BlockData{}
+	block.Height = int64(height)
+	block.RoundHeight = block.Height
+	fields := strings.Split(member, ":")
+	block.Nonce = fields[0]
+	block.PowHash = fields[1]
+	block.MixDigest = fields[2]
+	block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
+	block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
+	block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+	block.Mode = ModePPS
+	if len(fields) > 7 {
+		block.Finder = fields[6]
+		block.Mode = fields[7]
+		block.Solo = fields[7] == ModeSolo
+	}
+	if len(fields) > 9 {
+		block.Worker = fields[8]
+		block.ShareDiff, _ = strconv.ParseInt(fields[9], 10, 64)
+	}
+	block.candidateKey = member
+	return &block
+}
+
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
 func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
@@ -815,6 +1759,10 @@ func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
 			tx["address"] = fields[1]
 			tx["amount"], _ = strconv.ParseInt(fields[2], 10, 64)
 		}
+		// Sweep of pool fee, see PaymentSweep
+		if len(fields) > 3 {
+			tx["type"] = fields[3]
+		}
 		result = append(result, tx)
 	}
 	return result
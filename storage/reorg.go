@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Blocks reverted for login are kept that long, audit retry must come within it
+const reorgRevertsExpire = 30 * 24 * time.Hour
+
+// Matured block is moved to orphaned and marked reorged, script returns then if block has left matured set already.
+// Credit of login is taken back once per block, reorg:login has blocks reverted for it. Debit is bounded by
+// current balance, shortfall goes to debt of login and of pool. List entry, debit and shortfall of each login are returned.
+//
+// KEYS: matured set, orphaned set, state of block, finances, then miners:login, reorg:login and ledger:login of each login
+// ARGV: matured member, orphaned member, height, ts, block ref, expire seconds, ledger reason or empty if ledger is disabled,
+// then amount of each login
+const (
+	reorgStateLua = `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return {}
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+redis.call('HMSET', KEYS[3], 'state', 'orphaned', 'orphanedAt', ARGV[4], 'reorged', '1')
+`
+	reorgCreditsLua = `
+local debt = 0
+local result = {}
+for i = 0, (#KEYS - base) / 3 - 1 do
+	local miner, marker, ledger = KEYS[base + 1 + i * 3], KEYS[base + 2 + i * 3], KEYS[base + 3 + i * 3]
+	local amount = tonumber(ARGV[8 + i])
+	local entry, debit, shortfall = '', 0, 0
+	if redis.call('SADD', marker, ARGV[5]) == 1 then
+		redis.call('EXPIRE', marker, ARGV[6])
+		local balance = tonumber(redis.call('HGET', miner, 'balance') or '0')
+		debit = math.min(amount, math.max(balance, 0))
+		shortfall = amount - debit
+		if debit > 0 then
+			redis.call('HINCRBYFLOAT', miner, 'balance', tostring(-debit))
+			if ARGV[7] ~= '' then
+				entry = ARGV[4] .. ':' .. tostring(-debit) .. ':' .. ARGV[7] .. ':' .. ARGV[5]
+				redis.call('RPUSH', ledger, entry)
+			end
+		end
+		if shortfall > 0 then
+			redis.call('HINCRBYFLOAT', miner, 'debt', tostring(shortfall))
+		end
+	end
+	debt = debt + shortfall
+	result[i * 3 + 1] = entry
+	result[i * 3 + 2] = tostring(debit)
+	result[i * 3 + 3] = tostring(shortfall)
+end
+`
+)
+
+// One script over pool and miner keys, credit is taken back with state change
+var reorgLua = reorgStateLua + "local base = 4\n" + reorgCreditsLua + `
+if debt > 0 then
+	redis.call('HINCRBYFLOAT', KEYS[4], 'debt', tostring(debt))
+end
+return result
+`
+
+// Miner keys of one login in cluster mode, state is changed after all logins
+var reorgLoginLua = "local base = 0\n" + reorgCreditsLua + "return result\n"
+
+// Pool keys in cluster mode, ARGV[8] is debt of all logins
+var reorgPoolLua = reorgStateLua + `
+if tonumber(ARGV[8]) > 0 then
+	redis.call('HINCRBYFLOAT', KEYS[4], 'debt', ARGV[8])
+end
+return {}
+`
+
+type ReorgRevert struct {
+	// Credit of block taken back from balances, in Shannon
+	Debited float64
+	// Part of credit above balances of logins, recorded as debt
+	Debt float64
+}
+
+// Matured block of GetMaturedBlocks, which is not in canonical chain anymore, is orphaned and its credit is taken back
+func (r *RedisClient) RevertMaturedBlock(block *BlockData) (*ReorgRevert, error) {
+	immature, err := r.getBlockCredits(block)
+	if err != nil {
+		return nil, err
+	}
+	// Fee credits of PPS+ block and finder bonus paid go back with credits
+	credits, err := r.getFeeCredits(block)
+	if err != nil {
+		return nil, err
+	}
+	for login, amount := range immature {
+		credits[login] += float64(amount)
+	}
+	bonus, err := r.paidFinderBonus(block)
+	if err != nil {
+		return nil, err
+	}
+	if bonus > 0 {
+		credits[block.Finder] += float64(bonus)
+	}
+	from := block.immatureKey
+	block.Orphan = true
+	block.Reward = nil
+	ts := util.MakeTimestamp() / 1000
+	ref := join(block.RoundHeight, block.Nonce)
+	reason := ""
+	if r.cfg.Ledger.Enabled {
+		reason = LedgerReorg
+	}
+	poolKeys := []string{
+		r.formatKey("blocks", BlockMatured),
+		r.formatKey("blocks", BlockOrphaned),
+		r.formatBlockState(block.RoundHeight, block.Nonce),
+		r.formatKey("finances"),
+	}
+	poolArgs := []string{from, block.lifecycleKey(), strconv.FormatInt(block.RoundHeight, 10), strconv.FormatInt(ts, 10), ref,
+		strconv.FormatInt(int64(reorgRevertsExpire/time.Second), 10), reason}
+
+	var logins []string
+	var loginKeys [][]string
+	var amounts []string
+	for login, amount := range credits {
+		logins = append(logins, login)
+		loginKeys = append(loginKeys, []string{r.minerKey("miners", login), r.minerKey("reorg", login), r.minerKey("ledger", login)})
+		amounts = append(amounts, strconv.FormatFloat(amount, 'f', -1, 64))
+	}
+
+	var replies []interface{}
+	if r.cluster == nil {
+		keys := poolKeys
+		for i := range logins {
+			keys = append(keys, loginKeys[i]...)
+		}
+		res, err := r.client.Eval(reorgLua, keys, append(poolArgs, amounts...)).Result()
+		if err != nil {
+			return nil, err
+		}
+		replies, _ = res.([]interface{})
+	} else {
+		var debt float64
+		replies, debt, err = r.revertLogins(poolArgs, logins, loginKeys, amounts)
+		if err != nil {
+			return nil, fmt.Errorf("Block %s is not orphaned, %v", ref, err)
+		}
+		args := append(poolArgs, strconv.FormatFloat(debt, 'f', -1, 64))
+		if err := r.client.Eval(reorgPoolLua, poolKeys, args).Err(); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("Credit of block %s is taken back, it is not orphaned: %v", ref, err)
+		}
+	}
+
+	result := &ReorgRevert{}
+	tx, err := r.multi("")
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	_, err = tx.Exec(func() error {
+		for i := 0; i+2 < len(replies) && i/3 < len(logins); i += 3 {
+			entry, _ := replies[i].(string)
+			debit, _ := strconv.ParseFloat(fmt.Sprint(replies[i+1]), 64)
+			shortfall, _ := strconv.ParseFloat(fmt.Sprint(replies[i+2]), 64)
+			result.Debited += debit
+			result.Debt += shortfall
+			// Stream is record only, entry of credit taken back is not written again on retry
+			r.writeLedgerStream(tx, logins[i/3], entry)
+		}
+		tx.Del(r.formatBlockCredits(block.RoundHeight, block.Nonce), r.formatFeeCredits(block.RoundHeight, block.Nonce))
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, r.revertPoolFee(block)
+}
+
+// Credit of each login is taken back by its own script, debt of all logins is returned
+func (r *RedisClient) revertLogins(poolArgs, logins []string, loginKeys [][]string, amounts []string) ([]interface{}, float64, error) {
+	var replies []interface{}
+	debt := 0.0
+	for i, login := range logins {
+		res, err := r.client.Eval(reorgLoginLua, loginKeys[i], append(append([]string{}, poolArgs...), amounts[i])).Result()
+		if err != nil {
+			return nil, 0, fmt.Errorf("credit of %s is not taken back: %v", login, err)
+		}
+		reply, _ := res.([]interface{})
+		if len(reply) == 3 {
+			n, _ := strconv.ParseFloat(fmt.Sprint(reply[2]), 64)
+			debt += n
+		}
+		replies = append(replies, reply...)
+	}
+	return replies, debt, nil
+}
+
+// Pool fee accrued for block is taken back once
+func (r *RedisClient) revertPoolFee(block *BlockData) error {
+	accrued, err := r.client.HMGet(r.formatBlockState(block.RoundHeight, block.Nonce), "poolFeeAccrued", "txPoolFeeAccrued").Result()
+	if err != nil {
+		return err
+	}
+	total := 0.0
+	for _, v := range accrued {
+		n, _ := strconv.ParseFloat(stringValue(v), 64)
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+	return r.accruePoolFee(block.RoundHeight, block.Nonce, "poolFeeReverted", strconv.FormatFloat(-total, 'f', -1, 64), "")
+}
+
+// Block is alerted once, reorgAlerted of its state has time of it, so block audited on each pass is counted once.
+//
+// KEYS: nodes, then state of each block
+// ARGV: ts, alert field, count field
+const reorgAlertLua = `
+local alerted = 0
+for i = 2, #KEYS do
+	alerted = alerted + redis.call('HSETNX', KEYS[i], 'reorgAlerted', ARGV[1])
+end
+if alerted > 0 then
+	redis.call('HSET', KEYS[1], ARGV[2], ARGV[1])
+	redis.call('HINCRBY', KEYS[1], ARGV[3], alerted)
+end
+return alerted
+`
+
+// Alert stays in node state until it is deleted by hand, see docs/PAYOUTS.md. Number of blocks not alerted before is returned.
+func (r *RedisClient) WriteReorgAlert(id string, blocks []*BlockData) (int64, error) {
+	keys := []string{r.formatKey("nodes")}
+	for _, block := range blocks {
+		keys = append(keys, r.formatBlockState(block.RoundHeight, block.Nonce))
+	}
+	args := []string{strconv.FormatInt(util.MakeTimestamp()/1000, 10), join(id, "reorgAlert"), join(id, "reorgBlocks")}
+	res, err := r.client.Eval(reorgAlertLua, keys, args).Result()
+	if err != nil {
+		return 0, err
+	}
+	alerted, _ := res.(int64)
+	return alerted, nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Payment held back by sanity limits of payer, login is not paid until operator clears it
+type PaymentReview struct {
+	Login  string `json:"login"`
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+	At     int64  `json:"at"`
+}
+
+// Amount and reason of latest run are kept, in payments:review by login
+func (r *RedisClient) WritePaymentReview(login string, amount int64, reason string) error {
+	value := join(amount, util.MakeTimestamp()/1000, reason)
+	_, err := r.execTx("", func(tx *redis.Multi) error {
+		tx.HSet(r.formatKey("payments", "review"), login, value)
+		return nil
+	})
+	return err
+}
+
+// Oldest first
+func (r *RedisClient) GetPaymentReviews() ([]*PaymentReview, error) {
+	var values map[string]string
+	err := r.retryRead(func() error {
+		var err error
+		values, err = r.client.HGetAllMap(r.formatKey("payments", "review")).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*PaymentReview, 0, len(values))
+	for login, v := range values {
+		// Reason may hold separator, it goes last
+		fields := strings.SplitN(v, ":", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		review := &PaymentReview{Login: login, Reason: fields[2]}
+		review.Amount, _ = strconv.ParseInt(fields[0], 10, 64)
+		review.At, _ = strconv.ParseInt(fields[1], 10, 64)
+		result = append(result, review)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].At < result[j].At })
+	return result, nil
+}
+
+func (r *RedisClient) ClearPaymentReview(login string) (bool, error) {
+	n, err := r.client.HDel(r.formatKey("payments", "review"), login).Result()
+	return n > 0, err
+}
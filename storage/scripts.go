@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+// Share accounting done server side in one round trip, duplicate check included, so instances
+// writing the same round don't interleave. Scripts span miner and pool keys, so Go transactions
+// are used in cluster mode and for buffered shares.
+//
+// KEYS: pow, miners:login, hashrate, hashrate:login, workers:login, round of share, stats, seen:login,
+// ledger:login, ledger stream, PPLNS window
+// ARGV: height, sweep max, pow member, login, diff, reward, solo, ts, pool hashrate member,
+// miner hashrate member, expire seconds, worker counter, actual diff, worker, ledger entry, stream length,
+// window member, ledger list bound
+const (
+	checkPoWLua = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+if redis.call('ZADD', KEYS[1], ARGV[1], ARGV[3]) == 0 then
+	return 1
+end
+`
+	shareLua = `
+if ARGV[7] == '0' then
+	redis.call('HINCRBYFLOAT', KEYS[2], 'balance', ARGV[6])
+	redis.call('HINCRBYFLOAT', KEYS[2], 'minedShort', ARGV[6])
+	redis.call('HINCRBYFLOAT', KEYS[2], 'minedCurrent', ARGV[6])
+end
+redis.call('HINCRBY', KEYS[6], ARGV[4], ARGV[5])
+redis.call('HINCRBY', KEYS[2], 'hashesShort', ARGV[5])
+redis.call('HINCRBY', KEYS[2], 'hashesCurrent', ARGV[5])
+redis.call('ZADD', KEYS[3], ARGV[8], ARGV[9])
+redis.call('ZADD', KEYS[4], ARGV[8], ARGV[10])
+redis.call('EXPIRE', KEYS[4], ARGV[11])
+redis.call('HINCRBY', KEYS[5], ARGV[12], 1)
+redis.call('HINCRBY', KEYS[5], ARGV[12] .. 'Diff', ARGV[5])
+redis.call('EXPIRE', KEYS[5], ARGV[11])
+redis.call('HSET', KEYS[2], 'lastShare', ARGV[8])
+redis.call('HSET', KEYS[2], 'lastShareDiff', ARGV[13])
+redis.call('HSETNX', KEYS[2], 'firstSeen', ARGV[8])
+redis.call('HSETNX', KEYS[8], ARGV[14] .. ':first', ARGV[8])
+redis.call('HSETNX', KEYS[8], ARGV[14] .. ':since', ARGV[8])
+redis.call('HSET', KEYS[8], ARGV[14] .. ':last', ARGV[8])
+if ARGV[15] ~= '' then
+	redis.call('RPUSH', KEYS[9], ARGV[15])
+	redis.call('LTRIM', KEYS[9], -tonumber(ARGV[18]), -1)
+	redis.call('XADD', KEYS[10], 'MAXLEN', '~', ARGV[16], '*', 'login', ARGV[4], 'entry', ARGV[15])
+end
+if ARGV[17] ~= '' then
+	redis.call('LPUSH', KEYS[11], ARGV[17])
+end
+`
+)
+
+var shareScript = redis.NewScript(checkPoWLua + shareLua + `
+if ARGV[7] == '0' then
+	redis.call('HINCRBY', KEYS[7], 'roundShares', ARGV[5])
+end
+return 0
+`)
+
+// Extra KEYS: finders, round of block, candidates
+// Extra ARGV: candidate member before and after total shares
+// Snapshot left by write of the same block which crashed before candidate is kept, live round is not reset then.
+var blockScript = redis.NewScript(checkPoWLua + shareLua + `
+redis.call('HSET', KEYS[7], 'lastBlockFound', ARGV[8])
+redis.call('ZINCRBY', KEYS[12], 1, ARGV[4])
+redis.call('HINCRBY', KEYS[2], 'blocksFound', 1)
+if redis.call('RENAMENX', KEYS[6], KEYS[13]) == 1 then
+	redis.call('HDEL', KEYS[7], 'roundShares')
+end
+local total = 0
+for _, v in ipairs(redis.call('HVALS', KEYS[13])) do
+	total = total + tonumber(v)
+end
+redis.call('ZADD', KEYS[14], ARGV[1], ARGV[19] .. ':' .. string.format('%d', total) .. ':' .. ARGV[20])
+return 0
+`)
+
+// Solo round of login is closed in the same script, no share falls between rounds
+var soloBlockScript = redis.NewScript(checkPoWLua + shareLua + `
+redis.call('HSET', KEYS[7], 'lastBlockFound', ARGV[8])
+redis.call('ZINCRBY', KEYS[12], 1, ARGV[4])
+redis.call('HINCRBY', KEYS[2], 'blocksFound', 1)
+local total = redis.call('HGET', KEYS[13], ARGV[4])
+if not total then
+	total = redis.call('HGET', KEYS[6], ARGV[4])
+	redis.call('HINCRBY', KEYS[6], ARGV[4], '-' .. total)
+	redis.call('HSET', KEYS[13], ARGV[4], total)
+end
+redis.call('ZADD', KEYS[14], ARGV[1], ARGV[19] .. ':' .. total .. ':' .. ARGV[20])
+return 0
+`)
+
+func (r *RedisClient) useScripts() bool {
+	return r.cluster == nil && !r.cfg.LegacyShareWrites
+}
+
+// Scripts are loaded on check at startup, script flushed from server later is sent again on NOSCRIPT
+func (r *RedisClient) loadScripts() error {
+	for _, script := range []*redis.Script{shareScript, blockScript, soloBlockScript} {
+		if err := script.Load(r.single).Err(); err != nil {
+			return fmt.Errorf("Failed to load share scripts: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *RedisClient) shareKeysArgs(login, id string, params []string, diff, actualDiff int64, rate float64, height, topHeight uint64, stale, solo bool, expire time.Duration) ([]string, []string) {
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	round := r.formatKey("shares", "roundCurrent")
+	reward, entry, member := "0", "", ""
+	if solo {
+		round = r.formatKey("shares", "soloCurrent")
+	} else {
+		if r.windowShares() {
+			member = join(login, diff)
+		}
+		if r.creditShares() {
+			n := util.GetShareReward(diff, rate, height, topHeight)
+			reward = strconv.FormatFloat(n, 'f', -1, 64)
+			entry = r.ledgerEntry(ts, n, LedgerShare, params[1])
+		}
+	}
+	counter := join(id, "valid")
+	if stale {
+		counter = join(id, "stale")
+	}
+	keys := []string{
+		r.formatKey("pow"),
+		r.minerKey("miners", login),
+		r.formatKey("hashrate"),
+		r.minerKey("hashrate", login),
+		r.minerKey("workers", login),
+		round,
+		r.formatKey("stats"),
+		r.minerKey("seen", login),
+		r.minerKey("ledger", login),
+		r.formatKey("ledger"),
+		r.formatKey("shares", "pplns"),
+	}
+	args := []string{
+		strconv.FormatUint(height, 10),
+		fmt.Sprint("(", height-8),
+		strings.Join(params, ":"),
+		login,
+		strconv.FormatInt(diff, 10),
+		reward,
+		join(solo),
+		strconv.FormatInt(ts, 10),
+		join(diff, login, id, ms),
+		join(diff, id, ms),
+		strconv.FormatInt(int64(expire/time.Second), 10),
+		counter,
+		strconv.FormatInt(actualDiff, 10),
+		id,
+		entry,
+		strconv.FormatInt(r.ledgerStreamLength(), 10),
+		member,
+		strconv.FormatInt(r.ledgerListLimit(), 10),
+	}
+	return keys, args
+}
+
+func (r *RedisClient) writeShareScript(login, id string, params []string, diff, actualDiff int64, rate float64, height, topHeight uint64, stale, solo bool, expire time.Duration) (bool, error) {
+	keys, args := r.shareKeysArgs(login, id, params, diff, actualDiff, rate, height, topHeight, stale, solo, expire)
+	return runShareScript(shareScript, r.single, keys, args)
+}
+
+func (r *RedisClient) writeBlockScript(login, id string, params []string, diff, actualDiff int64, rate float64, roundDiff int64, height, topHeight uint64, solo bool, expire time.Duration) (bool, error) {
+	keys, args := r.shareKeysArgs(login, id, params, diff, actualDiff, rate, height, topHeight, false, solo, expire)
+	mode, script := ModeSolo, soloBlockScript
+	if !solo {
+		var err error
+		if mode, err = r.snapshotRound(int64(height), params[0], roundDiff); err != nil {
+			return false, err
+		}
+		script = blockScript
+	}
+	keys = append(keys, r.formatKey("finders"), r.formatRound(int64(height), params[0]), r.formatKey("blocks", "candidates"))
+	// Args hold ts at 8th position
+	args = append(args, join(strings.Join(params, ":"), args[7], roundDiff), join(login, mode, id, diff))
+	return runShareScript(script, r.single, keys, args)
+}
+
+// True if share is duplicate
+func runShareScript(script *redis.Script, client *redis.Client, keys, args []string) (bool, error) {
+	cmd := script.Run(client, keys, args)
+	if cmd.Err() != nil {
+		return false, cmd.Err()
+	}
+	exist, _ := cmd.Val().(int64)
+	return exist == 1, nil
+}
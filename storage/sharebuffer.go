@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/CryptoManiac/open-ethereum-pool/util"
+)
+
+const (
+	defaultShareFlushInterval = 100 * time.Millisecond
+	defaultMaxBufferedShares  = 1000
+	// Buffer refuses shares once it holds that many times maxShares, failed batch included
+	shareBufferCap = 10
+	// Marker of written batch outlives any outage its outcome is resolved after
+	shareBatchExpire = 24 * time.Hour
+)
+
+type ShareBufferConfig struct {
+	Enabled bool `json:"enabled"`
+	// Buffered shares are written this often
+	Interval string `json:"interval"`
+	// Buffer is written at once when it holds that many shares
+	MaxShares int `json:"maxShares"`
+}
+
+// Share accepted by WriteShare, written with next flush
+type bufferedShare struct {
+	ms, ts    int64
+	login, id string
+	// Header hash of job, ledger reference
+	job        string
+	diff       int64
+	actualDiff int64
+	height     uint64
+	topHeight  uint64
+	// Shannon per unit of difficulty
+	rate   float64
+	stale  bool
+	solo   bool
+	expire time.Duration
+	// Ledger entry of credit, set when miner part is written
+	ledger string
+	// Miner part is written by failed batch, only pool part is left
+	minerDone bool
+}
+
+// Shares of one flush. Every transaction of batch sets its marker, so outcome of failed one is read back
+// instead of guessed: transaction is applied whole or not at all.
+type shareBatch struct {
+	id     string
+	shares []bufferedShare
+}
+
+// Write-behind buffer of shares. Duplicate check and blocks are not buffered, they are written at once.
+type shareBuffer struct {
+	sync.Mutex
+	shares    []bufferedShare
+	maxShares int
+	// Error of failed flush, returned to next writer once, so proxy marks itself sick
+	lastErr error
+	// Batch of failed flush, resolved by its markers before next one is written
+	failed *shareBatch
+	// Shares of failed batch, read by writers
+	failedShares int
+	// Serializes flushes, so shares are written in order they came
+	flushMu sync.Mutex
+	flushMs int64
+	kick    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func (r *RedisClient) startShareBuffer(cfg *ShareBufferConfig) {
+	interval := defaultShareFlushInterval
+	if len(cfg.Interval) > 0 {
+		interval = util.MustParseDuration(cfg.Interval)
+	}
+	maxShares := cfg.MaxShares
+	if maxShares <= 0 {
+		maxShares = defaultMaxBufferedShares
+	}
+	b := &shareBuffer{
+		maxShares: maxShares,
+		kick:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	r.shares = b
+
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.kick:
+			case <-b.quit:
+				return
+			}
+			r.flushShares()
+		}
+	}()
+}
+
+// Returns error of previous failed flush, share is refused once buffer is full
+func (b *shareBuffer) add(share bufferedShare) error {
+	b.Lock()
+	if held := len(b.shares) + b.failedShares; held >= b.maxShares*shareBufferCap {
+		b.Unlock()
+		return fmt.Errorf("Share buffer is full with %d shares, share is not written", held)
+	}
+	b.shares = append(b.shares, share)
+	full := len(b.shares) >= b.maxShares
+	err := b.lastErr
+	b.lastErr = nil
+	b.Unlock()
+
+	if full {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (b *shareBuffer) take() []bufferedShare {
+	b.Lock()
+	defer b.Unlock()
+	shares := b.shares
+	b.shares = nil
+	return shares
+}
+
+// Puts shares back in front of ones added meanwhile
+func (b *shareBuffer) putBack(shares []bufferedShare) {
+	b.Lock()
+	b.shares = append(shares, b.shares...)
+	b.Unlock()
+}
+
+func (b *shareBuffer) setFailed(batch *shareBatch) {
+	b.Lock()
+	b.failedShares = 0
+	if batch != nil {
+		b.failedShares = len(batch.shares)
+	}
+	b.Unlock()
+	b.failed = batch
+}
+
+func (b *shareBuffer) fail(err error) error {
+	b.Lock()
+	b.lastErr = err
+	b.Unlock()
+	return err
+}
+
+// Shares are not dropped and never written twice. Failed batch is kept until its markers tell
+// what part of it is written, the rest goes with next flush. Error is reported to next writer.
+func (r *RedisClient) flushShares() error {
+	b := r.shares
+	if b == nil {
+		return nil
+	}
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	shares := b.take()
+	if b.failed != nil {
+		done, err := r.resolveShareBatch(b.failed)
+		if err != nil {
+			b.putBack(shares)
+			return b.fail(fmt.Errorf("Outcome of failed flush of %d buffered shares is unknown: %v", len(b.failed.shares), err))
+		}
+		if !done {
+			shares = append(b.failed.shares, shares...)
+		}
+		b.setFailed(nil)
+	}
+	if len(shares) == 0 {
+		return nil
+	}
+	batch := &shareBatch{id: newShareBatchId(), shares: shares}
+	start := time.Now()
+	err := r.writeShares(batch)
+	if err != nil {
+		// Write is retried once, with part of batch written by failed one skipped
+		var done bool
+		if done, err = r.resolveShareBatch(batch); err == nil && !done {
+			err = r.writeShares(batch)
+		}
+	}
+	atomic.StoreInt64(&b.flushMs, int64(time.Since(start)/time.Millisecond))
+	if err != nil {
+		b.setFailed(batch)
+		return b.fail(fmt.Errorf("Failed to flush %d buffered shares, unwritten ones go with next flush: %v", len(shares), err))
+	}
+	return nil
+}
+
+func newShareBatchId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Marker of pool transaction of batch, of whole batch in single node mode
+func (r *RedisClient) batchKey(id string) string {
+	return r.formatKey("sharebatch", id)
+}
+
+// Marker of miner transaction of batch, in slot of miner keys
+func (r *RedisClient) minerBatchKey(login, id string) string {
+	return join(r.minerKey("sharebatch", login), id)
+}
+
+// True if batch is written whole. Shares of miner transactions which are written are marked otherwise.
+func (r *RedisClient) resolveShareBatch(batch *shareBatch) (bool, error) {
+	done, err := r.client.Exists(r.batchKey(batch.id)).Result()
+	if err != nil || done || r.cluster == nil {
+		return done, err
+	}
+	written := make(map[string]bool)
+	for i := range batch.shares {
+		s := &batch.shares[i]
+		if s.minerDone {
+			continue
+		}
+		ok, seen := written[s.login]
+		if !seen {
+			ok, err = r.client.Exists(r.minerBatchKey(s.login, batch.id)).Result()
+			if err != nil {
+				return false, err
+			}
+			written[s.login] = ok
+		}
+		s.minerDone = ok
+	}
+	return false, nil
+}
+
+// One transaction in one round trip. In cluster mode shares are grouped in transaction per miner
+// and pool one, see execMinerPool. Miner part of shares marked as written by failed batch is skipped.
+func (r *RedisClient) writeShares(batch *shareBatch) error {
+	shares := batch.shares
+	minerCmds := func(tx *redis.Multi, s *bufferedShare) {
+		if !s.minerDone {
+			s.ledger = r.writeMinerShare(tx, s.ms, s.ts, s.login, s.id, s.job, s.diff, s.actualDiff, s.height, s.topHeight, s.rate, s.stale, s.solo, s.expire)
+		}
+	}
+	poolCmds := func(tx *redis.Multi) error {
+		roundShares := int64(0)
+		for i := range shares {
+			r.writePoolShare(tx, shares[i].ms, shares[i].ts, shares[i].login, shares[i].id, shares[i].ledger, shares[i].diff, shares[i].solo)
+			if !shares[i].solo {
+				roundShares += shares[i].diff
+			}
+		}
+		if roundShares > 0 {
+			tx.HIncrBy(r.formatKey("stats"), "roundShares", roundShares)
+		}
+		tx.Set(r.batchKey(batch.id), "1", shareBatchExpire)
+		return nil
+	}
+
+	if r.cluster == nil {
+		tx := r.single.Multi()
+		defer tx.Close()
+		_, err := tx.Exec(func() error {
+			for i := range shares {
+				minerCmds(tx, &shares[i])
+			}
+			return poolCmds(tx)
+		})
+		return err
+	}
+	byLogin := make(map[string][]*bufferedShare)
+	for i := range shares {
+		if !shares[i].minerDone {
+			byLogin[shares[i].login] = append(byLogin[shares[i].login], &shares[i])
+		}
+	}
+	written := 0
+	for login, list := range byLogin {
+		_, err := r.execTx(login, func(tx *redis.Multi) error {
+			for _, s := range list {
+				minerCmds(tx, s)
+			}
+			tx.Set(r.minerBatchKey(login, batch.id), "1", shareBatchExpire)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Keys of %d of %d miners are written, pool keys are not: %v", written, len(byLogin), err)
+		}
+		for _, s := range list {
+			s.minerDone = true
+		}
+		written++
+	}
+	if _, err := r.execTx("", poolCmds); err != nil {
+		return fmt.Errorf("Keys of miners are written, pool keys are not: %v", err)
+	}
+	return nil
+}
+
+// Depth of share buffer and duration of last flush, false if buffer is disabled
+func (r *RedisClient) ShareBufferStats() (int, time.Duration, bool) {
+	b := r.shares
+	if b == nil {
+		return 0, 0, false
+	}
+	b.Lock()
+	depth := len(b.shares)
+	b.Unlock()
+	return depth, time.Duration(atomic.LoadInt64(&b.flushMs)) * time.Millisecond, true
+}
+
+// Writes buffered shares, call it before exit
+func (r *RedisClient) Close() error {
+	if r.shares == nil {
+		return nil
+	}
+	close(r.shares.quit)
+	<-r.shares.done
+	return r.flushShares()
+}
@@ -0,0 +1,21 @@
+package storage
+
+import "testing"
+
+// Shares of failed batch count to cap, so buffer doesn't grow through outage
+func TestShareBufferCap(t *testing.T) {
+	b := &shareBuffer{maxShares: 2, kick: make(chan struct{}, 1)}
+	b.setFailed(&shareBatch{shares: make([]bufferedShare, 5)})
+	for i := 0; i < 2*shareBufferCap-5; i++ {
+		if err := b.add(bufferedShare{}); err != nil {
+			t.Fatalf("Share %v is refused: %v", i, err)
+		}
+	}
+	if err := b.add(bufferedShare{}); err == nil {
+		t.Error("Share is buffered past cap")
+	}
+	b.setFailed(nil)
+	if err := b.add(bufferedShare{}); err != nil {
+		t.Errorf("Share is refused once failed batch is written: %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	BackendRedis    = "redis"
+	BackendPostgres = "postgres"
+)
+
+// Backend of each concern. Hot one keeps share counters, stats and everything API reads,
+// durable one keeps record of payments, paid and pending balances, blocks and finders.
+type BackendConfig struct {
+	// Only redis, empty for it
+	Hot string `json:"hot"`
+	// Redis or postgres, empty for redis
+	Durable  string         `json:"durable"`
+	Postgres PostgresConfig `json:"postgres"`
+}
+
+// Methods modules use, implemented by RedisClient and by SplitBackend
+type Storage interface {
+	Check() (string, error)
+	// Writes buffered data, call it before exit
+	Close() error
+	BgSave() (string, error)
+
+	// Proxy and policy
+	GetBlacklist() ([]string, error)
+	GetWhitelist() ([]string, error)
+	GetLoginBlacklist() ([]string, error)
+	AddLoginBlacklist(login string) error
+	RemoveLoginBlacklist(login string) error
+	WriteNodeState(id string, height uint64, diff *big.Int, stats map[string]int64) error
+	WriteNodeRejects(id string, recent map[string][]string) error
+	WriteUpstreamSwitch(id, from, to string) error
+	WriteShare(login, id string, params []string, diff int64, actualDiff int64, rate float64, height, topHeight uint64, stale, solo bool, window time.Duration) (bool, error)
+	WriteBlock(login, id string, params []string, diff, actualDiff int64, rate float64, roundDiff int64, height, topHeight uint64, solo bool, window time.Duration) (bool, error)
+	WriteInvalidShare(login, id string, expire time.Duration) error
+	WriteStaleShare(login, id string, expire time.Duration) error
+	WriteWorkerDifficulty(login, id string, diff int64, expire time.Duration) error
+	GetWorkerDifficulty(login, id string) (int64, error)
+	GetMinerSettings(login string) (*MinerSettings, error)
+	WriteMinerSettings(login string, settings *MinerSettings) error
+	WritePayoutSettings(login string, minPayout int64, paused bool, signedAt int64) (bool, error)
+	ShareBufferStats() (int, time.Duration, bool)
+	WritePPSRate(rate *PPSRate, maxHistory int64) error
+	TrimPPLNSWindow(netDiff int64) error
+	GetPPSRate() (*PPSRate, error)
+
+	// Payouts
+	GetMiners() ([]string, error)
+	GetBalance(login string) (int64, error)
+	LockPayouts(login string, amount int64) error
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	UpdateBalance(login string, amount int64) error
+	RollbackBalance(login string, amount int64) error
+	WritePayment(login, txHash string, amount int64) error
+	WritePaymentFee(txHash string, fee int64) error
+	WritePaymentStatus(txHash, status string, block uint64) error
+	GetPaymentStatus(txHash string) (string, uint64, error)
+	GetPayments(login string, offset, limit int64) (*PaymentsPage, error)
+	WriteInflightPayment(p *InflightPayment) error
+	GetInflightPayment() (*InflightPayment, error)
+	GetPoolFee() (float64, error)
+	DebitPoolFee(amount int64) error
+	RollbackPoolFee(amount int64) error
+	WriteFeeSweep(address, txHash string, amount int64) error
+	WritePayoutsHalt(reason, by string) error
+	GetPayoutsHalt() (*PayoutsHalt, error)
+	ClearPayoutsHalt() error
+	WritePaymentReview(login string, amount int64, reason string) error
+	GetPaymentReviews() ([]*PaymentReview, error)
+	ClearPaymentReview(login string) (bool, error)
+	AdjustBalance(login string, amount int64, reason, operator, requestId string, force bool) (bool, float64, error)
+	GetAdjustments(offset, limit int64) ([]*BalanceAdjustment, int64, error)
+	CreditBlockFees(height int64, nonce string, fees int64, fee float64) (float64, error)
+	AcquireLeader(name, owner string, ttl time.Duration) (bool, error)
+	ReleaseLeader(name, owner string) error
+
+	// Block lifecycle, kept in redis only
+	GetCandidates(maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+	WriteImmatureBlock(block *BlockData, credits map[string]int64, poolFee, bonus int64) error
+	WriteMaturedBlock(block *BlockData) error
+	WriteOrphanBlock(block *BlockData) error
+	GetRoundShares(height int64, nonce string) (map[string]int64, error)
+	GetBlocks(state string, offset, limit int64) ([]*BlockData, int64, error)
+	GetMaturedBlocks(minHeight int64) ([]*BlockData, error)
+	RevertMaturedBlock(block *BlockData) (*ReorgRevert, error)
+	WriteReorgAlert(id string, blocks []*BlockData) (int64, error)
+
+	// Shifts
+	WriteLongShift(login string) error
+	WriteShortShift(login string) error
+	FlushShifts(windowLong, windowShort time.Duration, users []string) (int64, error)
+
+	// API
+	CollectStats(smallWindow time.Duration, maxPayments int64) (map[string]interface{}, error)
+	CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error)
+	FlushStaleStats(window, largeWindow time.Duration) (int64, error)
+	GetMinerStats(login string, maxPayments, maxShiftsLong, maxShiftsShort int64) (map[string]interface{}, error)
+	GetNodeStates() ([]map[string]interface{}, error)
+	GetUpstreamSwitches() ([]map[string]interface{}, error)
+	IsMinerExists(login string) (bool, error)
+	GetMinerActivity(login string, maxEvents int64) (map[string]interface{}, error)
+	GetLedger(login string, offset, limit int64) ([]*LedgerEntry, int64, error)
+	GetLeader(name string) (string, time.Duration, error)
+	GetPPSRates(max int64) ([]*PPSRate, error)
+
+	// Maintenance
+	PruneStale(window, retention time.Duration, opsPerSecond int) (*PruneResult, error)
+	RecordOffline(expire time.Duration, maxEvents int64, opsPerSecond int) (int64, error)
+	ReconcileLedger(opsPerSecond int) (*LedgerReport, error)
+}
+
+// Durable subset, payouts lock and pending payments are taken from it
+type Durable interface {
+	Check() error
+	Close() error
+	LockPayouts(login string, amount int64) error
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	// Balance is owed balance of login in redis after the change
+	UpdateBalance(login string, amount, balance int64) error
+	RollbackBalance(login string, amount, balance int64) error
+	WritePayment(login, txHash string, amount int64) error
+	WritePaymentFee(txHash string, fee int64) error
+	WriteInflightPayment(p *InflightPayment) error
+	GetInflightPayment() (*InflightPayment, error)
+	WriteCandidate(block *BlockData) error
+}
+
+// Redis backend is returned as is if durable backend is redis
+func NewBackend(cfg *BackendConfig, redis *RedisClient) (Storage, error) {
+	if len(cfg.Hot) > 0 && cfg.Hot != BackendRedis {
+		return nil, fmt.Errorf("Unsupported hot storage backend %s", cfg.Hot)
+	}
+	switch cfg.Durable {
+	case "", BackendRedis:
+		return redis, nil
+	case BackendPostgres:
+		durable, err := NewPostgresClient(&cfg.Postgres)
+		if err != nil {
+			return nil, err
+		}
+		return &SplitBackend{RedisClient: redis, durable: durable}, nil
+	}
+	return nil, fmt.Errorf("Unsupported durable storage backend %s", cfg.Durable)
+}
+
+// Redis still gets payments and blocks, so API shows them, durable backend is record of them.
+// Payouts lock, pending payments and payment in flight are read from durable backend. Redis write of balance change
+// is undone if durable one fails, so payout resolve does not credit back twice.
+type SplitBackend struct {
+	*RedisClient
+	durable Durable
+}
+
+func (b *SplitBackend) Check() (string, error) {
+	pong, err := b.RedisClient.Check()
+	if err != nil {
+		return pong, err
+	}
+	if err := b.durable.Check(); err != nil {
+		return pong, fmt.Errorf("Durable backend check failed: %v", err)
+	}
+	return pong, nil
+}
+
+func (b *SplitBackend) Close() error {
+	err := b.RedisClient.Close()
+	if durableErr := b.durable.Close(); err == nil {
+		err = durableErr
+	}
+	return err
+}
+
+func (b *SplitBackend) LockPayouts(login string, amount int64) error {
+	return b.durable.LockPayouts(login, amount)
+}
+
+func (b *SplitBackend) UnlockPayouts() error {
+	return b.durable.UnlockPayouts()
+}
+
+func (b *SplitBackend) IsPayoutsLocked() (bool, error) {
+	return b.durable.IsPayoutsLocked()
+}
+
+func (b *SplitBackend) GetPendingPayments() []*PendingPayment {
+	return b.durable.GetPendingPayments()
+}
+
+func (b *SplitBackend) WriteInflightPayment(p *InflightPayment) error {
+	return b.durable.WriteInflightPayment(p)
+}
+
+func (b *SplitBackend) GetInflightPayment() (*InflightPayment, error) {
+	return b.durable.GetInflightPayment()
+}
+
+func (b *SplitBackend) UpdateBalance(login string, amount int64) error {
+	if err := b.RedisClient.UpdateBalance(login, amount); err != nil {
+		return err
+	}
+	balance, err := b.RedisClient.GetBalance(login)
+	if err == nil {
+		err = b.durable.UpdateBalance(login, amount, balance)
+	}
+	if err != nil {
+		return b.undo(err, b.RedisClient.RollbackBalance(login, amount))
+	}
+	return nil
+}
+
+func (b *SplitBackend) RollbackBalance(login string, amount int64) error {
+	if err := b.RedisClient.RollbackBalance(login, amount); err != nil {
+		return err
+	}
+	balance, err := b.RedisClient.GetBalance(login)
+	if err == nil {
+		err = b.durable.RollbackBalance(login, amount, balance)
+	}
+	if err != nil {
+		return b.undo(err, b.RedisClient.UpdateBalance(login, amount))
+	}
+	return nil
+}
+
+// Transaction is sent already, durable record goes first
+func (b *SplitBackend) WritePayment(login, txHash string, amount int64) error {
+	if err := b.durable.WritePayment(login, txHash, amount); err != nil {
+		return err
+	}
+	if err := b.RedisClient.WritePayment(login, txHash, amount); err != nil {
+		return fmt.Errorf("Payment is written to durable backend only: %v", err)
+	}
+	return nil
+}
+
+func (b *SplitBackend) WritePaymentFee(txHash string, fee int64) error {
+	if err := b.durable.WritePaymentFee(txHash, fee); err != nil {
+		return err
+	}
+	if err := b.RedisClient.WritePaymentFee(txHash, fee); err != nil {
+		return fmt.Errorf("Payment fee is written to durable backend only: %v", err)
+	}
+	return nil
+}
+
+func (b *SplitBackend) WriteBlock(login, id string, params []string, diff, actualDiff int64, rate float64, roundDiff int64, height, topHeight uint64, solo bool, window time.Duration) (bool, error) {
+	exist, err := b.RedisClient.WriteBlock(login, id, params, diff, actualDiff, rate, roundDiff, height, topHeight, solo, window)
+	if exist || err != nil {
+		return exist, err
+	}
+	block := &BlockData{
+		Height:     int64(height),
+		Timestamp:  time.Now().Unix(),
+		Difficulty: roundDiff,
+		Nonce:      params[0],
+		PowHash:    params[1],
+		MixDigest:  params[2],
+		Finder:     login,
+		Worker:     id,
+		ShareDiff:  diff,
+		Solo:       solo,
+	}
+	if err := b.durable.WriteCandidate(block); err != nil {
+		return false, fmt.Errorf("Block is written to redis only: %v", err)
+	}
+	return false, nil
+}
+
+func (b *SplitBackend) undo(err, undoErr error) error {
+	if undoErr != nil {
+		return fmt.Errorf("%v, failed to undo redis write: %v", err, undoErr)
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"fmt"
+)
+
+const (
+	RewardsEthereum = "ethereum"
+	RewardsClassic  = "classic"
+	RewardsUbiq     = "ubiq"
+)
+
+// Reward of blocks from activation height on, in Shannon
+type RewardEra struct {
+	ActivationHeight uint64 `json:"activationHeight"`
+	BlockReward      int64  `json:"blockReward"`
+	// Fixed uncle reward in percent of block reward, 0 for (uncle height + 8 - height) / 8 of it
+	UnclePercent float64 `json:"unclePercent"`
+	// Reward for each included uncle in percent of block reward
+	NephewPercent float64 `json:"nephewPercent"`
+}
+
+// Eras in order of activation height, first one activates at 0.
+// Era of block applies to its uncles and nephew reward too.
+type RewardSchedule []RewardEra
+
+var RewardPresets = map[string]RewardSchedule{
+	// Frontier, Byzantium and Constantinople
+	RewardsEthereum: {
+		{0, 5000000000, 0, 3.125},
+		{4370000, 3000000000, 0, 3.125},
+		{7280000, 2000000000, 0, 3.125},
+	},
+	// ECIP-1017, reward is reduced by 20% each 5M blocks, fixed uncle reward from era 2
+	RewardsClassic: {
+		{0, 5000000000, 0, 3.125},
+		{5000001, 4000000000, 3.125, 3.125},
+		{10000001, 3200000000, 3.125, 3.125},
+		{15000001, 2560000000, 3.125, 3.125},
+		{20000001, 2048000000, 3.125, 3.125},
+		{25000001, 1638400000, 3.125, 3.125},
+		{30000001, 1310720000, 3.125, 3.125},
+		{35000001, 1048576000, 3.125, 3.125},
+		{40000001, 838860800, 3.125, 3.125},
+		{45000001, 671088640, 3.125, 3.125},
+		{50000001, 536870912, 3.125, 3.125},
+	},
+	RewardsUbiq: {
+		{0, 8000000000, 0, 3.125},
+		{358364, 7000000000, 0, 3.125},
+		{716728, 6000000000, 0, 3.125},
+		{1075091, 5000000000, 0, 3.125},
+		{1433455, 4000000000, 0, 3.125},
+		{1791819, 3000000000, 0, 3.125},
+		{2150182, 2000000000, 0, 3.125},
+		{2508546, 1000000000, 0, 3.125},
+	},
+}
+
+// Custom eras take precedence over preset, static block reward is the only era without both
+func NewRewardSchedule(preset string, eras []RewardEra) (RewardSchedule, error) {
+	schedule := RewardSchedule(eras)
+	if len(schedule) == 0 {
+		if len(preset) == 0 {
+			return RewardSchedule{{0, StaticBlockReward, 0, 3.125}}, nil
+		}
+		var ok bool
+		if schedule, ok = RewardPresets[preset]; !ok {
+			return nil, fmt.Errorf("Unknown reward schedule preset %q", preset)
+		}
+	}
+	if schedule[0].ActivationHeight != 0 {
+		return nil, fmt.Errorf("First reward era must activate at 0")
+	}
+	for i, era := range schedule {
+		if i > 0 && era.ActivationHeight <= schedule[i-1].ActivationHeight {
+			return nil, fmt.Errorf("Reward eras must be in increasing order of activation height")
+		}
+		if era.BlockReward <= 0 {
+			return nil, fmt.Errorf("Block reward of era at %v must be positive", era.ActivationHeight)
+		}
+		if era.UnclePercent < 0 || era.UnclePercent > 100 || era.NephewPercent < 0 || era.NephewPercent > 100 {
+			return nil, fmt.Errorf("Uncle and nephew percents of era at %v must be within 0 and 100", era.ActivationHeight)
+		}
+	}
+	return schedule, nil
+}
+
+func (s RewardSchedule) era(height uint64) *RewardEra {
+	era := &s[0]
+	for i := range s {
+		if s[i].ActivationHeight > height {
+			break
+		}
+		era = &s[i]
+	}
+	return era
+}
+
+// Block subsidy without uncle inclusion rewards and fees, in Shannon
+func (s RewardSchedule) BlockReward(height uint64) int64 {
+	return s.era(height).BlockReward
+}
+
+// Reward of uncle at uncleHeight included in block at height, in Shannon
+func (s RewardSchedule) UncleReward(uncleHeight, height uint64) int64 {
+	if uncleHeight >= height || height-uncleHeight >= 8 {
+		return 0
+	}
+	era := s.era(height)
+	if era.UnclePercent > 0 {
+		return int64(float64(era.BlockReward) * era.UnclePercent / 100)
+	}
+	return era.BlockReward * int64(uncleHeight+8-height) / 8
+}
+
+// Reward of block at height for uncles it includes, in Shannon
+func (s RewardSchedule) NephewReward(height uint64, uncles int) int64 {
+	era := s.era(height)
+	return int64(float64(era.BlockReward)*era.NephewPercent/100) * int64(uncles)
+}
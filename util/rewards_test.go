@@ -0,0 +1,123 @@
+package util
+
+import "testing"
+
+func mustSchedule(t *testing.T, preset string) RewardSchedule {
+	schedule, err := NewRewardSchedule(preset, nil)
+	if err != nil {
+		t.Fatalf("Preset %q: %v", preset, err)
+	}
+	return schedule
+}
+
+func TestBlockRewardEraBoundaries(t *testing.T) {
+	cases := []struct {
+		preset string
+		height uint64
+		reward int64
+	}{
+		{RewardsEthereum, 0, 5000000000},
+		{RewardsEthereum, 4369999, 5000000000},
+		{RewardsEthereum, 4370000, 3000000000},
+		{RewardsEthereum, 7279999, 3000000000},
+		{RewardsEthereum, 7280000, 2000000000},
+		{RewardsEthereum, 20000000, 2000000000},
+		{RewardsClassic, 5000000, 5000000000},
+		{RewardsClassic, 5000001, 4000000000},
+		{RewardsClassic, 10000001, 3200000000},
+		{RewardsClassic, 50000001, 536870912},
+		{RewardsUbiq, 358363, 8000000000},
+		{RewardsUbiq, 358364, 7000000000},
+		{RewardsUbiq, 2508546, 1000000000},
+		{"", 0, StaticBlockReward},
+		{"", 10000000, StaticBlockReward},
+	}
+	for _, c := range cases {
+		if got := mustSchedule(t, c.preset).BlockReward(c.height); got != c.reward {
+			t.Errorf("Block reward of %q at %v is %v, want %v", c.preset, c.height, got, c.reward)
+		}
+	}
+}
+
+func TestUncleRewardByDepth(t *testing.T) {
+	ethereum := mustSchedule(t, RewardsEthereum)
+	classic := mustSchedule(t, RewardsClassic)
+	cases := []struct {
+		name        string
+		schedule    RewardSchedule
+		uncleHeight uint64
+		height      uint64
+		reward      int64
+	}{
+		{"ethereum depth 1", ethereum, 7999999, 8000000, 1750000000},
+		{"ethereum depth 2", ethereum, 7999998, 8000000, 1500000000},
+		{"ethereum depth 3", ethereum, 7999997, 8000000, 1250000000},
+		{"ethereum depth 4", ethereum, 7999996, 8000000, 1000000000},
+		{"ethereum depth 5", ethereum, 7999995, 8000000, 750000000},
+		{"ethereum depth 6", ethereum, 7999994, 8000000, 500000000},
+		{"ethereum depth 7", ethereum, 7999993, 8000000, 250000000},
+		{"ethereum depth 8", ethereum, 7999992, 8000000, 0},
+		{"ethereum depth 0", ethereum, 8000000, 8000000, 0},
+		{"ethereum uncle above block", ethereum, 8000001, 8000000, 0},
+		// Era of including block applies
+		{"ethereum across byzantium", ethereum, 4369999, 4370001, 2250000000},
+		{"ethereum before byzantium", ethereum, 4369997, 4369999, 3750000000},
+		{"classic era 1 depth 1", classic, 4999999, 5000000, 4375000000},
+		{"classic era 1 depth 7", classic, 4999993, 5000000, 625000000},
+		{"classic era 2 depth 1", classic, 5000001, 5000002, 125000000},
+		{"classic era 2 depth 7", classic, 5000000, 5000007, 125000000},
+		{"classic era 2 depth 8", classic, 5000000, 5000008, 0},
+		{"classic era 3 depth 4", classic, 9999999, 10000003, 100000000},
+	}
+	for _, c := range cases {
+		if got := c.schedule.UncleReward(c.uncleHeight, c.height); got != c.reward {
+			t.Errorf("%s: uncle reward is %v, want %v", c.name, got, c.reward)
+		}
+	}
+}
+
+func TestNephewReward(t *testing.T) {
+	ethereum := mustSchedule(t, RewardsEthereum)
+	cases := []struct {
+		height uint64
+		uncles int
+		reward int64
+	}{
+		{4369999, 0, 0},
+		{4369999, 1, 156250000},
+		{4370000, 1, 93750000},
+		{7280000, 2, 125000000},
+	}
+	for _, c := range cases {
+		if got := ethereum.NephewReward(c.height, c.uncles); got != c.reward {
+			t.Errorf("Nephew reward of %v uncles at %v is %v, want %v", c.uncles, c.height, got, c.reward)
+		}
+	}
+}
+
+func TestRewardScheduleValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		eras []RewardEra
+	}{
+		{"first era above 0", []RewardEra{{10, 5000000000, 0, 3.125}}},
+		{"eras out of order", []RewardEra{{0, 5000000000, 0, 3.125}, {20, 4000000000, 0, 3.125}, {10, 3000000000, 0, 3.125}}},
+		{"zero reward", []RewardEra{{0, 0, 0, 3.125}}},
+		{"uncle percent above 100", []RewardEra{{0, 5000000000, 101, 3.125}}},
+	}
+	for _, c := range cases {
+		if _, err := NewRewardSchedule("", c.eras); err == nil {
+			t.Errorf("%s: schedule is accepted", c.name)
+		}
+	}
+	if _, err := NewRewardSchedule("bitcoin", nil); err == nil {
+		t.Error("Unknown preset is accepted")
+	}
+	custom, err := NewRewardSchedule(RewardsEthereum, []RewardEra{{0, 1000000000, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := custom.BlockReward(7280000); got != 1000000000 {
+		t.Errorf("Custom eras don't take precedence over preset, reward is %v", got)
+	}
+}
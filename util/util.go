@@ -2,8 +2,10 @@ package util
 
 import (
 	"math/big"
+	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -26,6 +28,19 @@ func IsValidHexAddress(s string) bool {
 	return true
 }
 
+// Lowercase or uppercase address has no checksum,
+// mixed case address must match EIP-55 checksum
+func IsValidChecksumAddress(s string) bool {
+	if !IsValidHexAddress(s) {
+		return false
+	}
+	hex := s[2:]
+	if hex == strings.ToLower(hex) || hex == strings.ToUpper(hex) {
+		return true
+	}
+	return common.HexToAddress(s).Hex() == s
+}
+
 func IsZeroHash(s string) bool {
 	return zeroHash.MatchString(s)
 }
@@ -59,36 +74,32 @@ func FormatRatReward(reward *big.Rat) string {
 	return reward.FloatString(8)
 }
 
-// Calculate PPS rate at given block and share height
-func GetShareReward(shareDiff, netDiff int64, height, topHeight uint64, fee float64) float64 {
+// Block reward of the only era of empty reward schedule, in Shannon
+const StaticBlockReward = 3000000000
+
+// Shannon per unit of share difficulty, uncle rate adds expected uncle rewards to block reward,
+// fee is in percent
+func GetPPSRate(blockReward int64, uncleRate, fee float64, netDiff int64) float64 {
+	if netDiff <= 0 {
+		return 0.0
+	}
+	base := new(big.Rat).SetInt64(blockReward)
+	base.Mul(base, new(big.Rat).SetFloat64(1+uncleRate))
+	feeValue := new(big.Rat).Mul(base, new(big.Rat).SetFloat64(fee/100))
+	base.Sub(base, feeValue)
+	base.Quo(base, new(big.Rat).SetInt64(netDiff))
+	ppsRate, _ := base.Float64()
+	return ppsRate
+}
+
+// Calculate PPS reward in Shannon at given rate, block and share height
+func GetShareReward(shareDiff int64, rate float64, height, topHeight uint64) float64 {
 	// Don't reward shares which are too lagging behind the tip
 	if topHeight-height > maxUncleLag {
 		return 0.0
 	}
-
-	// Base reward
-	base := new(big.Rat).SetInt(Ether)
-	base.Mul(base, new(big.Rat).SetInt64(3))
-	feePercent := new(big.Rat).SetFloat64(fee / 100)
-	feeValue := new(big.Rat).Mul(base, feePercent)
-	base.Sub(base, feeValue)
-	
 	// Reward with given tip and share height
-	R := new(big.Rat).SetInt64(int64(height))
-	R.Add(R, new(big.Rat).SetInt64(8))
-	R.Sub(R, new(big.Rat).SetInt64(int64(topHeight)))
-	R.Mul(R, base)
-	R.Quo(R, new(big.Rat).SetInt64(8))
-	
-	// Actual share reward
-	wei := R
-	wei.Mul(wei, new(big.Rat).SetInt64(shareDiff))
-	wei.Quo(wei, new(big.Rat).SetInt64(netDiff))
-	shannon := new(big.Rat).SetInt(Shannon)
-	inShannon := new(big.Rat).Quo(wei, shannon)
-	ppsRate, _ := inShannon.Float64()
-	
-	return ppsRate
+	return rate * float64(shareDiff) * float64(height+8-topHeight) / 8
 }
 
 func StringInSlice(a string, list []string) bool {
@@ -100,6 +111,15 @@ func StringInSlice(a string, list []string) bool {
 	return false
 }
 
+// Canonical form of IP, IPv4-mapped IPv6 addresses are converted to IPv4
+func NormalizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	return ip.String()
+}
+
 func MustParseDuration(s string) time.Duration {
 	value, err := time.ParseDuration(s)
 	if err != nil {
@@ -0,0 +1,23 @@
+package util
+
+import "testing"
+
+func TestNormalizeIP(t *testing.T) {
+	cases := []struct {
+		ip, normalized string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		// IPv4 accepted on dual stack socket
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+		{"::FFFF:0a00:0001", "10.0.0.1"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"2001:db8::0001", "2001:db8::1"},
+		// Not an address, kept as is
+		{"unknown", "unknown"},
+	}
+	for _, c := range cases {
+		if got := NormalizeIP(c.ip); got != c.normalized {
+			t.Errorf("%v is normalized to %v, want %v", c.ip, got, c.normalized)
+		}
+	}
+}